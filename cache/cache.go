@@ -0,0 +1,58 @@
+// Package cache provides a generic cache interface and its implementation backed by the database.
+package cache
+
+import (
+	"errors"
+	"time"
+
+	"github.com/ejuju/go-db-playground/textdb"
+)
+
+// Cache stores values for a limited time.
+type Cache interface {
+	// Get returns the value of a key, or false if it's missing or expired.
+	Get(key string) ([]byte, bool, error)
+	// Set stores a value that expires after the given TTL (never if the TTL is zero).
+	Set(key string, value []byte, ttl time.Duration) error
+	// Delete removes a key, it does nothing if the key is missing.
+	Delete(key string) error
+}
+
+// DB is a cache backed by the database, safe for concurrent use.
+// Values are stored as they are and expire with the TTL of their key (see textdb.DB.PutWithTTL),
+// so expired values are reclaimed by the expiry sweeper and compaction.
+type DB struct {
+	db     textdb.TTLStore
+	prefix string
+}
+
+var _ Cache = (*DB)(nil)
+
+// New returns a cache storing keys in the database under the given prefix.
+func New(db textdb.TTLStore, prefix string) *DB {
+	return &DB{db: db, prefix: prefix}
+}
+
+func (c *DB) Get(key string) ([]byte, bool, error) {
+	v, err := c.db.Get(c.prefix + key)
+	if errors.Is(err, textdb.ErrKeyNotFound) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return v, true, nil
+}
+
+func (c *DB) Set(key string, value []byte, ttl time.Duration) error {
+	if ttl > 0 {
+		return c.db.PutWithTTL(c.prefix+key, value, ttl)
+	}
+	return c.db.Put(c.prefix+key, value)
+}
+
+func (c *DB) Delete(key string) error {
+	if !c.db.Exists(c.prefix + key) {
+		return nil
+	}
+	return c.db.Delete(c.prefix + key)
+}
@@ -0,0 +1,53 @@
+package cache
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ejuju/go-db-playground/textdb"
+)
+
+func TestDB(t *testing.T) {
+	db, err := textdb.Open(filepath.Join(t.TempDir(), "test.db"), textdb.WithExpirySweep(5*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, s := range []textdb.TTLStore{db, textdb.NewMemDB()} {
+		var c Cache = New(s, "c:")
+		if err := c.Set("expiring", []byte("v"), 20*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Set("kept", nil, 0); err != nil {
+			t.Fatal(err)
+		}
+		if v, ok, err := c.Get("expiring"); err != nil || !ok || string(v) != "v" {
+			t.Fatalf("%T: got %q, %v, %v", s, v, ok, err)
+		}
+		if v, ok, err := c.Get("kept"); err != nil || !ok || len(v) != 0 {
+			t.Fatalf("%T: got %q, %v, %v for an empty value", s, v, ok, err)
+		}
+		// Values are stored as they are under the prefix
+		if v, err := s.Get("c:expiring"); err != nil || string(v) != "v" {
+			t.Fatalf("%T: got %q, %v under the prefix", s, v, err)
+		}
+		time.Sleep(30 * time.Millisecond)
+		if _, ok, err := c.Get("expiring"); err != nil || ok {
+			t.Fatalf("%T: got %v, %v for an expired value", s, ok, err)
+		}
+		if err := c.Delete("kept"); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Delete("kept"); err != nil {
+			t.Fatalf("%T: deleting a missing key: %v", s, err)
+		}
+		if _, ok, err := c.Get("kept"); err != nil || ok {
+			t.Fatalf("%T: got %v, %v for a deleted value", s, ok, err)
+		}
+	}
+	// The sweeper removed the expired key
+	if keys := db.Keys(); len(keys) != 0 {
+		t.Fatalf("got keys %q, want none", keys)
+	}
+}
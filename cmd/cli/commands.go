@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// command describes a command of the CLI, to validate its arguments and print its usage.
+type command struct {
+	name    string
+	args    string // usage of the arguments
+	help    string
+	minArgs int
+	maxArgs int
+}
+
+var commands = []command{
+	{name: "get", args: "<key>", help: "print the value of a key", minArgs: 1, maxArgs: 1},
+	{name: "find", args: "<key>", help: "same as get (deprecated)", minArgs: 1, maxArgs: 1},
+	{name: "exists", args: "<key>", help: "print whether a key exists", minArgs: 1, maxArgs: 1},
+	{name: "set", args: "<key>", help: "store a key without a value", minArgs: 1, maxArgs: 1},
+	{name: "put", args: "<key> <value>", help: "store a key and its value", minArgs: 2, maxArgs: 2},
+	{name: "delete", args: "<key>", help: "delete a key", minArgs: 1, maxArgs: 1},
+	{name: "keys", help: "list the keys in lexicographic order", minArgs: 0, maxArgs: 0},
+	{name: "scan", args: "[prefix]", help: "print the keys with the prefix and their values", minArgs: 0, maxArgs: 1},
+	{name: "count", help: "print the number of keys", minArgs: 0, maxArgs: 0},
+	{name: "dump", args: "[json|csv]", help: "write the keys and values to stdout (JSON lines by default)", minArgs: 0, maxArgs: 1},
+	{name: "load", args: "[json|csv]", help: "put the keys and values read from stdin in the format of dump", minArgs: 0, maxArgs: 1},
+	{name: "repl", help: "read commands from stdin, keeping the database open", minArgs: 0, maxArgs: 0},
+	{name: "stats", help: "print the number of keys, the size of the file and its dead bytes", minArgs: 0, maxArgs: 0},
+	{name: "inspect", args: "<offset>|#<row>", help: "decode a row, at an offset of the file or by its number (from 0)", minArgs: 1, maxArgs: 1},
+	{name: "compact", help: "compact the database file, printing its size before and after", minArgs: 0, maxArgs: 0},
+	{name: "backup", args: "<path>", help: "write a backup of the database to a new file", minArgs: 1, maxArgs: 1},
+	{name: "audit", help: "print the administrative operations recorded with -audit", minArgs: 0, maxArgs: 0},
+	{name: "restore", args: "<backup> <dst>", help: "write a database file from a backup (see -force)", minArgs: 2, maxArgs: 2},
+	{name: "migrate", args: "<src> <dst> [version]", help: "convert a database file to another format version", minArgs: 2, maxArgs: 3},
+	{name: "export-parquet", args: "<path>", help: "export the keys and values to a Parquet file", minArgs: 1, maxArgs: 1},
+	{name: "bench", args: "<workload> [records] [operations]", help: "run a workload against a temporary database", minArgs: 1, maxArgs: 3},
+	{name: "databases", help: "list the databases of the directory (with -dir)", minArgs: 0, maxArgs: 0},
+	{name: "help", args: "[command]", help: "print the usage of the CLI or of a command", minArgs: 0, maxArgs: 1},
+}
+
+// usageError is an invalid invocation of the CLI, which exits with status 2.
+type usageError struct{ msg string }
+
+func (err usageError) Error() string { return err.msg }
+
+func lookupCommand(name string) (command, bool) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+// checkArgs returns the command of the arguments if they're valid.
+func checkArgs(args []string) (command, error) {
+	if len(args) == 0 {
+		return command{}, usageError{"no command given"}
+	}
+	cmd, ok := lookupCommand(args[0])
+	if !ok {
+		return command{}, usageError{fmt.Sprintf("unknown command %q", args[0])}
+	}
+	if n := len(args) - 1; n < cmd.minArgs || n > cmd.maxArgs {
+		return command{}, usageError{"usage: " + cmd.usage()}
+	}
+	return cmd, nil
+}
+
+func (cmd command) usage() string {
+	if cmd.args == "" {
+		return "cli [flags] " + cmd.name
+	}
+	return "cli [flags] " + cmd.name + " " + cmd.args
+}
+
+// printUsage prints the usage of the CLI: its commands and flags.
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "usage: cli [flags] <command> [args...]")
+	fmt.Fprintln(w, "\ncommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-40s %s\n", cmd.name+" "+cmd.args, cmd.help)
+	}
+	fmt.Fprintln(w, "\nflags:")
+	flag.CommandLine.SetOutput(w)
+	flag.PrintDefaults()
+	flag.CommandLine.SetOutput(os.Stderr)
+}
+
+// help prints the usage of the CLI, or of the given command.
+func help(args []string) error {
+	if len(args) == 0 {
+		printUsage(os.Stdout)
+		return nil
+	}
+	cmd, ok := lookupCommand(args[0])
+	if !ok {
+		return usageError{fmt.Sprintf("unknown command %q", args[0])}
+	}
+	fmt.Printf("usage: %s\n\n%s\n", cmd.usage(), cmd.help)
+	return nil
+}
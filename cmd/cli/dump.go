@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ejuju/go-db-playground/textdb"
+)
+
+// loadBatchSize is the number of keys written per batch by load.
+const loadBatchSize = 1000
+
+// dumpRow is a key and its value in the JSON lines format.
+// Values that aren't valid UTF-8 are base64-encoded in the Base64 field instead of Value,
+// keys without value (written with Set) have neither.
+type dumpRow struct {
+	Key    string  `json:"key"`
+	Value  *string `json:"value,omitempty"`
+	Base64 *string `json:"base64,omitempty"`
+}
+
+func dumpFormat(args []string) (string, error) {
+	if len(args) == 0 {
+		return "json", nil
+	}
+	switch args[0] {
+	case "json", "csv":
+		return args[0], nil
+	}
+	return "", usageError{fmt.Sprintf("unknown format %q (json or csv)", args[0])}
+}
+
+// csvHeader is the header of CSV dumps. Values are base64-encoded, since CSV readers normalize line endings,
+// and the no_value column is "true" for keys without value (written with Set).
+var csvHeader = []string{"key", "value", "no_value"}
+
+// dump writes the keys and values of the database as JSON lines or CSV (see csvHeader).
+func dump(db *textdb.DB, args []string, w io.Writer) error {
+	format, err := dumpFormat(args)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	if format == "csv" {
+		cw := csv.NewWriter(bw)
+		cw.Write(csvHeader)
+		err = db.ForEach(func(k string, v []byte) error {
+			return cw.Write([]string{k, base64.StdEncoding.EncodeToString(v), strconv.FormatBool(v == nil)})
+		})
+		if cw.Flush(); err == nil {
+			err = cw.Error()
+		}
+	} else {
+		enc := json.NewEncoder(bw)
+		err = db.ForEach(func(k string, v []byte) error {
+			row := dumpRow{Key: k}
+			switch s := string(v); {
+			case v == nil: // key without value
+			case utf8.ValidString(s):
+				row.Value = &s
+			default:
+				s = base64.StdEncoding.EncodeToString(v)
+				row.Base64 = &s
+			}
+			return enc.Encode(row)
+		})
+	}
+	if flushErr := bw.Flush(); err == nil {
+		err = flushErr
+	}
+	return err
+}
+
+// load writes the keys and values read in the format of dump, in batches of loadBatchSize keys.
+// Keys without value are written with Set.
+func load(db *textdb.DB, args []string, r io.Reader) error {
+	format, err := dumpFormat(args)
+	if err != nil {
+		return err
+	}
+	next := loadJSON(r)
+	if format == "csv" {
+		if next, err = loadCSV(r); err != nil {
+			return err
+		}
+	}
+	n := 0
+	b := db.NewBatch()
+	for {
+		k, v, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return fmt.Errorf("load: row %d: %w", n+1, err)
+		}
+		if v == nil {
+			err = b.Set(k)
+		} else {
+			err = b.Put(k, v)
+		}
+		if err != nil {
+			return fmt.Errorf("load: row %d: %w", n+1, err)
+		}
+		n++
+		if b.Len() == loadBatchSize {
+			if err := b.Commit(); err != nil {
+				return fmt.Errorf("load: %w", err)
+			}
+		}
+	}
+	if err := b.Commit(); err != nil {
+		return fmt.Errorf("load: %w", err)
+	}
+	fmt.Printf("-> loaded %d keys\n", n)
+	return nil
+}
+
+func loadJSON(r io.Reader) func() (string, []byte, error) {
+	dec := json.NewDecoder(r)
+	return func() (string, []byte, error) {
+		var row dumpRow
+		if err := dec.Decode(&row); err != nil {
+			return "", nil, err
+		}
+		switch {
+		case row.Base64 != nil:
+			v, err := base64.StdEncoding.DecodeString(*row.Base64)
+			return row.Key, v, err
+		case row.Value != nil:
+			return row.Key, []byte(*row.Value), nil
+		}
+		return row.Key, nil, nil
+	}
+}
+
+func loadCSV(r io.Reader) (func() (string, []byte, error), error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = len(csvHeader)
+	header, err := cr.Read()
+	if errors.Is(err, io.EOF) {
+		return func() (string, []byte, error) { return "", nil, io.EOF }, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("load: %w", err)
+	}
+	for i, name := range csvHeader {
+		if header[i] != name {
+			return nil, fmt.Errorf("load: invalid CSV header %q (%s)", header, strings.Join(csvHeader, ","))
+		}
+	}
+	return func() (string, []byte, error) {
+		rec, err := cr.Read()
+		if err != nil {
+			return "", nil, err
+		}
+		noValue, err := strconv.ParseBool(rec[2])
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid no_value: %w", err)
+		}
+		if noValue {
+			return rec[0], nil, nil
+		}
+		v, err := base64.StdEncoding.DecodeString(rec[1])
+		if v == nil {
+			v = []byte{}
+		}
+		return rec[0], v, err
+	}, nil
+}
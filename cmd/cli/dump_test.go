@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/ejuju/go-db-playground/textdb"
+)
+
+func TestDumpLoad(t *testing.T) {
+	for _, format := range []string{"json", "csv"} {
+		src, err := textdb.Open(filepath.Join(t.TempDir(), "src.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer src.Close()
+		for k, v := range map[string][]byte{"crlf": []byte("a\r\nb"), "empty": {}, "binary": {0xff, 0}} {
+			if err := src.Put(k, v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := src.Set("set"); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := dump(src, []string{format}, &buf); err != nil {
+			t.Fatal(err)
+		}
+
+		dst, err := textdb.Open(filepath.Join(t.TempDir(), "dst.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dst.Close()
+		if err := load(dst, []string{format}, &buf); err != nil {
+			t.Fatal(err)
+		}
+		// Values are kept byte for byte, and keys without value stay without value
+		var got []string
+		err = dst.ForEach(func(k string, v []byte) error {
+			got = append(got, fmt.Sprintf("%s=%q/%t", k, v, v == nil))
+			return nil
+		})
+		want := `[binary="\xff\x00"/false crlf="a\r\nb"/false empty=""/false set=""/true]`
+		if err != nil || fmt.Sprint(got) != want {
+			t.Fatalf("%s: got %s, %v, want %s", format, got, err, want)
+		}
+	}
+}
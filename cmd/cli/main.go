@@ -1,38 +1,378 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/ejuju/go-db-playground/loadgen"
 	"github.com/ejuju/go-db-playground/textdb"
 )
 
 func main() {
-	db, err := textdb.NewDB("test.txt.db")
+	dbPath := flag.String("db", envOr("TEXTDB_PATH", "test.txt.db"), "path of the database file (or set TEXTDB_PATH)")
+	passphrase := flag.String("passphrase", "", "passphrase of an encrypted database (or set TEXTDB_PASSPHRASE)")
+	keyFile := flag.String("key-file", "", "file containing the base64-encoded encryption key")
+	dir := flag.String("dir", "", "directory of named databases (instead of -db)")
+	name := flag.String("name", "default", "name of the database in the directory (with -dir)")
+	repair := flag.Bool("repair", false, "move a partial last row (left by a crash) aside instead of failing to open")
+	readOnly := flag.Bool("read-only", false, "open the database without allowing writes")
+	binary := flag.Bool("binary", false, "create the database file in the binary format")
+	force := flag.Bool("force", false, "replace the destination of restore if it exists")
+	audit := flag.Bool("audit", false, "record compactions, restores and bucket deletions in the audit file of the database")
+	flag.Usage = func() { printUsage(os.Stderr) }
+	flag.Parse()
+	if *passphrase == "" {
+		*passphrase = os.Getenv("TEXTDB_PASSPHRASE") // not the flag default, which would show in the usage
+	}
+	args := flag.Args()
+	cmd, err := checkArgs(args)
+	if err != nil {
+		fatal(err)
+	}
+
+	var opts []textdb.Option
+	switch {
+	case *passphrase != "":
+		opts = append(opts, textdb.WithPassphrase(*passphrase))
+	case *keyFile != "":
+		opts = append(opts, textdb.WithKeyProvider(textdb.FileKeyProvider(*keyFile)))
+	case os.Getenv("TEXTDB_KEY") != "":
+		opts = append(opts, textdb.WithKeyProvider(textdb.EnvKeyProvider("TEXTDB_KEY")))
+	}
+	if *repair {
+		opts = append(opts, textdb.WithRepair())
+	}
+	if *readOnly {
+		opts = append(opts, textdb.WithReadOnly())
+	}
+	if *binary {
+		opts = append(opts, textdb.WithFormat(textdb.FormatBinary))
+	}
+	if *audit {
+		opts = append(opts, textdb.WithAuditTrail())
+	}
+	// Commands that don't open the database
+	switch cmd.name {
+	case "help":
+		err = help(args[1:])
+	case "migrate":
+		err = migrate(args[1:], opts)
+	case "restore":
+		err = restore(args[1:], *force, opts)
+	case "audit":
+		err = printAudit(*dbPath)
+	case "bench":
+		err = bench(args[1:], opts)
+	case "databases":
+		if *dir == "" {
+			err = usageError{"databases: -dir is required"}
+			break
+		}
+		err = runManaged(*dir, *name, args, opts)
+	default:
+		if *dir != "" {
+			err = runManaged(*dir, *name, args, opts)
+			break
+		}
+		err = runFile(*dbPath, *readOnly, args, opts)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+// runFile runs the command against the database file.
+func runFile(path string, readOnly bool, args []string, opts []textdb.Option) error {
+	db, err := openDB(path, readOnly, opts)
+	if err != nil {
+		return err
+	}
+	err = run(db, args)
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// fatal prints the error to stderr and exits, with status 2 for usage errors and 1 otherwise.
+func fatal(err error) {
+	var uerr usageError
+	if errors.As(err, &uerr) {
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, "run 'cli help' for the list of commands")
+		os.Exit(2)
+	}
+	fmt.Fprintf(os.Stderr, "error: %v\n", err)
+	os.Exit(1)
+}
+
+// openDB opens the database file, which is created unless it's opened read-only.
+func openDB(path string, readOnly bool, opts []textdb.Option) (*textdb.DB, error) {
+	info, err := os.Stat(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist) && readOnly:
+		return nil, fmt.Errorf("database %q doesn't exist", path)
+	case errors.Is(err, os.ErrNotExist):
+		if _, err := os.Stat(filepath.Dir(path)); err != nil {
+			return nil, fmt.Errorf("can't create database %q: %w", path, err)
+		}
+	case err != nil:
+		return nil, fmt.Errorf("can't access database %q: %w", path, err)
+	case info.IsDir():
+		return nil, fmt.Errorf("database %q is a directory", path)
+	}
+	db, err := textdb.Open(path, opts...)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("open database %q: %w", path, err)
 	}
+	return db, nil
+}
 
-	switch os.Args[1] {
+// runManaged runs the command against the named database of a directory of databases.
+func runManaged(dir, name string, args []string, opts []textdb.Option) error {
+	m, err := textdb.NewManager(dir, textdb.ManagerConfig{Options: opts})
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "databases":
+		var names []string
+		names, err = m.Names()
+		for _, name := range names {
+			fmt.Println(name)
+		}
+	default:
+		err = m.Do(name, func(db *textdb.DB) error { return run(db, args) })
+	}
+	if closeErr := m.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// run runs a command that uses the database.
+func run(db *textdb.DB, args []string) (err error) {
+	switch args[0] {
 	case "set":
-		err = db.Set(os.Args[2])
+		err = db.Set(args[1])
 	case "exists":
-		ok := db.Exists(os.Args[2])
-		fmt.Printf("-> exists %q: %v\n", os.Args[2], ok)
+		ok := db.Exists(args[1])
+		fmt.Printf("-> exists %q: %v\n", args[1], ok)
 	case "delete":
-		err = db.Delete(os.Args[2])
+		err = db.Delete(args[1])
 	case "put":
-		err = db.Put(os.Args[2], []byte(os.Args[3]))
-	case "get":
-		var v []byte
-		v, err = db.Get(os.Args[2])
-		fmt.Printf("-> %q\n", v)
-	case "find":
+		err = db.Put(args[1], []byte(args[2]))
+	case "get", "find":
 		var v []byte
-		v, err = db.Find(os.Args[2])
-		fmt.Printf("-> %q\n", v)
+		if v, err = db.Get(args[1]); err == nil {
+			fmt.Printf("-> %q\n", v)
+		}
+	case "keys":
+		for _, k := range db.Keys() {
+			fmt.Printf("%q\n", k)
+		}
+	case "scan":
+		prefix := ""
+		if len(args) > 1 {
+			prefix = args[1]
+		}
+		err = db.Scan(prefix, func(k string, v []byte) error {
+			fmt.Printf("%q -> %q\n", k, v)
+			return nil
+		})
+	case "count":
+		fmt.Printf("-> %d\n", len(db.Keys()))
+	case "dump":
+		err = dump(db, args[1:], os.Stdout)
+	case "load":
+		err = load(db, args[1:], os.Stdin)
+	case "export-parquet":
+		var f *os.File
+		f, err = os.Create(args[1])
+		if err != nil {
+			break
+		}
+		err = db.ExportParquet(f)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	case "compact":
+		err = compact(db)
+	case "stats":
+		err = stats(db)
+	case "inspect":
+		err = inspect(db, args[1])
+	case "backup":
+		err = db.BackupToFile(args[1])
+	case "repl":
+		err = repl(db, os.Stdin, os.Stdout)
+	}
+	return err
+}
+
+// compact compacts the database and prints the size of the file before and after.
+func compact(db *textdb.DB) error {
+	before, err := db.Stats()
+	if err != nil {
+		return err
+	}
+	if err := db.Compact(); err != nil {
+		return err
+	}
+	after, err := db.Stats()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("-> compacted: %d -> %d bytes, %d live keys\n", before.TotalBytes, after.TotalBytes, after.Keys)
+	return nil
+}
+
+// stats prints the statistics of the database.
+func stats(db *textdb.DB) error {
+	s, err := db.Stats()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("keys:        %d\n", len(db.Keys()))
+	fmt.Printf("file size:   %d bytes\n", s.TotalBytes)
+	fmt.Printf("dead bytes:  %d (%.1f%%)\n", s.TotalBytes-s.LiveBytes, 100*s.DeadRatio)
+	fmt.Printf("last write:  %s\n", s.LastWrite.Format(time.RFC3339))
+	return nil
+}
+
+// inspect prints the row at the offset, or the row with the number after # (e.g. #0 for the first row).
+func inspect(db *textdb.DB, at string) error {
+	var row textdb.Row
+	var err error
+	if n, ok := strings.CutPrefix(at, "#"); ok {
+		i, convErr := strconv.Atoi(n)
+		if convErr != nil {
+			return usageError{fmt.Sprintf("invalid row: %q", at)}
+		}
+		row, err = db.NthRow(i)
+	} else {
+		offset, convErr := strconv.ParseInt(at, 10, 64)
+		if convErr != nil {
+			return usageError{fmt.Sprintf("invalid offset: %q", at)}
+		}
+		row, err = db.RowAt(offset)
+	}
+	if err != nil && row.Size == 0 {
+		return err
+	}
+	fmt.Printf("offset:   %d\n", row.Offset)
+	fmt.Printf("size:     %d bytes\n", row.Size)
+	fmt.Printf("op:       %c\n", row.Op)
+	fmt.Printf("key:      %q\n", row.Key)
+	if row.Value != nil {
+		fmt.Printf("value:    %q\n", row.Value)
+	}
+	if row.MAC != nil {
+		fmt.Printf("mac:      %x\n", row.MAC)
+	}
+	fmt.Printf("checksum: %v\n", row.Checksum)
+	return err
+}
+
+// migrate converts a database file to another format version (the current one by default).
+// Usage: migrate <src> <dst> [version]
+func migrate(args []string, opts []textdb.Option) error {
+	version := textdb.CurrentFormat
+	if len(args) > 2 {
+		v, err := strconv.Atoi(args[2])
+		if err != nil {
+			return usageError{fmt.Sprintf("invalid version: %q", args[2])}
+		}
+		version = textdb.FormatVersion(v)
+	}
+	if err := textdb.Migrate(args[0], args[1], version, opts...); err != nil {
+		return err
+	}
+	fmt.Printf("-> migrated %q to %q (format %d)\n", args[0], args[1], version)
+	return nil
+}
+
+// restore writes a database file from a backup (see the backup command).
+// Usage: restore <backup> <dst>
+func restore(args []string, overwrite bool, opts []textdb.Option) error {
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := textdb.Restore(args[1], f, textdb.RestoreConfig{Overwrite: overwrite, Options: opts}); err != nil {
+		return err
+	}
+	fmt.Printf("-> restored %q from %q\n", args[1], args[0])
+	return nil
+}
+
+// printAudit prints the entries of the audit trail of the database file (see the -audit flag).
+func printAudit(path string) error {
+	entries, err := textdb.ReadAuditTrail(path)
+	for _, e := range entries {
+		fmt.Printf("%s %s", e.Time.Format(time.RFC3339), e.Op)
+		if e.Detail != "" {
+			fmt.Printf(" %s", e.Detail)
+		}
+		if e.Err != "" {
+			fmt.Printf(" (error: %s)", e.Err)
+		}
+		fmt.Println()
+	}
+	return err
+}
+
+// bench runs a workload (and its load phase) against a temporary database.
+// Usage: bench <workload> [records] [operations]
+func bench(args []string, opts []textdb.Option) error {
+	w, ok := loadgen.Workloads[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown workload %q", args[0])
+	}
+	var err error
+	if len(args) > 1 {
+		if w.RecordCount, err = strconv.Atoi(args[1]); err != nil {
+			return usageError{fmt.Sprintf("invalid records: %q", args[1])}
+		}
+	}
+	if len(args) > 2 {
+		if w.OperationCount, err = strconv.Atoi(args[2]); err != nil {
+			return usageError{fmt.Sprintf("invalid operations: %q", args[2])}
+		}
+	}
+
+	dir, err := os.MkdirTemp("", "textdb-bench")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	db, err := textdb.Open(filepath.Join(dir, "bench.txt.db"), opts...)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := loadgen.Load(db, w); err != nil {
+		return err
 	}
+	res, err := loadgen.Run(db, w)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	fmt.Print(res)
+	return nil
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ejuju/go-db-playground/textdb"
+)
+
+// replArgs is the number of arguments of the commands of the REPL.
+var replArgs = map[string]int{
+	"set": 1, "get": 1, "put": 2, "delete": 1, "exists": 1,
+	"keys": 0, "scan": 1, "stats": 0, "compact": 0, "quit": 0,
+}
+
+// repl runs the commands read line by line from r against the database, which stays open between them.
+// Errors of commands are printed, and it returns at the end of the input or on quit.
+// The value of put is the rest of the line, so it can contain spaces.
+func repl(db *textdb.DB, r io.Reader, w io.Writer) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 16<<20)
+	for fmt.Fprint(w, "> "); sc.Scan(); fmt.Fprint(w, "> ") {
+		args := strings.SplitN(strings.TrimSpace(sc.Text()), " ", 3)
+		if args[0] == "" {
+			continue
+		}
+		n, ok := replArgs[args[0]]
+		if args[0] == "scan" && len(args) == 1 {
+			args = append(args, "") // scan all keys
+		}
+		switch {
+		case !ok:
+			fmt.Fprintf(w, "unknown command %q (commands: set, get, put, delete, exists, keys, scan, stats, compact, quit)\n", args[0])
+			continue
+		case len(args)-1 != n:
+			fmt.Fprintf(w, "%s takes %d argument(s)\n", args[0], n)
+			continue
+		case args[0] == "quit":
+			return nil
+		}
+		if err := replCommand(db, args, w); err != nil {
+			fmt.Fprintf(w, "error: %v\n", err)
+		}
+	}
+	fmt.Fprintln(w)
+	return sc.Err()
+}
+
+func replCommand(db *textdb.DB, args []string, w io.Writer) error {
+	switch args[0] {
+	case "set":
+		return db.Set(args[1])
+	case "get":
+		v, err := db.Get(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "-> %q\n", v)
+	case "put":
+		return db.Put(args[1], []byte(args[2]))
+	case "delete":
+		return db.Delete(args[1])
+	case "exists":
+		fmt.Fprintf(w, "-> exists %q: %v\n", args[1], db.Exists(args[1]))
+	case "keys":
+		for _, k := range db.Keys() {
+			fmt.Fprintf(w, "%q\n", k)
+		}
+	case "scan":
+		return db.Scan(args[1], func(k string, v []byte) error {
+			_, err := fmt.Fprintf(w, "%q -> %q\n", k, v)
+			return err
+		})
+	case "stats":
+		s, err := db.Stats()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "-> %+v\n", s)
+	case "compact":
+		return db.Compact()
+	}
+	return nil
+}
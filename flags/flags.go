@@ -0,0 +1,203 @@
+// Package flags implements feature flags stored in the database,
+// with typed definitions, percentage rollouts and per-key overrides.
+package flags
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"github.com/ejuju/go-db-playground/textdb"
+)
+
+// State is the stored state of a flag.
+type State struct {
+	Value     json.RawMessage            `json:"value,omitempty"`     // value for keys in the rollout
+	Rollout   int                        `json:"rollout"`             // percentage of keys getting the value, others get the default
+	Overrides map[string]json.RawMessage `json:"overrides,omitempty"` // values of specific keys, regardless of the rollout
+}
+
+// Store holds flag states, it's safe for concurrent use.
+// States are read from the database each time, so changes made through other stores are seen.
+type Store struct {
+	mu        sync.Mutex
+	db        textdb.Store
+	prefix    string
+	watchers  []func(name string)
+	stopWatch func()
+}
+
+// watchable is implemented by databases reporting their writes, like textdb.DB.
+type watchable interface {
+	Watch(prefix string) (<-chan textdb.Event, func())
+}
+
+// New returns a store saving flags under the given key prefix ("flags:" if empty).
+func New(db textdb.Store, prefix string) *Store {
+	if prefix == "" {
+		prefix = "flags:"
+	}
+	s := &Store{db: db, prefix: prefix}
+	if w, ok := db.(watchable); ok {
+		var events <-chan textdb.Event
+		events, s.stopWatch = w.Watch(prefix)
+		go s.watch(events)
+	}
+	return s
+}
+
+// Close stops watching the writes of the database (see Watch).
+func (s *Store) Close() {
+	if s.stopWatch != nil {
+		s.stopWatch()
+	}
+}
+
+// watch notifies watchers of the written flags until the channel is closed.
+func (s *Store) watch(events <-chan textdb.Event) {
+	for e := range events {
+		s.mu.Lock()
+		watchers := s.watchers
+		s.mu.Unlock()
+		for _, fn := range watchers {
+			fn(e.Key[len(s.prefix):])
+		}
+	}
+}
+
+// State returns the state of a flag, nil if it was never set.
+func (s *Store) State(name string) (*State, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state(name)
+}
+
+func (s *Store) state(name string) (*State, error) {
+	v, err := s.db.Get(s.prefix + name)
+	var st *State
+	if err == nil {
+		st = &State{}
+		if err := json.Unmarshal(v, st); err != nil {
+			return nil, fmt.Errorf("flags: decode %q: %w", name, err)
+		}
+	} else if !errors.Is(err, textdb.ErrKeyNotFound) {
+		return nil, err
+	}
+	return st, nil
+}
+
+// update applies fn to the state of a flag, saves it and notifies watchers.
+func (s *Store) update(name string, fn func(st *State)) error {
+	s.mu.Lock()
+	st, err := s.state(name)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	updated := &State{Overrides: make(map[string]json.RawMessage)}
+	if st != nil {
+		updated.Value, updated.Rollout = st.Value, st.Rollout
+		for k, v := range st.Overrides {
+			updated.Overrides[k] = v
+		}
+	}
+	fn(updated)
+	v, err := json.Marshal(updated)
+	if err == nil {
+		err = s.db.Put(s.prefix+name, v)
+	}
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	if s.stopWatch != nil {
+		s.mu.Unlock()
+		return nil // watchers are notified by watch
+	}
+	watchers := s.watchers
+	s.mu.Unlock()
+
+	for _, fn := range watchers {
+		fn(name)
+	}
+	return nil
+}
+
+// Watch calls fn with the name of each changed flag.
+// If the database reports its writes (see textdb.DB.Watch), fn is called from another goroutine
+// for flags written through any store of the database, including writes read by a follower
+// (see textdb.WithFollow). Otherwise it's called for flags written through this store.
+func (s *Store) Watch(fn func(name string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.watchers = append(s.watchers, fn)
+}
+
+// inRollout deterministically assigns a key to a percentage bucket of a flag.
+func inRollout(name, key string, percent int) bool {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	return int(h.Sum32()%100) < percent
+}
+
+// Flag is a typed flag definition, T must be JSON-encodable.
+type Flag[T any] struct {
+	s    *Store
+	name string
+	def  T
+}
+
+// Define returns a flag with a default value, used when the flag isn't set or the key isn't in the rollout.
+func Define[T any](s *Store, name string, def T) *Flag[T] {
+	return &Flag[T]{s: s, name: name, def: def}
+}
+
+func (f *Flag[T]) Name() string { return f.name }
+
+// Get returns the value of the flag for a key (e.g. a user ID).
+// It returns the default value if the state can't be read.
+func (f *Flag[T]) Get(key string) T {
+	st, err := f.s.State(f.name)
+	if err != nil || st == nil {
+		return f.def
+	}
+	raw, ok := st.Overrides[key]
+	if !ok {
+		if st.Value == nil || !inRollout(f.name, key, st.Rollout) {
+			return f.def
+		}
+		raw = st.Value
+	}
+	var v T
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return f.def
+	}
+	return v
+}
+
+// Set rolls out a value to a percentage of keys (100 for all keys).
+func (f *Flag[T]) Set(v T, rollout int) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return f.s.update(f.name, func(st *State) { st.Value, st.Rollout = raw, rollout })
+}
+
+// Override sets the value of the flag for a specific key.
+func (f *Flag[T]) Override(key string, v T) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return f.s.update(f.name, func(st *State) { st.Overrides[key] = raw })
+}
+
+// ClearOverride removes the value set for a specific key.
+func (f *Flag[T]) ClearOverride(key string) error {
+	return f.s.update(f.name, func(st *State) { delete(st.Overrides, key) })
+}
@@ -0,0 +1,109 @@
+package flags
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ejuju/go-db-playground/textdb"
+)
+
+func TestFlags(t *testing.T) {
+	s := New(textdb.NewMemDB(), "")
+	color := Define(s, "color", "blue")
+	if v := color.Get("user"); v != "blue" {
+		t.Fatalf("got %q for an unset flag, want the default", v)
+	}
+	if err := color.Set("red", 50); err != nil {
+		t.Fatal(err)
+	}
+	// Keys are deterministically in or out of the rollout
+	in := 0
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprint("user", i)
+		v := color.Get(key)
+		if v != color.Get(key) {
+			t.Fatalf("%q: the value changed between calls", key)
+		}
+		if v == "red" {
+			in++
+		}
+	}
+	if in < 400 || in > 600 {
+		t.Fatalf("%d keys out of 1000 in a rollout of 50%%", in)
+	}
+
+	if err := color.Set("red", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := color.Override("user1", "green"); err != nil {
+		t.Fatal(err)
+	}
+	if v := color.Get("user1"); v != "green" {
+		t.Fatalf("got %q, want the override", v)
+	}
+	if err := color.ClearOverride("user1"); err != nil {
+		t.Fatal(err)
+	}
+	if v := color.Get("user1"); v != "blue" {
+		t.Fatalf("got %q after clearing the override, want the default", v)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	db, err := textdb.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	a, b := New(db, ""), New(db, "")
+	defer a.Close()
+	defer b.Close()
+	changed := make(chan string, 4)
+	a.Watch(func(name string) { changed <- name })
+	dark := Define(a, "dark", false)
+	if dark.Get("user") {
+		t.Fatal("got the value of an unset flag")
+	}
+
+	// Changes made through another store are seen and notified
+	if err := Define(b, "dark", false).Set(true, 100); err != nil {
+		t.Fatal(err)
+	}
+	if !dark.Get("user") {
+		t.Fatal("the change made through another store isn't seen")
+	}
+	select {
+	case name := <-changed:
+		if name != "dark" {
+			t.Fatalf("got a notification for %q, want dark", name)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the change made through another store wasn't notified")
+	}
+
+	// Changes made through the store are notified once
+	if err := dark.Set(false, 100); err != nil {
+		t.Fatal(err)
+	}
+	if name := <-changed; name != "dark" {
+		t.Fatalf("got a notification for %q, want dark", name)
+	}
+	select {
+	case name := <-changed:
+		t.Fatalf("got a second notification for %q", name)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Stores of databases that can't be watched notify their own changes
+	m := New(textdb.NewMemDB(), "")
+	called := false
+	m.Watch(func(string) { called = true })
+	if err := Define(m, "n", 0).Set(1, 100); err != nil {
+		t.Fatal(err)
+	}
+	if !called {
+		t.Fatal("the change wasn't notified")
+	}
+}
@@ -1,3 +1,8 @@
 module github.com/ejuju/go-db-playground
 
 go 1.20
+
+require (
+	golang.org/x/crypto v0.33.0
+	golang.org/x/sys v0.30.0
+)
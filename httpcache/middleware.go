@@ -0,0 +1,179 @@
+// Package httpcache implements an HTTP middleware caching responses,
+// typically in the database (see cache.New).
+package httpcache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ejuju/go-db-playground/cache"
+)
+
+// Config configures the cache middleware.
+type Config struct {
+	// TTL of cached responses that don't set Cache-Control max-age.
+	TTL time.Duration
+	// MaxBodySize is the size above which responses aren't cached (1 MiB by default).
+	MaxBodySize int
+	// Vary lists the request headers that are part of the cache key (e.g. Accept-Encoding).
+	Vary []string
+	// OnError is called with the errors of the store (e.g. to log them), requests are then served without the cache.
+	OnError func(error)
+}
+
+// Middleware caches successful responses to GET and HEAD requests,
+// keyed by the method, host, URL and configured request headers.
+// Requests with an Authorization header and responses with Cache-Control no-store or private are never cached.
+// Responses served from the cache have the header X-Cache: HIT.
+func Middleware(store cache.Cache, cfg Config) func(http.Handler) http.Handler {
+	if cfg.MaxBodySize <= 0 {
+		cfg.MaxBodySize = 1 << 20
+	}
+	c := &responseCache{store: store, cfg: cfg}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if (r.Method != http.MethodGet && r.Method != http.MethodHead) || r.Header.Get("Authorization") != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			key := c.key(r)
+			if res, ok := c.get(key); ok {
+				res.write(w)
+				return
+			}
+			rec := &recorder{ResponseWriter: w, status: http.StatusOK, maxBodySize: cfg.MaxBodySize}
+			next.ServeHTTP(rec, r)
+			if ttl, ok := c.ttl(rec); ok {
+				c.put(key, ttl, rec)
+			}
+		})
+	}
+}
+
+type responseCache struct {
+	store cache.Cache
+	cfg   Config
+}
+
+func (c *responseCache) key(r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(r.Method)
+	b.WriteByte(' ')
+	b.WriteString(r.Host) // the URL of server requests has no host
+	b.WriteByte(' ')
+	b.WriteString(r.URL.String())
+	for _, h := range c.cfg.Vary {
+		b.WriteByte('\n')
+		b.WriteString(h)
+		b.WriteByte(':')
+		b.WriteString(strings.Join(r.Header.Values(h), ","))
+	}
+	return b.String()
+}
+
+// ttl returns how long a recorded response can be cached for, or false if it can't be.
+func (c *responseCache) ttl(rec *recorder) (time.Duration, bool) {
+	if rec.status != http.StatusOK || rec.tooLarge || rec.Header().Get("Vary") == "*" || rec.Header().Get("Set-Cookie") != "" {
+		return 0, false
+	}
+	ttl := c.cfg.TTL
+	for _, directive := range strings.Split(rec.Header().Get("Cache-Control"), ",") {
+		directive = strings.TrimSpace(directive)
+		switch {
+		case directive == "no-store" || directive == "private" || directive == "no-cache":
+			return 0, false
+		case strings.HasPrefix(directive, "max-age="):
+			if secs, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age=")); err == nil {
+				ttl = time.Duration(secs) * time.Second
+			}
+		}
+	}
+	return ttl, ttl > 0
+}
+
+// A cached response is stored as its status code, headers and body.
+type response struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+func (res *response) write(w http.ResponseWriter) {
+	for k, v := range res.header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("X-Cache", "HIT")
+	w.WriteHeader(res.status)
+	w.Write(res.body)
+}
+
+func (c *responseCache) get(key string) (*response, bool) {
+	v, ok, err := c.store.Get(key)
+	if err != nil {
+		c.fail(fmt.Errorf("httpcache: get %q: %w", key, err))
+		return nil, false
+	}
+	if !ok || len(v) < 2 {
+		return nil, false
+	}
+	res := &response{status: int(binary.BigEndian.Uint16(v))}
+	br := bytes.NewReader(v[2:])
+	tr := textproto.NewReader(bufio.NewReader(br))
+	header, err := tr.ReadMIMEHeader()
+	if err != nil {
+		return nil, false
+	}
+	res.header = http.Header(header)
+	res.body = v[len(v)-tr.R.Buffered()-br.Len():]
+	return res, true
+}
+
+func (c *responseCache) put(key string, ttl time.Duration, rec *recorder) {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint16(rec.status))
+	rec.Header().Write(&buf)
+	buf.WriteString("\r\n")
+	buf.Write(rec.body.Bytes())
+	if err := c.store.Set(key, buf.Bytes(), ttl); err != nil {
+		c.fail(fmt.Errorf("httpcache: set %q: %w", key, err))
+	}
+}
+
+func (c *responseCache) fail(err error) {
+	if c.cfg.OnError != nil {
+		c.cfg.OnError(err)
+	}
+}
+
+// recorder passes the response through while keeping a copy of it.
+type recorder struct {
+	http.ResponseWriter
+	status      int
+	body        bytes.Buffer
+	maxBodySize int
+	tooLarge    bool
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *recorder) Write(p []byte) (int, error) {
+	if !rec.tooLarge {
+		if rec.body.Len()+len(p) > rec.maxBodySize {
+			rec.tooLarge = true
+			rec.body = bytes.Buffer{}
+		} else {
+			rec.body.Write(p)
+		}
+	}
+	return rec.ResponseWriter.Write(p)
+}
@@ -0,0 +1,76 @@
+package httpcache
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ejuju/go-db-playground/cache"
+	"github.com/ejuju/go-db-playground/textdb"
+)
+
+func TestMiddleware(t *testing.T) {
+	calls := 0
+	h := Middleware(cache.New(textdb.NewMemDB(), "http:"), Config{TTL: time.Minute, Vary: []string{"Accept"}})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "text/plain")
+		if r.URL.Path == "/no-store" {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		fmt.Fprint(w, "hello ", r.Host, r.URL.Path, r.Header.Get("Accept"))
+	}))
+	get := func(host, path, accept string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "http://"+host+path, nil)
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	first, second := get("a.test", "/a", "1"), get("a.test", "/a", "1")
+	if first.Body.String() != second.Body.String() || second.Header().Get("X-Cache") != "HIT" || second.Header().Get("Content-Type") != "text/plain" {
+		t.Fatalf("cached response: %q %v, want %q with the headers", second.Body, second.Header(), first.Body)
+	}
+	// The host and the varying headers are part of the key
+	if w := get("b.test", "/a", "1"); w.Header().Get("X-Cache") != "" || !strings.Contains(w.Body.String(), "b.test") {
+		t.Fatalf("response of another host: %q %v", w.Body, w.Header())
+	}
+	if w := get("a.test", "/a", "2"); w.Header().Get("X-Cache") != "" {
+		t.Fatalf("response with another Accept header served from the cache: %q", w.Body)
+	}
+	get("a.test", "/no-store", "")
+	get("a.test", "/no-store", "")
+	if calls != 5 {
+		t.Fatalf("handler called %d times, want 5", calls)
+	}
+}
+
+// failingCache fails every operation.
+type failingCache struct{}
+
+var errStore = errors.New("store failure")
+
+func (failingCache) Get(string) ([]byte, bool, error)        { return nil, false, errStore }
+func (failingCache) Set(string, []byte, time.Duration) error { return errStore }
+func (failingCache) Delete(string) error                     { return errStore }
+
+func TestMiddlewareStoreErrors(t *testing.T) {
+	var errs []error
+	cfg := Config{TTL: time.Minute, OnError: func(err error) { errs = append(errs, err) }}
+	h := Middleware(failingCache{}, cfg)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Body.String() != "hello" {
+		t.Fatalf("got %q, want the response of the handler", w.Body)
+	}
+	if len(errs) != 2 || !errors.Is(errs[0], errStore) || !errors.Is(errs[1], errStore) {
+		t.Fatalf("got errors %v, want the errors of Get and Set", errs)
+	}
+}
@@ -0,0 +1,138 @@
+package loadgen
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Op is an operation type.
+type Op string
+
+const (
+	OpRead            Op = "read"
+	OpUpdate          Op = "update"
+	OpInsert          Op = "insert"
+	OpReadModifyWrite Op = "read-modify-write"
+)
+
+// Result summarizes a run.
+type Result struct {
+	Workload string
+	Elapsed  time.Duration
+	Ops      map[Op]int
+	Errors   int
+
+	latencies map[Op][]time.Duration
+}
+
+// Total returns the number of operations performed.
+func (res *Result) Total() int {
+	n := 0
+	for _, c := range res.Ops {
+		n += c
+	}
+	return n
+}
+
+// Throughput returns the number of operations per second.
+func (res *Result) Throughput() float64 { return float64(res.Total()) / res.Elapsed.Seconds() }
+
+// Percentile returns the latency at the given percentile (between 0 and 100) for an operation type.
+func (res *Result) Percentile(op Op, p float64) time.Duration {
+	l := res.latencies[op]
+	if len(l) == 0 {
+		return 0
+	}
+	return l[int(float64(len(l)-1)*p/100)]
+}
+
+func (res *Result) String() string {
+	s := fmt.Sprintf("workload %s: %d ops in %s (%.0f ops/s, %d errors)\n", res.Workload, res.Total(), res.Elapsed, res.Throughput(), res.Errors)
+	ops := make([]string, 0, len(res.Ops))
+	for op := range res.Ops {
+		ops = append(ops, string(op))
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		s += fmt.Sprintf("  %-18s %8d ops, p50 %s, p99 %s\n", op, res.Ops[Op(op)], res.Percentile(Op(op), 50), res.Percentile(Op(op), 99))
+	}
+	return s
+}
+
+// Load inserts the initial records of the workload.
+func Load(s Store, w Workload) error {
+	w = w.withDefaults()
+	r := rand.New(rand.NewSource(w.Seed))
+	for i := 0; i < w.RecordCount; i++ {
+		if err := s.Put(Key(i), w.value(r)); err != nil {
+			return fmt.Errorf("load record %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Run performs the workload operations, the store must have been loaded first.
+// Runs with the same workload and seed perform the same operations.
+func Run(s Store, w Workload) (*Result, error) {
+	w = w.withDefaults()
+	r := rand.New(rand.NewSource(w.Seed + 1))
+	res := &Result{Workload: w.Name, Ops: make(map[Op]int), latencies: make(map[Op][]time.Duration)}
+	numKeys := w.RecordCount
+	zipf := newZipfian(w.RecordCount)
+
+	nextKey := func() string {
+		switch w.Distribution {
+		case Zipfian:
+			return Key(zipf.next(r))
+		case Latest:
+			n := numKeys - 1 - zipf.next(r)
+			if n < 0 {
+				n = 0
+			}
+			return Key(n)
+		default:
+			return Key(r.Intn(numKeys))
+		}
+	}
+
+	total := w.ReadProportion + w.UpdateProportion + w.InsertProportion + w.ReadModifyWriteProportion
+	if total <= 0 {
+		return nil, fmt.Errorf("workload %q has no operations", w.Name)
+	}
+	start := time.Now()
+	for i := 0; i < w.OperationCount; i++ {
+		var op Op
+		var err error
+		opStart := time.Now()
+		switch x := r.Float64() * total; {
+		case x < w.ReadProportion:
+			op = OpRead
+			_, err = s.Get(nextKey())
+		case x < w.ReadProportion+w.UpdateProportion:
+			op = OpUpdate
+			err = s.Put(nextKey(), w.value(r))
+		case x < w.ReadProportion+w.UpdateProportion+w.InsertProportion:
+			op = OpInsert
+			err = s.Put(Key(numKeys), w.value(r))
+			numKeys++
+		default:
+			op = OpReadModifyWrite
+			k := nextKey()
+			if _, err = s.Get(k); err == nil {
+				err = s.Put(k, w.value(r))
+			}
+		}
+		res.latencies[op] = append(res.latencies[op], time.Since(opStart))
+		res.Ops[op]++
+		if err != nil {
+			res.Errors++
+		}
+	}
+	res.Elapsed = time.Since(start)
+	for _, l := range res.latencies {
+		sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+	}
+	return res, nil
+}
@@ -0,0 +1,89 @@
+// Package loadgen generates reproducible YCSB-style workloads against key-value stores.
+package loadgen
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+)
+
+// Store is the key-value store a workload runs against.
+type Store interface {
+	Get(k string) ([]byte, error)
+	Put(k string, v []byte) error
+}
+
+// Distribution selects which existing keys are accessed.
+type Distribution int
+
+const (
+	Uniform Distribution = iota
+	Zipfian              // a few keys get most of the accesses
+	Latest               // recently inserted keys are the most accessed
+)
+
+// Workload describes a mix of operations.
+// Proportions are relative to each other and don't need to add up to 1.
+type Workload struct {
+	Name           string
+	RecordCount    int // keys inserted by Load
+	OperationCount int // operations performed by Run
+
+	ReadProportion            float64
+	UpdateProportion          float64
+	InsertProportion          float64
+	ReadModifyWriteProportion float64
+
+	Distribution Distribution
+	MinValueSize int
+	MaxValueSize int
+	Seed         int64
+}
+
+// Core workloads from YCSB (except E which requires range scans).
+var (
+	WorkloadA = Workload{Name: "a", ReadProportion: 0.5, UpdateProportion: 0.5, Distribution: Zipfian}
+	WorkloadB = Workload{Name: "b", ReadProportion: 0.95, UpdateProportion: 0.05, Distribution: Zipfian}
+	WorkloadC = Workload{Name: "c", ReadProportion: 1, Distribution: Zipfian}
+	WorkloadD = Workload{Name: "d", ReadProportion: 0.95, InsertProportion: 0.05, Distribution: Latest}
+	WorkloadF = Workload{Name: "f", ReadProportion: 0.5, ReadModifyWriteProportion: 0.5, Distribution: Zipfian}
+)
+
+// Workloads lists the core workloads by name.
+var Workloads = map[string]Workload{"a": WorkloadA, "b": WorkloadB, "c": WorkloadC, "d": WorkloadD, "f": WorkloadF}
+
+func (w Workload) withDefaults() Workload {
+	if w.RecordCount <= 0 {
+		w.RecordCount = 1000
+	}
+	if w.OperationCount <= 0 {
+		w.OperationCount = 1000
+	}
+	if w.MaxValueSize <= 0 {
+		w.MaxValueSize = 100
+	}
+	if w.MinValueSize <= 0 || w.MinValueSize > w.MaxValueSize {
+		w.MinValueSize = w.MaxValueSize
+	}
+	return w
+}
+
+// Key returns the key of the n-th inserted record.
+// Keys are hashed so that inserts aren't in key order.
+func Key(n int) string {
+	h := fnv.New64a()
+	fmt.Fprint(h, n)
+	return fmt.Sprintf("user%020d", h.Sum64())
+}
+
+func (w Workload) value(r *rand.Rand) []byte {
+	size := w.MinValueSize
+	if w.MaxValueSize > w.MinValueSize {
+		size += r.Intn(w.MaxValueSize - w.MinValueSize + 1)
+	}
+	v := make([]byte, size)
+	for i := range v {
+		v[i] = 'a' + byte(r.Intn(26))
+	}
+	return v
+}
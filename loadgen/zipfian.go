@@ -0,0 +1,51 @@
+package loadgen
+
+import (
+	"math"
+	"math/rand"
+)
+
+const zipfianConstant = 0.99
+
+// zipfian generates integers in [0, items) following a Zipfian distribution,
+// using the algorithm from "Quickly Generating Billion-Record Synthetic Databases" (Gray et al.)
+// as YCSB does.
+type zipfian struct {
+	items int
+	theta float64
+	alpha float64
+	zetan float64
+	eta   float64
+}
+
+func newZipfian(items int) *zipfian {
+	z := &zipfian{items: items, theta: zipfianConstant}
+	z.alpha = 1 / (1 - z.theta)
+	z.zetan = zeta(items, z.theta)
+	z.eta = (1 - math.Pow(2/float64(items), 1-z.theta)) / (1 - zeta(2, z.theta)/z.zetan)
+	return z
+}
+
+func zeta(n int, theta float64) float64 {
+	sum := 0.0
+	for i := 1; i <= n; i++ {
+		sum += 1 / math.Pow(float64(i), theta)
+	}
+	return sum
+}
+
+func (z *zipfian) next(r *rand.Rand) int {
+	u := r.Float64()
+	uz := u * z.zetan
+	if uz < 1 {
+		return 0
+	}
+	if uz < 1+math.Pow(0.5, z.theta) {
+		return 1
+	}
+	n := int(float64(z.items) * math.Pow(z.eta*u-z.eta+1, z.alpha))
+	if n >= z.items {
+		n = z.items - 1
+	}
+	return n
+}
@@ -0,0 +1,116 @@
+// Package ratelimit implements token bucket rate limiters whose state is stored in the database,
+// so that limits survive restarts.
+package ratelimit
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/ejuju/go-db-playground/textdb"
+)
+
+// Config configures a limiter.
+type Config struct {
+	Rate   float64 // tokens added per second
+	Burst  int     // bucket capacity
+	Prefix string  // prefix of database keys ("ratelimit:" by default)
+}
+
+// Limiter rate limits keys (e.g. client IPs or user IDs) with one bucket per key.
+// Buckets are updated with CompareAndSwap, so limiters of several instances can share the database.
+// It's safe for concurrent use.
+type Limiter struct {
+	db  textdb.CASStore
+	cfg Config
+	now func() time.Time
+}
+
+func New(db textdb.CASStore, cfg Config) *Limiter {
+	if cfg.Prefix == "" {
+		cfg.Prefix = "ratelimit:"
+	}
+	return &Limiter{db: db, cfg: cfg, now: time.Now}
+}
+
+// A bucket is stored as its number of tokens and the time it was last updated.
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// load returns the bucket of the key refilled up to now, and its stored value (nil if it's not stored).
+func (l *Limiter) load(key string) (bucket, []byte, error) {
+	v, err := l.db.Get(l.cfg.Prefix + key)
+	if errors.Is(err, textdb.ErrKeyNotFound) {
+		return bucket{tokens: float64(l.cfg.Burst), updated: l.now()}, nil, nil
+	} else if err != nil {
+		return bucket{}, nil, err
+	}
+	if len(v) != 16 {
+		return bucket{}, nil, fmt.Errorf("ratelimit: corrupted bucket %q", key)
+	}
+	b := bucket{
+		tokens:  math.Float64frombits(binary.BigEndian.Uint64(v)),
+		updated: time.Unix(0, int64(binary.BigEndian.Uint64(v[8:]))),
+	}
+
+	// Refill tokens for the time elapsed since the last update
+	now := l.now()
+	if elapsed := now.Sub(b.updated); elapsed > 0 {
+		b.tokens = math.Min(float64(l.cfg.Burst), b.tokens+elapsed.Seconds()*l.cfg.Rate)
+		b.updated = now
+	}
+	return b, v, nil
+}
+
+func (b bucket) encode() []byte {
+	v := make([]byte, 16)
+	binary.BigEndian.PutUint64(v, math.Float64bits(b.tokens))
+	binary.BigEndian.PutUint64(v[8:], uint64(b.updated.UnixNano()))
+	return v
+}
+
+// Allow takes a token from the bucket of the key and reports whether one was available.
+func (l *Limiter) Allow(key string) (bool, error) { return l.AllowN(key, 1) }
+
+// AllowN takes n tokens from the bucket of the key if they're all available.
+// The bucket is read again if it was updated meanwhile (by this or another limiter).
+func (l *Limiter) AllowN(key string, n int) (bool, error) {
+	for {
+		b, old, err := l.load(key)
+		if err != nil {
+			return false, err
+		}
+		if b.tokens < float64(n) {
+			return false, nil
+		}
+		b.tokens -= float64(n)
+		swapped, err := l.db.CompareAndSwap(l.cfg.Prefix+key, old, b.encode())
+		if err != nil || swapped {
+			return swapped, err
+		}
+	}
+}
+
+// RetryAfter returns how long to wait until n tokens are available for the key.
+func (l *Limiter) RetryAfter(key string, n int) (time.Duration, error) {
+	b, _, err := l.load(key)
+	if err != nil || b.tokens >= float64(n) {
+		return 0, err
+	}
+	if n > l.cfg.Burst || l.cfg.Rate <= 0 {
+		return 0, fmt.Errorf("ratelimit: %d tokens will never be available", n)
+	}
+	return time.Duration((float64(n) - b.tokens) / l.cfg.Rate * float64(time.Second)), nil
+}
+
+// Reset refills the bucket of the key.
+func (l *Limiter) Reset(key string) error {
+	if !l.db.Exists(l.cfg.Prefix + key) {
+		return nil
+	}
+	return l.db.Delete(l.cfg.Prefix + key)
+}
@@ -0,0 +1,89 @@
+package ratelimit
+
+import (
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ejuju/go-db-playground/textdb"
+)
+
+func TestLimiterPersists(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "test.db")
+	db, err := textdb.Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	l := New(db, Config{Rate: 1, Burst: 3})
+	l.now = func() time.Time { return now }
+	for i, want := range []bool{true, true, true, false} {
+		if ok, err := l.Allow("ip"); err != nil || ok != want {
+			t.Fatalf("allow %d: got %v, %v, want %v", i, ok, err, want)
+		}
+	}
+	if d, err := l.RetryAfter("ip", 1); err != nil || d != time.Second {
+		t.Fatalf("retry after: got %v, %v, want 1s", d, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The bucket is refilled for the time elapsed since it was stored
+	db, err = textdb.Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	now = now.Add(1500 * time.Millisecond)
+	l = New(db, Config{Rate: 1, Burst: 3})
+	l.now = func() time.Time { return now }
+	for i, want := range []bool{true, false} {
+		if ok, err := l.Allow("ip"); err != nil || ok != want {
+			t.Fatalf("allow %d after reopening: got %v, %v, want %v", i, ok, err, want)
+		}
+	}
+	if err := l.Reset("ip"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := l.AllowN("ip", 3); err != nil || !ok {
+		t.Fatalf("allow after reset: got %v, %v", ok, err)
+	}
+}
+
+func TestLimitersShareBuckets(t *testing.T) {
+	db, err := textdb.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, store := range []textdb.CASStore{db, textdb.NewMemDB()} {
+		// Limiters of several instances update the same bucket, without refill every token is taken once
+		const burst = 100
+		var allowed atomic.Int64
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			l := New(store, Config{Burst: burst})
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					ok, err := l.Allow("shared")
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if ok {
+						allowed.Add(1)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if n := allowed.Load(); n != burst {
+			t.Fatalf("%T: %d requests allowed, want %d", store, n, burst)
+		}
+	}
+}
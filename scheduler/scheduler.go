@@ -0,0 +1,390 @@
+// Package scheduler implements a delayed task queue persisted in the database,
+// with leases so a crashed worker's tasks are retried, and retries with backoff.
+package scheduler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ejuju/go-db-playground/textdb"
+)
+
+// Task is a unit of work to run at a given time.
+type Task struct {
+	ID          uint64
+	Name        string
+	Payload     []byte
+	RunAt       time.Time
+	Attempts    int       // number of times the task has been leased
+	LeaseHolder string    // ID of the scheduler holding the lease (see Config.ID)
+	LeaseUntil  time.Time // the task isn't handed out again before this time
+	LastError   string
+	Dead        bool      // set once the task failed MaxAttempts times
+	DiedAt      time.Time // time the task was marked dead
+}
+
+// Config configures the scheduler, zero values are replaced by defaults.
+type Config struct {
+	Prefix string // prefix of database keys ("scheduler:" by default)
+	// ID identifies the scheduler in the leases of its tasks,
+	// it must be unique among the schedulers sharing the database (random by default).
+	ID            string
+	LeaseDuration time.Duration // how long a worker has to complete a task (1 minute by default)
+	MaxAttempts   int           // attempts before a task is marked dead (5 by default)
+	DeadRetention time.Duration // how long dead tasks are kept before Acquire purges them (7 days by default)
+	// Backoff returns the delay before retrying a task that failed for the n-th time
+	// (exponential from 1 second up to 1 hour by default).
+	Backoff func(n int) time.Duration
+}
+
+func defaultBackoff(n int) time.Duration {
+	d := time.Second << (n - 1)
+	if d > time.Hour || d <= 0 {
+		return time.Hour
+	}
+	return d
+}
+
+// Scheduler hands out due tasks to workers, it's safe for concurrent use.
+// Schedulers of several processes can share the database: tasks are read from the database
+// and each change of a task (including its lease) is written with CompareAndSwap,
+// so a task is only leased to one worker at a time.
+//
+// Tasks are stored under sequential IDs, along with the next ID and the lowest ID of a remaining task,
+// so that finding due tasks doesn't scan completed ones.
+type Scheduler struct {
+	db  textdb.CASStore
+	cfg Config
+	now func() time.Time
+}
+
+var (
+	ErrUnknownTask = errors.New("scheduler: unknown task")
+	ErrLeaseLost   = errors.New("scheduler: task isn't leased by this attempt")
+)
+
+// New returns a scheduler of the tasks stored in the database under the configured prefix.
+func New(db textdb.CASStore, cfg Config) (*Scheduler, error) {
+	if cfg.Prefix == "" {
+		cfg.Prefix = "scheduler:"
+	}
+	if cfg.ID == "" {
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			return nil, fmt.Errorf("scheduler: generate ID: %w", err)
+		}
+		cfg.ID = hex.EncodeToString(id)
+	}
+	if cfg.LeaseDuration <= 0 {
+		cfg.LeaseDuration = time.Minute
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 5
+	}
+	if cfg.DeadRetention <= 0 {
+		cfg.DeadRetention = 7 * 24 * time.Hour
+	}
+	if cfg.Backoff == nil {
+		cfg.Backoff = defaultBackoff
+	}
+	return &Scheduler{db: db, cfg: cfg, now: time.Now}, nil
+}
+
+func (s *Scheduler) taskKey(id uint64) string { return fmt.Sprintf("%stask:%020d", s.cfg.Prefix, id) }
+
+// counter returns the value of the counter and its stored value (nil if it's not stored).
+func (s *Scheduler) counter(name string) (uint64, []byte, error) {
+	v, err := s.db.Get(s.cfg.Prefix + name)
+	if errors.Is(err, textdb.ErrKeyNotFound) {
+		return 0, nil, nil
+	} else if err != nil {
+		return 0, nil, err
+	}
+	if len(v) != 8 {
+		return 0, nil, fmt.Errorf("scheduler: corrupted counter %q", name)
+	}
+	return binary.BigEndian.Uint64(v), v, nil
+}
+
+// swapCounter sets the counter if its stored value is still old.
+func (s *Scheduler) swapCounter(name string, old []byte, n uint64) (bool, error) {
+	return s.db.CompareAndSwap(s.cfg.Prefix+name, old, binary.BigEndian.AppendUint64(nil, n))
+}
+
+// load returns the task and its stored value.
+func (s *Scheduler) load(id uint64) (*Task, []byte, error) {
+	v, err := s.db.Get(s.taskKey(id))
+	if errors.Is(err, textdb.ErrKeyNotFound) {
+		return nil, nil, fmt.Errorf("%w: %d", ErrUnknownTask, id)
+	} else if err != nil {
+		return nil, nil, err
+	}
+	t := &Task{}
+	if err := json.Unmarshal(v, t); err != nil {
+		return nil, nil, fmt.Errorf("scheduler: decode task %d: %w", id, err)
+	}
+	return t, v, nil
+}
+
+// scan calls fn with each remaining task and its stored value.
+func (s *Scheduler) scan(fn func(t *Task, v []byte) error) error {
+	low, _, err := s.counter("low")
+	if err != nil {
+		return err
+	}
+	next, _, err := s.counter("next")
+	if err != nil {
+		return err
+	}
+	for id := low; id < next; id++ {
+		t, v, err := s.load(id)
+		if errors.Is(err, ErrUnknownTask) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := fn(t, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Enqueue adds a task to run at the given time (or as soon as possible if it's in the past).
+func (s *Scheduler) Enqueue(name string, payload []byte, runAt time.Time) (uint64, error) {
+	// Take the next ID
+	var id uint64
+	for {
+		next, old, err := s.counter("next")
+		if err != nil {
+			return 0, err
+		}
+		if next == 0 {
+			next = 1
+		}
+		if ok, err := s.swapCounter("next", old, next+1); err != nil {
+			return 0, err
+		} else if ok {
+			id = next
+			break
+		}
+	}
+	v, err := json.Marshal(&Task{ID: id, Name: name, Payload: payload, RunAt: runAt})
+	if err != nil {
+		return 0, err
+	}
+	if err := s.db.Put(s.taskKey(id), v); err != nil {
+		return 0, err
+	}
+
+	// The lowest ID may have moved past the ID while the task was written
+	for {
+		low, old, err := s.counter("low")
+		if err != nil || low <= id {
+			return id, err
+		}
+		if ok, err := s.swapCounter("low", old, id); err != nil || ok {
+			return id, err
+		}
+	}
+}
+
+// Acquire leases the earliest due task, or returns false if no task is due.
+// The task must be completed (or failed) with its attempt number before its lease expires,
+// otherwise the attempt counts as failed and the task is retried like with Fail.
+// Dead tasks are purged once they've been kept for the configured retention.
+func (s *Scheduler) Acquire() (Task, bool, error) {
+	for {
+		now := s.now()
+		var next *Task
+		var nextV []byte
+		purged := false
+		err := s.scan(func(t *Task, v []byte) error {
+			switch {
+			case t.Dead && now.Sub(t.DiedAt) >= s.cfg.DeadRetention:
+				ok, err := s.db.CompareAndSwap(s.taskKey(t.ID), v, nil)
+				purged = purged || ok
+				return err
+			case !t.Dead && !t.LeaseUntil.IsZero() && !t.LeaseUntil.After(now):
+				// The worker crashed or is too slow
+				failed := s.failed(t, "lease expired", t.LeaseUntil)
+				failedV, err := json.Marshal(failed)
+				if err != nil {
+					return err
+				}
+				if ok, err := s.db.CompareAndSwap(s.taskKey(t.ID), v, failedV); err != nil || !ok {
+					return err // changed meanwhile
+				}
+				t, v = failed, failedV
+			}
+			if t.Dead || t.RunAt.After(now) || t.LeaseUntil.After(now) {
+				return nil
+			}
+			if next == nil || t.RunAt.Before(next.RunAt) || (t.RunAt.Equal(next.RunAt) && t.ID < next.ID) {
+				next, nextV = t, v
+			}
+			return nil
+		})
+		if err == nil && purged {
+			err = s.advanceLow()
+		}
+		if err != nil || next == nil {
+			return Task{}, false, err
+		}
+
+		leased := *next
+		leased.Attempts++
+		leased.LeaseHolder = s.cfg.ID
+		leased.LeaseUntil = now.Add(s.cfg.LeaseDuration)
+		v, err := json.Marshal(&leased)
+		if err != nil {
+			return Task{}, false, err
+		}
+		ok, err := s.db.CompareAndSwap(s.taskKey(leased.ID), nextV, v)
+		if err != nil {
+			return Task{}, false, err
+		}
+		if ok {
+			return leased, true, nil
+		}
+		// The task was leased by another scheduler meanwhile
+	}
+}
+
+// leased returns the task and its stored value if it's leased by the attempt of this scheduler (see Task.Attempts).
+func (s *Scheduler) leased(id uint64, attempt int) (*Task, []byte, error) {
+	t, v, err := s.load(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if t.Dead || t.LeaseUntil.IsZero() || t.Attempts != attempt || t.LeaseHolder != s.cfg.ID {
+		return nil, nil, fmt.Errorf("%w: task %d, attempt %d", ErrLeaseLost, id, attempt)
+	}
+	return t, v, nil
+}
+
+// Complete removes a task once it's been handled by the given attempt (see Task.Attempts).
+// It returns ErrLeaseLost if the lease of the attempt expired and the task was failed or leased again.
+func (s *Scheduler) Complete(id uint64, attempt int) error {
+	for {
+		_, v, err := s.leased(id, attempt)
+		if err != nil {
+			return err
+		}
+		if ok, err := s.db.CompareAndSwap(s.taskKey(id), v, nil); err != nil {
+			return err
+		} else if ok {
+			return s.advanceLow()
+		}
+	}
+}
+
+// advanceLow moves the lowest ID of a remaining task past the removed tasks,
+// unless another scheduler changed it meanwhile.
+func (s *Scheduler) advanceLow() error {
+	low, old, err := s.counter("low")
+	if err != nil {
+		return err
+	}
+	next, _, err := s.counter("next")
+	if err != nil {
+		return err
+	}
+	id := low
+	for id < next && !s.db.Exists(s.taskKey(id)) {
+		id++
+	}
+	if id == low {
+		return nil
+	}
+	_, err = s.swapCounter("low", old, id)
+	return err
+}
+
+// Fail releases a task leased by the given attempt (see Task.Attempts) so that it's retried
+// after a backoff delay, or marks it dead if it has been attempted MaxAttempts times.
+// It returns ErrLeaseLost like Complete.
+func (s *Scheduler) Fail(id uint64, attempt int, taskErr error) error {
+	var msg string
+	if taskErr != nil {
+		msg = taskErr.Error()
+	}
+	for {
+		t, v, err := s.leased(id, attempt)
+		if err != nil {
+			return err
+		}
+		failedV, err := json.Marshal(s.failed(t, msg, s.now()))
+		if err != nil {
+			return err
+		}
+		if ok, err := s.db.CompareAndSwap(s.taskKey(id), v, failedV); err != nil || ok {
+			return err
+		}
+	}
+}
+
+// failed returns the task once its lease ended at the given time.
+func (s *Scheduler) failed(t *Task, msg string, at time.Time) *Task {
+	failed := *t
+	failed.LeaseHolder, failed.LeaseUntil = "", time.Time{}
+	if msg != "" {
+		failed.LastError = msg
+	}
+	if failed.Attempts >= s.cfg.MaxAttempts {
+		failed.Dead, failed.DiedAt = true, at
+	} else {
+		failed.RunAt = at.Add(s.cfg.Backoff(failed.Attempts))
+	}
+	return &failed
+}
+
+// Dead returns the tasks that failed too many times and haven't been purged yet.
+func (s *Scheduler) Dead() ([]Task, error) {
+	var dead []Task
+	err := s.scan(func(t *Task, _ []byte) error {
+		if t.Dead {
+			dead = append(dead, *t)
+		}
+		return nil
+	})
+	return dead, err
+}
+
+// Run polls for due tasks and handles them until the context is canceled.
+// Tasks are completed if the handler returns nil and failed otherwise.
+func (s *Scheduler) Run(ctx context.Context, pollInterval time.Duration, handle func(context.Context, Task) error) error {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for ctx.Err() == nil {
+		t, ok, err := s.Acquire()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-ticker.C:
+				continue
+			}
+		}
+		if err = handle(ctx, t); err != nil {
+			err = s.Fail(t.ID, t.Attempts, err)
+		} else {
+			err = s.Complete(t.ID, t.Attempts)
+		}
+		if errors.Is(err, ErrLeaseLost) {
+			continue // the handler took longer than the lease, the task was retried meanwhile
+		} else if err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,195 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ejuju/go-db-playground/textdb"
+)
+
+func TestRun(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "test.db")
+	db, err := textdb.Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(db, Config{MaxAttempts: 2, Backoff: func(int) time.Duration { return time.Millisecond }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, task := range []struct {
+		name  string
+		runAt time.Time
+	}{{"a", now}, {"later", now.Add(time.Hour)}, {"failing", now}} {
+		if _, err := s.Enqueue(task.name, nil, task.runAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	var ran []string
+	err = s.Run(ctx, time.Millisecond, func(ctx context.Context, task Task) error {
+		ran = append(ran, task.Name)
+		if task.Name == "failing" {
+			return errors.New("failure")
+		}
+		return nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(ran) != "[a failing failing]" {
+		t.Fatalf("ran %v", ran)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The remaining tasks are stored
+	db, err = textdb.Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s, err = New(db, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead, err := s.Dead()
+	if err != nil || len(dead) != 1 || dead[0].Name != "failing" || dead[0].LastError != "failure" {
+		t.Fatalf("dead tasks: %+v, %v", dead, err)
+	}
+	s.now = func() time.Time { return now.Add(2 * time.Hour) }
+	if task, ok, err := s.Acquire(); err != nil || !ok || task.Name != "later" {
+		t.Fatalf("got %+v, %v, %v, want the later task", task, ok, err)
+	}
+}
+
+func TestLeases(t *testing.T) {
+	db := textdb.NewMemDB()
+	s, err := New(db, Config{MaxAttempts: 3, LeaseDuration: time.Minute, Backoff: func(int) time.Duration { return time.Second }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	id, err := s.Enqueue("a", nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Expired leases count as failed attempts
+	for i := 1; i <= 3; i++ {
+		task, ok, err := s.Acquire()
+		if err != nil || !ok || task.Attempts != i {
+			t.Fatalf("attempt %d: got %+v, %v, %v", i, task, ok, err)
+		}
+		now = now.Add(2 * time.Minute)
+	}
+	if task, ok, err := s.Acquire(); err != nil || ok {
+		t.Fatalf("got %+v, %v, %v after the last attempt", task, ok, err)
+	}
+	if dead, err := s.Dead(); err != nil || len(dead) != 1 || dead[0].LastError != "lease expired" {
+		t.Fatalf("dead tasks: %+v, %v", dead, err)
+	}
+	if err := s.Complete(id, 3); !errors.Is(err, ErrLeaseLost) {
+		t.Fatalf("completing a dead task: got %v, want %v", err, ErrLeaseLost)
+	}
+
+	// A stale attempt can't complete nor fail the task leased again
+	id, err = s.Enqueue("b", nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale, _, _ := s.Acquire()
+	now = now.Add(2 * time.Minute)
+	task, ok, err := s.Acquire()
+	if err != nil || !ok || task.ID != id || task.Attempts != 2 {
+		t.Fatalf("got %+v, %v, %v, want the second attempt", task, ok, err)
+	}
+	if err := s.Fail(stale.ID, stale.Attempts, errors.New("stale")); !errors.Is(err, ErrLeaseLost) {
+		t.Fatalf("failing a stale attempt: got %v, want %v", err, ErrLeaseLost)
+	}
+	// Nor can another scheduler
+	other, err := New(db, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Complete(task.ID, task.Attempts); !errors.Is(err, ErrLeaseLost) {
+		t.Fatalf("completing the lease of another scheduler: got %v, want %v", err, ErrLeaseLost)
+	}
+	if err := s.Complete(task.ID, task.Attempts); err != nil {
+		t.Fatal(err)
+	}
+
+	// Dead tasks are purged after the retention
+	now = now.Add(8 * 24 * time.Hour)
+	if _, ok, err := s.Acquire(); err != nil || ok {
+		t.Fatalf("got %v, %v, want no task", ok, err)
+	}
+	if dead, err := s.Dead(); err != nil || len(dead) != 0 {
+		t.Fatalf("dead tasks: %+v, %v, want none", dead, err)
+	}
+	if low, _, err := s.counter("low"); err != nil || low != id+1 {
+		t.Fatalf("lowest ID: %d, %v, want %d", low, err, id+1)
+	}
+}
+
+func TestSchedulersShareTasks(t *testing.T) {
+	db, err := textdb.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	const tasks = 50
+	var mu sync.Mutex
+	handled := make(map[uint64]int)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		s, err := New(db, Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < tasks/4+1; j++ {
+				if _, err := s.Enqueue("task", nil, time.Now()); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+			for {
+				task, ok, err := s.Acquire()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if !ok {
+					return
+				}
+				mu.Lock()
+				handled[task.ID]++
+				mu.Unlock()
+				if err := s.Complete(task.ID, task.Attempts); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if len(handled) != 4*(tasks/4+1) {
+		t.Fatalf("%d tasks handled, want %d", len(handled), 4*(tasks/4+1))
+	}
+	for id, n := range handled {
+		if n != 1 {
+			t.Fatalf("task %d handled %d times", id, n)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+// Package sessions implements a session store backed by the database.
+//
+// Store has the method set of the github.com/alexedwards/scs Store interface,
+// so it can be used as a session store with scs.SessionManager without this module depending on it.
+package sessions
+
+import (
+	"time"
+
+	"github.com/ejuju/go-db-playground/cache"
+	"github.com/ejuju/go-db-playground/textdb"
+)
+
+// DefaultPrefix is prepended to session tokens to form database keys.
+const DefaultPrefix = "session:"
+
+// Store persists session data until its expiry time, in a cache (see cache.DB).
+// Expired sessions are never returned.
+type Store struct {
+	c   *cache.DB
+	now func() time.Time
+}
+
+// New returns a store saving sessions under DefaultPrefix.
+func New(db textdb.TTLStore) *Store { return NewWithPrefix(db, DefaultPrefix) }
+
+// NewWithPrefix returns a store saving sessions under the given key prefix.
+func NewWithPrefix(db textdb.TTLStore, prefix string) *Store {
+	return &Store{c: cache.New(db, prefix), now: time.Now}
+}
+
+// Find returns the data of a session, found is false if the session doesn't exist or has expired.
+func (s *Store) Find(token string) (b []byte, found bool, err error) { return s.c.Get(token) }
+
+// Commit saves the session data, replacing existing data.
+func (s *Store) Commit(token string, b []byte, expiry time.Time) error {
+	ttl := expiry.Sub(s.now())
+	if ttl <= 0 {
+		return s.c.Delete(token) // a zero TTL would never expire
+	}
+	return s.c.Set(token, b, ttl)
+}
+
+// Delete removes the session, it does nothing if the session doesn't exist.
+func (s *Store) Delete(token string) error { return s.c.Delete(token) }
@@ -0,0 +1,57 @@
+package sessions
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ejuju/go-db-playground/textdb"
+)
+
+func TestStore(t *testing.T) {
+	db, err := textdb.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, s := range []*Store{New(db), NewWithPrefix(textdb.NewMemDB(), "s:")} {
+		if err := s.Commit("token", []byte("data"), time.Now().Add(50*time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+		if b, found, err := s.Find("token"); err != nil || !found || string(b) != "data" {
+			t.Fatalf("got %q, %v, %v", b, found, err)
+		}
+		if err := s.Commit("past", []byte("data"), time.Now().Add(-time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		if _, found, err := s.Find("past"); err != nil || found {
+			t.Fatalf("got %v, %v for a session committed with a past expiry", found, err)
+		}
+		time.Sleep(60 * time.Millisecond)
+		if _, found, err := s.Find("token"); err != nil || found {
+			t.Fatalf("got %v, %v for an expired session", found, err)
+		}
+
+		if err := s.Commit("deleted", []byte("data"), time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Delete("deleted"); err != nil {
+			t.Fatal(err)
+		}
+		if _, found, err := s.Find("deleted"); err != nil || found {
+			t.Fatalf("got %v, %v for a deleted session", found, err)
+		}
+		if err := s.Delete("unknown"); err != nil {
+			t.Fatalf("deleting an unknown session: %v", err)
+		}
+	}
+
+	// Sessions are stored under the prefix
+	s := New(db)
+	if err := s.Commit("kept", []byte("data"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Get(DefaultPrefix + "kept"); err != nil || string(v) != "data" {
+		t.Fatalf("got %q, %v under the default prefix", v, err)
+	}
+}
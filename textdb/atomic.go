@@ -0,0 +1,61 @@
+package textdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// CompareAndSwap writes new if the current value of the key is old, and reports whether it did.
+// A nil old only matches a key that doesn't exist and a nil new deletes the key.
+func (db *DB) CompareAndSwap(k string, old, new []byte) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.ValidateKey(k); err != nil {
+		return false, err
+	}
+	current, err := db.get(k)
+	if err != nil {
+		return false, err
+	}
+	exists := db.exists(k)
+	if old == nil && exists || old != nil && (!exists || !bytes.Equal(current, old)) {
+		return false, nil
+	}
+	if new == nil {
+		if !exists {
+			return true, nil
+		}
+		return true, db.syncWrite(db.delete(k))
+	}
+	return true, db.syncWrite(db.put(k, new))
+}
+
+var ErrNotInteger = errors.New("value is not an integer")
+
+// IncrBy adds delta to the value of the key stored as a decimal integer and returns the result.
+// A missing key (or one without value) counts as zero.
+func (db *DB) IncrBy(k string, delta int64) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.ValidateKey(k); err != nil {
+		return 0, err
+	}
+	v, err := db.get(k)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	if len(v) > 0 {
+		if n, err = strconv.ParseInt(string(v), 10, 64); err != nil {
+			return 0, fmt.Errorf("%w: %q", ErrNotInteger, k)
+		}
+	}
+	if delta > 0 && n > math.MaxInt64-delta || delta < 0 && n < math.MinInt64-delta {
+		return 0, fmt.Errorf("increment %q by %d: overflow", k, delta)
+	}
+	n += delta
+	return n, db.syncWrite(db.put(k, strconv.AppendInt(nil, n, 10)))
+}
@@ -0,0 +1,110 @@
+package textdb
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// AuditSuffix is appended to the file path to name the audit file written by WithAuditTrail.
+const AuditSuffix = ".audit"
+
+// Administrative operations recorded in the audit trail
+const (
+	AuditCompact      = "compact"
+	AuditRestore      = "restore"
+	AuditDeleteBucket = "delete-bucket"
+)
+
+// AuditEntry is an administrative operation recorded in the audit trail.
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Op     string    `json:"op"`               // AuditCompact, AuditRestore or AuditDeleteBucket
+	Detail string    `json:"detail,omitempty"` // e.g. the name of the deleted bucket
+	Err    string    `json:"error,omitempty"`  // the error of a failed operation
+}
+
+// WithAuditTrail records administrative operations (compactions, restores and bucket deletions) in an audit file
+// next to the database file, as JSON lines. Unlike the rows of the database file, the entries are never compacted.
+// Restore records its entry when its options include WithAuditTrail.
+func WithAuditTrail() Option {
+	return func(db *DB) { db.auditTrail = true }
+}
+
+func auditPath(fpath string) string { return fpath + AuditSuffix }
+
+// audit records the operation if the audit trail is enabled, and returns err joined with the error of recording it.
+func (db *DB) audit(op, detail string, err error) error {
+	if !db.auditTrail || db.unnamed {
+		return err
+	}
+	return errors.Join(err, appendAudit(db.fs, db.fpath, op, detail, err))
+}
+
+func appendAudit(fsys FileSystem, fpath, op, detail string, opErr error) error {
+	e := AuditEntry{Time: time.Now().UTC(), Op: op, Detail: detail}
+	if opErr != nil {
+		e.Err = opErr.Error()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("audit: %w", err)
+	}
+	f, err := fsys.OpenFile(auditPath(fpath), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("audit: %w", err)
+	}
+	_, err = f.Write(append(line, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("audit: %w", err)
+	}
+	return nil
+}
+
+// AuditTrail returns the entries of the audit trail of the database, oldest first (see WithAuditTrail).
+func (db *DB) AuditTrail() ([]AuditEntry, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	return readAudit(db.fs, db.fpath)
+}
+
+// ReadAuditTrail returns the entries of the audit trail of the database file at the given path,
+// which doesn't need to be opened.
+func ReadAuditTrail(fpath string) ([]AuditEntry, error) { return readAudit(osFS{}, fpath) }
+
+func readAudit(fsys FileSystem, fpath string) ([]AuditEntry, error) {
+	f, err := fsys.OpenFile(auditPath(fpath), os.O_RDONLY, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("audit: %w", err)
+	}
+	defer f.Close()
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return entries, fmt.Errorf("audit: line %d: %w", line, err)
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return entries, fmt.Errorf("audit: %w", err)
+	}
+	return entries, nil
+}
@@ -0,0 +1,397 @@
+package textdb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/ejuju/go-db-playground/textdb/record"
+)
+
+// AutoCompaction configures when the database compacts itself in the background.
+// A threshold is ignored if it's zero.
+type AutoCompaction struct {
+	DeadRatio     float64       // compact once this fraction of the file is overwritten or deleted rows
+	DeadBytes     int64         // compact once overwritten or deleted rows take this many bytes
+	CheckInterval time.Duration // how often the thresholds are checked (1 minute by default)
+}
+
+// CompactionStats reports the compactions of the database since it was opened.
+type CompactionStats struct {
+	Runs           int // completed compactions, manual or automatic
+	LastRun        time.Time
+	LastDuration   time.Duration
+	BytesReclaimed int64 // total size removed from the file
+	LastErr        error // error of the last automatic compaction, nil if it succeeded
+}
+
+// WithAutoCompaction compacts the database in the background once the thresholds are exceeded.
+// The live rows are copied without holding the lock, then the rows written meanwhile are copied
+// and the files are swapped, which briefly blocks reads and writes.
+func WithAutoCompaction(cfg AutoCompaction) Option {
+	if cfg.CheckInterval <= 0 {
+		cfg.CheckInterval = time.Minute
+	}
+	return func(db *DB) { db.autoCompaction = &cfg }
+}
+
+// CompactionStats returns statistics about the compactions since the database was opened.
+func (db *DB) CompactionStats() CompactionStats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.compactionStats
+}
+
+// DeadBytes estimates the size of the rows of the file that a compaction would remove.
+func (db *DB) DeadBytes() int64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.deadBytes()
+}
+
+func (db *DB) deadBytes() int64 {
+	dead := int64(db.wIndex-db.dataStart) - db.liveSize()
+	if dead < 0 {
+		return 0
+	}
+	return dead
+}
+
+// liveSize returns the size of the rows a compaction would write.
+func (db *DB) liveSize() int64 {
+	format := db.rowFormat()
+	trailerLen := format.TrailerLen(db.hmacKey != nil, true)
+	buf := getBuffer(0)
+	defer putBuffer(buf, *buf)
+	size := 0
+	db.keys.forEach(func(k []byte, r ref) bool {
+		switch {
+		case !r.hasValue():
+			*buf = format.AppendBody((*buf)[:0], opSet, string(k), nil)
+		case r.cold:
+			*buf = format.AppendBody((*buf)[:0], opCold, string(k), nil)
+			r.width = 0 // the value is in the cold file
+		default:
+			*buf = db.valueHeader((*buf)[:0], string(k), r)
+		}
+		size += len(*buf) + r.valueWidth() + trailerLen
+		return true
+	})
+	for k, exp := range db.expiries {
+		*buf = format.AppendBody((*buf)[:0], opExpire, k, strconv.AppendInt(nil, exp, 10))
+		size += len(*buf) + trailerLen
+	}
+	for k, v := range db.meta {
+		*buf = format.AppendBody((*buf)[:0], opMeta, k, []byte(v))
+		size += len(*buf) + trailerLen
+	}
+	return int64(size)
+}
+
+func (db *DB) compactionDue() bool {
+	cfg := db.autoCompaction
+	dead := db.deadBytes()
+	if cfg.DeadBytes > 0 && dead >= cfg.DeadBytes {
+		return true
+	}
+	total := db.wIndex - db.dataStart
+	return cfg.DeadRatio > 0 && total > 0 && float64(dead)/float64(total) >= cfg.DeadRatio
+}
+
+func (db *DB) startAutoCompaction() {
+	if db.autoCompaction == nil || db.readOnly || db.unnamed {
+		return
+	}
+	db.runPeriodically(db.autoCompaction.CheckInterval, func() {
+		if db.compacting || db.degraded != nil || db.inconsistent != nil || !db.compactionDue() {
+			return
+		}
+		db.compacting = true
+		go db.compactInBackground(db.stop)
+	})
+}
+
+// recordCompaction updates the statistics once a compaction that started at the given time
+// with a file of the given size has completed.
+func (db *DB) recordCompaction(start time.Time, size int) {
+	db.compactionStats.Runs++
+	db.compactionStats.LastRun = time.Now()
+	db.compactionStats.LastDuration = time.Since(start)
+	if size > db.wIndex {
+		db.compactionStats.BytesReclaimed += int64(size - db.wIndex)
+	}
+}
+
+func (db *DB) compactInBackground(stop chan struct{}) {
+	err := db.compactOnline(func() error {
+		select {
+		case <-stop:
+			return ErrClosed
+		default:
+			return nil
+		}
+	})
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.compacting = false
+	if !db.closed {
+		db.compactionStats.LastErr = db.audit(AuditCompact, "background", err)
+	}
+}
+
+// liveEntry is a key of the index when a background compaction started.
+type liveEntry struct {
+	k string
+	r ref
+}
+
+// compactOnline compacts the file like Compact, but copies the live rows without holding the lock.
+// The rows appended meanwhile are then copied as is with the lock held, and the files are swapped.
+// While copying, it stops with the error of cancelled if it returns one.
+func (db *DB) compactOnline(cancelled func() error) error {
+	// Take a snapshot of the index
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return ErrClosed
+	}
+	if err := db.flush(); err != nil {
+		db.mu.Unlock()
+		return fmt.Errorf("compact: %w", err)
+	}
+	db.purgeExpired()
+	startTime, start := time.Now(), db.wIndex
+	entries := make([]liveEntry, 0, db.keys.len())
+	db.keys.forEach(func(k []byte, r ref) bool {
+		entries = append(entries, liveEntry{k: string(k), r: r})
+		return true
+	})
+	meta := make(map[string]string, len(db.meta))
+	for k, v := range db.meta {
+		meta[k] = v
+	}
+	expiries := make(map[string]int64, len(db.expiries))
+	for k, exp := range db.expiries {
+		expiries[k] = exp
+	}
+	cw, err := db.newColdWriter()
+	db.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("compact: %w", err)
+	}
+
+	// Rows before the write offset of the snapshot don't change, so they're read from another handle
+	src, err := db.fs.OpenFile(db.fpath, os.O_RDONLY, 0)
+	if err != nil {
+		cw.abort()
+		return fmt.Errorf("compact: %w", err)
+	}
+	defer src.Close()
+	readAt := func(p []byte, off int64) error {
+		_, err := src.ReadAt(p, off)
+		return err
+	}
+	tmpPath := db.fpath + ".compact"
+	f, err := db.fs.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		cw.abort()
+		return fmt.Errorf("compact: %w", err)
+	}
+	defer f.Close()
+	bufw := bufio.NewWriter(f)
+	rw := newRowWriter(bufw, db.format, db.headerFlags(), db.hmacKey)
+	newRefs, err := db.writeEntries(rw, cw, entries, meta, expiries, readAt, cancelled)
+	if err == nil && cw != nil {
+		err = cw.finish()
+	}
+	if err != nil {
+		db.fs.Remove(tmpPath)
+		cw.abort()
+		return fmt.Errorf("compact: %w", err)
+	}
+	shift := rw.offset - start
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		db.fs.Remove(tmpPath)
+		cw.abort()
+		return ErrClosed
+	}
+	err = db.flush()
+	if err == nil {
+		err = db.copyRows(rw, io.NewSectionReader(src, int64(start), int64(db.wIndex-start)), db.wIndex-start)
+	}
+	if err == nil {
+		err = bufw.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = f.Close()
+	}
+	var updates []liveEntry
+	if err == nil {
+		updates, err = db.compactedRefs(start, shift, newRefs)
+	}
+	if err == nil {
+		if fp := hitFailpoint(FailpointCompact); fp != nil {
+			err = fp.Err
+		}
+	}
+	if err != nil {
+		db.fs.Remove(tmpPath)
+		cw.abort()
+		return fmt.Errorf("compact: %w", err)
+	}
+
+	// Swap the files (the cold file first), on failure the database is reopened from the old file
+	size := db.wIndex
+	err = errors.Join(db.closeFiles(), db.closeCold())
+	if err == nil {
+		db.fs.Remove(hintPath(db.fpath)) // it's of the old file
+		if cw != nil {
+			err = cw.replace()
+		}
+	}
+	if err == nil {
+		err = db.fs.Rename(tmpPath, db.fpath)
+	}
+	if err == nil && cw != nil {
+		cw.removeUnused()
+	}
+	if err == nil {
+		db.prealloc, db.bw = nil, nil
+		err = db.openHandles()
+	}
+	if err == nil {
+		err = db.openCold()
+	}
+	if err != nil {
+		db.fs.Remove(tmpPath)
+		cw.abort()
+		if reopenErr := db.reopen(); reopenErr != nil {
+			// The database can't be used anymore
+			db.closed = true
+			return errors.Join(fmt.Errorf("compact: %w", err), fmt.Errorf("compact: reopen: %w", reopenErr), db.keys.close(), db.unlock())
+		}
+		return fmt.Errorf("compact: %w", err)
+	}
+	db.wIndex, db.lastMAC = rw.offset, rw.mac
+	db.rowTime = 0 // the time rows before the snapshot offset weren't copied
+	db.initWriter()
+	for _, e := range updates {
+		db.keys.set(e.k, e.r)
+	}
+	if vi, ok := db.keys.(*versionedIndex); ok {
+		vi.reset()
+	}
+	db.syncedOffset = db.wIndex
+	db.degraded, db.tornTail = nil, false
+	db.inconsistent, db.rowsSinceCheck = nil, 0
+	if db.cache != nil {
+		db.cache.clear()
+	}
+	db.recordCompaction(startTime, size)
+	return nil
+}
+
+// writeEntries writes the rows of a snapshot of the database and returns the new references of the values.
+// Cold values are written to cw if it's not nil (see WithColdTier).
+func (db *DB) writeEntries(rw *rowWriter, cw *coldWriter, entries []liveEntry, meta map[string]string, expiries map[string]int64, readAt readAtFunc, cancelled func() error) (map[string]ref, error) {
+	metaKeys := make([]string, 0, len(meta))
+	for k := range meta {
+		metaKeys = append(metaKeys, k)
+	}
+	sort.Strings(metaKeys)
+	for _, k := range metaKeys {
+		rw.write(opMeta, k, []byte(meta[k]))
+	}
+
+	newRefs := make(map[string]ref, len(entries))
+	for i, e := range entries {
+		if i%1024 == 0 {
+			if err := cancelled(); err != nil {
+				return nil, err
+			}
+		}
+		if !e.r.hasValue() {
+			rw.write(opSet, e.k, nil)
+			continue
+		}
+		read := readAt
+		if e.r.cold {
+			read = db.readColdAt // the cold file only changes when compacting
+		}
+		v := make([]byte, e.r.width)
+		if err := db.readVerified(read, e.k, e.r, v); err != nil {
+			return nil, err
+		}
+		op := opPut
+		if e.r.compressed {
+			op = opPutCompressed
+		}
+		if db.aeads != nil && len(v) > 0 && v[0] != db.encryptionKeyID {
+			var err error
+			if v, err = db.reencryptValue(op, e.k, v); err != nil {
+				return nil, err
+			}
+		}
+		newRefs[e.k] = cw.write(rw, op, e.k, e.r, v)
+	}
+	// Expiration times follow the keys they apply to
+	for k, exp := range expiries {
+		rw.write(opExpire, k, strconv.AppendInt(nil, exp, 10))
+	}
+	return newRefs, nil
+}
+
+// copyRows appends the rows read from src to the new file, which must keep their offsets
+// relative to each other (the rows are only written again to chain their MACs).
+func (db *DB) copyRows(rw *rowWriter, src io.ReadSeeker, size int) error {
+	rr := record.NewSeekingReader(src, int64(size))
+	rr.MAC = db.hmacKey != nil
+	rr.Format = db.rowFormat()
+	for {
+		r, n, err := rr.Next()
+		if errors.Is(err, io.EOF) && n == 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, written := rw.write(r.Op, r.Key, r.Value); written != n {
+			return fmt.Errorf("row of %d bytes copied as %d bytes", n, written)
+		}
+	}
+}
+
+// compactedRefs returns the references of the values of the index in the compacted file:
+// values written before the snapshot offset were rewritten, the others were shifted.
+func (db *DB) compactedRefs(start, shift int, newRefs map[string]ref) ([]liveEntry, error) {
+	var updates []liveEntry
+	var err error
+	db.keys.forEach(func(k []byte, r ref) bool {
+		switch {
+		case !r.hasValue():
+		case r.index >= start && !r.cold:
+			r.index += shift
+			updates = append(updates, liveEntry{k: string(k), r: r})
+		default:
+			nr, ok := newRefs[string(k)]
+			if !ok {
+				err = fmt.Errorf("key %q missing from the compacted file", k)
+				return false
+			}
+			updates = append(updates, liveEntry{k: string(k), r: nr})
+		}
+		return true
+	})
+	return updates, err
+}
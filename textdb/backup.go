@@ -0,0 +1,144 @@
+package textdb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// Backup writes a byte-exact copy of the database file up to its current end, which can be opened
+// with the options of the database. Only the start of the backup waits for pending writes to be flushed,
+// the rows are then copied from another handle of the file while the database is used
+// (on Windows, Compact fails while the file is open elsewhere).
+// With a cold file (see WithColdTier), the backup is instead a compacted copy with the cold values
+// in the file, read from a snapshot of the database (see Snapshot) while the database is used.
+func (db *DB) Backup(w io.Writer) error {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return ErrClosed
+	}
+	if db.unnamed {
+		db.mu.Unlock()
+		return errors.New("backup: not supported for unnamed files")
+	}
+	if err := db.flush(); err != nil {
+		db.mu.Unlock()
+		return fmt.Errorf("backup: %w", err)
+	}
+	if db.coldR != nil {
+		b := coldBackup{flags: db.headerFlags(), meta: make(map[string]string, len(db.meta)), expiries: make(map[string]int64)}
+		for k, v := range db.meta {
+			b.meta[k] = v
+		}
+		for k, exp := range db.expiries {
+			b.expiries[k] = exp
+		}
+		s, err := db.snapshotLocked()
+		db.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("backup: %w", err)
+		}
+		defer s.Close()
+		if err := b.write(w, s); err != nil {
+			return fmt.Errorf("backup: %w", err)
+		}
+		return nil
+	}
+	// Rows before the write offset don't change, and a compaction replaces the file without modifying it
+	f, err := db.fs.OpenFile(db.fpath, os.O_RDONLY, 0)
+	end := db.wIndex
+	db.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(w, io.NewSectionReader(f, 0, int64(end))); err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+	return nil
+}
+
+// coldBackup holds the state of the database copied with the lock held for a backup with a cold file.
+type coldBackup struct {
+	flags    HeaderFlags
+	meta     map[string]string
+	expiries map[string]int64 // by stored key
+}
+
+// write writes the rows of the keys of the snapshot with their values as stored, like writeLiveRows.
+func (b *coldBackup) write(w io.Writer, s *Snapshot) error {
+	bufw := bufio.NewWriter(w)
+	rw := newRowWriter(bufw, s.db.format, b.flags, nil)
+	metaKeys := make([]string, 0, len(b.meta))
+	for k := range b.meta {
+		metaKeys = append(metaKeys, k)
+	}
+	sort.Strings(metaKeys)
+	for _, k := range metaKeys {
+		rw.write(opMeta, k, []byte(b.meta[k]))
+	}
+
+	for _, k := range s.Keys() {
+		r := s.keys[k]
+		if !r.hasValue() {
+			rw.write(opSet, k, nil)
+			continue
+		}
+		read := s.readAt
+		if r.cold {
+			read = s.readColdAt
+		}
+		v := make([]byte, r.width)
+		s.db.mu.RLock()
+		err := s.db.readVerified(read, k, r, v)
+		s.db.mu.RUnlock()
+		if err != nil {
+			return err
+		}
+		op := opPut
+		if r.compressed {
+			op = opPutCompressed
+		}
+		rw.write(op, k, v)
+	}
+	// Expiration times follow the keys they apply to
+	for k, exp := range b.expiries {
+		if _, ok := s.keys[k]; ok {
+			rw.write(opExpire, k, strconv.AppendInt(nil, exp, 10))
+		}
+	}
+	return bufw.Flush()
+}
+
+// BackupToFile writes a backup (see Backup) to a new file at the given path.
+// The backup is synced before being moved to the path, so the file is either complete or missing.
+func (db *DB) BackupToFile(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("backup: destination already exists: %q", path)
+	}
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+	err = db.Backup(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
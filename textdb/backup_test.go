@@ -0,0 +1,337 @@
+package textdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testContents writes keys with and without values, deleted and overwritten keys, and returns the expected contents.
+func testContents(t *testing.T, db *DB) map[string][]byte {
+	t.Helper()
+	want := make(map[string][]byte)
+	for i := 0; i < 100; i++ {
+		k := fmt.Sprintf("k%03d", i)
+		v := []byte(fmt.Sprintf("value %d\n\x00", i))
+		if err := db.Put(k, []byte("first")); err != nil {
+			t.Fatal(err)
+		}
+		switch i % 3 {
+		case 0:
+			if err := db.Delete(k); err != nil {
+				t.Fatal(err)
+			}
+		case 1:
+			if err := db.Set(k); err != nil {
+				t.Fatal(err)
+			}
+			want[k] = []byte{}
+		default:
+			if err := db.Put(k, v); err != nil {
+				t.Fatal(err)
+			}
+			want[k] = v
+		}
+	}
+	return want
+}
+
+func checkContents(t *testing.T, db *DB, want map[string][]byte) {
+	t.Helper()
+	got := make(map[string][]byte)
+	err := db.ForEach(func(k string, v []byte) error {
+		got[k] = append([]byte{}, v...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d keys, want %d", len(got), len(want))
+	}
+	for k, v := range want {
+		if !bytes.Equal(got[k], v) {
+			t.Fatalf("%q: got %q, want %q", k, got[k], v)
+		}
+	}
+}
+
+// checkValues is like checkContents but gets the keys instead of iterating over them,
+// so it also works with hashed keys.
+func checkValues(t *testing.T, db *DB, want map[string][]byte) {
+	t.Helper()
+	for k, v := range want {
+		if got, err := db.Get(k); err != nil || !bytes.Equal(got, v) {
+			t.Fatalf("%q: got %q, %v, want %q", k, got, err, v)
+		}
+	}
+	if s, err := db.Stats(); err != nil || s.Keys != len(want) {
+		t.Fatalf("got %d keys, %v, want %d", s.Keys, err, len(want))
+	}
+}
+
+func TestBackupRestoreRoundTrip(t *testing.T) {
+	key := make([]byte, 32)
+	for name, opts := range map[string][]Option{
+		"default":   nil,
+		"binary":    {WithFormat(FormatBinary)},
+		"hmac":      {WithHMACChain([]byte("secret"))},
+		"encrypted": {WithEncryptionKey(key)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			db, err := Open(filepath.Join(dir, "src.db"), opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			want := testContents(t, db)
+			var backup bytes.Buffer
+			if err := db.Backup(&backup); err != nil {
+				t.Fatal(err)
+			}
+
+			// Writes after the backup aren't in it
+			if err := db.Put("after", []byte("backup")); err != nil {
+				t.Fatal(err)
+			}
+			dst := filepath.Join(dir, "dst.db")
+			if err := Restore(dst, bytes.NewReader(backup.Bytes()), RestoreConfig{Options: opts}); err != nil {
+				t.Fatal(err)
+			}
+			restored, err := Open(dst, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer restored.Close()
+			checkContents(t, restored, want)
+		})
+	}
+}
+
+func TestBackupToFile(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(filepath.Join(dir, "src.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	want := testContents(t, db)
+	dst := filepath.Join(dir, "backup.db")
+	if err := db.BackupToFile(dst); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.BackupToFile(dst); err == nil {
+		t.Fatal("overwrote an existing backup")
+	}
+	backup, err := Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+	checkContents(t, backup, want)
+}
+
+func TestRestoreRefusals(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.db")
+	db, err := Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := testContents(t, db)
+	var backup bytes.Buffer
+	if err := db.Backup(&backup); err != nil {
+		t.Fatal(err)
+	}
+
+	// A damaged backup is refused without creating the destination
+	damaged := append([]byte{}, backup.Bytes()...)
+	damaged[len(damaged)-5] ^= 1
+	dst := filepath.Join(dir, "dst.db")
+	if err := Restore(dst, bytes.NewReader(damaged), RestoreConfig{}); err == nil {
+		t.Fatal("restored a damaged backup")
+	}
+	if _, err := os.Stat(dst); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("the destination of a refused restore exists: %v", err)
+	}
+
+	// An existing database is only replaced when forced, and not while it's open
+	if err := Restore(dst, bytes.NewReader(backup.Bytes()), RestoreConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Restore(dst, bytes.NewReader(backup.Bytes()), RestoreConfig{}); err == nil {
+		t.Fatal("replaced an existing database without Overwrite")
+	}
+	if err := Restore(src, bytes.NewReader(backup.Bytes()), RestoreConfig{Overwrite: true}); !errors.Is(err, ErrLocked) {
+		t.Fatalf("replaced an open database: %v", err)
+	}
+	if err := db.Put("after", []byte("backup")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Restore(src, bytes.NewReader(backup.Bytes()), RestoreConfig{Overwrite: true}); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkContents(t, db, want)
+}
+
+func TestRestoreHMACChain(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.db")
+	key := WithHMACChain([]byte("secret"))
+	db, err := Open(src, key, WithHintFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := testContents(t, db)
+	var backup bytes.Buffer
+	if err := db.Backup(&backup); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(src + HintSuffix); err != nil {
+		t.Fatal(err)
+	}
+
+	// The chain of the backup is checked with the options of the restore
+	if err := Restore(filepath.Join(dir, "nokey.db"), bytes.NewReader(backup.Bytes()), RestoreConfig{}); err == nil {
+		t.Fatal("restored a backup with an HMAC chain without its key")
+	}
+	// Replacing a database removes its stale hint file
+	if err := Restore(src, bytes.NewReader(backup.Bytes()), RestoreConfig{Overwrite: true, Options: []Option{key}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(src + HintSuffix); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("got %v, want the hint file removed", err)
+	}
+	db, err = Open(src, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkContents(t, db, want)
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuditTrail(t *testing.T) {
+	dir := t.TempDir()
+	fpath := filepath.Join(dir, "test.db")
+	db, err := Open(fpath, WithAuditTrail())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := testContents(t, db)
+	if err := db.Bucket("b").Put("k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteBucket("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	var backup bytes.Buffer
+	if err := db.Backup(&backup); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A refused restore is recorded as well
+	r := bytes.NewReader(backup.Bytes())
+	if err := Restore(fpath, r, RestoreConfig{Options: []Option{WithAuditTrail()}}); err == nil {
+		t.Fatal("restore over an existing database without Overwrite succeeded")
+	}
+	r.Reset(backup.Bytes())
+	if err := Restore(fpath, r, RestoreConfig{Overwrite: true, Options: []Option{WithAuditTrail()}}); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(fpath, WithAuditTrail())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkContents(t, db, want)
+
+	entries, err := db.AuditTrail()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantOps := []string{AuditDeleteBucket, AuditCompact, AuditRestore, AuditRestore}
+	if len(entries) != len(wantOps) {
+		t.Fatalf("got %d entries, want %d: %+v", len(entries), len(wantOps), entries)
+	}
+	for i, e := range entries {
+		if e.Op != wantOps[i] || e.Time.IsZero() {
+			t.Fatalf("entry %d: got %+v, want op %q", i, e, wantOps[i])
+		}
+		if failed := i == 2; (e.Err != "") != failed {
+			t.Fatalf("entry %d: got error %q, want failed: %v", i, e.Err, failed)
+		}
+	}
+	if entries[0].Detail != "b (1 deleted)" {
+		t.Fatalf("got detail %q, want the bucket name", entries[0].Detail)
+	}
+	if read, err := ReadAuditTrail(fpath); err != nil || len(read) != len(entries) {
+		t.Fatalf("got %d entries, %v, want %d", len(read), err, len(entries))
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	for _, opts := range [][]Option{
+		nil,
+		{WithHMACChain([]byte("key"))},
+		{WithPassphrase("passphrase"), WithCompression(Gzip, 10)},
+		{WithHashedKeys([]byte("secret"))},
+	} {
+		for _, target := range []FormatVersion{FormatChecksummed, FormatBinary} {
+			dir := t.TempDir()
+			src, dst := filepath.Join(dir, "src.db"), filepath.Join(dir, "dst.db")
+			db, err := Open(src, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := testContents(t, db)
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := Migrate(src, dst, target, opts...); err != nil {
+				t.Fatal(err)
+			}
+			db, err = Open(dst, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if db.format != target {
+				t.Fatalf("got format %d, want %d", db.format, target)
+			}
+			checkValues(t, db, want)
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := Migrate(src, dst, target, opts...); err == nil {
+				t.Fatal("replaced an existing file")
+			}
+			if err := Migrate(src, filepath.Join(dir, "unknown.db"), 99, opts...); err == nil {
+				t.Fatal("migrated to an unknown format")
+			}
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package textdb
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/ejuju/go-db-playground/textdb/record"
+)
+
+// Batch groups writes that are committed together: its rows are appended in a single write,
+// after a header row with their count, and the index is only updated once the write succeeds.
+// When the database is opened, a batch that wasn't fully written is discarded,
+// so either all or none of its writes are visible after a crash.
+//
+// A batch isn't safe for concurrent use.
+type Batch struct {
+	db  *DB
+	ops []batchOp
+}
+
+type batchOp struct {
+	op byte // opSet, opDelete, opPut or opExpire
+	k  string
+	v  []byte
+}
+
+func (db *DB) NewBatch() *Batch { return &Batch{db: db} }
+
+// Len returns the number of writes in the batch.
+func (b *Batch) Len() int { return len(b.ops) }
+
+func (b *Batch) Set(k string) error { return b.add(opSet, k, nil) }
+
+func (b *Batch) Delete(k string) error { return b.add(opDelete, k, nil) }
+
+// Put adds a write of the key with a copy of the value.
+func (b *Batch) Put(k string, v []byte) error {
+	if err := b.db.ValidateValue(v); err != nil {
+		return err
+	}
+	return b.add(opPut, k, append(make([]byte, 0, len(v)), v...))
+}
+
+func (b *Batch) add(op byte, k string, v []byte) error {
+	if err := b.db.ValidateKey(k); err != nil {
+		return err
+	}
+	b.ops = append(b.ops, batchOp{op: op, k: k, v: v})
+	return nil
+}
+
+// Reset discards the writes of the batch.
+func (b *Batch) Reset() { b.ops = b.ops[:0] }
+
+// Commit appends the writes of the batch and resets it.
+// On error, none of the writes are applied and the batch is left as is.
+func (b *Batch) Commit() error {
+	if len(b.ops) == 0 {
+		return nil
+	}
+	db := b.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.commitBatch(b.ops); err != nil {
+		return err
+	}
+	b.Reset()
+	return db.syncWrite(nil)
+}
+
+// commitBatch appends the rows of the writes in a single write and applies them to the index.
+func (db *DB) commitBatch(ops []batchOp) error {
+	if err := db.prepareWrite(); err != nil {
+		return err
+	}
+	rows, err := db.encodeBatch(ops)
+	if err != nil {
+		return err
+	}
+	if err := db.writeTime(); err != nil {
+		db.rollbackUsage(rows)
+		return err
+	}
+
+	buf := getBuffer(0)
+	out := *buf
+	defer func() { putBuffer(buf, out) }()
+	var mac []byte
+	prevMAC := db.lastMAC
+	appendRow := func(op byte, k string, v []byte) int {
+		start := len(out)
+		out = db.rowFormat().AppendBody(out, op, k, v)
+		vStart := len(out) - len(v)
+		if db.hmacKey != nil {
+			mac = chainMAC(db.hmacKey, prevMAC, out[start:])
+			prevMAC = mac
+		}
+		out = db.rowFormat().AppendEnd(out, start, mac)
+		return vStart
+	}
+	if len(rows) > 1 {
+		appendRow(opBatch, strconv.Itoa(len(rows)), nil)
+	}
+	for i := range rows {
+		rows[i].vStart = db.wIndex + appendRow(rows[i].op, rows[i].k, rows[i].v)
+	}
+	if err := db.appendRows(out, mac); err != nil {
+		db.rollbackUsage(rows)
+		return err
+	}
+
+	for i, row := range rows {
+		switch row.op {
+		case opDelete:
+			db.keys.delete(row.k)
+			delete(db.expiries, row.k)
+			db.notify(EventDelete, row.k, nil)
+		case opExpire:
+			db.setExpiry(row.k, row.v)
+		case opSet:
+			db.keys.set(row.k, row.ref())
+			delete(db.expiries, row.k)
+			db.notify(EventSet, row.k, nil)
+		default:
+			db.keys.set(row.k, row.ref())
+			delete(db.expiries, row.k)
+			db.notify(EventPut, row.k, copyOf(ops[i].v))
+		}
+		db.uncache(row.k)
+	}
+	return nil
+}
+
+// encodeBatch prepares the rows of a batch and accounts for their quota usage,
+// checking quotas as if the previous writes of the batch were already applied.
+func (db *DB) encodeBatch(ops []batchOp) ([]batchRow, error) {
+	rows := make([]batchRow, len(ops))
+	written := make(map[string]ref) // refs of the keys written by previous rows
+	for i, op := range ops {
+		row, err := db.encodeBatchRow(op)
+		if err == nil && len(db.quotas) > 0 && row.op != opExpire {
+			current, exists := written[row.k]
+			if exists {
+				exists = current.index != refDeleted
+			} else {
+				current, exists = db.keys.get(row.k)
+			}
+			row.delta = quotaDeltaFrom(row.k, current, exists, len(row.v), row.op == opDelete)
+			err = db.checkQuota(row.k, row.delta)
+			written[row.k] = row.ref()
+		}
+		if err != nil {
+			db.rollbackUsage(rows[:i])
+			return nil, err
+		}
+		db.addUsage(row.k, row.delta)
+		rows[i] = row
+	}
+	return rows, nil
+}
+
+func (db *DB) encodeBatchRow(op batchOp) (batchRow, error) {
+	row := batchRow{op: op.op, k: db.hashKey(op.k)}
+	if op.op == opExpire {
+		row.v = op.v
+	}
+	if op.op != opPut {
+		return row, nil
+	}
+	var err error
+	row.v, row.compressed, err = db.compressValue(op.v)
+	if err != nil {
+		return row, err
+	}
+	if row.compressed {
+		row.op = opPutCompressed
+	}
+	row.v, err = db.encryptValue(row.op, row.k, row.v)
+	if err != nil {
+		return row, err
+	}
+	if len(row.v) > maxValueSize {
+		return row, fmt.Errorf("%w: %d (max %d)", ErrValueTooLarge, len(row.v), maxValueSize)
+	}
+	return row, nil
+}
+
+func (db *DB) rollbackUsage(rows []batchRow) {
+	for _, row := range rows {
+		db.addUsage(row.k, Usage{Keys: -row.delta.Keys, Bytes: -row.delta.Bytes})
+	}
+}
+
+type batchRow struct {
+	op         byte
+	k          string
+	v          []byte
+	compressed bool
+	delta      Usage
+	vStart     int // offset of the value in the file
+}
+
+// ref returns the ref of the row once written.
+func (row batchRow) ref() ref {
+	switch row.op {
+	case opSet:
+		return keyOnly
+	case opDelete:
+		return ref{index: refDeleted}
+	}
+	return ref{index: row.vStart, width: len(row.v), compressed: row.compressed}
+}
+
+// pendingBatch holds the rows of a batch while it's replayed,
+// they're only applied once all of them have been read.
+type pendingBatch struct {
+	size    int
+	offset  int // offset of the batch header
+	prevMAC []byte
+	rows    []pendingRow
+}
+
+type pendingRow struct {
+	r      record.Record
+	offset int
+}
+
+func newPendingBatch(size string, offset int, prevMAC []byte) (*pendingBatch, error) {
+	n, err := strconv.Atoi(size)
+	if err != nil || n <= 0 {
+		return nil, errors.New("invalid batch size: " + strconv.Quote(size))
+	}
+	return &pendingBatch{size: n, offset: offset, prevMAC: prevMAC}, nil
+}
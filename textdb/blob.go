@@ -0,0 +1,123 @@
+package textdb
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Blobs are stored under the hex SHA-256 of their content, along with a reference count.
+const (
+	blobPrefix    = "blob:sha256:"
+	blobRefPrefix = "blobref:sha256:"
+)
+
+var ErrBlobCorrupted = errors.New("blob content doesn't match its hash")
+
+// PutBlob stores data under its SHA-256 (returned as hex) and increments its reference count.
+// Identical data is only stored once.
+func (db *DB) PutBlob(data []byte) (string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	refs, err := db.blobRefs(hash)
+	if err != nil {
+		return "", err
+	}
+	if !db.exists(blobPrefix + hash) {
+		if err := db.put(blobPrefix+hash, data); err != nil {
+			return "", err
+		}
+	}
+	return hash, db.syncWrite(db.putBlobRefs(hash, refs+1))
+}
+
+// GetBlob returns the data stored under the given hash, or nil if there is none.
+func (db *DB) GetBlob(hash string) ([]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	data, err := db.get(blobPrefix + hash)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != hash {
+		return nil, fmt.Errorf("%w: %s", ErrBlobCorrupted, hash)
+	}
+	return data, nil
+}
+
+// ReleaseBlob decrements the reference count of a blob,
+// blobs that are no longer referenced are deleted by GCBlobs.
+func (db *DB) ReleaseBlob(hash string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	refs, err := db.blobRefs(hash)
+	if err != nil {
+		return err
+	}
+	if refs == 0 {
+		return fmt.Errorf("release blob %s: %w", hash, ErrKeyNotFound)
+	}
+	return db.syncWrite(db.putBlobRefs(hash, refs-1))
+}
+
+// GCBlobs deletes unreferenced blobs and returns how many were deleted.
+// It isn't supported with hashed keys since blob keys can't be told apart.
+func (db *DB) GCBlobs() (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	deleted, err := db.gcBlobs()
+	return deleted, db.syncWrite(err)
+}
+
+func (db *DB) gcBlobs() (int, error) {
+	if db.keyHashSecret != nil {
+		return 0, errors.New("gc blobs: not supported with hashed keys")
+	}
+	var hashes []string
+	db.keys.forEach(func(k []byte, _ ref) bool {
+		if strings.HasPrefix(string(k), blobPrefix) {
+			hashes = append(hashes, strings.TrimPrefix(string(k), blobPrefix))
+		}
+		return true
+	})
+	deleted := 0
+	for _, hash := range hashes {
+		refs, err := db.blobRefs(hash)
+		if err != nil {
+			return deleted, err
+		}
+		if refs > 0 {
+			continue
+		}
+		if err := db.delete(blobPrefix + hash); err != nil {
+			return deleted, err
+		}
+		if db.exists(blobRefPrefix + hash) {
+			if err := db.delete(blobRefPrefix + hash); err != nil {
+				return deleted, err
+			}
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+func (db *DB) blobRefs(hash string) (uint64, error) {
+	v, err := db.get(blobRefPrefix + hash)
+	if err != nil || v == nil {
+		return 0, err
+	}
+	if len(v) != 8 {
+		return 0, fmt.Errorf("blob %s: invalid reference count", hash)
+	}
+	return binary.BigEndian.Uint64(v), nil
+}
+
+func (db *DB) putBlobRefs(hash string, refs uint64) error {
+	return db.put(blobRefPrefix+hash, binary.BigEndian.AppendUint64(nil, refs))
+}
@@ -0,0 +1,321 @@
+package textdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Block files store the bytes of a database file compressed in blocks, followed by the index of the blocks
+// and a footer locating the index, so that a row is read by decompressing only the block(s) holding it.
+//
+//	textdb-blocks 1\n <compressor ID>
+//	<compressed blocks>
+//	<number of blocks> (<compressed size> <uncompressed size> <CRC-32 of the compressed block>)... (uvarints)
+//	<offset of the index> <CRC-32 of the index> (big-endian uint64 and uint32)
+//
+// They're written by the compaction of cold segments (see ColdSegments) and opened read-only.
+
+const (
+	blockMagic       = "textdb-blocks 1\n"
+	blockFooterSize  = 12
+	defaultBlockSize = 64 << 10
+)
+
+// blockWriter compresses the bytes written to it in blocks, Close writes the index and footer.
+type blockWriter struct {
+	w      io.Writer
+	c      Compressor
+	size   int
+	buf    []byte
+	index  []byte
+	n      int   // number of blocks
+	offset int64 // bytes written to w
+	err    error
+}
+
+func newBlockWriter(w io.Writer, c Compressor, blockSize int) *blockWriter {
+	bw := &blockWriter{w: w, c: c, size: blockSize}
+	bw.write(append([]byte(blockMagic), c.ID()))
+	return bw
+}
+
+func (bw *blockWriter) Write(p []byte) (int, error) {
+	bw.buf = append(bw.buf, p...)
+	for len(bw.buf) >= bw.size && bw.err == nil {
+		bw.flushBlock(bw.buf[:bw.size])
+		bw.buf = append(bw.buf[:0], bw.buf[bw.size:]...)
+	}
+	if bw.err != nil {
+		return 0, bw.err
+	}
+	return len(p), nil
+}
+
+func (bw *blockWriter) flushBlock(block []byte) {
+	compressed, err := bw.c.Compress(block)
+	if err != nil {
+		bw.err = fmt.Errorf("compress block: %w", err)
+		return
+	}
+	bw.index = binary.AppendUvarint(bw.index, uint64(len(compressed)))
+	bw.index = binary.AppendUvarint(bw.index, uint64(len(block)))
+	bw.index = binary.BigEndian.AppendUint32(bw.index, crc32.ChecksumIEEE(compressed))
+	bw.n++
+	bw.write(compressed)
+}
+
+func (bw *blockWriter) write(p []byte) {
+	if bw.err != nil {
+		return
+	}
+	n, err := bw.w.Write(p)
+	bw.offset += int64(n)
+	bw.err = err
+}
+
+// Close writes the last block, the index and the footer (it doesn't close the underlying writer).
+func (bw *blockWriter) Close() error {
+	if len(bw.buf) > 0 {
+		bw.flushBlock(bw.buf)
+	}
+	index := binary.AppendUvarint(nil, uint64(bw.n))
+	index = append(index, bw.index...)
+	footer := binary.BigEndian.AppendUint64(nil, uint64(bw.offset))
+	footer = binary.BigEndian.AppendUint32(footer, crc32.ChecksumIEEE(index))
+	bw.write(index)
+	bw.write(footer)
+	return bw.err
+}
+
+// blockFile is a read-only File of the decompressed bytes of a block file.
+type blockFile struct {
+	f      File
+	c      Compressor
+	starts []int64 // offset of each block in the file, then of the index
+	ends   []int64 // end of each block in the decompressed bytes
+	sums   []uint32
+	pos    int64
+
+	mu     sync.Mutex
+	cached int // block in buf, -1 if none
+	buf    []byte
+}
+
+var errBlockFileReadOnly = errors.New("block file is read-only")
+
+func openBlockFile(f File, compressors map[byte]Compressor) (*blockFile, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	head := make([]byte, len(blockMagic)+1)
+	footer := make([]byte, blockFooterSize)
+	if fi.Size() < int64(len(head)+len(footer)) {
+		return nil, fmt.Errorf("%w: truncated block file", ErrCorruptRecord)
+	}
+	if _, err := f.ReadAt(head, 0); err != nil {
+		return nil, err
+	}
+	if _, err := f.ReadAt(footer, fi.Size()-blockFooterSize); err != nil {
+		return nil, err
+	}
+	c, ok := compressors[head[len(blockMagic)]]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown compressor ID %d", ErrDecompress, head[len(blockMagic)])
+	}
+	indexStart := int64(binary.BigEndian.Uint64(footer))
+	if indexStart < int64(len(head)) || indexStart > fi.Size()-blockFooterSize {
+		return nil, fmt.Errorf("%w: invalid block index offset %d", ErrCorruptRecord, indexStart)
+	}
+	index := make([]byte, fi.Size()-blockFooterSize-indexStart)
+	if _, err := f.ReadAt(index, indexStart); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(index) != binary.BigEndian.Uint32(footer[8:]) {
+		return nil, fmt.Errorf("%w: block index checksum mismatch", ErrCorruptRecord)
+	}
+
+	bf := &blockFile{f: f, c: c, cached: -1}
+	r := bytes.NewReader(index)
+	n, err := binary.ReadUvarint(r)
+	offset, end := int64(len(head)), int64(0)
+	for i := uint64(0); err == nil && i < n; i++ {
+		var compressedLen, blockLen uint64
+		var sum uint32
+		if compressedLen, err = binary.ReadUvarint(r); err != nil {
+			break
+		}
+		if blockLen, err = binary.ReadUvarint(r); err != nil {
+			break
+		}
+		if err = binary.Read(r, binary.BigEndian, &sum); err != nil {
+			break
+		}
+		end += int64(blockLen)
+		bf.starts, bf.ends, bf.sums = append(bf.starts, offset), append(bf.ends, end), append(bf.sums, sum)
+		offset += int64(compressedLen)
+	}
+	if err != nil || offset != indexStart {
+		return nil, fmt.Errorf("%w: invalid block index", ErrCorruptRecord)
+	}
+	bf.starts = append(bf.starts, indexStart)
+	return bf, nil
+}
+
+// block returns the decompressed block i, which is only valid until the lock is released.
+func (bf *blockFile) block(i int) ([]byte, error) {
+	if bf.cached == i {
+		return bf.buf, nil
+	}
+	compressed := make([]byte, bf.starts[i+1]-bf.starts[i])
+	if _, err := bf.f.ReadAt(compressed, bf.starts[i]); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(compressed) != bf.sums[i] {
+		return nil, &CorruptRecordError{Offset: bf.starts[i], Err: errors.New("block checksum mismatch")}
+	}
+	b, err := bf.c.Decompress(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("%w: block %d: %w", ErrDecompress, i, err)
+	}
+	if start := bf.blockStart(i); int64(len(b)) != bf.ends[i]-start {
+		return nil, &CorruptRecordError{Offset: bf.starts[i], Err: fmt.Errorf("block of %d bytes instead of %d", len(b), bf.ends[i]-start)}
+	}
+	bf.cached, bf.buf = i, b
+	return b, nil
+}
+
+func (bf *blockFile) blockStart(i int) int64 {
+	if i == 0 {
+		return 0
+	}
+	return bf.ends[i-1]
+}
+
+func (bf *blockFile) size() int64 {
+	if len(bf.ends) == 0 {
+		return 0
+	}
+	return bf.ends[len(bf.ends)-1]
+}
+
+func (bf *blockFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	n := 0
+	for n < len(p) {
+		i := sort.Search(len(bf.ends), func(i int) bool { return bf.ends[i] > off })
+		if i == len(bf.ends) {
+			return n, io.EOF
+		}
+		b, err := bf.block(i)
+		if err != nil {
+			return n, err
+		}
+		copied := copy(p[n:], b[off-bf.blockStart(i):])
+		n += copied
+		off += int64(copied)
+	}
+	return n, nil
+}
+
+func (bf *blockFile) Read(p []byte) (int, error) {
+	n, err := bf.ReadAt(p, bf.pos)
+	bf.pos += int64(n)
+	if n > 0 && errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return n, err
+}
+
+func (bf *blockFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += bf.pos
+	case io.SeekEnd:
+		offset += bf.size()
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	bf.pos = offset
+	return offset, nil
+}
+
+func (bf *blockFile) Stat() (os.FileInfo, error) {
+	fi, err := bf.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return blockFileInfo{FileInfo: fi, size: bf.size()}, nil
+}
+
+func (bf *blockFile) Close() error              { return bf.f.Close() }
+func (bf *blockFile) Sync() error               { return nil }
+func (bf *blockFile) Write([]byte) (int, error) { return 0, errBlockFileReadOnly }
+func (bf *blockFile) Truncate(size int64) error { return errBlockFileReadOnly }
+
+// blockFileInfo reports the decompressed size of a block file.
+type blockFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi blockFileInfo) Size() int64 { return fi.size }
+
+// blockFS opens block files as their decompressed bytes, other files are opened as is.
+type blockFS struct {
+	FileSystem
+	compressors map[byte]Compressor
+}
+
+func (fs blockFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fs.FileSystem.OpenFile(name, flag, perm)
+	if err != nil || flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		return f, err
+	}
+	magic := make([]byte, len(blockMagic))
+	if n, _ := f.ReadAt(magic, 0); n < len(magic) || string(magic) != blockMagic {
+		return f, nil
+	}
+	bf, err := openBlockFile(f, fs.compressors)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("open %s: %w", name, err)
+	}
+	return bf, nil
+}
+
+// writeBlocks is like writeLive but writes the file compressed in blocks.
+func (db *DB) writeBlocks(f File, cfg *ColdSegments, filter *liveFilter) error {
+	defer f.Close()
+	bw := newBlockWriter(f, cfg.Compressor, cfg.BlockSize)
+	if err := db.writeLiveRows(bw, db.format, true, filter, nil); err != nil {
+		return err
+	}
+	if err := bw.Close(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// withBlockFiles opens the database file read-only, decompressing it if it's a block file.
+func withBlockFiles() Option {
+	return func(db *DB) {
+		db.fs = blockFS{FileSystem: db.fs, compressors: db.compressors}
+		db.readOnly = true
+	}
+}
@@ -0,0 +1,60 @@
+package textdb
+
+import (
+	"hash/maphash"
+	"math"
+)
+
+// WithIndexBloomFilter keeps a bloom filter of the keys of each run of a spilled index
+// (see WithIndexMemoryLimit), so that looking up a missing key rarely reads the runs.
+// The filters are in memory and take about 10 bits per key at a false positive rate of 1%.
+func WithIndexBloomFilter(falsePositiveRate float64) Option {
+	return func(db *DB) { db.bloomRate = falsePositiveRate }
+}
+
+// bloomFilter is a set of hashes that may report keys as present when they aren't.
+type bloomFilter struct {
+	seed      maphash.Seed
+	bits      []uint64
+	numHashes int
+}
+
+// newBloomFilter returns a filter of keys hashed with the seed, sized for n keys at the given false positive rate.
+func newBloomFilter(seed maphash.Seed, n int, rate float64) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	if rate <= 0 || rate >= 1 {
+		rate = 0.01
+	}
+	numBits := int(math.Ceil(-float64(n) * math.Log(rate) / (math.Ln2 * math.Ln2)))
+	numHashes := int(math.Round(float64(numBits) / float64(n) * math.Ln2))
+	if numHashes < 1 {
+		numHashes = 1
+	}
+	return &bloomFilter{seed: seed, bits: make([]uint64, (numBits+63)/64), numHashes: numHashes}
+}
+
+// add adds a key given its hash (see maphash.Bytes).
+func (bf *bloomFilter) add(h uint64) {
+	m := uint64(len(bf.bits) * 64)
+	h1, h2 := h, h>>32|h<<32
+	for i := 0; i < bf.numHashes; i++ {
+		bit := (h1 + uint64(i)*h2) % m
+		bf.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// mayContain reports whether the key may have been added.
+func (bf *bloomFilter) mayContain(k string) bool {
+	h := maphash.String(bf.seed, k)
+	m := uint64(len(bf.bits) * 64)
+	h1, h2 := h, h>>32|h<<32
+	for i := 0; i < bf.numHashes; i++ {
+		bit := (h1 + uint64(i)*h2) % m
+		if bf.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
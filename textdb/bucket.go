@@ -0,0 +1,154 @@
+package textdb
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// BucketSeparator separates the name of a bucket from the keys it contains:
+// the key k of the bucket b is stored as b + BucketSeparator + k,
+// so keys written outside of buckets shouldn't contain it.
+const BucketSeparator = "\x00"
+
+// Bucket is a namespace of keys in the database, see DB.Bucket.
+type Bucket struct {
+	db     *DB
+	name   string
+	prefix string
+}
+
+// Bucket returns the bucket with the given name, which must not be empty nor contain BucketSeparator.
+// Buckets don't need to be created: a bucket exists as long as it contains keys.
+func (db *DB) Bucket(name string) *Bucket {
+	return &Bucket{db: db, name: name, prefix: name + BucketSeparator}
+}
+
+func (b *Bucket) Name() string { return b.name }
+
+func validateBucketName(name string) error {
+	if name == "" || strings.Contains(name, BucketSeparator) {
+		return fmt.Errorf("%w: invalid bucket name %q", ErrInvalidKey, name)
+	}
+	return nil
+}
+
+// key returns the key in the database of the key of the bucket.
+func (b *Bucket) key(k string) (string, error) {
+	if err := validateBucketName(b.name); err != nil {
+		return "", err
+	}
+	if k == "" {
+		return "", fmt.Errorf("%w: key is empty", ErrInvalidKey)
+	}
+	return b.prefix + k, nil
+}
+
+func (b *Bucket) Get(k string) ([]byte, error) {
+	key, err := b.key(k)
+	if err != nil {
+		return nil, err
+	}
+	v, err := b.db.Get(key)
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, fmt.Errorf("%w: %q in bucket %q", ErrKeyNotFound, k, b.name)
+	}
+	return v, err
+}
+
+func (b *Bucket) Put(k string, v []byte) error {
+	key, err := b.key(k)
+	if err != nil {
+		return err
+	}
+	return b.db.Put(key, v)
+}
+
+func (b *Bucket) Set(k string) error {
+	key, err := b.key(k)
+	if err != nil {
+		return err
+	}
+	return b.db.Set(key)
+}
+
+func (b *Bucket) Delete(k string) error {
+	key, err := b.key(k)
+	if err != nil {
+		return err
+	}
+	return b.db.Delete(key)
+}
+
+func (b *Bucket) Exists(k string) bool {
+	key, err := b.key(k)
+	return err == nil && b.db.Exists(key)
+}
+
+// ForEach is like DB.ForEach for the keys of the bucket, which are passed without the bucket name.
+func (b *Bucket) ForEach(fn func(k string, v []byte) error) error { return b.Scan("", fn) }
+
+// Scan is like DB.Scan for the keys of the bucket, which are passed without the bucket name.
+func (b *Bucket) Scan(prefix string, fn func(k string, v []byte) error) error {
+	if err := validateBucketName(b.name); err != nil {
+		return err
+	}
+	return b.db.Scan(b.prefix+prefix, func(k string, v []byte) error {
+		return fn(k[len(b.prefix):], v)
+	})
+}
+
+// ListBuckets returns the names of the buckets that contain keys, in lexicographic order.
+// It isn't supported with WithHashedKeys, and it's recorded in the audit trail if enabled (see WithAuditTrail).
+func (db *DB) ListBuckets() ([]string, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	if db.keyHashSecret != nil {
+		return nil, errors.New("list buckets: not supported with hashed keys")
+	}
+	var names []string
+	seen := make(map[string]bool)
+	db.keys.forEach(func(k []byte, _ ref) bool {
+		i := strings.Index(string(k), BucketSeparator)
+		if i <= 0 || db.expired(string(k)) {
+			return true
+		}
+		if name := string(k[:i]); !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+		return true
+	})
+	sort.Strings(names)
+	return names, nil
+}
+
+// DeleteBucket deletes all keys of the bucket in a single batch (see Batch).
+// It isn't supported with WithHashedKeys.
+func (db *DB) DeleteBucket(name string) error {
+	if err := validateBucketName(name); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	if db.keyHashSecret != nil {
+		return errors.New("delete bucket: not supported with hashed keys")
+	}
+	keys := db.keysWithPrefix(name + BucketSeparator)
+	if len(keys) == 0 {
+		return nil
+	}
+	ops := make([]batchOp, len(keys))
+	for i, k := range keys {
+		ops[i] = batchOp{op: opDelete, k: k}
+	}
+	err := db.syncWrite(db.commitBatch(ops))
+	return db.audit(AuditDeleteBucket, fmt.Sprintf("%s (%d deleted)", name, len(keys)), err)
+}
@@ -0,0 +1,160 @@
+package textdb
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// WriteBuffer configures in-memory buffering of appended rows.
+// Buffered rows are flushed to the file when one of the (non-zero) thresholds is reached,
+// on Flush and on Close. They are visible to reads right away but are lost if the process
+// exits before they're flushed. Errors from automatic flushes are returned by the next
+// write, Flush or Close, which retry writing the remaining buffered rows.
+type WriteBuffer struct {
+	MaxBytes   int
+	MaxRecords int
+	Interval   time.Duration
+}
+
+func WithWriteBuffer(cfg WriteBuffer) Option {
+	return func(db *DB) { db.writeBuffer = &cfg }
+}
+
+// Flush writes buffered rows to the file, it's a no-op without a write buffer.
+func (db *DB) Flush() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.flush()
+}
+
+func (db *DB) flush() error {
+	if db.closed {
+		return ErrClosed
+	}
+	if db.bw == nil {
+		return nil
+	}
+	if err := db.bw.Flush(); err != nil {
+		return db.writeFailed(0, err)
+	}
+	db.degraded = nil
+	return nil
+}
+
+func (db *DB) readAt(p []byte, off int64) error {
+	if db.bw != nil {
+		if buffered, err := db.bw.readBuffered(p, off); buffered {
+			return err
+		}
+	}
+	_, err := db.reader().ReadAt(p, off)
+	return err
+}
+
+type bufferedWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	cfg     WriteBuffer
+	buf     []byte
+	records int
+	flushed int64 // file offset where the buffer starts
+	err     error // error from the last failed automatic flush
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newBufferedWriter(w io.Writer, cfg WriteBuffer, offset int64) *bufferedWriter {
+	bw := &bufferedWriter{w: w, cfg: cfg, flushed: offset}
+	if cfg.Interval > 0 {
+		bw.stop, bw.done = make(chan struct{}), make(chan struct{})
+		go bw.flushPeriodically()
+	}
+	return bw
+}
+
+func (bw *bufferedWriter) flushPeriodically() {
+	defer close(bw.done)
+	ticker := time.NewTicker(bw.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-bw.stop:
+			return
+		case <-ticker.C:
+			bw.mu.Lock()
+			bw.err = bw.flushLocked()
+			bw.mu.Unlock()
+		}
+	}
+}
+
+// Write buffers a single row.
+func (bw *bufferedWriter) Write(row []byte) (int, error) {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	if bw.err != nil {
+		if bw.err = bw.flushLocked(); bw.err != nil {
+			return 0, bw.err
+		}
+	}
+	bw.buf = append(bw.buf, row...)
+	bw.records++
+	if (bw.cfg.MaxBytes > 0 && len(bw.buf) >= bw.cfg.MaxBytes) ||
+		(bw.cfg.MaxRecords > 0 && bw.records >= bw.cfg.MaxRecords) {
+		bw.err = bw.flushLocked()
+	}
+	return len(row), nil
+}
+
+func (bw *bufferedWriter) Flush() error {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	bw.err = bw.flushLocked()
+	return bw.err
+}
+
+func (bw *bufferedWriter) flushLocked() error {
+	if len(bw.buf) == 0 {
+		return nil
+	}
+	n, err := bw.w.Write(bw.buf)
+	bw.flushed += int64(n)
+	bw.buf = bw.buf[:copy(bw.buf, bw.buf[n:])]
+	if err != nil {
+		return err
+	}
+	bw.records = 0
+	return nil
+}
+
+func (bw *bufferedWriter) flushedOffset() int64 {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	return bw.flushed
+}
+
+// readBuffered reads from the buffer if the offset hasn't been flushed yet,
+// it returns false if the data must be read from the file instead.
+func (bw *bufferedWriter) readBuffered(p []byte, off int64) (bool, error) {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	if off < bw.flushed {
+		return false, nil
+	}
+	start := off - bw.flushed
+	if start+int64(len(p)) > int64(len(bw.buf)) {
+		return true, io.ErrUnexpectedEOF
+	}
+	copy(p, bw.buf[start:])
+	return true, nil
+}
+
+func (bw *bufferedWriter) Close() error {
+	if bw.stop != nil {
+		close(bw.stop)
+		<-bw.done
+	}
+	return bw.Flush()
+}
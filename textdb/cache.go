@@ -0,0 +1,114 @@
+package textdb
+
+import (
+	"container/list"
+	"sync"
+)
+
+// WithValueCache keeps recently read values in memory, up to maxBytes of values,
+// so that repeated reads of hot keys don't go to disk (or get decrypted again).
+// The least recently used values are evicted first.
+func WithValueCache(maxBytes int) Option {
+	return func(db *DB) { db.cache = newValueCache(maxBytes) }
+}
+
+// CacheStats reports value cache usage.
+type CacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+	Bytes   int
+}
+
+// CacheStats returns the value cache statistics, or false if the cache isn't enabled.
+func (db *DB) CacheStats() (CacheStats, bool) {
+	if db.cache == nil {
+		return CacheStats{}, false
+	}
+	return db.cache.stats(), true
+}
+
+type valueCache struct {
+	mu       sync.Mutex
+	maxBytes int
+	lru      *list.List // front is most recently used
+	items    map[string]*list.Element
+	s        CacheStats
+}
+
+type cacheEntry struct {
+	key   string
+	index int // value offset, so that a stale entry is never returned for a rewritten key
+	value []byte
+}
+
+func newValueCache(maxBytes int) *valueCache {
+	return &valueCache{maxBytes: maxBytes, lru: list.New(), items: make(map[string]*list.Element)}
+}
+
+// get returns a copy of the cached value at the given offset.
+func (c *valueCache) get(k string, index int) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[k]
+	if !ok || el.Value.(*cacheEntry).index != index {
+		c.s.Misses++
+		return nil, false
+	}
+	c.s.Hits++
+	c.lru.MoveToFront(el)
+	return append([]byte(nil), el.Value.(*cacheEntry).value...), true
+}
+
+// add caches a copy of the value.
+func (c *valueCache) add(k string, index int, v []byte) {
+	if len(v) > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(k)
+	c.items[k] = c.lru.PushFront(&cacheEntry{key: k, index: index, value: append([]byte(nil), v...)})
+	c.s.Entries++
+	c.s.Bytes += len(v)
+	for c.s.Bytes > c.maxBytes {
+		c.removeLocked(c.lru.Back().Value.(*cacheEntry).key)
+	}
+}
+
+func (db *DB) uncache(k string) {
+	if db.cache != nil {
+		db.cache.remove(k)
+	}
+}
+
+func (c *valueCache) remove(k string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(k)
+}
+
+func (c *valueCache) removeLocked(k string) {
+	el, ok := c.items[k]
+	if !ok {
+		return
+	}
+	c.lru.Remove(el)
+	delete(c.items, k)
+	c.s.Entries--
+	c.s.Bytes -= len(el.Value.(*cacheEntry).value)
+}
+
+func (c *valueCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	c.items = make(map[string]*list.Element)
+	c.s.Entries, c.s.Bytes = 0, 0
+}
+
+func (c *valueCache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.s
+}
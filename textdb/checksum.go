@@ -0,0 +1,81 @@
+package textdb
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/ejuju/go-db-playground/textdb/record"
+)
+
+// Rows end with a CRC-32 of their content, verified when the file is read on open
+// and when values are read. Rows written before checksums were added have none and aren't verified.
+
+var ErrCorruptRecord = errors.New("corrupt record")
+
+type CorruptRecordError struct {
+	Row    int   // row number, zero when unknown (values read by key)
+	Offset int64 // offset of the row in the file
+	Err    error
+}
+
+func (err *CorruptRecordError) Error() string {
+	if err.Row == 0 {
+		return fmt.Sprintf("%s: %v (offset %d)", ErrCorruptRecord, err.Err, err.Offset)
+	}
+	return fmt.Sprintf("%s: %v (row %d, offset %d)", ErrCorruptRecord, err.Err, err.Row, err.Offset)
+}
+
+func (err *CorruptRecordError) Unwrap() []error { return []error{ErrCorruptRecord, err.Err} }
+
+// WithLazyChecksums only verifies checksums of values when they're read,
+// so that opening the database can skip values instead of reading them.
+func WithLazyChecksums() Option {
+	return func(db *DB) { db.lazyChecksums = true }
+}
+
+// readVerified reads a stored value with read and verifies the checksum of its row if it has one.
+// k is the key as stored.
+func (db *DB) readVerified(read readAtFunc, k string, r ref, dst []byte) error {
+	// The value is followed by the MAC (if enabled) and the checksum
+	buf := getBuffer(r.width + db.rowFormat().TrailerLen(db.hmacKey != nil, true))
+	defer putBuffer(buf, *buf)
+	if err := read(*buf, int64(r.index)); err != nil {
+		// Only a row without checksum can end the file before
+		return read(dst, int64(r.index))
+	}
+	copy(dst, *buf)
+
+	header := getBuffer(0)
+	*header = db.valueHeader(*header, k, r)
+	defer putBuffer(header, *header)
+	sum := crc32.ChecksumIEEE(*header)
+	sum = crc32.Update(sum, crc32.IEEETable, dst)
+	return checkTrailer(db.rowFormat(), db.hmacKey != nil, int64(r.index-len(*header)), sum, (*buf)[r.width:])
+}
+
+// valueHeader appends the header of the row of a stored value (see record.Format.AppendHeader).
+func (db *DB) valueHeader(dst []byte, k string, r ref) []byte {
+	op := opPut
+	if r.compressed {
+		op = opPutCompressed
+	}
+	return db.rowFormat().AppendHeader(dst, op, k, r.width)
+}
+
+// checkTrailer verifies the checksum of the row at the given offset, given the checksum of its body
+// and the bytes following the body (see record.Format.SplitTrailer).
+func checkTrailer(format record.Format, mac bool, offset int64, sum uint32, trailer []byte) error {
+	covered, want, ok, err := format.SplitTrailer(trailer, mac)
+	if err != nil {
+		return &CorruptRecordError{Offset: offset, Err: err}
+	}
+	if !ok {
+		return nil // legacy row
+	}
+	sum = crc32.Update(sum, crc32.IEEETable, covered)
+	if sum != want {
+		return &CorruptRecordError{Offset: offset, Err: fmt.Errorf("%w: %08x (computed %08x)", record.ErrChecksum, want, sum)}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package textdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Compact rewrites the file with only the current metadata and live keys, dropping overwritten
+// and deleted rows, then replaces the database file with it and reloads the index.
+// Values encrypted with a previous key are encrypted with the current one, completing a key rotation,
+// and the HMAC chain (if enabled) restarts from the first row of the new file.
+// Reads and writes wait for the compaction to finish (see WithAutoCompaction to compact in the background).
+//
+// The compacted file is synced before it replaces the database file,
+// so a crash leaves either the old or the new file in place.
+// With WithColdTier, rarely read large values are written to a new cold file, which replaces the old one first.
+// Compactions are recorded in the audit trail if enabled (see WithAuditTrail).
+func (db *DB) Compact() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	size := db.wIndex
+	err := db.compact()
+	if err == nil {
+		return db.audit(AuditCompact, fmt.Sprintf("%d -> %d bytes", size, db.wIndex), nil)
+	}
+	if !errors.Is(err, ErrClosed) && !errors.Is(err, ErrReadOnly) {
+		err = db.audit(AuditCompact, "", err)
+	}
+	return err
+}
+
+// compact is Compact with the lock held.
+func (db *DB) compact() error {
+	if db.closed {
+		return ErrClosed
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if db.unnamed {
+		return errors.New("compact: not supported for unnamed files")
+	}
+	if db.compacting {
+		return errors.New("compact: a background compaction is running")
+	}
+	start, size := time.Now(), db.wIndex
+
+	tmpPath := db.fpath + ".compact"
+	f, err := db.fs.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("compact: %w", err)
+	}
+	cw, err := db.newColdWriter()
+	if err != nil {
+		f.Close()
+		db.fs.Remove(tmpPath)
+		return fmt.Errorf("compact: %w", err)
+	}
+	err = db.writeLive(f, db.format, true, nil, cw)
+	if err == nil && cw != nil {
+		err = cw.finish()
+	}
+	if err == nil {
+		if fp := hitFailpoint(FailpointCompact); fp != nil {
+			err = fp.Err
+		}
+	}
+	if err != nil {
+		db.fs.Remove(tmpPath)
+		cw.abort()
+		return fmt.Errorf("compact: %w", err)
+	}
+
+	// Swap the files (the cold file first), on failure the database is reopened from the old file
+	err = errors.Join(db.closeFiles(), db.closeCold())
+	if err == nil {
+		db.fs.Remove(hintPath(db.fpath)) // it's of the old file
+		if cw != nil {
+			err = cw.replace()
+		}
+	}
+	if err == nil {
+		err = db.fs.Rename(tmpPath, db.fpath)
+	}
+	if err == nil && cw != nil {
+		cw.removeUnused()
+	}
+	if err != nil {
+		db.fs.Remove(tmpPath)
+		cw.abort()
+		err = fmt.Errorf("compact: %w", err)
+	}
+	if reopenErr := db.reopen(); reopenErr != nil {
+		// The database can't be used anymore
+		db.closed = true
+		return errors.Join(err, fmt.Errorf("compact: reopen: %w", reopenErr), db.keys.close(), db.unlock())
+	}
+	if err == nil {
+		db.recordCompaction(start, size)
+		err = db.saveHint()
+	}
+	return err
+}
+
+// reopen resets the state loaded from the file and opens it again.
+func (db *DB) reopen() error {
+	if err := db.keys.close(); err != nil {
+		return err
+	}
+	if err := db.initIndex(); err != nil {
+		return err
+	}
+	db.meta = make(map[string]string)
+	db.expiries = nil
+	db.wIndex, db.lastMAC, db.rowTime = 0, nil, 0
+	db.prealloc, db.bw = nil, nil
+	db.degraded, db.tornTail = nil, false
+	db.inconsistent, db.rowsSinceCheck = nil, 0
+	if db.cache != nil {
+		db.cache.clear()
+	}
+	if err := db.openFiles(); err != nil {
+		return err
+	}
+	if err := db.checkConsistency(); err != nil && db.inconsistent == nil {
+		return err
+	}
+	db.syncedOffset = db.wIndex // the compacted file was synced before being renamed
+	for _, st := range db.quotas {
+		st.usage = Usage{}
+	}
+	return db.initQuotas()
+}
@@ -0,0 +1,142 @@
+package textdb
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Compressor compresses values, Gzip and Flate are built in
+// and other algorithms (e.g. snappy or zstd) can be plugged in by implementing it.
+type Compressor interface {
+	// ID is stored with each compressed value to select its decompressor,
+	// it must be unique and stable across versions.
+	ID() byte
+	Compress(v []byte) ([]byte, error)
+	Decompress(v []byte) ([]byte, error)
+}
+
+// WithCompression compresses values of at least minSize bytes with the given compressor.
+// Values are stored uncompressed when compression doesn't make them smaller.
+// Compressed values are written in rows of a distinct op so they're told apart on read,
+// and can be read back as long as their compressor is built in or registered with WithCompressors.
+func WithCompression(c Compressor, minSize int) Option {
+	return func(db *DB) {
+		db.compressor, db.compressionMinSize = c, minSize
+		db.compressors[c.ID()] = c
+	}
+}
+
+// WithCompressors registers compressors used to read existing values (but not to write new ones).
+func WithCompressors(cs ...Compressor) Option {
+	return func(db *DB) {
+		for _, c := range cs {
+			db.compressors[c.ID()] = c
+		}
+	}
+}
+
+var ErrDecompress = errors.New("decompress value")
+
+// PutWithCompression is like Put but compresses the value with the given compressor
+// instead of the one of WithCompression, whatever its size (or stores it uncompressed if c is nil).
+// The compressor must be built in or registered with WithCompression or WithCompressors.
+func (db *DB) PutWithCompression(k string, v []byte, c Compressor) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if c != nil {
+		if _, ok := db.compressors[c.ID()]; !ok {
+			return fmt.Errorf("compressor %d isn't registered", c.ID())
+		}
+	}
+	return db.syncWrite(db.putCompressed(k, v, c, 0))
+}
+
+// compressValue returns the value prefixed with the compressor ID,
+// or false if the value wasn't compressed.
+func (db *DB) compressValue(v []byte) ([]byte, bool, error) {
+	return compressWith(db.compressor, db.compressionMinSize, v)
+}
+
+// compressWith is like compressValue with the given compressor and minimum size.
+func compressWith(c Compressor, minSize int, v []byte) ([]byte, bool, error) {
+	if c == nil || len(v) < minSize {
+		return v, false, nil
+	}
+	compressed, err := c.Compress(v)
+	if err != nil {
+		return nil, false, fmt.Errorf("compress value: %w", err)
+	}
+	if 1+len(compressed) >= len(v) {
+		return v, false, nil
+	}
+	return append([]byte{c.ID()}, compressed...), true, nil
+}
+
+func (db *DB) decompressValue(k string, stored []byte) ([]byte, error) {
+	if len(stored) == 0 {
+		return nil, fmt.Errorf("%w: %q: missing compressor ID", ErrDecompress, k)
+	}
+	c, ok := db.compressors[stored[0]]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q: unknown compressor ID %d", ErrDecompress, k, stored[0])
+	}
+	v, err := c.Decompress(stored[1:])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q: %w", ErrDecompress, k, err)
+	}
+	return v, nil
+}
+
+// Built-in compressors
+var (
+	Gzip  Compressor = gzipCompressor{}
+	Flate Compressor = flateCompressor{}
+)
+
+func builtinCompressors() map[byte]Compressor {
+	return map[byte]Compressor{Gzip.ID(): Gzip, Flate.ID(): Flate}
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) ID() byte { return 1 }
+
+func (gzipCompressor) Compress(v []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(v); err != nil {
+		return nil, err
+	}
+	err := zw.Close()
+	return buf.Bytes(), err
+}
+
+func (gzipCompressor) Decompress(v []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(v))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(zr)
+}
+
+type flateCompressor struct{}
+
+func (flateCompressor) ID() byte { return 2 }
+
+func (flateCompressor) Compress(v []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	if _, err := zw.Write(v); err != nil {
+		return nil, err
+	}
+	err := zw.Close()
+	return buf.Bytes(), err
+}
+
+func (flateCompressor) Decompress(v []byte) ([]byte, error) {
+	return io.ReadAll(flate.NewReader(bytes.NewReader(v)))
+}
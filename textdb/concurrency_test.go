@@ -0,0 +1,559 @@
+package textdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestConcurrentUse is meant to be run with -race.
+func TestConcurrentUse(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const writers, keysPerWriter = 8, 200
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < keysPerWriter; i++ {
+				k := fmt.Sprintf("w%d-%d", w, i)
+				var err error
+				switch i % 4 {
+				case 0:
+					err = db.Set(k)
+				case 3:
+					if err = db.Put(k, []byte("old")); err == nil {
+						err = db.Delete(k)
+					}
+				default:
+					err = db.Put(k, []byte(k))
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	// Readers and compactions run along the writers
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func(r int) {
+			defer readers.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				k := fmt.Sprintf("w%d-%d", i%writers, i%keysPerWriter)
+				if v, err := db.Get(k); err == nil && len(v) > 0 && !bytes.Equal(v, []byte(k)) && string(v) != "old" {
+					t.Errorf("get %q: got %q", k, v)
+					return
+				}
+				db.Exists(k)
+				if r == 0 && i%500 == 0 {
+					if err := db.Compact(); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+				if r == 1 && i%100 == 0 {
+					db.Keys()
+				}
+			}
+		}(r)
+	}
+	wg.Wait()
+	close(stop)
+	readers.Wait()
+
+	check := func(db *DB) {
+		t.Helper()
+		for w := 0; w < writers; w++ {
+			for i := 0; i < keysPerWriter; i++ {
+				k := fmt.Sprintf("w%d-%d", w, i)
+				v, err := db.Get(k)
+				switch i % 4 {
+				case 0:
+					if err != nil || len(v) != 0 {
+						t.Fatalf("get %q: got %q, %v, want an empty value", k, v, err)
+					}
+				case 3:
+					if err == nil {
+						t.Fatalf("get %q: got %q, want a deleted key", k, v)
+					}
+				default:
+					if err != nil || string(v) != k {
+						t.Fatalf("get %q: got %q, %v, want %q", k, v, err, k)
+					}
+				}
+			}
+		}
+		if n, want := len(db.Keys()), writers*keysPerWriter*3/4; n != want {
+			t.Fatalf("got %d keys, want %d", n, want)
+		}
+	}
+	check(db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(db)
+}
+
+// TestConcurrentUseWithOptions runs mixed operations with the options adding state shared by readers
+// (value cache, spilled index, read handles, write buffer). It's meant to be run with -race.
+func TestConcurrentUseWithOptions(t *testing.T) {
+	for _, opts := range [][]Option{
+		{WithValueCache(1 << 10), WithIndexMemoryLimit(2000), WithReadHandles(4)},
+		{WithWriteBuffer(WriteBuffer{MaxRecords: 10, Interval: time.Millisecond}), WithCompression(Gzip, 4), WithPassphrase("passphrase")},
+	} {
+		db, err := Open(filepath.Join(t.TempDir(), "test.db"), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < 300; i++ {
+					k := fmt.Sprint("k", (g*7+i)%50)
+					var err error
+					switch i % 4 {
+					case 0:
+						err = db.Put(k, []byte(k+"-value"))
+					case 1:
+						var v []byte
+						if v, err = db.Get(k); err == nil && string(v) != k+"-value" {
+							err = fmt.Errorf("get %q: got %q", k, v)
+						}
+					case 2:
+						err = db.Scan("k1", func(string, []byte) error { return nil })
+						db.Exists(k)
+						var view *View
+						if view, err = db.GetView(k); err == nil {
+							view.Release()
+						}
+					case 3:
+						if g%2 == 0 {
+							err = db.Delete(k)
+						} else {
+							_, err = db.PutBlob([]byte(k))
+						}
+					}
+					if err != nil && !errors.Is(err, ErrKeyNotFound) {
+						t.Error(err)
+						return
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestManager(t *testing.T) {
+	m, err := NewManager(t.TempDir(), ManagerConfig{IdleTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const workers, writes = 8, 200
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < writes; j++ {
+				err := m.Do(fmt.Sprint("db", i%3), func(db *DB) error { return db.Put(fmt.Sprint(i, "-", j), nil) })
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if names, err := m.Names(); err != nil || fmt.Sprint(names) != "[db0 db1 db2]" {
+		t.Fatalf("got %v, %v", names, err)
+	}
+	if s, err := m.Stats(); err != nil || s.Databases != 3 || s.Open != 3 || s.Keys != workers*writes {
+		t.Fatalf("got %+v, %v, want 3 open databases", s, err)
+	}
+
+	// Idle databases are closed, and opened again when used
+	time.Sleep(150 * time.Millisecond)
+	if s, err := m.Stats(); err != nil || s.Open != 0 {
+		t.Fatalf("got %+v, %v, want the idle databases closed", s, err)
+	}
+	err = m.Do("db0", func(db *DB) error {
+		if keys := db.Keys(); len(keys) != 3*writes {
+			return fmt.Errorf("got %d keys, want %d", len(keys), 3*writes)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Do("../escape", func(*DB) error { return nil }); err == nil {
+		t.Fatal("used a name outside of the directory")
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Do("db0", func(*DB) error { return nil }); !errors.Is(err, ErrManagerClosed) {
+		t.Fatalf("got %v, want %v", err, ErrManagerClosed)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// A nil old value means the key must be missing, a nil new value deletes it
+	if ok, err := db.CompareAndSwap("lock", nil, []byte("a")); err != nil || !ok {
+		t.Fatalf("got %v, %v, want the missing key created", ok, err)
+	}
+	if ok, err := db.CompareAndSwap("lock", nil, []byte("b")); err != nil || ok {
+		t.Fatalf("got %v, %v, want the existing key kept", ok, err)
+	}
+	if ok, err := db.CompareAndSwap("lock", []byte("b"), nil); err != nil || ok {
+		t.Fatalf("got %v, %v, want a different value kept", ok, err)
+	}
+	if ok, err := db.CompareAndSwap("lock", []byte("a"), nil); err != nil || !ok || db.Exists("lock") {
+		t.Fatalf("got %v, %v, want the key deleted", ok, err)
+	}
+
+	// Concurrent increments don't lose updates
+	if err := db.Put("n", []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+	const workers, increments = 8, 100
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				for {
+					v, err := db.Get("n")
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					n, err := strconv.Atoi(string(v))
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					ok, err := db.CompareAndSwap("n", v, []byte(strconv.Itoa(n+1)))
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if ok {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if v, err := db.Get("n"); err != nil || string(v) != strconv.Itoa(workers*increments) {
+		t.Fatalf("got %q, %v, want %d", v, err, workers*increments)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CompareAndSwap("n", nil, nil); !errors.Is(err, ErrClosed) {
+		t.Fatalf("got %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestAutoCompaction(t *testing.T) {
+	for i, opts := range [][]Option{
+		nil,
+		{WithHMACChain([]byte("secret"))},
+		{WithFormat(FormatBinary)},
+		{WithEncryptionKey(make([]byte, 32))},
+		{WithWriteBuffer(WriteBuffer{MaxBytes: 1024})},
+		{WithIndexMemoryLimit(256)},
+		{WithCompression(gzipCompressor{}, 10)},
+	} {
+		fpath := filepath.Join(t.TempDir(), "test.db")
+		auto := WithAutoCompaction(AutoCompaction{DeadRatio: 0.5, CheckInterval: 5 * time.Millisecond})
+		db, err := Open(fpath, append([]Option{auto}, opts...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		const workers, writes = 4, 1000
+		want := make(map[string][]byte)
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for j := 0; j < writes; j++ {
+					k := fmt.Sprintf("w%d-k%d", w, j%50)
+					if j%7 == 0 {
+						if err := db.Delete(k); err != nil {
+							t.Error(err)
+							return
+						}
+						mu.Lock()
+						delete(want, k)
+						mu.Unlock()
+						continue
+					}
+					v := []byte(fmt.Sprintf("value-%d-%d-%s", w, j, bytes.Repeat([]byte("x"), 24)))
+					if err := db.Put(k, v); err != nil {
+						t.Error(err)
+						return
+					}
+					mu.Lock()
+					want[k] = v
+					mu.Unlock()
+				}
+			}(w)
+		}
+		wg.Wait()
+		time.Sleep(50 * time.Millisecond)
+		if s := db.CompactionStats(); s.Runs == 0 || s.BytesReclaimed == 0 || s.LastErr != nil {
+			t.Fatalf("options %d: got %+v, want the database compacted in the background", i, s)
+		}
+		checkValues(t, db, want)
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		db, err = Open(fpath, opts...)
+		if err != nil {
+			t.Fatalf("options %d: %v", i, err)
+		}
+		checkValues(t, db, want)
+		if db.hmacKey != nil {
+			if err := db.Verify(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBackupConcurrentWrites(t *testing.T) {
+	dir := t.TempDir()
+	key := []byte("secret")
+	db, err := Open(filepath.Join(dir, "test.db"), WithWriteBuffer(WriteBuffer{}), WithHMACChain(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	const writes = 1000
+	for i := 0; i < writes; i++ {
+		if err := db.Put(fmt.Sprint(i), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < writes; i++ {
+			if err := db.Put(fmt.Sprint("w", i), []byte("v")); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	dst := filepath.Join(dir, "backup.db")
+	if err := db.BackupToFile(dst); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	// The backup is a consistent prefix of the file, with its buffered rows
+	backup, err := Open(dst, WithHMACChain(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+	if err := backup.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := backup.Get(fmt.Sprint(writes - 1)); err != nil || string(v) != "v" {
+		t.Fatalf("got %q, %v, want the writes before the backup", v, err)
+	}
+}
+
+func TestSharded(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenSharded(dir, ShardConfig{Shards: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const workers, writes = 8, 200
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				if err := s.Put(fmt.Sprintf("k%d-%03d", w, i), []byte("v")); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if err := s.Delete("k0-000"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The number of shards is stored, and can't change
+	if s, err := OpenSharded(dir, ShardConfig{Shards: 4}); err == nil {
+		s.Close()
+		t.Fatal("opened the shards with a different number of shards")
+	}
+	s, err = OpenSharded(dir, ShardConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := s.Shards(); n != 3 {
+		t.Fatalf("got %d shards, want 3", n)
+	}
+	// Keys and scans merge the shards in order
+	if keys := s.Keys(); len(keys) != workers*writes-1 || keys[0] != "k0-001" {
+		t.Fatalf("got %d keys, want %d from k0-001", len(keys), workers*writes-1)
+	}
+	n := 0
+	err = s.Scan("k7-", func(k string, v []byte) error {
+		n++
+		return nil
+	})
+	if err != nil || n != writes {
+		t.Fatalf("got %d keys, %v, want %d", n, err, writes)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("k1-001"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("got %v, want %v", err, ErrClosed)
+	}
+	if err := s.Close(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("got %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	for _, delay := range []time.Duration{0, time.Millisecond} {
+		fpath := filepath.Join(t.TempDir(), "test.db")
+		db, err := Open(fpath, WithGroupCommit(delay))
+		if err != nil {
+			t.Fatal(err)
+		}
+		const workers, writes = 32, 50
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < writes; i++ {
+					if err := db.Put(fmt.Sprintf("k%d-%d", w, i), []byte("v")); err != nil {
+						t.Error(err)
+						return
+					}
+					// Compactions replace the file while writes wait for their sync
+					if w == 0 && i == writes/2 {
+						if err := db.Compact(); err != nil {
+							t.Error(err)
+						}
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+		db.mu.RLock()
+		synced, written := db.syncedOffset, db.wIndex
+		db.mu.RUnlock()
+		if synced != written {
+			t.Fatalf("delay %v: got %d bytes synced, want %d once the writes returned", delay, synced, written)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		db, err = Open(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := len(db.Keys()); n != workers*writes {
+			t.Fatalf("delay %v: got %d keys, want %d", delay, n, workers*writes)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkGetParallel compares concurrent reads through one file handle and through several (see WithReadHandles).
+func BenchmarkGetParallel(b *testing.B) {
+	for _, handles := range []int{1, 8} {
+		b.Run(fmt.Sprintf("handles=%d", handles), func(b *testing.B) {
+			db, err := Open(filepath.Join(b.TempDir(), "test.db"), WithReadHandles(handles))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			const keys = 1000
+			for i := 0; i < keys; i++ {
+				if err := db.Put(fmt.Sprint(i), bytes.Repeat([]byte("v"), 128)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.SetParallelism(64)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					if _, err := db.Get(fmt.Sprint(i % keys)); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
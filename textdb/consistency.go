@@ -0,0 +1,60 @@
+package textdb
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ejuju/go-db-playground/textdb/record"
+)
+
+var ErrInconsistent = errors.New("file doesn't match the write offset")
+
+// Rows appended between two consistency checks.
+const consistencyCheckInterval = 1024
+
+// checkConsistency verifies that the file ends where the next row is expected to be appended,
+// and that its last row is terminated (in the text formats). Otherwise (e.g. the file was modified by another process),
+// appending would write rows at offsets that don't match the index,
+// so writes are refused until the database is reopened.
+func (db *DB) checkConsistency() error {
+	db.rowsSinceCheck = 0
+	if db.tornTail {
+		return nil // checked once the partial row is truncated
+	}
+	expected := int64(db.wIndex)
+	if db.bw != nil {
+		expected = db.bw.flushedOffset()
+	}
+	info, err := db.r.Stat()
+	if err != nil {
+		return fmt.Errorf("check consistency: %w", err)
+	}
+	if info.Size() != expected {
+		db.inconsistent = fmt.Errorf("%w: file size is %d, expected %d", ErrInconsistent, info.Size(), expected)
+		return db.inconsistent
+	}
+	if expected == 0 || db.rowFormat() == record.Binary {
+		return nil // binary rows have no terminator
+	}
+	last := make([]byte, 1)
+	if _, err := db.r.ReadAt(last, expected-1); err != nil {
+		return fmt.Errorf("check consistency: %w", err)
+	}
+	if last[0] != '\n' {
+		db.inconsistent = fmt.Errorf("%w: last row isn't terminated", ErrInconsistent)
+		return db.inconsistent
+	}
+	return nil
+}
+
+// checkBeforeWrite refuses writes once an inconsistency was found and runs periodic checks.
+func (db *DB) checkBeforeWrite() error {
+	if db.inconsistent != nil {
+		return db.inconsistent
+	}
+	db.rowsSinceCheck++
+	if db.rowsSinceCheck < consistencyCheckInterval {
+		return nil
+	}
+	return db.checkConsistency()
+}
@@ -0,0 +1,109 @@
+package textdb
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// The Context variants return the error of the context once it's done.
+// Short operations only check it before starting, long ones also check it as they go.
+
+func (db *DB) GetContext(ctx context.Context, k string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return db.Get(k)
+}
+
+func (db *DB) PutContext(ctx context.Context, k string, v []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return db.Put(k, v)
+}
+
+// ForEachContext is like ForEach but stops between keys once the context is done.
+func (db *DB) ForEachContext(ctx context.Context, fn func(k string, v []byte) error) error {
+	return db.ForEach(contextVisitor(ctx, fn))
+}
+
+// ScanContext is like Scan but stops between keys once the context is done.
+func (db *DB) ScanContext(ctx context.Context, prefix string, fn func(k string, v []byte) error) error {
+	return db.Scan(prefix, contextVisitor(ctx, fn))
+}
+
+func contextVisitor(ctx context.Context, fn func(k string, v []byte) error) func(k string, v []byte) error {
+	return func(k string, v []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fn(k, v)
+	}
+}
+
+// CompactContext is like Compact but compacts like WithAutoCompaction: reads and writes
+// only wait while the files are swapped. It stops copying rows once the context is done.
+func (db *DB) CompactContext(ctx context.Context) error {
+	db.mu.Lock()
+	switch {
+	case db.closed:
+		db.mu.Unlock()
+		return ErrClosed
+	case db.readOnly:
+		db.mu.Unlock()
+		return ErrReadOnly
+	case db.unnamed:
+		db.mu.Unlock()
+		return errors.New("compact: not supported for unnamed files")
+	case db.compacting:
+		db.mu.Unlock()
+		return errors.New("compact: a background compaction is running")
+	}
+	db.compacting = true
+	db.mu.Unlock()
+
+	err := db.compactOnline(ctx.Err)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.compacting = false
+	if err == nil {
+		err = db.saveHint()
+	}
+	return db.audit(AuditCompact, "online", err)
+}
+
+// GetReaderContext is like GetReader but reading fails once the context is done.
+func (db *DB) GetReaderContext(ctx context.Context, k string) (io.ReadCloser, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	rc, size, err := db.GetReader(k)
+	if err != nil {
+		return nil, 0, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{contextReader{ctx, rc}, rc}, size, nil
+}
+
+// PutReaderContext is like PutReader but stops reading r once the context is done, writing nothing.
+func (db *DB) PutReaderContext(ctx context.Context, k string, r io.Reader, size int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return db.PutReader(k, contextReader{ctx, r}, size)
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
@@ -1,246 +1,819 @@
 package textdb
 
 import (
-	"bufio"
+	"crypto/cipher"
 	"errors"
 	"fmt"
 	"io"
-	"math"
 	"os"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ejuju/go-db-playground/textdb/record"
 )
 
+// DB is safe for concurrent use: writes are serialized and exclude reads,
+// reads run concurrently with each other.
 type DB struct {
-	r      *os.File
+	mu sync.RWMutex // guards the index, the metadata and the write path
+
+	fs     FileSystem
+	fpath  string
+	r      File
+	wf     File
 	w      io.Writer
 	wIndex int
-	keys   map[string]*ref
-}
+	keys   index
+	meta   map[string]string
+	lockf  *os.File
+	closed bool
+
+	format    FormatVersion
+	dataStart int // offset of the first row, after the file header
+
+	readOnly    bool
+	fileMode    os.FileMode
+	maxKeyLen   int
+	maxValueLen int
+	validation  Validation
+
+	indexDir string       // directory of the spilled index, next to the file by default
+	cleanup  func() error // called once closed
+	unnamed  bool         // the file has no name (see NewTempDB) so it can't be replaced
+
+	lazyChecksums bool
+	repair        bool // sideline a partial last row instead of failing to open
+	hintFile      bool // load and write a snapshot of the index next to the file
+	auditTrail    bool // record administrative operations next to the file
+
+	syncPolicy   SyncPolicy
+	syncInterval time.Duration
+	groupDelay   time.Duration
+	group        groupCommit
+	fileGen      uint64 // incremented when the file handles are opened
+	syncedOffset int    // write offset at the last sync
+	syncErr      error  // error of the last background sync
+
+	expiries      map[string]int64 // expiration times of stored keys, in Unix nanoseconds
+	sweepInterval time.Duration
+
+	watchers map[*watcher]struct{}
+
+	autoCompaction  *AutoCompaction
+	compacting      bool // a background compaction is running
+	compactionStats CompactionStats
+
+	follow         bool // read-only, reading the rows appended by the writer
+	followInterval time.Duration
+	followErr      error // error of the last background catch-up
+
+	stop chan struct{} // closed on Close to stop background goroutines
+
+	degraded error // set when a write failed because the disk is full
+	tornTail bool  // a partially written row must be truncated before appending
+
+	inconsistent   error // set when the file doesn't match the write offset
+	rowsSinceCheck int
+
+	encryptionKeyID byte
+	encryptionKeys  map[byte][]byte
+	aeads           map[byte]cipher.AEAD
+	passphrase      string
+	encrypted       bool // the header has FlagEncrypted
+	keyProvider     KeyProvider
 
-type ref struct {
-	index int
-	width int
+	keyHashSecret []byte
+	quotas        map[string]*quotaState
+
+	writeBuffer *WriteBuffer
+	bw          *bufferedWriter
+
+	mmaps mmaps
+	cache *valueCache
+
+	compressor         Compressor
+	compressionMinSize int
+	compressors        map[byte]Compressor
+
+	indexMemoryLimit int
+	bloomRate        float64
+
+	preallocChunk int64
+	prealloc      *preallocWriter
+
+	numReadHandles int
+	readers        []File
+	nextReader     atomic.Uint32
+
+	rowsReplayed int            // see Stats
+	upTo         *RecoveryPoint // see OpenAt
+	lastSync     time.Time
+	lastWrite    time.Time
+	reads        atomic.Uint64
+	writes       atomic.Uint64
+
+	hmacKey []byte
+	lastMAC []byte
+
+	timestamps bool
+	rowTime    int64 // time of the last time row, in Unix nanoseconds
+
+	versions     bool // see WithVersions
+	versionLimit int
+
+	onReplayProgress func(ReplayProgress)
+	progress         *replayProgress // set while replaying at open
+
+	coldTier    *ColdTier      // see WithColdTier
+	coldR       File           // handle of the cold file, nil if there is none
+	pendingCold bool           // cold rows were replayed, their values are located in the cold file
+	readsMu     sync.Mutex     // guards valueReads, which is updated by reads holding the read lock
+	valueReads  map[string]int // reads of large values by stored key since the last compaction
 }
 
 const (
-	opSet    = byte('S')
-	opDelete = byte('D')
-	opPut    = byte('P')
+	opSet    = record.OpSet
+	opDelete = record.OpDelete
+	opPut    = record.OpPut
+	opMeta   = record.OpMeta
+
+	opPutCompressed = record.OpPutCompressed
+	opBatch         = record.OpBatch
+	opExpire        = record.OpExpire
+	opTime          = record.OpTime
+	opCold          = record.OpCold
+)
+
+// NewDB is like Open.
+func NewDB(fpath string, opts ...Option) (*DB, error) { return Open(fpath, opts...) }
+
+// Open opens the database file at the given path, creating it if needed.
+// If opening fails, the files and lock that were acquired are released.
+func Open(fpath string, opts ...Option) (*DB, error) {
+	db := &DB{
+		fs:          osFS{},
+		fpath:       fpath,
+		fileMode:    os.ModePerm,
+		maxKeyLen:   maxKeySize,
+		maxValueLen: maxValueSize,
+		meta:        make(map[string]string),
+		compressors: builtinCompressors(),
+	}
+	for _, opt := range opts {
+		opt(db)
+	}
+	if err := db.lock(fpath); err != nil {
+		return nil, err
+	}
+	if err := db.open(); err != nil {
+		db.abortOpen()
+		return nil, err
+	}
+	db.startPeriodicSync()
+	db.startExpirySweep()
+	db.startFollowing()
+	db.startAutoCompaction()
+	return db, nil
+}
 
-	kPrefix = byte(' ')
-	rowEnd  = byte('\n')
+func (db *DB) open() error {
+	if err := db.initIndex(); err != nil {
+		return err
+	}
+	if db.onReplayProgress != nil {
+		db.progress = &replayProgress{fn: db.onReplayProgress}
+	}
+	err := db.openFiles()
+	db.progress = nil
+	if err != nil {
+		return err
+	}
+	if err := db.checkConsistency(); err != nil && db.inconsistent == nil {
+		return err
+	}
 
-	vLenPrefix = byte(' ')
-	vPrefix    = byte(' ')
-)
+	isNew := db.wIndex == db.dataStart
+	if err := db.initHashedKeys(isNew); err != nil {
+		return err
+	}
+	if err := db.initQuotas(); err != nil {
+		return err
+	}
+	db.purgeExpired()
+	if err := db.initKeyProvider(); err != nil {
+		return err
+	}
+	if err := db.initPassphrase(isNew); err != nil {
+		return err
+	}
+	if err := db.initEncryption(); err != nil {
+		return err
+	}
+	if db.validation == ValidateAll {
+		return db.validateAll()
+	}
+	return nil
+}
 
-func NewDB(fpath string) (*DB, error) {
-	db := &DB{keys: make(map[string]*ref)}
-	var err error
+// abortOpen releases what was acquired by a failed open.
+func (db *DB) abortOpen() {
+	if db.bw != nil {
+		db.bw.Close()
+	}
+	db.mmaps.close()
+	if db.prealloc != nil {
+		db.prealloc.release()
+	}
+	for _, f := range []File{db.wf, db.r, db.coldR} {
+		if f != nil {
+			f.Close()
+		}
+	}
+	db.closeReadHandles()
+	if db.keys != nil {
+		db.keys.close()
+	}
+	db.unlock()
+}
+
+// initIndex creates an empty index.
+func (db *DB) initIndex() error {
+	if db.indexMemoryLimit == 0 {
+		db.keys = newKeydir()
+	} else {
+		var err error
+		switch {
+		case db.indexDir != "":
+		case db.readOnly || db.follow:
+			// The directory next to the file is the writer's, which removes it at open
+			if db.indexDir, err = os.MkdirTemp("", "textdb-*.index"); err != nil {
+				return err
+			}
+		default:
+			db.indexDir = db.fpath + ".index"
+		}
+		if db.keys, err = newSpillIndex(db.indexDir, db.indexMemoryLimit, db.bloomRate); err != nil {
+			return err
+		}
+	}
+	if db.versions {
+		db.keys = newVersionedIndex(db.keys, db.versionLimit)
+	}
+	return nil
+}
+
+// openFiles opens the file handles, loads the index from the file and sets up the writer.
+func (db *DB) openFiles() error {
+	if err := db.openHandles(); err != nil {
+		return err
+	}
+
+	// Extract existing data from file
+	fi, err := db.r.Stat()
+	if err != nil {
+		return err
+	}
+	if err := db.initHeader(fi.Size()); err != nil {
+		return err
+	}
+	db.wIndex = db.dataStart
+	db.lastWrite = fi.ModTime()
+	if db.hintFile && !db.unnamed {
+		if _, err := db.loadHint(fi.Size()); err != nil {
+			return err
+		}
+	}
+	src, size := db.replaySource(fi.Size())
+	if _, err := src.Seek(int64(db.wIndex), io.SeekStart); err != nil {
+		return err
+	}
+	db.rowsReplayed = 0
+	if db.progress != nil {
+		db.progress.total, db.progress.lastReport = fi.Size(), db.wIndex
+	}
+	batch, torn, err := db.replay(db.recordReader(src, size), false)
+	if err != nil {
+		return err
+	}
+	if batch != nil {
+		// The last batch wasn't fully written, none of its rows are applied
+		if !db.readOnly {
+			if err := db.wf.Truncate(int64(batch.offset)); err != nil {
+				return fmt.Errorf("truncate incomplete batch: %w", err)
+			}
+		}
+		db.wIndex, db.lastMAC = batch.offset, batch.prevMAC
+	} else if torn && !db.readOnly {
+		if err := db.sidelineTail(int64(db.wIndex), fi.Size()); err != nil {
+			return err
+		}
+	}
+	db.reportProgress(true)
+	db.initWriter()
+	return db.openCold()
+}
 
+// openHandles opens the read and write handles of the file.
+func (db *DB) openHandles() error {
 	// Open read-only file handle and create if needed
-	db.r, err = os.OpenFile(fpath, os.O_RDONLY|os.O_CREATE, os.ModePerm)
+	flag := os.O_RDONLY | os.O_CREATE
+	if db.readOnly {
+		flag = os.O_RDONLY
+	}
+	db.fileGen++
+	var err error
+	db.r, err = db.fs.OpenFile(db.fpath, flag, db.fileMode)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	// Open write-only file handle in append mode
-	db.w, err = os.OpenFile(fpath, os.O_WRONLY|os.O_APPEND, os.ModePerm)
-	if err != nil {
-		return nil, err
+	if !db.readOnly {
+		db.wf, err = db.fs.OpenFile(db.fpath, os.O_WRONLY|os.O_APPEND, db.fileMode)
+		if err != nil {
+			return err
+		}
+		db.w = failpointWriter{db.wf}
 	}
 
-	// Extract existing data from file
-	bufr := bufio.NewReader(db.r)
+	// Open additional read handles
+	return db.openReadHandles(db.fpath)
+}
+
+// initWriter wraps the write handle to preallocate and buffer as configured.
+func (db *DB) initWriter() {
+	if f, ok := db.wf.(*os.File); ok && db.preallocChunk > 0 {
+		db.prealloc = &preallocWriter{f: f, w: db.w, offset: int64(db.wIndex), allocated: int64(db.wIndex), chunk: db.preallocChunk}
+		db.w = db.prealloc
+	}
+	if db.writeBuffer != nil && !db.readOnly {
+		db.bw = newBufferedWriter(db.w, *db.writeBuffer, int64(db.wIndex))
+		db.w = db.bw
+	}
+}
+
+// replay applies the rows read from the write offset, which is moved past them.
+// It stops at a partial row (torn is true), which is an error unless repairing or read-only,
+// and returns the last batch if it's incomplete (its rows aren't applied).
+// If notify is true, watchers are notified of the applied rows.
+func (db *DB) replay(rr *record.Reader, notify bool) (batch *pendingBatch, torn bool, err error) {
 	numRows := 0
 	for {
-		op, err := bufr.ReadByte()
-		if errors.Is(err, io.EOF) {
+		if db.upTo != nil && db.upTo.Rows > 0 && numRows == db.upTo.Rows {
 			break
 		}
-		if err != nil {
-			return nil, err
+		r, n, err := rr.Next()
+		if errors.Is(err, io.EOF) && n == 0 {
+			break
 		}
 		numRows++
-		db.wIndex++
-
-		if !(op == opSet || op == opDelete || op == opPut) {
-			return nil, fmt.Errorf("unknown op: %q (row %d)", op, numRows)
-		}
-
-		switch op {
-		case opSet, opDelete:
-			// Read key-length (with suffix)
-			n, kLen, err := db.readLengthWithSuffix(bufr, kPrefix)
-			db.wIndex += n
-			if err != nil {
-				return nil, fmt.Errorf("read key-length: %w (row %d)", err, numRows)
+		torn = errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+		if (batch != nil || r.Op == opBatch) && torn {
+			// Torn row of an incomplete batch
+			if batch == nil {
+				batch = &pendingBatch{offset: db.wIndex, prevMAC: db.lastMAC}
 			}
+			break
+		}
+		if torn && (db.repair || db.readOnly) {
+			break
+		}
+		if err != nil {
+			return nil, false, &CorruptRecordError{Row: numRows, Offset: int64(db.wIndex), Err: err}
+		}
 
-			// Read key (with row-end)
-			kWithRowEnd := make([]byte, kLen+1)
-			n, err = io.ReadFull(bufr, kWithRowEnd)
-			db.wIndex += n
-			if err != nil {
-				return nil, fmt.Errorf("read key and row-end: %w (row %d)", err, numRows)
-			}
-			k := string(kWithRowEnd[:kLen])
-
-			// Remove key from refs
-			if op == opDelete {
-				delete(db.keys, k)
-			} else {
-				db.keys[k] = nil
+		switch {
+		case r.Op == opBatch:
+			if batch != nil {
+				return nil, false, fmt.Errorf("batch header in a batch (row %d)", numRows)
 			}
-		case opPut:
-			// Read key-length (with suffix)
-			n, kLen, err := db.readLengthWithSuffix(bufr, vLenPrefix)
-			db.wIndex += n
+			batch, err = newPendingBatch(r.Key, db.wIndex, db.lastMAC)
 			if err != nil {
-				return nil, fmt.Errorf("read key-length: %w (row %d)", err, numRows)
+				return nil, false, fmt.Errorf("%w (row %d)", err, numRows)
 			}
-
-			// Read value-length (with suffix)
-			n, vLen, err := db.readLengthWithSuffix(bufr, kPrefix)
-			db.wIndex += n
-			if err != nil {
-				return nil, fmt.Errorf("read value-length: %w (row %d)", err, numRows)
+		case batch != nil:
+			batch.rows = append(batch.rows, pendingRow{r: r, offset: db.wIndex})
+			if len(batch.rows) == batch.size {
+				for _, row := range batch.rows {
+					db.applyRecord(row.r, row.offset)
+					if notify {
+						db.notifyRecord(row.r, row.offset)
+					}
+				}
+				batch = nil
 			}
-
-			// Read key (with suffix)
-			kWithSuffix := make([]byte, kLen+1)
-			n, err = io.ReadFull(bufr, kWithSuffix)
-			db.wIndex += n
-			if err != nil {
-				return nil, fmt.Errorf("read key: %w (row %d)", err, numRows)
+		default:
+			db.applyRecord(r, db.wIndex)
+			if notify {
+				db.notifyRecord(r, db.wIndex)
 			}
-			k := string(kWithSuffix[:kLen])
+		}
+		db.wIndex += n
+		db.lastMAC = r.MAC
+		db.rowsReplayed++
+		db.reportProgress(false)
+	}
+	return batch, torn, nil
+}
 
-			// Read value (with suffix)
-			valueStartIndex := db.wIndex
-			vWithRowEnd := make([]byte, vLen+1)
-			n, err = io.ReadFull(bufr, vWithRowEnd)
-			db.wIndex += n
-			if err != nil {
-				return nil, fmt.Errorf("read value: %w (row %d)", err, numRows)
-			}
-			v := vWithRowEnd[:vLen]
+// applyRecord updates the index (or metadata) with a row read at the given offset.
+func (db *DB) applyRecord(r record.Record, offset int) {
+	switch r.Op {
+	case opSet:
+		db.uncache(r.Key) // when catching up
+		db.keys.set(r.Key, keyOnly)
+		delete(db.expiries, r.Key)
+	case opDelete:
+		db.uncache(r.Key)
+		db.keys.delete(r.Key)
+		delete(db.expiries, r.Key)
+	case opPut, opPutCompressed:
+		db.uncache(r.Key)
+		db.keys.set(r.Key, ref{index: offset + r.ValueOffset, width: r.ValueLen, compressed: r.Op == opPutCompressed})
+		delete(db.expiries, r.Key)
+	case opCold:
+		db.uncache(r.Key)
+		db.keys.set(r.Key, coldPending)
+		delete(db.expiries, r.Key)
+		db.pendingCold = true
+	case opExpire:
+		db.setExpiry(r.Key, r.Value)
+	case opMeta:
+		db.meta[r.Key] = string(r.Value)
+	case opTime:
+		db.rowTime, _ = strconv.ParseInt(string(r.Value), 10, 64)
+	}
+}
 
-			// Record key ref
-			db.keys[k] = &ref{index: valueStartIndex, width: len(v)}
+// closeFiles flushes buffered rows, syncs the file and closes the file handles.
+func (db *DB) closeFiles() error {
+	var flushErr error
+	if db.bw != nil {
+		flushErr = db.bw.Close()
+	}
+	db.mmaps.close()
+	var releaseErr error
+	if db.prealloc != nil {
+		releaseErr = db.prealloc.release()
+	}
+	var syncErr, closeErr error
+	if db.wf != nil {
+		if db.syncPolicy != SyncNever {
+			syncErr = db.sync()
 		}
+		closeErr = db.wf.Close()
 	}
+	return errors.Join(flushErr, releaseErr, syncErr, closeErr, db.r.Close(), db.closeReadHandles())
+}
 
-	return db, nil
+// recordReader returns a reader of rows that skips the values the index doesn't need.
+func (db *DB) recordReader(src io.ReadSeeker, size int64) *record.Reader {
+	rr := record.NewSeekingReader(src, size)
+	rr.MAC = db.hmacKey != nil
+	rr.ReadValue = func(op byte) bool { return op == opMeta || op == opExpire || op == opTime }
+	rr.SkipChecksums = db.lazyChecksums
+	rr.Format = db.rowFormat()
+	return rr
 }
 
-func (db *DB) readLengthWithSuffix(bufr *bufio.Reader, until byte) (int, int, error) {
-	lenWithSuffix, err := bufr.ReadBytes(until)
-	if err != nil {
-		return len(lenWithSuffix), 0, err
+var ErrClosed = errors.New("database is closed")
+
+// Close flushes buffered rows, syncs the file to disk (unless the sync policy is SyncNever)
+// and closes the file handles. Once closed, operations return ErrClosed (and Exists returns false).
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
 	}
-	length, err := strconv.Atoi(string(lenWithSuffix[:len(lenWithSuffix)-1]))
-	if err != nil {
-		return len(lenWithSuffix), 0, fmt.Errorf("parse integer: %w", err)
+	hintErr := db.saveHint()
+	db.closed = true
+	if db.stop != nil {
+		close(db.stop)
+	}
+	db.stopWatchers()
+	err := errors.Join(db.syncErr, db.followErr, hintErr, db.closeFiles(), db.closeCold(), db.keys.close(), db.unlock())
+	if db.cleanup != nil {
+		err = errors.Join(err, db.cleanup())
 	}
-	return len(lenWithSuffix), length, nil
+	return err
 }
 
-func (db *DB) ValidateKey(k string) error {
+func (db *DB) ValidateKey(k string) error { return validateKey(k, db.maxKeyLen) }
+
+// ValidateValue checks the size of a value, which may contain any byte (including newlines).
+func (db *DB) ValidateValue(v []byte) error { return validateValue(v, db.maxValueLen) }
+
+var (
+	ErrInvalidKey    = errors.New("invalid key")
+	ErrKeyTooLarge   = errors.New("key is too large")
+	ErrValueTooLarge = errors.New("value is too large")
+)
+
+func validateKey(k string, max int) error {
 	if len(k) == 0 {
-		return errors.New("key is empty")
+		return fmt.Errorf("%w: key is empty", ErrInvalidKey)
+	}
+	if len(k) > max {
+		return fmt.Errorf("%w: %d (max %d)", ErrKeyTooLarge, len(k), max)
 	}
-	if len(k) > math.MaxInt {
-		return fmt.Errorf("key is too large: %d (max %d)", len(k), math.MaxInt)
+	return nil
+}
+
+func validateValue(v []byte, max int) error {
+	if len(v) > max {
+		return fmt.Errorf("%w: %d (max %d)", ErrValueTooLarge, len(v), max)
 	}
 	return nil
 }
 
+// Set writes the key without value: it exists (see Exists) and has an empty value, unlike a missing key.
+// Use Put to store a value.
 func (db *DB) Set(k string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.syncWrite(db.set(k))
+}
+
+func (db *DB) set(k string) error {
+	if err := db.ValidateKey(k); err != nil {
+		return err
+	}
+	k = db.hashKey(k)
+	delta := db.quotaDelta(k, 0, false)
+	if err := db.checkQuota(k, delta); err != nil {
+		return err
+	}
 	err := db.writeKeyOnlyRow(opSet, k)
 	if err != nil {
 		return err
 	}
-	db.keys[k] = nil
+	db.keys.set(k, keyOnly)
+	delete(db.expiries, k)
+	db.uncache(k)
+	db.addUsage(k, delta)
+	db.notify(EventSet, k, nil)
 	return nil
 }
 
 func (db *DB) Delete(k string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.syncWrite(db.delete(k))
+}
+
+func (db *DB) delete(k string) error {
+	if err := db.ValidateKey(k); err != nil {
+		return err
+	}
+	k = db.hashKey(k)
+	delta := db.quotaDelta(k, 0, true)
 	err := db.writeKeyOnlyRow(opDelete, k)
 	if err != nil {
 		return err
 	}
-	delete(db.keys, k)
+	db.keys.delete(k)
+	delete(db.expiries, k)
+	db.uncache(k)
+	db.addUsage(k, delta)
+	db.notify(EventDelete, k, nil)
 	return nil
 }
 
 func (db *DB) writeKeyOnlyRow(op byte, k string) error {
-	if err := db.ValidateKey(k); err != nil {
+	if err := db.writeTime(); err != nil {
+		return err
+	}
+	buf := getBuffer(0)
+	row := db.rowFormat().AppendBody(*buf, op, k, nil)
+	return db.writeAndIncrementOffset(buf, row)
+}
+
+// writeAndIncrementOffset terminates the row (with its MAC if enabled) and appends it to the file.
+// The row is built in the given pooled buffer, which is released once written.
+func (db *DB) writeAndIncrementOffset(buf *[]byte, row []byte) error {
+	defer func() { putBuffer(buf, row) }()
+	if err := db.prepareWrite(); err != nil {
 		return err
 	}
-	var row []byte
-	row = append(row, op)
-	row = append(row, strconv.Itoa(len(k))...)
-	row = append(row, kPrefix)
-	row = append(row, k...)
-	row = append(row, rowEnd)
+	mac := db.rowMAC(row)
+	row = db.rowFormat().AppendEnd(row, 0, mac)
+	return db.appendRows(row, mac)
+}
 
-	return db.writeAndIncrementOffset(row)
+// prepareWrite checks that rows can be appended.
+func (db *DB) prepareWrite() error {
+	if db.closed {
+		return ErrClosed
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if err := db.truncateTornTail(); err != nil {
+		return err
+	}
+	return db.checkBeforeWrite()
 }
 
-func (db *DB) writeAndIncrementOffset(b []byte) error {
-	n, err := db.w.Write(b)
+// appendRows appends terminated rows in a single write, mac is the MAC of the last one.
+func (db *DB) appendRows(rows, mac []byte) error {
+	n, err := db.w.Write(rows)
+	if err != nil {
+		return db.writeFailed(n, err)
+	}
 	db.wIndex += n
-	return err
+	db.lastMAC = mac
+	db.degraded = nil
+	db.writes.Add(1)
+	db.lastWrite = time.Now()
+	return nil
 }
 
+// Put writes the key with the value, which may be empty.
 func (db *DB) Put(k string, v []byte) error {
-	vStartIndex, err := db.writeKeyValueRow(k, v)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.syncWrite(db.put(k, v))
+}
+
+func (db *DB) put(k string, v []byte) error {
+	return db.putCompressed(k, v, db.compressor, db.compressionMinSize)
+}
+
+// putCompressed is like put with the given compressor and minimum size to compress values.
+func (db *DB) putCompressed(k string, v []byte, c Compressor, minSize int) error {
+	if err := db.ValidateKey(k); err != nil {
+		return err
+	}
+	if err := db.ValidateValue(v); err != nil {
+		return err
+	}
+	k = db.hashKey(k)
+	value := v
+	v, compressed, err := compressWith(c, minSize, v)
 	if err != nil {
 		return err
 	}
-	db.keys[k] = &ref{index: vStartIndex, width: len(v)}
+	op := opPut
+	if compressed {
+		op = opPutCompressed
+	}
+	v, err = db.encryptValue(op, k, v)
+	if err != nil {
+		return err
+	}
+	if len(v) > maxValueSize {
+		return fmt.Errorf("%w: %d (max %d)", ErrValueTooLarge, len(v), maxValueSize)
+	}
+	delta := db.quotaDelta(k, len(v), false)
+	if err := db.checkQuota(k, delta); err != nil {
+		return err
+	}
+	vStartIndex, err := db.writeKeyValueRow(op, k, v)
+	if err != nil {
+		return err
+	}
+	db.keys.set(k, ref{index: vStartIndex, width: len(v), compressed: compressed})
+	delete(db.expiries, k)
+	db.uncache(k)
+	db.addUsage(k, delta)
+	db.notify(EventPut, k, copyOf(value))
 	return nil
 }
 
-func (db *DB) writeKeyValueRow(k string, v []byte) (int, error) {
-	if err := db.ValidateKey(k); err != nil {
-		return 0, err
+// putMeta records database metadata (not visible as a key).
+func (db *DB) putMeta(k, v string) error {
+	_, err := db.writeKeyValueRow(opMeta, k, []byte(v))
+	if err != nil {
+		return err
 	}
+	db.meta[k] = v
+	return nil
+}
 
-	var row []byte
-	row = append(row, opPut)
-	row = append(row, strconv.Itoa(len(k))...)
-	row = append(row, vLenPrefix)
-	row = append(row, strconv.Itoa(len(v))...)
-	row = append(row, kPrefix)
-	row = append(row, k...)
-	row = append(row, vPrefix)
-	vStartIndex := len(row)
-	row = append(row, v...)
-	row = append(row, rowEnd)
-
-	return vStartIndex, db.writeAndIncrementOffset(row)
+func (db *DB) writeKeyValueRow(op byte, k string, v []byte) (int, error) {
+	if err := db.writeTime(); err != nil {
+		return 0, err
+	}
+	buf := getBuffer(0)
+	row := db.rowFormat().AppendBody(*buf, op, k, v)
+	vStartIndex := db.wIndex + len(row) - len(v)
+	return vStartIndex, db.writeAndIncrementOffset(buf, row)
 }
 
+// Get returns the value of the key, or ErrKeyNotFound if it doesn't exist.
+// Keys written without value (see Set) have an empty value.
 func (db *DB) Get(k string) ([]byte, error) {
-	ref, ok := db.keys[k]
-	if !ok {
-		return nil, nil
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	v, err := db.get(k)
+	if v == nil && err == nil {
+		return notFoundOrEmpty(k, db.exists(k))
 	}
-	v := make([]byte, ref.width)
-	_, err := db.r.ReadAt(v, int64(ref.index))
 	return v, err
 }
 
-var ErrKeyNotFound = errors.New("key not found")
-
-func (db *DB) Find(k string) ([]byte, error) {
+// Lookup is like Get but reports whether the key exists instead of returning ErrKeyNotFound:
+// a missing key has a nil value, a key without value (see Set) an empty one.
+func (db *DB) Lookup(k string) ([]byte, bool, error) {
 	v, err := db.Get(k)
-	if v == nil && err == nil {
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, false, nil
+	}
+	return v, err == nil, err
+}
+
+// notFoundOrEmpty is the result of Get for a key without value.
+func notFoundOrEmpty(k string, exists bool) ([]byte, error) {
+	if !exists {
 		return nil, fmt.Errorf("%w: %q", ErrKeyNotFound, k)
 	}
-	return v, err
+	return []byte{}, nil
+}
+
+func (db *DB) get(k string) ([]byte, error) {
+	k = db.hashKey(k)
+	db.countRead(k)
+	return db.getStored(k)
+}
+
+// getStored is like get given the key as stored (hashed if enabled).
+func (db *DB) getStored(k string) ([]byte, error) {
+	if db.closed {
+		return nil, ErrClosed
+	}
+	db.reads.Add(1)
+	ref, ok := db.keys.get(k)
+	if !ok || !ref.hasValue() || db.expired(k) {
+		return nil, nil
+	}
+	if db.cache == nil {
+		return db.readValue(k, ref)
+	}
+	if v, ok := db.cache.get(k, ref.index); ok {
+		return v, nil
+	}
+	v, err := db.readValue(k, ref)
+	if err != nil {
+		return nil, err
+	}
+	db.cache.add(k, ref.index, v)
+	return v, nil
+}
+
+// readValue reads (and decrypts and decompresses) the value from the file.
+func (db *DB) readValue(k string, ref ref) ([]byte, error) {
+	return db.readValueFrom(db.valueReader(ref), k, ref)
+}
+
+// readAtFunc reads len(p) bytes of the file at the given offset.
+type readAtFunc func(p []byte, off int64) error
+
+// readValueFrom is like readValue with the given read function.
+func (db *DB) readValueFrom(read readAtFunc, k string, ref ref) ([]byte, error) {
+	if db.aeads == nil && !ref.compressed {
+		v := make([]byte, ref.width)
+		err := db.readVerified(read, k, ref, v)
+		if err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+
+	// Read stored value in scratch space, decryption and decompression allocate the returned value
+	buf := getBuffer(ref.width)
+	defer putBuffer(buf, *buf)
+	err := db.readVerified(read, k, ref, *buf)
+	if err != nil {
+		return nil, err
+	}
+	if !ref.compressed {
+		return db.decryptValue(opPut, k, *buf)
+	}
+	v, err := db.decryptValue(opPutCompressed, k, *buf)
+	if err != nil {
+		return nil, err
+	}
+	return db.decompressValue(k, v)
+}
+
+var ErrKeyNotFound = errors.New("key not found")
+
+// Deprecated: Find is Get, which returns ErrKeyNotFound for missing keys.
+func (db *DB) Find(k string) ([]byte, error) { return db.Get(k) }
+
+func (db *DB) Exists(k string) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.exists(k)
 }
 
-func (db *DB) Exists(k string) bool { _, ok := db.keys[k]; return ok }
+func (db *DB) exists(k string) bool {
+	if db.closed {
+		return false
+	}
+	k = db.hashKey(k)
+	return db.keys.has(k) && !db.expired(k)
+}
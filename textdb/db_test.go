@@ -0,0 +1,3919 @@
+package textdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ejuju/go-db-playground/textdb/record"
+)
+
+func TestBinarySafeValues(t *testing.T) {
+	values := map[string][]byte{
+		"newline":          []byte("a\nb\n"),
+		"carriage\rreturn": []byte("\r\n"),
+		"nul\x00":          {0, 0, 'x', 0},
+		"row\nlike":        []byte("P1 1 k v\nD1 k\n"),
+	}
+	for _, format := range []FormatVersion{FormatChecksummed, FormatBinary} {
+		fpath := filepath.Join(t.TempDir(), "test.db")
+		db, err := Open(fpath, WithFormat(format))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range values {
+			if err := db.Put(k, v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Set("after"); err != nil {
+			t.Fatal(err)
+		}
+		check := func(db *DB) {
+			t.Helper()
+			for k, want := range values {
+				got, err := db.Get(k)
+				if err != nil {
+					t.Fatalf("format %d: get %q: %v", format, k, err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Fatalf("format %d: get %q: got %q, want %q", format, k, got, want)
+				}
+			}
+			if !db.Exists("after") {
+				t.Fatalf("format %d: the row after the values wasn't read", format)
+			}
+		}
+		check(db)
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The rows are parsed again when the file is replayed
+		db, err = Open(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(db)
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOpenDamagedLength(t *testing.T) {
+	rows := []string{
+		"S-1 x 00000000\n",
+		"P1 -3 x abc 00000000\n",
+		"P1 99999999999999 x abc 00000000\n",
+		"P-1 3 x abc 00000000\n",
+	}
+	for _, row := range rows {
+		fpath := filepath.Join(t.TempDir(), "test.db")
+		if err := os.WriteFile(fpath, []byte("#textdb 2 0\n"+row), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		for _, opts := range [][]Option{nil, {WithRepair()}} {
+			db, err := Open(fpath, opts...)
+			var corrupt *CorruptRecordError
+			if !errors.As(err, &corrupt) || !errors.Is(err, ErrCorruptRecord) {
+				if err == nil {
+					db.Close()
+				}
+				t.Fatalf("%q: got %v, want a corrupt record error", row, err)
+			}
+			if corrupt.Row != 1 {
+				t.Fatalf("%q: got row %d, want 1", row, corrupt.Row)
+			}
+		}
+	}
+}
+
+func TestStore(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, s := range []Store{db, NewMemDB()} {
+		if err := s.Put("put", nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Set("set"); err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range []string{"put", "set"} {
+			if v, err := s.Get(k); err != nil || v == nil || len(v) != 0 || !s.Exists(k) {
+				t.Fatalf("%T: got %#v, %v for %q, want an empty value", s, v, err, k)
+			}
+		}
+		if _, err := s.Find("missing"); !errors.Is(err, ErrKeyNotFound) || s.Exists("missing") {
+			t.Fatalf("%T: got %v, want %v", s, err, ErrKeyNotFound)
+		}
+		if err := s.Delete("missing"); err != nil {
+			t.Fatalf("%T: got %v deleting a missing key", s, err)
+		}
+		if err := s.Put("", nil); !errors.Is(err, ErrInvalidKey) {
+			t.Fatalf("%T: got %v, want %v", s, err, ErrInvalidKey)
+		}
+		if err := s.Delete(""); !errors.Is(err, ErrInvalidKey) {
+			t.Fatalf("%T: got %v, want %v", s, err, ErrInvalidKey)
+		}
+	}
+}
+
+func TestStoreTTL(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, s := range []TTLStore{db, NewMemDB()} {
+		if err := s.PutWithTTL("expired", []byte("v"), 20*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.PutWithTTL("overwritten", []byte("v"), 20*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Set("overwritten"); err != nil {
+			t.Fatal(err)
+		}
+		if !s.Exists("expired") {
+			t.Fatalf("%T: the key expired too early", s)
+		}
+		time.Sleep(30 * time.Millisecond)
+		if _, err := s.Get("expired"); !errors.Is(err, ErrKeyNotFound) || s.Exists("expired") {
+			t.Fatalf("%T: got %v for an expired key, want ErrKeyNotFound", s, err)
+		}
+		if v, err := s.Get("overwritten"); err != nil || len(v) != 0 {
+			t.Fatalf("%T: got %q, %v for a key set after PutWithTTL", s, v, err)
+		}
+		if err := s.Delete("expired"); err != nil {
+			t.Fatalf("%T: got %v deleting an expired key", s, err)
+		}
+	}
+}
+
+// testWrite is a write of a key, a nil value for Set and a nil write for Delete.
+type testWrite struct {
+	k     string
+	v     []byte
+	write bool
+}
+
+// checkPrefix checks that the database has the state after a prefix of the writes (all of them if all is true).
+// The key "failed" is only checked to have its value if it exists.
+func checkPrefix(t *testing.T, db *DB, writes []testWrite, all bool) {
+	t.Helper()
+	state := make(map[string][]byte)
+	for i := 0; ; i++ {
+		if (!all || i == len(writes)) && hasState(db, state) {
+			return
+		}
+		if i == len(writes) {
+			t.Fatalf("the state doesn't match a prefix of the %d acknowledged writes (all: %v)", len(writes), all)
+		}
+		if w := writes[i]; w.write {
+			state[w.k] = w.v
+		} else {
+			delete(state, w.k)
+		}
+	}
+}
+
+func hasState(db *DB, state map[string][]byte) bool {
+	n := 0
+	err := db.ForEach(func(k string, v []byte) error {
+		if k == "failed" {
+			if !bytes.Equal(v, []byte("failed value")) {
+				return fmt.Errorf("got %q for the failed write", v)
+			}
+			return nil
+		}
+		n++
+		want, ok := state[k]
+		if !ok || !bytes.Equal(v, want) || (v == nil) != (want == nil) {
+			return errors.New("mismatch")
+		}
+		return nil
+	})
+	return err == nil && n == len(state)
+}
+
+func TestFailpointRecovery(t *testing.T) {
+	errFault := errors.New("injected fault")
+	cases := []struct {
+		name  string
+		fp    Failpoint
+		opts  []Option
+		fault func(db *DB) error
+	}{
+		{
+			name:  FailpointWrite,
+			fp:    Failpoint{Err: errFault, ShortWrite: 5},
+			fault: func(db *DB) error { return db.Put("failed", []byte("failed value")) },
+		},
+		{
+			name: FailpointWrite,
+			fp:   Failpoint{Err: errFault, ShortWrite: 5},
+			opts: []Option{WithWriteBuffer(WriteBuffer{MaxRecords: 8})},
+			fault: func(db *DB) error {
+				if err := db.Put("failed", []byte("failed value")); err != nil {
+					return err
+				}
+				return db.Flush()
+			},
+		},
+		{
+			name:  FailpointSync,
+			fp:    Failpoint{Err: errFault},
+			opts:  []Option{WithSyncPolicy(SyncEveryWrite)},
+			fault: func(db *DB) error { return db.Put("failed", []byte("failed value")) },
+		},
+		{
+			name:  FailpointCompact,
+			fp:    Failpoint{Err: errFault},
+			fault: func(db *DB) error { return db.Compact() },
+		},
+	}
+	for i, c := range cases {
+		dir := t.TempDir()
+		fpath := filepath.Join(dir, "test.db")
+		db, err := Open(fpath, c.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var acked []testWrite
+		write := func(j int) {
+			k := fmt.Sprintf("k%d", j%7)
+			w := testWrite{k: k, write: j%5 != 4}
+			switch {
+			case !w.write:
+				err = db.Delete(k)
+			case j%3 == 0:
+				err = db.Set(k)
+			default:
+				w.v = []byte(fmt.Sprintf("value %d", j))
+				err = db.Put(k, w.v)
+			}
+			if err == nil {
+				acked = append(acked, w)
+			}
+		}
+		for j := 0; j < 20; j++ {
+			write(j)
+		}
+		disable := EnableFailpoint(c.name, c.fp)
+		if err := c.fault(db); !errors.Is(err, errFault) {
+			t.Fatalf("case %d (%s): got %v, want the injected fault", i, c.name, err)
+		}
+		disable()
+		for j := 20; j < 40; j++ {
+			write(j)
+		}
+
+		// A crash keeps what was written to the file
+		data, err := os.ReadFile(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		crashed := filepath.Join(dir, "crashed.db")
+		if err := os.WriteFile(crashed, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		recovered, err := Open(crashed, WithRepair())
+		if err != nil {
+			t.Fatalf("case %d (%s): open after a crash: %v", i, c.name, err)
+		}
+		checkPrefix(t, recovered, acked, false)
+		if err := recovered.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.Close(); err != nil {
+			t.Fatalf("case %d (%s): close: %v", i, c.name, err)
+		}
+		db, err = Open(fpath)
+		if err != nil {
+			t.Fatalf("case %d (%s): reopen: %v", i, c.name, err)
+		}
+		checkPrefix(t, db, acked, true)
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFailpointTimes(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	errFault := errors.New("fault")
+	disable := EnableFailpoint(FailpointWrite, Failpoint{Err: errFault, ShortWrite: 3, Times: 1})
+	defer disable()
+	if err := db.Put("b", []byte("2")); !errors.Is(err, errFault) {
+		t.Fatalf("got %v, want the fault", err)
+	}
+	// The failpoint only triggers once, the torn row is repaired before the next write
+	if err := db.Put("c", []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	disable()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkContents(t, db, map[string][]byte{"a": []byte("1"), "c": []byte("3")})
+}
+
+func TestColdTier(t *testing.T) {
+	large := func(c byte) []byte { return bytes.Repeat([]byte{c}, 200) }
+	values := map[string][]byte{"small": []byte("small value"), "a": large('a'), "b": large('b')}
+	for _, format := range []FormatVersion{FormatChecksummed, FormatBinary} {
+		dir := t.TempDir()
+		fpath := filepath.Join(dir, "test.db")
+		opts := []Option{WithFormat(format), WithHintFile(), WithColdTier(ColdTier{MinValueSize: 100, MaxReads: 2})}
+		db, err := Open(fpath, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range values {
+			if err := db.Put(k, v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Set("set"); err != nil {
+			t.Fatal(err)
+		}
+		check := func(db *DB, cold string) {
+			t.Helper()
+			for k, want := range values {
+				r, _ := db.keys.get(k)
+				if isCold := k == cold; r.cold != isCold {
+					t.Fatalf("format %d: %q is cold: %v, want %v", format, k, r.cold, isCold)
+				}
+				got, err := db.Get(k)
+				if err != nil {
+					t.Fatalf("format %d: get %q: %v", format, k, err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Fatalf("format %d: get %q: got %q, want %q", format, k, got, want)
+				}
+			}
+			if !db.Exists("set") {
+				t.Fatalf("format %d: key without value is missing", format)
+			}
+		}
+		for i := 0; i < 3; i++ {
+			if _, err := db.Get("b"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		check(db, "a")
+		if stats, err := db.Stats(); err != nil || stats.ColdBytes == 0 || stats.LiveBytes != stats.TotalBytes {
+			t.Fatalf("format %d: stats: %+v, %v", format, stats, err)
+		}
+		versions, err := db.History("a")
+		if err != nil || len(versions) != 1 || !bytes.Equal(versions[0].Value, values["a"]) {
+			t.Fatalf("format %d: history: %v, %v", format, versions, err)
+		}
+		backup := &unlockedWriter{db: db}
+		if err := db.Backup(backup); err != nil {
+			t.Fatal(err)
+		}
+		if backup.locked {
+			t.Fatalf("format %d: the backup was written with the lock held", format)
+		}
+		snap, err := db.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Reads bring a cold value back, the background compaction moves values as well
+		for i := 0; i < 3; i++ {
+			if _, err := db.Get("a"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		old, err := os.ReadFile(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.compactOnline(func() error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+		check(db, "b")
+		if v, err := snap.Get("a"); err != nil || !bytes.Equal(v, values["a"]) {
+			t.Fatalf("format %d: snapshot: %q, %v", format, v, err)
+		}
+		if err := snap.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// A crash between the replacement of the files leaves the old file with the new cold file
+		crashed := filepath.Join(dir, "crashed.db")
+		cold, err := os.ReadFile(fpath + ColdSuffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(crashed, old, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(crashed+ColdSuffix, cold, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		db, err = Open(crashed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(db, "a")
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The backup has the cold values
+		restored := filepath.Join(dir, "restored.db")
+		if err := os.WriteFile(restored, backup.Bytes(), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		db, err = Open(restored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(db, "")
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The hint locates cold values, compacting without the option moves them back
+		db, err = Open(fpath, WithHintFile())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if db.rowsReplayed != 0 {
+			t.Fatalf("format %d: the hint wasn't loaded", format)
+		}
+		check(db, "b")
+		for i := 0; i < 2; i++ { // values moved back are kept in the cold file by the first compaction
+			if err := db.Compact(); err != nil {
+				t.Fatal(err)
+			}
+			check(db, "")
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(fpath + ColdSuffix); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("format %d: unused cold file: %v", format, err)
+		}
+	}
+}
+
+// unlockedWriter records whether the lock of the database is held when it's written to.
+type unlockedWriter struct {
+	bytes.Buffer
+	db     *DB
+	locked bool
+}
+
+func (w *unlockedWriter) Write(p []byte) (int, error) {
+	if w.db.mu.TryLock() {
+		w.db.mu.Unlock()
+	} else {
+		w.locked = true
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestColdSegments(t *testing.T) {
+	dir := t.TempDir()
+	cfg := SegmentConfig{MaxSegmentSize: 4 << 10, Cold: &ColdSegments{BlockSize: 1 << 10}}
+	s, err := OpenSegmented(dir, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string][]byte)
+	for i := 0; i < 100; i++ {
+		k := fmt.Sprintf("key %03d", i)
+		values[k] = bytes.Repeat([]byte(k), 20)
+		if err := s.Put(k, values[k]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, k := range []string{"key 010", "key 050"} {
+		if err := s.Delete(k); err != nil {
+			t.Fatal(err)
+		}
+		delete(values, k)
+	}
+	check := func(s *SegmentedDB) {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			k := fmt.Sprintf("key %03d", i)
+			got, err := s.Get(k)
+			if want, ok := values[k]; !ok {
+				if !errors.Is(err, ErrKeyNotFound) {
+					t.Fatalf("get deleted %q: %q, %v", k, got, err)
+				}
+			} else if err != nil || !bytes.Equal(got, want) {
+				t.Fatalf("get %q: %q, %v", k, got, err)
+			}
+		}
+	}
+	segmentsSize := func() (size int64, cold int) {
+		t.Helper()
+		entries, err := readManifest(filepath.Join(dir, SegmentManifest))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			fi, err := os.Stat(s.segmentPath(e.id, e.cold))
+			if err != nil {
+				t.Fatal(err)
+			}
+			size += fi.Size()
+			if e.cold {
+				cold++
+			}
+		}
+		return size, cold
+	}
+
+	// The first segment is read, so only the others are compressed
+	if _, err := s.Get("key 000"); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := segmentsSize()
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	after, cold := segmentsSize()
+	if n := len(s.segments); cold != n-2 || !s.segments[1].cold || s.segments[0].cold || s.segments[n-1].cold {
+		t.Fatalf("%d cold segments out of %d", cold, n)
+	}
+	if after >= before/2 {
+		t.Fatalf("segments of %d bytes compacted to %d bytes", before, after)
+	}
+	check(s)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cold segments are compacted again, the first one is compressed once it isn't read
+	s, err = OpenSegmented(dir, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, cold := segmentsSize(); cold != len(s.segments)-1 {
+		t.Fatalf("%d cold segments out of %d", cold, len(s.segments))
+	}
+	check(s)
+
+	// Segments that were read are written back uncompressed
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, cold := segmentsSize(); cold != 0 {
+		t.Fatalf("%d cold segments out of %d", cold, len(s.segments))
+	}
+	check(s)
+	if err := s.Put("key 001", []byte("new value")); err != nil {
+		t.Fatal(err)
+	}
+	values["key 001"] = []byte("new value")
+	check(s)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetViewChecksum(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("k", []byte("original")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("other", []byte("intact")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fpath, bytes.Replace(b, []byte("original"), []byte("modified"), 1), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Values aren't verified on open with lazy checksums, the view must verify the mapped row
+	db, err = Open(fpath, WithLazyChecksums())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if v, err := db.GetView("k"); !errors.Is(err, ErrCorruptRecord) {
+		if err == nil {
+			t.Fatalf("got view %q, want a corrupt record error", v.Bytes())
+		}
+		t.Fatalf("got %v, want a corrupt record error", err)
+	}
+	v, err := db.GetView("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Release()
+	if string(v.Bytes()) != "intact" {
+		t.Fatalf("got %q, want %q", v.Bytes(), "intact")
+	}
+}
+
+func TestHashedKeysSecret(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(fpath, WithHashedKeys([]byte("secret")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	// The check is kept by compaction
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err := Open(fpath, WithHashedKeys([]byte("other"))); !errors.Is(err, ErrWrongKeyHashSecret) {
+		if err == nil {
+			db.Close()
+		}
+		t.Fatalf("got %v, want %v", err, ErrWrongKeyHashSecret)
+	}
+	db, err = Open(fpath, WithHashedKeys([]byte("secret")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if v, err := db.Get("k"); err != nil || string(v) != "v" {
+		t.Fatalf("got %q, %v, want %q", v, err, "v")
+	}
+}
+
+// countingStore counts the ranged reads of a SegmentStore.
+type countingStore struct {
+	SegmentStore
+	reads atomic.Int64
+}
+
+func (s *countingStore) ReadAt(name string, p []byte, off int64) (int, error) {
+	s.reads.Add(1)
+	return s.SegmentStore.ReadAt(name, p, off)
+}
+
+func TestRemoteSegments(t *testing.T) {
+	dir, storeDir := t.TempDir(), t.TempDir()
+	store := &countingStore{SegmentStore: DirSegmentStore(storeDir)}
+	cfg := SegmentConfig{MaxSegmentSize: 4 << 10, Remote: &RemoteSegments{Store: store}}
+	s, err := OpenSegmented(dir, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string][]byte)
+	for i := 0; i < 100; i++ {
+		k := fmt.Sprintf("key %03d", i)
+		values[k] = bytes.Repeat([]byte(k), 20)
+		if err := s.Put(k, values[k]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Delete("key 010"); err != nil {
+		t.Fatal(err)
+	}
+	delete(values, "key 010")
+	check := func(s *SegmentedDB) {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			k := fmt.Sprintf("key %03d", i)
+			got, err := s.Get(k)
+			if want, ok := values[k]; !ok {
+				if !errors.Is(err, ErrKeyNotFound) {
+					t.Fatalf("get deleted %q: %q, %v", k, got, err)
+				}
+			} else if err != nil || !bytes.Equal(got, want) {
+				t.Fatalf("get %q: %q, %v", k, got, err)
+			}
+		}
+	}
+	// Only the active segment is in the directory
+	local, _ := filepath.Glob(filepath.Join(dir, "*"+SegmentFileExt))
+	remote, _ := filepath.Glob(filepath.Join(storeDir, "*"+SegmentFileExt))
+	if n := len(s.segments); n < 3 || len(local) != 1 || len(remote) != n-1 {
+		t.Fatalf("%d segments: %d local and %d remote files", n, len(local), len(remote))
+	}
+	check(s)
+
+	// The pages read are cached
+	reads := store.reads.Load()
+	check(s)
+	if n := store.reads.Load(); n != reads {
+		t.Fatalf("%d reads from the store for cached pages", n-reads)
+	}
+
+	// Compacting uploads the compacted segments, which are read again from the store
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check(s)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = OpenSegmented(dir, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	check(s)
+	if err := s.Put("key 001", []byte("new value")); err != nil {
+		t.Fatal(err)
+	}
+	values["key 001"] = []byte("new value")
+	check(s)
+}
+
+func TestExportParquet(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), WithTimestamps())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	before := time.Now()
+	for _, w := range []testWrite{{"a", []byte("1"), true}, {"b", nil, true}, {"c", []byte("3"), true}, {k: "c"}} {
+		if !w.write {
+			err = db.Delete(w.k)
+		} else if w.v == nil {
+			err = db.Set(w.k)
+		} else {
+			err = db.Put(w.k, w.v)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	times, err := db.writeTimes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(times) != 2 || times["a"] < before.UnixNano() || times["b"] < times["a"] {
+		t.Fatalf("got write times %v, want the times of a and b", times)
+	}
+
+	var buf bytes.Buffer
+	if err := db.ExportParquet(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if b := buf.Bytes(); !bytes.HasPrefix(b, []byte("PAR1")) || !bytes.HasSuffix(b, []byte("PAR1")) {
+		t.Fatal("the export isn't a Parquet file")
+	}
+	// Timestamps are stored in microseconds
+	micros := binary.LittleEndian.AppendUint64(nil, uint64(times["a"]/1000))
+	if !bytes.Contains(buf.Bytes(), micros) || !bytes.Contains(buf.Bytes(), []byte("written_at")) {
+		t.Fatal("the export doesn't have the write time of a")
+	}
+
+	// Databases without timestamps have null write times
+	plain, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if err := plain.Put("a", nil); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := plain.ExportParquet(&buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptionFlag(t *testing.T) {
+	key := make([]byte, 32)
+	fpath := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(fpath, WithEncryptionKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("k", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err := Open(fpath); err == nil {
+		db.Close()
+		t.Fatal("opened an encrypted file without a key")
+	}
+
+	// Compaction keeps the flag
+	db, err = Open(fpath, WithEncryptionKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Get("k"); err != nil || string(v) != "secret" {
+		t.Fatalf("got %q, %v after compacting", v, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err := Open(fpath); err == nil {
+		db.Close()
+		t.Fatal("opened an encrypted file without a key after compacting it")
+	}
+
+	plainPath := filepath.Join(t.TempDir(), "test.db")
+	db, err = Open(plainPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err := Open(plainPath, WithEncryptionKey(key)); err == nil {
+		db.Close()
+		t.Fatal("opened a plaintext file with a key")
+	}
+
+	// Passphrases set the flag too
+	passPath := filepath.Join(t.TempDir(), "test.db")
+	db, err = Open(passPath, WithPassphrase("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err := Open(passPath); err == nil {
+		db.Close()
+		t.Fatal("opened a passphrase-protected file without the passphrase")
+	}
+	if _, err := Open(passPath, WithPassphrase("wrong")); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("got %v for a wrong passphrase, want %v", err, ErrWrongPassphrase)
+	}
+	db, err = Open(passPath, WithPassphrase("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if v, err := db.Get("k"); err != nil || string(v) != "v" {
+		t.Fatalf("got %q, %v", v, err)
+	}
+}
+
+// checkIndex applies random writes to the index and checks it against a map along the way.
+func checkIndex(t *testing.T, idx index, writes int, check func() error) {
+	t.Helper()
+	want := make(map[string]ref)
+	rng := rand.New(rand.NewSource(1))
+	for i := 1; i <= writes; i++ {
+		k := fmt.Sprintf("key-%d", rng.Intn(writes/10))
+		if rng.Intn(3) == 0 {
+			idx.delete(k)
+			delete(want, k)
+		} else {
+			r := ref{index: rng.Intn(1 << 30), width: rng.Intn(1000)}
+			if rng.Intn(5) == 0 {
+				r = keyOnly
+			}
+			idx.set(k, r)
+			want[k] = r
+		}
+		if err := check(); err != nil {
+			t.Fatal(err)
+		}
+		if i%(writes/10) != 0 {
+			continue
+		}
+		if idx.len() != len(want) {
+			t.Fatalf("got %d keys, want %d", idx.len(), len(want))
+		}
+		for k, r := range want {
+			if got, ok := idx.get(k); !ok || got != r {
+				t.Fatalf("%q: got %+v, %v, want %+v", k, got, ok, r)
+			}
+		}
+		for _, start := range []string{"", fmt.Sprintf("key-%d", rng.Intn(writes/10)), "key-5", "zzz"} {
+			var prev string
+			n := 0
+			idx.ascend(start, func(k []byte, r ref) bool {
+				if string(k) < start || (n > 0 && string(k) <= prev) {
+					t.Fatalf("start %q: %q after %q", start, k, prev)
+				}
+				if want[string(k)] != r {
+					t.Fatalf("%q: got %+v, want %+v", k, r, want[string(k)])
+				}
+				prev = string(k)
+				n++
+				return true
+			})
+			wantN := 0
+			for k := range want {
+				if k >= start {
+					wantN++
+				}
+			}
+			if n != wantN {
+				t.Fatalf("start %q: iterated over %d keys, want %d", start, n, wantN)
+			}
+		}
+	}
+	// Deleting all keys lets the keydir reclaim their space
+	for k := range want {
+		idx.delete(k)
+	}
+	if idx.len() != 0 {
+		t.Fatalf("got %d keys after deleting all of them", idx.len())
+	}
+}
+
+func TestKeydir(t *testing.T) {
+	checkIndex(t, newKeydir(), 200_000, func() error { return nil })
+}
+
+func TestSpillIndex(t *testing.T) {
+	si, err := newSpillIndex(filepath.Join(t.TempDir(), "test.index"), 16<<10, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIndex(t, si, 50_000, func() error { return si.err })
+	if len(si.runs) == 0 {
+		t.Fatal("the index wasn't spilled")
+	}
+	if err := si.close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSpilledDB(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(fpath, WithIndexMemoryLimit(32<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	const n = 20_000
+	for i := 0; i < n; i++ {
+		if err := db.Put(fmt.Sprintf("key-%05d", i), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < n; i += 3 {
+		if err := db.Delete(fmt.Sprintf("key-%05d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(db *DB) {
+		t.Helper()
+		if s, err := db.Stats(); err != nil || s.Keys != n-(n+2)/3 {
+			t.Fatalf("got %d keys, %v, want %d", s.Keys, err, n-(n+2)/3)
+		}
+		if v, err := db.Get("key-19999"); err != nil || string(v) != "19999" {
+			t.Fatalf("got %q, %v", v, err)
+		}
+		if db.Exists("key-19998") {
+			t.Fatal("a deleted key exists")
+		}
+	}
+	check(db)
+	runs, _ := filepath.Glob(fpath + ".index/*")
+	if len(runs) == 0 {
+		t.Fatal("the index wasn't spilled")
+	}
+
+	// Followers spill to their own directory, removed on close
+	follower, err := Open(fpath, WithFollow(0), WithIndexMemoryLimit(32<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(follower)
+	followerDir := follower.indexDir
+	if followerDir == fpath+".index" {
+		t.Fatal("the follower spills to the directory of the writer")
+	}
+	if err := follower.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(followerDir); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("the directory of the follower wasn't removed: %v", err)
+	}
+	if after, _ := filepath.Glob(fpath + ".index/*"); len(after) != len(runs) {
+		t.Fatalf("%d runs of the writer left out of %d", len(after), len(runs))
+	}
+	check(db)
+
+	// Spill errors are reported by Stats, the index stays in memory
+	if err := os.RemoveAll(fpath + ".index"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fpath+".index", nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2000; i++ {
+		if err := db.Put(fmt.Sprintf("new-%05d", i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s, err := db.Stats(); err != nil || s.SpillErr == nil {
+		t.Fatalf("got %v, %v, want a spill error", s.SpillErr, err)
+	}
+	if !db.Exists("new-01999") {
+		t.Fatal("a key written while spilling fails is missing")
+	}
+}
+
+func TestPreallocation(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(fpath, WithPreallocation(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put("k", bytes.Repeat([]byte("v"), 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pw := db.prealloc; !pw.disabled && pw.allocated < 1<<20 {
+		t.Fatalf("%d bytes allocated, want at least one chunk", pw.allocated)
+	}
+	// The preallocated space isn't part of the file
+	fi, err := os.Stat(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(db.wIndex) {
+		t.Fatalf("the file has %d bytes, want %d", fi.Size(), db.wIndex)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if v, err := db.Get("k"); err != nil || len(v) != 100 {
+		t.Fatalf("got %q, %v", v, err)
+	}
+}
+
+func TestValueCache(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), WithValueCache(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	get := func(k, want string) {
+		t.Helper()
+		if v, err := db.Get(k); err != nil || string(v) != want {
+			t.Fatalf("%q: got %q, %v, want %q", k, v, err, want)
+		}
+	}
+	for k, v := range map[string]string{"a": "12345", "b": "6789", "c": "xyz"} {
+		if err := db.Put(k, []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get("a", "12345")
+	get("a", "12345")
+	get("b", "6789")
+	if s, _ := db.CacheStats(); s.Hits != 1 || s.Misses != 2 || s.Entries != 2 || s.Bytes != 9 {
+		t.Fatalf("got %+v, want 1 hit, 2 misses and the values of a and b", s)
+	}
+	// Reading c evicts the least recently used value
+	get("c", "xyz")
+	if s, _ := db.CacheStats(); s.Entries != 2 || s.Bytes != 7 {
+		t.Fatalf("got %+v, want the values of b and c", s)
+	}
+	get("b", "6789")
+	if s, _ := db.CacheStats(); s.Hits != 2 {
+		t.Fatalf("got %+v, want a hit for b", s)
+	}
+	if s, err := db.Stats(); err != nil || s.CacheHits != 2 || s.CacheMisses != 3 {
+		t.Fatalf("got %+v, %v, want the hits and misses in Stats", s, err)
+	}
+
+	// Writes invalidate the cached values
+	if err := db.Put("b", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	get("b", "new")
+	if err := db.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("b"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("got %v for a deleted key, want %v", err, ErrKeyNotFound)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	big := bytes.Repeat([]byte("hello world "), 100)
+	values := map[string][]byte{"big": big, "small": []byte("x"), "random": []byte("qwertyuiopasdfghjklzxcvbnm")}
+	for _, encrypted := range []bool{false, true} {
+		var opts []Option
+		if encrypted {
+			opts = append(opts, WithEncryptionKey(make([]byte, 32)))
+		}
+		fpath := filepath.Join(t.TempDir(), "test.db")
+		db, err := Open(fpath, append([]Option{WithCompression(Gzip, 16)}, opts...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range values {
+			if err := db.Put(k, v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if r, _ := db.keys.get("big"); !r.compressed || r.width >= len(big) {
+			t.Fatalf("encrypted: %v: the big value wasn't compressed: %+v", encrypted, r)
+		}
+		if r, _ := db.keys.get("small"); r.compressed {
+			t.Fatalf("encrypted: %v: a value under the minimum size was compressed", encrypted)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Built-in compressors don't need to be configured to read values
+		db, err = Open(fpath, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, want := range values {
+			if v, err := db.Get(k); err != nil || !bytes.Equal(v, want) {
+				t.Fatalf("encrypted: %v: %q: got %q, %v", encrypted, k, v, err)
+			}
+		}
+		view, err := db.GetView("big")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(view.Bytes(), big) {
+			t.Fatalf("encrypted: %v: the view of the big value doesn't match", encrypted)
+		}
+		view.Release()
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPutWithCompression(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := bytes.Repeat([]byte(`{"a":1}`), 100)
+	if err := db.PutWithCompression("a", v, Flate); err != nil {
+		t.Fatal(err)
+	}
+	// The compressor must be one of the database
+	if err := db.PutWithCompression("b", v, NewDictCompressor(9, nil)); err == nil {
+		t.Fatal("compressed a value with an unknown compressor")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The value is decompressed without compression options
+	db, err = Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkValues(t, db, map[string][]byte{"a": v})
+	if s, err := db.Stats(); err != nil || s.TotalBytes >= int64(len(v)) {
+		t.Fatalf("got %+v, %v, want the value stored compressed", s, err)
+	}
+}
+
+func TestDictionary(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2000; i++ {
+		v := fmt.Sprintf(`{"id":%d,"url":"https://example.com/products/%d?utm_source=newsletter","status":"active"}`, i, i*37)
+		if err := db.Put(fmt.Sprint("u", i), []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	samples, err := db.SampleValues(200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 200 {
+		t.Fatalf("got %d samples, want 200", len(samples))
+	}
+	dict := TrainDictionary(samples, 4096)
+	if len(dict) == 0 || len(dict) > 4096 {
+		t.Fatalf("got a dictionary of %d bytes", len(dict))
+	}
+
+	// The dictionary compresses the values better than flate alone
+	dc := NewDictCompressor(9, dict)
+	sizes := make(map[byte]int)
+	for _, c := range []Compressor{Flate, dc} {
+		for _, s := range samples {
+			b, err := c.Compress(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d, err := c.Decompress(b); err != nil || !bytes.Equal(d, s) {
+				t.Fatalf("compressor %d: got %q, %v, want %q", c.ID(), d, err, s)
+			}
+			sizes[c.ID()] += len(b)
+		}
+	}
+	if sizes[dc.ID()] >= sizes[Flate.ID()] {
+		t.Fatalf("%d bytes with the dictionary, %d without", sizes[dc.ID()], sizes[Flate.ID()])
+	}
+
+	if err := db.PutWithCompression("dict", samples[0], dc); err == nil {
+		t.Fatal("wrote a value with an unregistered compressor")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(fpath, WithCompression(dc, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("dict", samples[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Reading the value back needs the dictionary
+	db, err = Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("dict"); !errors.Is(err, ErrDecompress) {
+		t.Fatalf("got %v without the dictionary, want %v", err, ErrDecompress)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(fpath, WithCompressors(dc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if v, err := db.Get("dict"); err != nil || !bytes.Equal(v, samples[0]) {
+		t.Fatalf("got %q, %v, want %q", v, err, samples[0])
+	}
+}
+
+func TestBlobs(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	shared, err := db.PutBlob([]byte("shared"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, err := db.PutBlob([]byte("shared")); err != nil || h != shared {
+		t.Fatalf("got %q, %v for the same data, want %q", h, err, shared)
+	}
+	other, err := db.PutBlob([]byte("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == shared {
+		t.Fatal("different data has the same hash")
+	}
+
+	// Blobs are deleted once they're no longer referenced
+	if err := db.ReleaseBlob(shared); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ReleaseBlob(other); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.GCBlobs(); err != nil || n != 1 {
+		t.Fatalf("got %d, %v, want 1 blob deleted", n, err)
+	}
+	if data, err := db.GetBlob(shared); err != nil || string(data) != "shared" {
+		t.Fatalf("got %q, %v for a referenced blob", data, err)
+	}
+	if data, err := db.GetBlob(other); data != nil {
+		t.Fatalf("got %q, %v for a deleted blob", data, err)
+	}
+	if err := db.ReleaseBlob(other); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("got %v releasing a deleted blob, want %v", err, ErrKeyNotFound)
+	}
+
+	// The content is checked against the hash
+	if err := db.Put(blobPrefix+shared, []byte("tampered")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetBlob(shared); !errors.Is(err, ErrBlobCorrupted) {
+		t.Fatalf("got %v, want %v", err, ErrBlobCorrupted)
+	}
+}
+
+func TestDiskFull(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the failpoint returns ENOSPC, Windows reports a full disk with other errors")
+	}
+	for _, buffered := range []bool{false, true} {
+		fpath := filepath.Join(t.TempDir(), "test.db")
+		var opts []Option
+		if buffered {
+			opts = append(opts, WithWriteBuffer(WriteBuffer{MaxRecords: 1}))
+		}
+		db, err := Open(fpath, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("a", []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+		disable := EnableFailpoint(FailpointWrite, Failpoint{Err: syscall.ENOSPC, ShortWrite: 3, Times: 2})
+		defer disable()
+		want := map[string][]byte{"a": []byte("1"), "d": []byte("4")}
+		if err := db.Put("b", []byte("2")); buffered {
+			// The row is buffered, it's written along with the next one
+			if err != nil {
+				t.Fatal(err)
+			}
+			want["b"] = []byte("2")
+		} else if !errors.Is(err, ErrDiskFull) {
+			t.Fatalf("got %v, want %v", err, ErrDiskFull)
+		}
+		if err := db.Put("c", []byte("3")); !errors.Is(err, ErrDiskFull) {
+			t.Fatalf("buffered: %v: got %v, want %v", buffered, err, ErrDiskFull)
+		}
+		if !errors.Is(db.Degraded(), ErrDiskFull) {
+			t.Fatalf("buffered: %v: got %v, want the database to be degraded", buffered, db.Degraded())
+		}
+		if v, err := db.Get("a"); err != nil || string(v) != "1" {
+			t.Fatalf("buffered: %v: got %q, %v while degraded", buffered, v, err)
+		}
+		disable()
+
+		// The next successful write leaves the degraded state
+		if err := db.Put("d", []byte("4")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Degraded(); err != nil {
+			t.Fatalf("buffered: %v: still degraded after a successful write: %v", buffered, err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = Open(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkContents(t, db, want)
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConsistencyGuard(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	// Another process appends to the file
+	f, err := os.OpenFile(fpath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("garbage")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The file is checked periodically
+	for i := 0; err == nil; i++ {
+		if i > consistencyCheckInterval {
+			t.Fatal("the appended bytes weren't detected")
+		}
+		err = db.Put("b", []byte("2"))
+	}
+	if !errors.Is(err, ErrInconsistent) {
+		t.Fatalf("got %v, want %v", err, ErrInconsistent)
+	}
+	if err := db.Put("c", []byte("3")); !errors.Is(err, ErrInconsistent) {
+		t.Fatalf("got %v once inconsistent, want %v", err, ErrInconsistent)
+	}
+	if v, err := db.Get("a"); err != nil || string(v) != "1" {
+		t.Fatalf("got %q, %v, reads should still be served", v, err)
+	}
+}
+
+func TestTempDB(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"TMPDIR", "TMP", "TEMP"} {
+		t.Setenv(name, dir)
+	}
+	checkRemoved := func() {
+		t.Helper()
+		if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+			t.Fatalf("got %d files left in the temporary directory, %v", len(entries), err)
+		}
+	}
+
+	db, err := NewTempDB(WithIndexMemoryLimit(1<<10), WithReadHandles(3), WithPreallocation(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2000; i++ {
+		if err := db.Put(fmt.Sprintf("key-%04d", i), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, err := db.Get("key-0001"); err != nil || string(v) != "v" {
+		t.Fatalf("got %q, %v", v, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkRemoved()
+
+	// Regular temporary files are used where unnamed ones aren't supported
+	tf, err := createNamedTempFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(tf.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.cleanup = tf.remove
+	if err := db.Put("k", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkRemoved()
+}
+
+func TestClose(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(fpath, WithWriteBuffer(WriteBuffer{MaxRecords: 100}), WithIndexMemoryLimit(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i, err := range []error{db.Close(), db.Put("k", nil), db.Set("k"), db.Delete("k"), db.Flush(), db.Compact()} {
+		if !errors.Is(err, ErrClosed) {
+			t.Fatalf("operation %d: got %v, want %v", i, err, ErrClosed)
+		}
+	}
+	if _, err := db.Get("k"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("got %v, want %v", err, ErrClosed)
+	}
+	if db.Exists("k") {
+		t.Fatal("a key exists once closed")
+	}
+	// The buffered row was flushed and the lock released
+	db, err = Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Get("k"); err != nil || string(v) != "v" {
+		t.Fatalf("got %q, %v", v, err)
+	}
+
+	// Sync errors are returned, the database is closed nonetheless
+	errFault := errors.New("fault")
+	disable := EnableFailpoint(FailpointSync, Failpoint{Err: errFault})
+	defer disable()
+	if err := db.Close(); !errors.Is(err, errFault) {
+		t.Fatalf("got %v, want the sync error", err)
+	}
+	disable()
+	if err := db.Close(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("got %v closing again, want %v", err, ErrClosed)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	keyring := map[byte][]byte{0: make([]byte, 16), 1: bytes.Repeat([]byte{1}, 16)}
+	for i, opts := range [][]Option{
+		nil,
+		{WithHMACChain([]byte("key")), WithValueCache(1 << 20)},
+		{WithEncryptionKeyring(1, keyring), WithCompression(Gzip, 10), WithIndexMemoryLimit(500)},
+		{WithHashedKeys([]byte("secret")), WithWriteBuffer(WriteBuffer{MaxRecords: 7}), WithPreallocation(1 << 16)},
+		{WithQuota("k", Quota{MaxKeys: 1000}), WithWriteBuffer(WriteBuffer{MaxRecords: 7})},
+	} {
+		fpath := filepath.Join(t.TempDir(), "test.db")
+		want := make(map[string][]byte)
+		if i == 2 {
+			// A value encrypted with the previous key is encrypted again with the current one
+			db, err := Open(fpath, WithEncryptionKeyring(0, keyring))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Put("old", []byte("old value")); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			want["old"] = []byte("old value")
+		}
+		db, err := Open(fpath, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 1000; j++ {
+			k, v := fmt.Sprint("k", j%100), []byte(fmt.Sprint("value ", j))
+			if err := db.Put(k, v); err != nil {
+				t.Fatal(err)
+			}
+			want[k] = v
+		}
+		if err := db.Set("set"); err != nil {
+			t.Fatal(err)
+		}
+		want["set"] = []byte{}
+		if err := db.Delete("k3"); err != nil {
+			t.Fatal(err)
+		}
+		delete(want, "k3")
+		usage, _ := db.QuotaUsage("k")
+
+		before, err := os.Stat(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		after, err := os.Stat(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if after.Size() >= before.Size()/5 {
+			t.Fatalf("options %d: the file went from %d to %d bytes", i, before.Size(), after.Size())
+		}
+		checkValues(t, db, want)
+		if u, _ := db.QuotaUsage("k"); u != usage {
+			t.Fatalf("options %d: got usage %+v after compacting, want %+v", i, u, usage)
+		}
+		if db.hmacKey != nil {
+			if err := db.Verify(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if i == 2 {
+			r, _ := db.keys.get("old")
+			if stored, err := db.readStored("old", r); err != nil || stored[0] != 1 {
+				t.Fatalf("got %v, the old value isn't encrypted with the current key", err)
+			}
+		}
+
+		// The database is left as is if the compaction fails
+		if err := db.Put("after", []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+		want["after"] = []byte("v")
+		errFault := errors.New("fault")
+		disable := EnableFailpoint(FailpointCompact, Failpoint{Err: errFault})
+		if err := db.Compact(); !errors.Is(err, errFault) {
+			t.Fatalf("options %d: got %v, want the fault", i, err)
+		}
+		disable()
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(fpath + ".compact"); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("options %d: the compacted file was left: %v", i, err)
+		}
+		db, err = Open(fpath, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkValues(t, db, want)
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := NewTempDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Compact(); err == nil && db.unnamed {
+		t.Fatal("compacted an unnamed file")
+	}
+}
+
+func TestBatch(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithHMACChain([]byte("key"))}, {WithPassphrase("passphrase"), WithCompression(Gzip, 4)}} {
+		fpath := filepath.Join(t.TempDir(), "test.db")
+		db, err := Open(fpath, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("deleted", []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+		want := map[string][]byte{"set": {}}
+		b := db.NewBatch()
+		for i := 0; i < 10; i++ {
+			k, v := fmt.Sprint("k", i), []byte(fmt.Sprint("v", i))
+			if err := b.Put(k, v); err != nil {
+				t.Fatal(err)
+			}
+			want[k] = v
+		}
+		if err := b.Delete("deleted"); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Set("set"); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if b.Len() != 0 {
+			t.Fatalf("got %d writes once committed, want the batch reset", b.Len())
+		}
+		checkContents(t, db, want)
+		committed, err := os.Stat(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Put("late1", []byte("value"))
+		b.Put("late2", []byte("value"))
+		if err := b.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if db.hmacKey != nil {
+			if err := db.Verify(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// A batch cut anywhere is discarded as a whole
+		data, err := os.ReadFile(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for cut := committed.Size(); cut < int64(len(data)); cut += 7 {
+			cutPath := filepath.Join(t.TempDir(), "cut.db")
+			if err := os.WriteFile(cutPath, data[:cut], 0o600); err != nil {
+				t.Fatal(err)
+			}
+			db, err := Open(cutPath, opts...)
+			if err != nil {
+				t.Fatalf("cut at %d: %v", cut, err)
+			}
+			checkContents(t, db, want)
+			// The partial batch is truncated before writing
+			if err := db.Put("after", nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if db, err = Open(cutPath, opts...); err != nil || !db.Exists("after") {
+				t.Fatalf("cut at %d: got %v, want the row written after the partial batch", cut, err)
+			}
+			db.Close()
+		}
+	}
+}
+
+func TestBatchQuota(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), WithQuota("q", Quota{MaxKeys: 3}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// Quotas are checked as if the previous writes of the batch were applied
+	b := db.NewBatch()
+	for _, k := range []string{"q1", "q1", "q2"} {
+		b.Put(k, nil)
+	}
+	b.Delete("q1")
+	b.Put("q3", nil)
+	b.Put("q4", nil)
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := db.QuotaUsage("q"); u.Keys != 3 {
+		t.Fatalf("got %d keys, want 3", u.Keys)
+	}
+	for _, k := range []string{"q1", "q2", "q3", "q4"} {
+		b.Put(k, nil)
+	}
+	var quotaErr *QuotaError
+	if err := b.Commit(); !errors.As(err, &quotaErr) {
+		t.Fatalf("got %v, want a quota error", err)
+	}
+	if b.Len() != 4 {
+		t.Fatalf("got %d writes after a failed commit, want the batch left as is", b.Len())
+	}
+	if u, _ := db.QuotaUsage("q"); u.Keys != 3 || db.Exists("q1") {
+		t.Fatalf("got %d keys, the failed batch was applied", u.Keys)
+	}
+}
+
+func TestForEach(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, k := range []string{"d", "b", "c", "a"} {
+		if err := db.Put(k, []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Set("e"); err != nil {
+		t.Fatal(err)
+	}
+	if keys := db.Keys(); fmt.Sprint(keys) != "[a b c d e]" {
+		t.Fatalf("got keys %q, want them sorted", keys)
+	}
+
+	// fn may write to the database
+	var visited []string
+	err = db.ForEach(func(k string, v []byte) error {
+		visited = append(visited, k+"="+string(v))
+		if k == "a" {
+			if err := db.Delete("b"); err != nil {
+				return err
+			}
+			return db.Put("c", []byte("new"))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(visited) != "[a=a c=new d=d e=]" {
+		t.Fatalf("visited %q", visited)
+	}
+
+	errStop := errors.New("stop")
+	n := 0
+	err = db.ForEach(func(string, []byte) error {
+		n++
+		return errStop
+	})
+	if !errors.Is(err, errStop) || n != 1 {
+		t.Fatalf("got %v after %d keys, want fn's error after the first key", err, n)
+	}
+}
+
+func TestForEachHashedKeys(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), WithHashedKeys([]byte("secret")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 5; i++ {
+		if err := db.Put(fmt.Sprint("k", i), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys := db.Keys()
+	if len(keys) != 5 {
+		t.Fatalf("got %d keys, want 5", len(keys))
+	}
+	values := make(map[string]bool)
+	err = db.ForEach(func(k string, v []byte) error {
+		if strings.HasPrefix(k, "k") {
+			return fmt.Errorf("got the plain key %q", k)
+		}
+		values[string(v)] = true
+		return nil
+	})
+	if err != nil || len(values) != 5 {
+		t.Fatalf("got %d values, %v, want 5", len(values), err)
+	}
+}
+
+func TestScan(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, k := range []string{"a", "ab", "abc", "b", "aa", "ac", ""} {
+		if err := db.Put(k+"x", []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for prefix, want := range map[string]string{
+		"a":  "[aax abcx abx acx ax]",
+		"ab": "[abcx abx]",
+		"":   "[aax abcx abx acx ax bx x]",
+		"c":  "[]",
+	} {
+		var got []string
+		err := db.Scan(prefix, func(k string, v []byte) error {
+			if k != string(v)+"x" {
+				return fmt.Errorf("%q: got %q", k, v)
+			}
+			got = append(got, k)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got) != want {
+			t.Fatalf("prefix %q: got %q, want %s", prefix, got, want)
+		}
+	}
+
+	hashed, err := Open(filepath.Join(t.TempDir(), "test.db"), WithHashedKeys([]byte("secret")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hashed.Close()
+	if err := hashed.Scan("a", func(string, []byte) error { return nil }); err == nil {
+		t.Fatal("scanned hashed keys")
+	}
+}
+
+func TestRange(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), WithIndexMemoryLimit(300))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		if err := db.Set(fmt.Sprintf("ts:%03d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if keys := db.Range("ts:010", "ts:015"); fmt.Sprint(keys) != "[ts:010 ts:011 ts:012 ts:013 ts:014]" {
+		t.Fatalf("got %q", keys)
+	}
+	if keys := db.Range("ts:095", ""); len(keys) != 5 || keys[4] != "ts:099" {
+		t.Fatalf("got %q without upper bound", keys)
+	}
+	if keys := db.Range("ts:0955", "ts:097"); fmt.Sprint(keys) != "[ts:096]" {
+		t.Fatalf("got %q", keys)
+	}
+	if keys := db.Range("a", "b"); len(keys) != 0 {
+		t.Fatalf("got %q, want no keys", keys)
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithHMACChain([]byte("key"))}} {
+		fpath := filepath.Join(t.TempDir(), "test.db")
+		db, err := Open(fpath, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("a", []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("b", []byte("world")); err != nil {
+			t.Fatal(err)
+		}
+		b := db.NewBatch()
+		b.Put("c", []byte("x"))
+		b.Set("d")
+		if err := b.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Flip a byte of the value of b
+		data, err := os.ReadFile(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data[bytes.Index(data, []byte("world"))] = 'W'
+		if err := os.WriteFile(fpath, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		_, err = Open(fpath, opts...)
+		var corrupt *CorruptRecordError
+		if !errors.As(err, &corrupt) || !errors.Is(err, record.ErrChecksum) || corrupt.Row != 2 {
+			t.Fatalf("got %v, want a checksum mismatch on row 2", err)
+		}
+
+		// Lazy checksums are verified when values are read
+		db, err = Open(fpath, append(opts, WithLazyChecksums())...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Get("b"); !errors.Is(err, ErrCorruptRecord) || !errors.Is(err, record.ErrChecksum) {
+			t.Fatalf("got %v, want a checksum mismatch", err)
+		}
+		if v, err := db.Get("a"); err != nil || string(v) != "hello" {
+			t.Fatalf("got %q, %v for an intact row", v, err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLegacyRows(t *testing.T) {
+	dir := t.TempDir()
+	fpath := filepath.Join(dir, "test.db")
+	if err := os.WriteFile(fpath, []byte("P1 3 a foo\nS1 b\nP1 3 c bar\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// New rows have a checksum, files can mix both kinds of rows
+	if err := db.Put("d", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]byte{"a": []byte("foo"), "b": {}, "c": []byte("bar"), "d": []byte("new")}
+	checkContents(t, db, want)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, db, want)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Migrating adds the checksums
+	migrated := filepath.Join(dir, "migrated.db")
+	if err := Migrate(fpath, migrated, FormatChecksummed); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(migrated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.format != FormatChecksummed {
+		t.Fatalf("got format %d, want %d", db.format, FormatChecksummed)
+	}
+	checkContents(t, db, want)
+}
+
+func TestRepair(t *testing.T) {
+	for _, cut := range []int{1, 3, 6, 9, 12, 15} {
+		fpath := filepath.Join(t.TempDir(), "test.db")
+		db, err := Open(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("a", []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("bb", []byte("world")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lastRow := data[bytes.LastIndexByte(data[:len(data)-1], '\n')+1:]
+		if err := os.WriteFile(fpath, data[:len(data)-cut], 0o600); err != nil {
+			t.Fatal(err)
+		}
+		var corrupt *CorruptRecordError
+		if _, err := Open(fpath); !errors.As(err, &corrupt) || corrupt.Row != 2 {
+			t.Fatalf("cut %d: got %v, want a corrupt record error on row 2", cut, err)
+		}
+
+		// The partial row is moved aside
+		db, err = Open(fpath, WithRepair())
+		if err != nil {
+			t.Fatalf("cut %d: %v", cut, err)
+		}
+		if err := db.Put("c", []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if torn, err := os.ReadFile(fpath + TornRowSuffix); err != nil || !bytes.Equal(torn, lastRow[:len(lastRow)-cut]) {
+			t.Fatalf("cut %d: got the torn row %q, %v, want %q", cut, torn, err, lastRow[:len(lastRow)-cut])
+		}
+		db, err = Open(fpath)
+		if err != nil {
+			t.Fatalf("cut %d: %v", cut, err)
+		}
+		checkContents(t, db, map[string][]byte{"a": []byte("hello"), "c": []byte("x")})
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSyncPolicy(t *testing.T) {
+	dir := t.TempDir()
+	errFault := errors.New("fault")
+	db, err := Open(filepath.Join(dir, "every-write.db"), WithSyncPolicy(SyncEveryWrite), WithWriteBuffer(WriteBuffer{MaxRecords: 100}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("a", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := db.Stats(); db.bw.flushedOffset() != int64(db.wIndex) || s.LastSync.IsZero() {
+		t.Fatal("the write wasn't flushed and synced")
+	}
+	// A failed sync is reported, the write is applied nonetheless
+	disable := EnableFailpoint(FailpointSync, Failpoint{Err: errFault})
+	defer disable()
+	if err := db.Put("b", []byte("v")); !errors.Is(err, errFault) {
+		t.Fatalf("got %v, want the sync error", err)
+	}
+	if v, err := db.Get("b"); err != nil || string(v) != "v" {
+		t.Fatalf("got %q, %v", v, err)
+	}
+	disable()
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(filepath.Join(dir, "interval.db"), WithSyncInterval(10*time.Millisecond), WithWriteBuffer(WriteBuffer{MaxRecords: 100}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	synced := func() bool {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		return db.syncedOffset == db.wIndex && db.bw.flushedOffset() == int64(db.wIndex)
+	}
+	if err := db.Put("a", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if !synced() {
+		t.Fatal("the write wasn't synced in the background")
+	}
+	// Background sync errors are returned by the next call to Sync
+	disable = EnableFailpoint(FailpointSync, Failpoint{Err: errFault})
+	if err := db.Put("b", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	disable()
+	if err := db.Sync(); !errors.Is(err, errFault) {
+		t.Fatalf("got %v, want the background sync error", err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// SyncNever doesn't sync on Close
+	db, err = Open(filepath.Join(dir, "never.db"), WithSyncPolicy(SyncNever))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("a", nil); err != nil {
+		t.Fatal(err)
+	}
+	disable = EnableFailpoint(FailpointSync, Failpoint{Err: errFault})
+	if err := db.Close(); err != nil {
+		t.Fatalf("got %v, want no sync on close", err)
+	}
+	disable()
+}
+
+func TestOpenOptions(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "test.db")
+	hmacKey := []byte("key")
+	db, err := Open(fpath, WithFileMode(0o640), WithMaxKeySize(4), WithMaxValueSize(3), WithHMACChain(hmacKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("large", nil); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("got %v, want %v", err, ErrKeyTooLarge)
+	}
+	if err := db.Put("k", []byte("1234")); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("got %v, want %v", err, ErrValueTooLarge)
+	}
+	if err := db.NewBatch().Put("k", []byte("1234")); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("got %v in a batch, want %v", err, ErrValueTooLarge)
+	}
+	if err := db.Put("k", []byte("123")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && fi.Mode().Perm() != 0o640 {
+		t.Fatalf("got mode %v, want %v", fi.Mode().Perm(), os.FileMode(0o640))
+	}
+
+	// Change the value without updating its checksum nor MAC
+	data, err := os.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[bytes.Index(data, []byte(" 123 "))+3] = '4'
+	if err := os.WriteFile(fpath, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(fpath, WithHMACChain(hmacKey)); !errors.Is(err, record.ErrChecksum) {
+		t.Fatalf("got %v, want %v", err, record.ErrChecksum)
+	}
+	db, err = Open(fpath, WithHMACChain(hmacKey), WithValidation(ValidateRows))
+	if err != nil {
+		t.Fatalf("got %v validating only the row structure", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(fpath, WithHMACChain(hmacKey), WithValidation(ValidateAll), WithLazyChecksums()); !errors.Is(err, ErrTampered) {
+		t.Fatalf("got %v, want %v", err, ErrTampered)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "test.db")
+	if _, err := OpenReadOnly(fpath); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("got %v for a missing file, want %v", err, os.ErrNotExist)
+	}
+	db, err := Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("a", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	b := db.NewBatch()
+	b.Set("b")
+	b.Set("c")
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Cut the batch, read-only databases ignore it without repairing the file
+	data, err := os.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = data[:len(data)-3]
+	if err := os.WriteFile(fpath, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ro, err := OpenReadOnly(fpath, WithWriteBuffer(WriteBuffer{MaxRecords: 3}), WithSyncPolicy(SyncEveryWrite))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, ro, map[string][]byte{"a": []byte("v")})
+	for i, err := range []error{ro.Put("a", nil), ro.Set("b"), ro.Delete("a"), ro.Compact()} {
+		if !errors.Is(err, ErrReadOnly) {
+			t.Fatalf("operation %d: got %v, want %v", i, err, ErrReadOnly)
+		}
+	}
+	if err := ro.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ro.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if after, err := os.ReadFile(fpath); err != nil || !bytes.Equal(after, data) {
+		t.Fatalf("the file was modified: %v", err)
+	}
+}
+
+func TestLock(t *testing.T) {
+	if !lockSupported {
+		t.Skip("file locking isn't supported on this platform")
+	}
+	fpath := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(fpath); !errors.Is(err, ErrLocked) {
+		t.Fatalf("got %v opening a locked file, want %v", err, ErrLocked)
+	}
+	if _, err := OpenReadOnly(fpath); !errors.Is(err, ErrLocked) {
+		t.Fatalf("got %v opening a locked file read-only, want %v", err, ErrLocked)
+	}
+	// Followers run along the writer
+	follower, err := Open(fpath, WithFollow(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read-only databases share the lock
+	ro1, err := OpenReadOnly(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ro2, err := OpenReadOnly(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(fpath); !errors.Is(err, ErrLocked) {
+		t.Fatalf("got %v opening a file opened read-only, want %v", err, ErrLocked)
+	}
+	if err := ro1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ro2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWithTTL("a", []byte("1"), 30*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWithTTL("b", []byte("2"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("c", []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Expire("d", 30*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Expire("missing", time.Hour); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("got %v expiring a missing key, want %v", err, ErrKeyNotFound)
+	}
+	if ttl, ok := db.TTL("b"); !ok || ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Fatalf("got %v, %v, want about an hour", ttl, ok)
+	}
+	if _, ok := db.TTL("c"); ok {
+		t.Fatal("got a TTL for a key without expiration")
+	}
+	time.Sleep(40 * time.Millisecond)
+	if keys := db.Keys(); fmt.Sprint(keys) != "[b c]" {
+		t.Fatalf("got keys %q, want the expired keys hidden", keys)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Expiration times are stored
+	db, err = Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err := db.Stats(); err != nil || s.Keys != 2 {
+		t.Fatalf("got %d keys, %v, want the expired keys dropped", s.Keys, err)
+	}
+	if _, ok := db.TTL("b"); !ok {
+		t.Fatal("the TTL wasn't stored")
+	}
+	// Writing a key clears its expiration time
+	if err := db.Put("b", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.TTL("b"); ok {
+		t.Fatal("the TTL was kept after overwriting the key")
+	}
+	if err := db.Expire("c", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWithTTL("e", nil, 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	// Compaction keeps expiration times, the sweeper removes expired keys
+	db, err = Open(fpath, WithExpirySweep(5*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, ok := db.TTL("c"); !ok {
+		t.Fatal("the TTL wasn't kept by the compaction")
+	}
+	if db.Exists("e") {
+		t.Fatal("an expired key exists")
+	}
+	if err := db.PutWithTTL("f", nil, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(40 * time.Millisecond)
+	db.mu.RLock()
+	n, expiries := db.keys.len(), len(db.expiries)
+	db.mu.RUnlock()
+	if n != 2 || expiries != 1 {
+		t.Fatalf("got %d keys and %d expiration times, want the expired key swept", n, expiries)
+	}
+}
+
+func TestIncrBy(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// A missing key counts from zero
+	if n, err := db.IncrBy("n", 5); err != nil || n != 5 {
+		t.Fatalf("got %d, %v, want 5", n, err)
+	}
+	if n, err := db.IncrBy("n", -7); err != nil || n != -2 {
+		t.Fatalf("got %d, %v, want -2", n, err)
+	}
+	if v, err := db.Get("n"); err != nil || string(v) != "-2" {
+		t.Fatalf("got %q, %v, want the value stored as text", v, err)
+	}
+
+	if err := db.Put("s", []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.IncrBy("s", 1); !errors.Is(err, ErrNotInteger) {
+		t.Fatalf("got %v, want %v", err, ErrNotInteger)
+	}
+
+	// Overflows are errors and leave the value unchanged
+	if err := db.Put("max", []byte(fmt.Sprint(math.MaxInt64-1))); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.IncrBy("max", 1); err != nil || n != math.MaxInt64 {
+		t.Fatalf("got %d, %v, want %d", n, err, int64(math.MaxInt64))
+	}
+	if _, err := db.IncrBy("max", 1); err == nil || !strings.Contains(err.Error(), "overflow") {
+		t.Fatalf("got %v, want an overflow", err)
+	}
+	if n, err := db.IncrBy("min", math.MinInt64); err != nil || n != math.MinInt64 {
+		t.Fatalf("got %d, %v, want %d", n, err, int64(math.MinInt64))
+	}
+	if _, err := db.IncrBy("min", -1); err == nil || !strings.Contains(err.Error(), "overflow") {
+		t.Fatalf("got %v, want an overflow", err)
+	}
+	if v, err := db.Get("max"); err != nil || string(v) != fmt.Sprint(int64(math.MaxInt64)) {
+		t.Fatalf("got %q, %v, want the value unchanged", v, err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	for i, opts := range [][]Option{
+		nil,
+		{WithWriteBuffer(WriteBuffer{MaxRecords: 100}), WithEncryptionKey(make([]byte, 32))},
+	} {
+		db, err := Open(filepath.Join(t.TempDir(), "test.db"), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("a", []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("b", []byte("2")); err != nil {
+			t.Fatal(err)
+		}
+		s, err := db.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Writes and compactions after the snapshot aren't visible through it
+		if err := db.Put("a", []byte("changed")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Delete("b"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("c", []byte("3")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("a", []byte("after compaction")); err != nil {
+			t.Fatal(err)
+		}
+		if v, err := s.Get("a"); err != nil || string(v) != "1" {
+			t.Fatalf("options %d: got %q, %v, want the value at the time of the snapshot", i, v, err)
+		}
+		if !s.Exists("b") || s.Exists("c") {
+			t.Fatalf("options %d: got keys %q, want [a b]", i, s.Keys())
+		}
+		var got []string
+		err = s.ForEach(func(k string, v []byte) error {
+			got = append(got, k+"="+string(v))
+			return nil
+		})
+		if err != nil || fmt.Sprint(got) != "[a=1 b=2]" {
+			t.Fatalf("options %d: got %q, %v", i, got, err)
+		}
+
+		// The snapshot outlives the database
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if v, err := s.Get("b"); err != nil || string(v) != "2" {
+			t.Fatalf("options %d: got %q, %v after closing the database", i, v, err)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if s.Exists("a") {
+			t.Fatalf("options %d: a key exists in a closed snapshot", i)
+		}
+		if _, err := s.Get("a"); !errors.Is(err, ErrSnapshotClosed) {
+			t.Fatalf("options %d: got %v, want %v", i, err, ErrSnapshotClosed)
+		}
+	}
+}
+
+func TestTx(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes are only visible in the transaction until it's committed
+	tx := db.Begin()
+	if err := tx.Put("a", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Put("b", []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Put("c", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := tx.Get("a"); err != nil || string(v) != "2" {
+		t.Fatalf("got %q, %v, want the staged value", v, err)
+	}
+	if v, err := db.Get("a"); err != nil || string(v) != "1" {
+		t.Fatalf("got %q, %v, want the committed value", v, err)
+	}
+	if !tx.Exists("b") || db.Exists("b") || tx.Exists("c") {
+		t.Fatal("got staged writes visible outside of the transaction")
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrTxDone) {
+		t.Fatalf("got %v, want %v", err, ErrTxDone)
+	}
+	if err := tx.Rollback(); !errors.Is(err, ErrTxDone) {
+		t.Fatalf("got %v, want %v", err, ErrTxDone)
+	}
+	checkValues(t, db, map[string][]byte{"a": []byte("2"), "b": []byte("3")})
+
+	// Rollbacks discard the writes
+	tx = db.Begin()
+	if err := tx.Put("z", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if db.Exists("z") {
+		t.Fatal("got a write of a rolled back transaction")
+	}
+}
+
+func TestBinaryFormat(t *testing.T) {
+	dir := t.TempDir()
+	fpath := filepath.Join(dir, "test.db")
+	key := []byte("secret")
+	db, err := Open(fpath, WithFormat(FormatBinary), WithHMACChain(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]byte{
+		"a": []byte("x\ny\r\n\x00z"),
+		"c": bytes.Repeat([]byte{0, '\n'}, 5000),
+		"d": []byte("\n"),
+		"s": nil,
+		"t": []byte("1"),
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		if err := db.Put(k, want[k]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Set("s"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWithTTL("t", want["t"], time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	b := db.NewBatch()
+	b.Put("d", want["d"])
+	b.Delete("b")
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	check := func(db *DB) {
+		t.Helper()
+		checkValues(t, db, want)
+		if _, ok := db.TTL("t"); !ok {
+			t.Fatal("the TTL wasn't stored")
+		}
+	}
+
+	// The format of an existing file is kept
+	db, err = Open(fpath, WithHMACChain(key), WithLazyChecksums())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.format != FormatBinary {
+		t.Fatalf("got format %d, want %d", db.format, FormatBinary)
+	}
+	check(db)
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("e", []byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	want["e"] = []byte("after")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Migrations to and from text rows
+	textPath, binaryPath := filepath.Join(dir, "text.db"), filepath.Join(dir, "binary.db")
+	if err := Migrate(fpath, textPath, FormatChecksummed, WithHMACChain(key)); err != nil {
+		t.Fatal(err)
+	}
+	if err := Migrate(textPath, binaryPath, FormatBinary, WithHMACChain(key)); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(binaryPath, WithHMACChain(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupted values are detected when opening, or when read with lazy checksums
+	raw, err := os.ReadFile(binaryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := bytes.Index(raw, []byte("after"))
+	raw[i] = 'A'
+	if err := os.WriteFile(binaryPath, raw, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(binaryPath, WithHMACChain(key)); !errors.Is(err, ErrCorruptRecord) {
+		t.Fatalf("got %v, want %v", err, ErrCorruptRecord)
+	}
+	db, err = Open(binaryPath, WithHMACChain(key), WithLazyChecksums())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("e"); !errors.Is(err, ErrCorruptRecord) {
+		t.Fatalf("got %v, want %v", err, ErrCorruptRecord)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Torn rows are repaired
+	raw[i] = 'a'
+	if err := os.WriteFile(binaryPath, raw[:len(raw)-3], 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(binaryPath, WithHMACChain(key)); err == nil {
+		t.Fatal("opened a torn file without repairing it")
+	}
+	db, err = Open(binaryPath, WithHMACChain(key), WithRepair())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.TTL("t"); ok || !db.Exists("e") {
+		t.Fatal("got the torn expiration time kept, or the previous rows dropped")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(binaryPath, []byte("#textdb 9\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(binaryPath); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Fatalf("got %v, want %v", err, ErrUnsupportedFormat)
+	}
+}
+
+func TestHeader(t *testing.T) {
+	dir := t.TempDir()
+	fpath := filepath.Join(dir, "test.db")
+	db, err := Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := os.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const header = "#textdb 2 0\n"
+	if !strings.HasPrefix(string(raw), header) {
+		t.Fatalf("got %q, want the header %q", raw, header)
+	}
+	// The flags of the header must match the options
+	if _, err := Open(fpath, WithHMACChain([]byte("key"))); err == nil {
+		t.Fatal("opened a file without HMAC chain with WithHMACChain")
+	}
+	hmacPath := filepath.Join(dir, "hmac.db")
+	db, err = Open(hmacPath, WithHMACChain([]byte("key")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(hmacPath); err == nil {
+		t.Fatal("opened a file with HMAC chain without WithHMACChain")
+	}
+
+	// Files without header are still supported
+	legacyPath := filepath.Join(dir, "legacy.db")
+	if err := os.WriteFile(legacyPath, raw[len(header):], 0o600); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(legacyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValues(t, db, map[string][]byte{"k": []byte("v")})
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for content, want := range map[string]error{
+		"hello":           ErrNotATextDB,
+		"#textdb x\n":     ErrNotATextDB,
+		"#textdb 7 0\n":   ErrUnsupportedVersion,
+		"#textdb 2 128\n": ErrUnsupportedVersion,
+	} {
+		if err := os.WriteFile(legacyPath, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Open(legacyPath); !errors.Is(err, want) {
+			t.Fatalf("%q: got %v, want %v", content, err, want)
+		}
+	}
+
+	// Migrating to the text format writes its version in the header
+	textPath := filepath.Join(dir, "text.db")
+	if err := Migrate(fpath, textPath, FormatText); err != nil {
+		t.Fatal(err)
+	}
+	if raw, err := os.ReadFile(textPath); err != nil || string(raw) != "#textdb 1 0\nP1 1 k v\n" {
+		t.Fatalf("got %q, %v", raw, err)
+	}
+	db, err = Open(textPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkValues(t, db, map[string][]byte{"k": []byte("v")})
+}
+
+func TestBinarySafeKeysAndValues(t *testing.T) {
+	values := [][]byte{[]byte("\n"), []byte("\r\n"), {0}, []byte("a\nP1 1 x y\n"), []byte(" \n \n"), nil}
+	key := func(i int) string { return fmt.Sprintf("%c\n\x00", 'a'+i) }
+	for _, format := range []FormatVersion{FormatChecksummed, FormatBinary} {
+		fpath := filepath.Join(t.TempDir(), "test.db")
+		db, err := Open(fpath, WithFormat(format))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, v := range values {
+			if err := db.Put(key(i), v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = Open(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, want := range values {
+			if v, err := db.Get(key(i)); err != nil || !bytes.Equal(v, want) {
+				t.Fatalf("format %d: got %q, %v, want %q", format, v, err, want)
+			}
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The key length of a text row must end on the separator
+	fpath := filepath.Join(t.TempDir(), "test.db")
+	if err := os.WriteFile(fpath, []byte("P2 1 k v\nP1 1 a b\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(fpath); !errors.Is(err, ErrCorruptRecord) {
+		t.Fatalf("got %v, want %v", err, ErrCorruptRecord)
+	}
+}
+
+func TestStreamedValues(t *testing.T) {
+	big := bytes.Repeat([]byte("0123456789\n"), 100000)
+	for _, format := range []FormatVersion{FormatChecksummed, FormatBinary} {
+		for i, opts := range [][]Option{
+			nil,
+			{WithHMACChain([]byte("key"))},
+			{WithWriteBuffer(WriteBuffer{MaxBytes: 1 << 20})},
+		} {
+			fpath := filepath.Join(t.TempDir(), "test.db")
+			db, err := Open(fpath, append([]Option{WithFormat(format)}, opts...)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := db.PutReader("big", bytes.NewReader(big), int64(len(big))); err != nil {
+				t.Fatal(err)
+			}
+			// A reader shorter than its announced size isn't written
+			if err := db.PutReader("short", bytes.NewReader(big[:10]), 100); err == nil {
+				t.Fatalf("format %d, options %d: wrote a short value", format, i)
+			}
+			if err := db.Put("z", []byte("w")); err != nil {
+				t.Fatal(err)
+			}
+			rc, n, err := db.GetReader("big")
+			if err != nil || n != int64(len(big)) {
+				t.Fatalf("format %d, options %d: got size %d, %v, want %d", format, i, n, err, len(big))
+			}
+			v, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil || !bytes.Equal(v, big) {
+				t.Fatalf("format %d, options %d: got %d bytes, %v, want %d", format, i, len(v), err, len(big))
+			}
+			if _, _, err := db.GetReader("missing"); !errors.Is(err, ErrKeyNotFound) {
+				t.Fatalf("got %v, want %v", err, ErrKeyNotFound)
+			}
+			if db.hmacKey != nil {
+				if err := db.Verify(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			db, err = Open(fpath, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkValues(t, db, map[string][]byte{"big": big, "z": []byte("w")})
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Corrupted streamed values fail the read
+			raw, err := os.ReadFile(fpath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw[bytes.Index(raw, big[:10])+500] = 'X'
+			if err := os.WriteFile(fpath, raw, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			db, err = Open(fpath, append([]Option{WithLazyChecksums()}, opts...)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rc, _, err = db.GetReader("big")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadAll(rc); !errors.Is(err, ErrCorruptRecord) {
+				t.Fatalf("format %d, options %d: got %v, want %v", format, i, err, ErrCorruptRecord)
+			}
+			rc.Close()
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestFollow(t *testing.T) {
+	for _, format := range []FormatVersion{FormatChecksummed, FormatBinary} {
+		fpath := filepath.Join(t.TempDir(), "test.db")
+		writer, err := Open(fpath, WithFormat(format))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer writer.Close()
+		if err := writer.Put("a", []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+		follower, err := Open(fpath, WithFollow(0), WithValueCache(1<<20))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkValues(t, follower, map[string][]byte{"a": []byte("1")})
+		if err := follower.Put("x", nil); err == nil {
+			t.Fatalf("format %d: wrote with a follower", format)
+		}
+
+		// Writes and compactions of the writer are replayed when catching up
+		if err := writer.Put("a", []byte("2")); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Put("b", []byte("3")); err != nil {
+			t.Fatal(err)
+		}
+		b := writer.NewBatch()
+		b.Put("c", []byte("4"))
+		b.Delete("b")
+		if err := b.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if err := follower.CatchUp(); err != nil {
+			t.Fatal(err)
+		}
+		checkValues(t, follower, map[string][]byte{"a": []byte("2"), "c": []byte("4")})
+		if err := writer.Put("d", []byte("5")); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Put("e", []byte("6")); err != nil {
+			t.Fatal(err)
+		}
+		if err := follower.CatchUp(); err != nil {
+			t.Fatal(err)
+		}
+		checkValues(t, follower, map[string][]byte{"a": []byte("2"), "c": []byte("4"), "d": []byte("5"), "e": []byte("6")})
+		if err := follower.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Followers with an interval catch up in the background
+		follower, err = Open(fpath, WithFollow(5*time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Delete("e"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+		follower.mu.RLock()
+		exists := follower.exists("e")
+		follower.mu.RUnlock()
+		if exists {
+			t.Fatalf("format %d: the follower didn't catch up in the background", format)
+		}
+		if err := follower.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFollowEmptyFile(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "test.db")
+	if err := os.WriteFile(fpath, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	follower, err := Open(fpath, WithFollow(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Close()
+	writer, err := Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	if err := writer.Put("k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.CatchUp(); err != nil {
+		t.Fatal(err)
+	}
+	checkValues(t, follower, map[string][]byte{"k": []byte("v")})
+}
+
+func TestWatch(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	receive := func(ch <-chan Event, n int) string {
+		t.Helper()
+		var got []string
+		for len(got) < n {
+			select {
+			case e := <-ch:
+				got = append(got, fmt.Sprintf("%d %s=%s", e.Op, e.Key, e.Value))
+			case <-time.After(time.Second):
+				t.Fatalf("got events %q, want %d", got, n)
+			}
+		}
+		return strings.Join(got, ", ")
+	}
+
+	events, stop := db.Watch("user:")
+	all, stopAll := db.Watch("")
+	defer stopAll()
+	if err := db.Put("user:1", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("other", []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("user:2"); err != nil {
+		t.Fatal(err)
+	}
+	b := db.NewBatch()
+	b.Put("user:3", []byte("c"))
+	b.Delete("user:1")
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutReader("user:4", strings.NewReader("d"), 1); err != nil {
+		t.Fatal(err)
+	}
+	// Expired keys are reported once removed from the index
+	if err := db.PutWithTTL("user:5", []byte("e"), time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	db.mu.Lock()
+	db.purgeExpired()
+	db.mu.Unlock()
+	want := "1 user:1=a, 2 user:2=, 1 user:3=c, 3 user:1=, 1 user:4=d, 1 user:5=e, 3 user:5="
+	if got := receive(events, 7); got != want {
+		t.Fatalf("got events %q, want %q", got, want)
+	}
+	if got := receive(all, 8); !strings.Contains(got, "1 other=b") {
+		t.Fatalf("got events %q, want all the keys", got)
+	}
+	stop()
+	if _, ok := <-events; ok {
+		t.Fatal("the channel wasn't closed when stopping")
+	}
+
+	// Followers report the writes they catch up with, and close the channels when closed
+	follower, err := Open(fpath, WithFollow(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, _ = follower.Watch("user:")
+	if err := db.Put("user:6", []byte("f")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("user:3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.CatchUp(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := receive(events, 2), "1 user:6=f, 3 user:3="; got != want {
+		t.Fatalf("got events %q, want %q", got, want)
+	}
+	if err := follower.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-events; ok {
+		t.Fatal("the channel wasn't closed when closing the database")
+	}
+}
+
+func TestSegments(t *testing.T) {
+	dir := t.TempDir()
+	cfg := SegmentConfig{MaxSegmentSize: 200}
+	s, err := OpenSegmented(dir, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := s.Put(fmt.Sprintf("k%d", i%10), []byte(fmt.Sprintf("value-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Delete("k3"); err != nil {
+		t.Fatal(err)
+	}
+	segments := len(s.segments)
+	if segments < 3 {
+		t.Fatalf("got %d segments, want the writes split in at least 3", segments)
+	}
+	check := func(s *SegmentedDB) {
+		t.Helper()
+		for i := 0; i < 10; i++ {
+			v, err := s.Get(fmt.Sprintf("k%d", i))
+			if i == 3 {
+				if !errors.Is(err, ErrKeyNotFound) {
+					t.Fatalf("got %q, %v for a deleted key", v, err)
+				}
+				continue
+			}
+			if want := fmt.Sprintf("value-%d", 40+i); err != nil || string(v) != want {
+				t.Fatalf("got %q, %v, want %q", v, err, want)
+			}
+		}
+	}
+	check(s)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = OpenSegmented(dir, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(s)
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check(s)
+	if len(s.segments) >= segments {
+		t.Fatalf("got %d segments after compaction, want less than %d", len(s.segments), segments)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, SegmentManifest)); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = OpenSegmented(dir, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	check(s)
+}
+
+func TestHintFile(t *testing.T) {
+	for i, opts := range [][]Option{
+		nil,
+		{WithHMACChain([]byte("secret"))},
+		{WithFormat(FormatBinary)},
+		{WithIndexMemoryLimit(64)},
+	} {
+		fpath := filepath.Join(t.TempDir(), "test.db")
+		withHint := append([]Option{WithHintFile()}, opts...)
+		db, err := Open(fpath, withHint...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string][]byte{"flag": nil, "ttl": []byte("x")}
+		for j := 0; j < 100; j++ {
+			k, v := fmt.Sprintf("k%d", j), []byte(fmt.Sprintf("v%d", j))
+			if err := db.Put(k, v); err != nil {
+				t.Fatal(err)
+			}
+			want[k] = v
+		}
+		if err := db.Set("flag"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Delete("k5"); err != nil {
+			t.Fatal(err)
+		}
+		delete(want, "k5")
+		if err := db.PutWithTTL("ttl", want["ttl"], time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(fpath + HintSuffix); err != nil {
+			t.Fatalf("options %d: %v", i, err)
+		}
+
+		// Rows written after the hint file are replayed
+		db, err = Open(fpath, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("after", []byte("hint")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Delete("k7"); err != nil {
+			t.Fatal(err)
+		}
+		want["after"] = []byte("hint")
+		delete(want, "k7")
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		check := func(db *DB) {
+			t.Helper()
+			checkValues(t, db, want)
+			if _, ok := db.TTL("ttl"); !ok {
+				t.Fatalf("options %d: the TTL wasn't loaded", i)
+			}
+		}
+		db, err = Open(fpath, withHint...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(db)
+		if err := db.Put("more", nil); err != nil {
+			t.Fatal(err)
+		}
+		want["more"] = nil
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		check(db)
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		db, err = Open(fpath, withHint...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(db)
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDeadBytes(t *testing.T) {
+	for i, opts := range [][]Option{nil, {WithFormat(FormatBinary)}, {WithCompression(gzipCompressor{}, 10)}} {
+		db, err := Open(filepath.Join(t.TempDir(), "test.db"), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 100; j++ {
+			if err := db.Put(fmt.Sprintf("k%d", j%50), []byte(fmt.Sprintf("value-%d-%s", j, strings.Repeat("x", 40)))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Set("s"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutWithTTL("t", []byte("x"), time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		s, err := db.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dead := db.DeadBytes(); dead == 0 || dead != s.TotalBytes-s.LiveBytes {
+			t.Fatalf("options %d: got %d dead bytes, want the %d overwritten bytes", i, dead, s.TotalBytes-s.LiveBytes)
+		}
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		// The live size is exact for a compacted file
+		if s, err := db.Stats(); err != nil || db.DeadBytes() != 0 || s.LiveBytes != s.TotalBytes {
+			t.Fatalf("options %d: got %d dead bytes and %+v, %v after compaction", i, db.DeadBytes(), s, err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(fpath, WithSyncPolicy(SyncEveryWrite))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("a", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("a"); err != nil {
+		t.Fatal(err)
+	}
+	b := db.NewBatch()
+	b.Put("c", []byte("3"))
+	b.Put("d", []byte("4"))
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Keys != 4 || s.Reads != 1 || s.Writes != 4 || s.RowsReplayed != 0 {
+		t.Fatalf("got %+v, want 4 keys, 1 read and 4 writes", s)
+	}
+	if s.DeadRatio <= 0 || s.LiveBytes >= s.TotalBytes || s.LastSync.IsZero() || s.LastWrite.IsZero() {
+		t.Fatalf("got %+v, want the overwritten row counted as dead", s)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Stats(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("got %v, want %v", err, ErrClosed)
+	}
+
+	// Sizes are the same once replayed, operation counters start over
+	db, err = Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	replayed, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed.Keys != s.Keys || replayed.LiveBytes != s.LiveBytes || replayed.TotalBytes != s.TotalBytes || replayed.RowsReplayed == 0 {
+		t.Fatalf("got %+v, want the sizes of %+v", replayed, s)
+	}
+	if replayed.Reads != 0 || replayed.Writes != 0 || !replayed.LastSync.IsZero() {
+		t.Fatalf("got %+v, want the counters reset", replayed)
+	}
+	if fi, err := os.Stat(fpath); err != nil || fi.Size() != replayed.TotalBytes {
+		t.Fatalf("got %v, want the size of the file", err)
+	}
+}
+
+func TestContext(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 5000; i++ {
+		if err := db.Put(fmt.Sprint("k", i%2000), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Canceling stops the iteration and fails the other operations
+	ctx, cancel := context.WithCancel(context.Background())
+	n := 0
+	err = db.ForEachContext(ctx, func(k string, v []byte) error {
+		if n++; n == 10 {
+			cancel()
+		}
+		return nil
+	})
+	if n != 10 || !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %d keys, %v, want the iteration stopped", n, err)
+	}
+	if err := db.CompactContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+	if _, _, err := db.GetReaderContext(ctx, "k1"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+	if s := db.CompactionStats(); s.Runs != 0 {
+		t.Fatalf("got %d compactions, want the canceled one not counted", s.Runs)
+	}
+
+	if err := db.CompactContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if s := db.CompactionStats(); s.Runs != 1 || s.BytesReclaimed == 0 {
+		t.Fatalf("got %+v, want a compaction", s)
+	}
+	rc, _, err := db.GetReaderContext(context.Background(), "k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if v, err := io.ReadAll(rc); err != nil || string(v) != "value" {
+		t.Fatalf("got %q, %v", v, err)
+	}
+	if v, err := db.Get("k1999"); err != nil || string(v) != "value" {
+		t.Fatalf("got %q, %v", v, err)
+	}
+}
+
+func TestTyped(t *testing.T) {
+	type user struct {
+		Name string
+		Age  int
+	}
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, c := range []Codec[user]{JSONCodec[user]{}, GobCodec[user]{}} {
+		s := Typed[user](db, c)
+		want := user{Name: "a", Age: 3}
+		if err := s.Put("user:1", want); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Set("user:2"); err != nil {
+			t.Fatal(err)
+		}
+		if u, err := s.Get("user:1"); err != nil || u != want {
+			t.Fatalf("%T: got %+v, %v, want %+v", c, u, err, want)
+		}
+		if _, err := s.Get("missing"); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("%T: got %v, want %v", c, err, ErrKeyNotFound)
+		}
+		// Keys without value are skipped
+		var keys []string
+		err := s.Scan("user:", func(k string, u user) error {
+			keys = append(keys, k)
+			return nil
+		})
+		if err != nil || fmt.Sprint(keys) != "[user:1]" {
+			t.Fatalf("%T: got %q, %v, want [user:1]", c, keys, err)
+		}
+	}
+}
+
+func TestGetManyPutMany(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(fpath, WithCompression(gzipCompressor{}, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutMany(map[string][]byte{"a": []byte("1"), "b": []byte("22"), "c": nil}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("d"); err != nil {
+		t.Fatal(err)
+	}
+	// Missing keys are left out, keys without value map to an empty value
+	m, err := db.GetMany([]string{"a", "b", "c", "d", "missing"})
+	if err != nil || len(m) != 4 || string(m["a"]) != "1" || string(m["b"]) != "22" || m["c"] == nil || m["d"] == nil {
+		t.Fatalf("got %q, %v", m, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if m, err := db.GetMany([]string{"a", "b"}); err != nil || string(m["a"]) != "1" || string(m["b"]) != "22" {
+		t.Fatalf("got %q, %v after reopening", m, err)
+	}
+}
+
+func TestBuckets(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, orders := db.Bucket("users"), db.Bucket("orders")
+	for _, w := range []struct {
+		b    *Bucket
+		k, v string
+	}{{users, "1", "a"}, {users, "2", "b"}, {orders, "1", "c"}} {
+		if err := w.b.Put(w.k, []byte(w.v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("users1", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Buckets don't see the keys of other buckets or of the database
+	if v, err := users.Get("1"); err != nil || string(v) != "a" {
+		t.Fatalf("got %q, %v, want %q", v, err, "a")
+	}
+	if _, err := users.Get("3"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("got %v, want %v", err, ErrKeyNotFound)
+	}
+	var keys []string
+	err = users.ForEach(func(k string, v []byte) error {
+		keys = append(keys, k+"="+string(v))
+		return nil
+	})
+	if err != nil || fmt.Sprint(keys) != "[1=a 2=b]" {
+		t.Fatalf("got %q, %v", keys, err)
+	}
+	if names, err := db.ListBuckets(); err != nil || fmt.Sprint(names) != "[orders users]" {
+		t.Fatalf("got %q, %v", names, err)
+	}
+	if err := db.DeleteBucket("users"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if names, err := db.ListBuckets(); err != nil || fmt.Sprint(names) != "[orders]" {
+		t.Fatalf("got %q, %v after deleting a bucket", names, err)
+	}
+	if db.Bucket("users").Exists("1") || !db.Exists("users1") {
+		t.Fatal("deleting a bucket didn't delete only its keys")
+	}
+	if err := db.Bucket("a\x00b").Put("k", nil); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidKey)
+	}
+}
+
+func TestOpenAt(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(fpath, WithHintFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	s, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("a", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	b := db.NewBatch()
+	b.Put("b", []byte("3"))
+	b.Put("c", []byte("4"))
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rows past the point aren't applied, nor batches cut by it, nor the hint file
+	for _, tc := range []struct {
+		at     RecoveryPoint
+		a      string
+		exists bool
+	}{
+		{RecoveryPoint{Offset: s.TotalBytes}, "1", false},
+		{RecoveryPoint{Offset: s.TotalBytes + 3}, "1", false},
+		{RecoveryPoint{Rows: 2}, "2", false},
+		{RecoveryPoint{Rows: 4}, "2", false},
+		{RecoveryPoint{Rows: 5}, "2", true},
+		{RecoveryPoint{Offset: 5}, "", false},
+		{RecoveryPoint{}, "2", true},
+	} {
+		db, err := OpenAt(fpath, tc.at)
+		if err != nil {
+			t.Fatalf("%+v: %v", tc.at, err)
+		}
+		v, err := db.Get("a")
+		if tc.a == "" && !errors.Is(err, ErrKeyNotFound) || tc.a != "" && string(v) != tc.a {
+			t.Fatalf("%+v: got %q, %v, want %q", tc.at, v, err, tc.a)
+		}
+		if db.Exists("b") != tc.exists {
+			t.Fatalf("%+v: got the batch applied %v, want %v", tc.at, !tc.exists, tc.exists)
+		}
+		if err := db.Put("z", nil); !errors.Is(err, ErrReadOnly) {
+			t.Fatalf("got %v, want %v", err, ErrReadOnly)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReplayLargeValues(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "test.db")
+	key := WithHMACChain([]byte("secret"))
+	db, err := NewDB(fpath, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3000; i++ {
+		if err := db.Put(fmt.Sprintf("k%c", 'a'+i%26), make([]byte, 1+i*7%100000)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("small", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.putMeta("m", "meta"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDB(fpath, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Get("small"); err != nil || string(v) != "v" || db.meta["m"] != "meta" {
+		t.Fatalf("got %q, %v and metadata %q", v, err, db.meta)
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A large value cut by the end of the file is detected
+	fi, err := os.Stat(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(fpath, fi.Size()-10000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDB(fpath, key); err == nil {
+		t.Fatal("opened a truncated file")
+	}
+}
+
+func TestHistory(t *testing.T) {
+	for i, opts := range [][]Option{
+		{WithTimestamps()},
+		{WithTimestamps(), WithFormat(FormatBinary), WithHMACChain([]byte("secret")), WithCompression(gzipCompressor{}, 1)},
+		nil,
+	} {
+		timestamps := len(opts) > 0
+		fpath := filepath.Join(t.TempDir(), "test.db")
+		db, err := Open(fpath, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("a", []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+		if err := db.Put("a", []byte("2")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Delete("a"); err != nil {
+			t.Fatal(err)
+		}
+		b := db.NewBatch()
+		b.Put("a", []byte("3"))
+		b.Set("b")
+		if err := b.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		db, err = Open(fpath, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Set("a"); err != nil {
+			t.Fatal(err)
+		}
+		h, err := db.History("a")
+		if err != nil || len(h) != 5 {
+			t.Fatalf("options %d: got %+v, %v, want 5 versions", i, h, err)
+		}
+		if string(h[0].Value) != "1" || string(h[1].Value) != "2" || !h[2].Deleted || string(h[3].Value) != "3" || h[4].Value == nil {
+			t.Fatalf("options %d: got %+v", i, h)
+		}
+		if timestamps && (h[0].Time.IsZero() || !h[1].Time.After(h[0].Time) || time.Since(h[4].Time) > time.Second) {
+			t.Fatalf("options %d: got %+v, want the write times", i, h)
+		}
+		if !timestamps && !h[0].Time.IsZero() {
+			t.Fatalf("options %d: got %+v, want no write times", i, h)
+		}
+
+		// Compaction only keeps the current value, without its write time
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("a", []byte("4")); err != nil {
+			t.Fatal(err)
+		}
+		h, err = db.History("a")
+		if err != nil || len(h) != 2 || !h[0].Time.IsZero() || timestamps && h[1].Time.IsZero() {
+			t.Fatalf("options %d: got %+v, %v after compaction", i, h, err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGetVersion(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "test.db")
+	opts := []Option{WithVersions(3), WithCompression(gzipCompressor{}, 1)}
+	db, err := Open(fpath, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range []testWrite{
+		{"a", []byte("1"), true},
+		{"a", []byte("2"), true},
+		{"a", nil, false},
+		{"a", []byte("3"), true},
+		{"a", nil, true},
+	} {
+		switch {
+		case !w.write:
+			err = db.Delete(w.k)
+		case w.v == nil:
+			err = db.Set(w.k)
+		default:
+			err = db.Put(w.k, w.v)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The versions are loaded when replaying, deletes and versions past the limit aren't found
+	db, err = Open(fpath, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for n, want := range []string{"", "3", "deleted", "2", "dropped"} {
+		v, err := db.GetVersion("a", n)
+		if want == "deleted" || want == "dropped" {
+			if !errors.Is(err, ErrKeyNotFound) {
+				t.Fatalf("version %d: got %q, %v, want %v", n, v, err, ErrKeyNotFound)
+			}
+			continue
+		}
+		if err != nil || string(v) != want {
+			t.Fatalf("version %d: got %q, %v, want %q", n, v, err, want)
+		}
+	}
+
+	// Compaction drops the previous versions
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetVersion("a", 1); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("got %v, want %v", err, ErrKeyNotFound)
+	}
+	if err := db.Put("a", []byte("4")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.GetVersion("a", 1); err != nil || len(v) != 0 {
+		t.Fatalf("got %q, %v, want the empty value kept by the compaction", v, err)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	type lookupStore interface {
+		Store
+		Lookup(k string) ([]byte, bool, error)
+	}
+	for _, s := range []lookupStore{db, NewMemDB()} {
+		if err := s.Set("set"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Put("put", []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+		if v, ok, err := s.Lookup("set"); err != nil || !ok || v == nil || len(v) != 0 {
+			t.Fatalf("%T: got %#v, %v, %v, want an empty value", s, v, ok, err)
+		}
+		if v, ok, err := s.Lookup("put"); err != nil || !ok || string(v) != "v" {
+			t.Fatalf("%T: got %q, %v, %v, want %q", s, v, ok, err, "v")
+		}
+		// Missing keys aren't errors
+		if v, ok, err := s.Lookup("missing"); err != nil || ok || v != nil {
+			t.Fatalf("%T: got %q, %v, %v for a missing key", s, v, ok, err)
+		}
+	}
+}
+
+func TestReplayProgress(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const rows = 800
+	v := make([]byte, 64<<10)
+	for i := 0; i < rows; i++ {
+		if err := db.Put(fmt.Sprint(i%10), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []ReplayProgress
+	db, err = Open(fpath, WithReplayProgress(func(p ReplayProgress) { got = append(got, p) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only opening reports progress
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) < 2 {
+		t.Fatalf("got %+v, want reports while replaying", got)
+	}
+	for i, p := range got[:len(got)-1] {
+		if p.Done || p.Offset >= got[i+1].Offset || p.TotalBytes != got[i+1].TotalBytes {
+			t.Fatalf("got %+v, want increasing offsets", got)
+		}
+	}
+	if last := got[len(got)-1]; !last.Done || last.Rows != rows || last.Offset != last.TotalBytes {
+		t.Fatalf("got %+v, want the %d rows read", last, rows)
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	const n = 10000
+	seed := maphash.MakeSeed()
+	bf := newBloomFilter(seed, n, 0.01)
+	for i := 0; i < n; i++ {
+		bf.add(maphash.Bytes(seed, []byte(fmt.Sprint("k", i))))
+	}
+	falsePositives := 0
+	for i := 0; i < n; i++ {
+		if !bf.mayContain(fmt.Sprint("k", i)) {
+			t.Fatalf("got a false negative for k%d", i)
+		}
+		if bf.mayContain(fmt.Sprint("x", i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 2*n/100 {
+		t.Fatalf("got %d false positives out of %d, want about 1%%", falsePositives, n)
+	}
+
+	// The runs of a spilled index get a filter
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), WithIndexMemoryLimit(16<<10), WithIndexBloomFilter(0.01))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < n/2; i++ {
+		if err := db.Put(fmt.Sprint("k", i), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.mu.RLock()
+	si := db.keys.(*spillIndex)
+	spilled := len(si.runs) > 0 && si.runs[0].bloom != nil
+	db.mu.RUnlock()
+	if !spilled {
+		t.Fatal("got no spilled run with a bloom filter")
+	}
+	for i := 0; i < n/2; i++ {
+		if !db.Exists(fmt.Sprint("k", i)) || db.Exists(fmt.Sprint("x", i)) {
+			t.Fatalf("got the wrong existence of k%d or x%d", i, i)
+		}
+	}
+}
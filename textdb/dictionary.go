@@ -0,0 +1,136 @@
+package textdb
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"math/rand"
+	"sort"
+)
+
+// Maximum dictionary size, flate only looks back this far.
+const maxDictionarySize = 32 << 10
+
+// dictionaryGramSize is the length of the byte sequences counted when training a dictionary.
+const dictionaryGramSize = 8
+
+// NewDictCompressor returns a flate compressor using a preset dictionary (see TrainDictionary),
+// which greatly improves the compression of small similar values (e.g. JSON documents or URLs).
+// The same ID and dictionary must be used to read values back.
+func NewDictCompressor(id byte, dict []byte) Compressor {
+	if len(dict) > maxDictionarySize {
+		dict = dict[len(dict)-maxDictionarySize:]
+	}
+	return dictCompressor{id: id, dict: dict}
+}
+
+type dictCompressor struct {
+	id   byte
+	dict []byte
+}
+
+func (c dictCompressor) ID() byte { return c.id }
+
+func (c dictCompressor) Compress(v []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, _ := flate.NewWriterDict(&buf, flate.BestCompression, c.dict)
+	if _, err := zw.Write(v); err != nil {
+		return nil, err
+	}
+	err := zw.Close()
+	return buf.Bytes(), err
+}
+
+func (c dictCompressor) Decompress(v []byte) ([]byte, error) {
+	return io.ReadAll(flate.NewReaderDict(bytes.NewReader(v), c.dict))
+}
+
+// TrainDictionary builds a dictionary of at most size bytes from sample values,
+// made of the byte sequences found in the most samples.
+// The most common sequences are placed at the end, where they are the cheapest to reference.
+func TrainDictionary(samples [][]byte, size int) []byte {
+	if size > maxDictionarySize {
+		size = maxDictionarySize
+	}
+
+	// Count the number of samples each sequence appears in
+	counts := make(map[string]int)
+	seen := make(map[string]bool)
+	for _, s := range samples {
+		for k := range seen {
+			delete(seen, k)
+		}
+		for i := 0; i+dictionaryGramSize <= len(s); i++ {
+			g := string(s[i : i+dictionaryGramSize])
+			if !seen[g] {
+				seen[g] = true
+				counts[g]++
+			}
+		}
+	}
+	grams := make([]string, 0, len(counts))
+	for g, n := range counts {
+		if n > 1 {
+			grams = append(grams, g)
+		}
+	}
+	sort.Slice(grams, func(i, j int) bool {
+		if counts[grams[i]] != counts[grams[j]] {
+			return counts[grams[i]] > counts[grams[j]]
+		}
+		return grams[i] < grams[j]
+	})
+
+	// Keep the most common sequences that aren't already part of the dictionary
+	var selected []string
+	var dict []byte
+	for _, g := range grams {
+		if len(dict)+len(g) > size {
+			break
+		}
+		if bytes.Contains(dict, []byte(g)) {
+			continue
+		}
+		selected = append(selected, g)
+		dict = append(dict, g...)
+	}
+	dict = dict[:0]
+	for i := len(selected) - 1; i >= 0; i-- {
+		dict = append(dict, selected[i]...)
+	}
+	return dict
+}
+
+// SampleValues returns up to n values picked at random, to train a dictionary with.
+func (db *DB) SampleValues(n int) ([][]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	var keys []string
+	seen := 0
+	db.keys.forEach(func(k []byte, r ref) bool {
+		if !r.hasValue() {
+			return true
+		}
+		// Reservoir sampling
+		seen++
+		if len(keys) < n {
+			keys = append(keys, string(k))
+		} else if i := rand.Intn(seen); i < n {
+			keys[i] = string(k)
+		}
+		return true
+	})
+	samples := make([][]byte, 0, len(keys))
+	for _, k := range keys {
+		r, _ := db.keys.get(k)
+		v, err := db.readValue(k, r)
+		if err != nil {
+			return nil, err
+		}
+		samples = append(samples, v)
+	}
+	return samples, nil
+}
@@ -0,0 +1,57 @@
+package textdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+var ErrDiskFull = errors.New("disk full")
+
+// Degraded returns the error of the last write that failed because the disk was full, or nil.
+// While degraded, reads are still served and each write retries,
+// the database leaves the degraded state as soon as a write succeeds.
+func (db *DB) Degraded() error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.degraded
+}
+
+// writeFailed handles an append that failed after writing n bytes.
+// Since the index is only updated after a successful write, it only needs to remove
+// the partial row from the file so that the next row is appended at the expected offset.
+func (db *DB) writeFailed(n int, err error) error {
+	if n > 0 {
+		db.tornTail = true
+		db.truncateTornTail()
+	}
+	if isDiskFull(err) {
+		err = fmt.Errorf("%w: %w", ErrDiskFull, err)
+		db.degraded = err
+	}
+	return err
+}
+
+// truncateTornTail removes the bytes of a partially written row at the end of the file.
+// The append-only handle can't be truncated on all platforms so another handle is used.
+func (db *DB) truncateTornTail() error {
+	if !db.tornTail {
+		return nil
+	}
+	f, err := db.fs.OpenFile(db.fpath, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("truncate partial row: %w", err)
+	}
+	err = f.Truncate(int64(db.wIndex))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("truncate partial row: %w", err)
+	}
+	if db.prealloc != nil {
+		db.prealloc.offset = int64(db.wIndex)
+	}
+	db.tornTail = false
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+
+package textdb
+
+import (
+	"errors"
+	"syscall"
+)
+
+func isDiskFull(err error) bool { return errors.Is(err, syscall.ENOSPC) }
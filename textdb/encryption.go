@@ -0,0 +1,116 @@
+package textdb
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// WithEncryptionKey encrypts values with AES-GCM using the given 16, 24 or 32 byte key.
+// It is equivalent to a keyring that only contains the key with ID 0.
+// Files record whether they're encrypted when they're created (see FlagEncrypted),
+// so opening an encrypted file without a key or a plaintext file with one fails.
+func WithEncryptionKey(key []byte) Option {
+	return WithEncryptionKeyring(0, map[byte][]byte{0: key})
+}
+
+// WithEncryptionKeyring encrypts new values with the key of the given ID
+// and decrypts existing values with the key they were written with.
+//
+// Each value is stored as the key ID, a random nonce and the sealed value,
+// the key ID along with the op and key of the row are authenticated.
+func WithEncryptionKeyring(currentKeyID byte, keys map[byte][]byte) Option {
+	return func(db *DB) {
+		db.encryptionKeyID = currentKeyID
+		db.encryptionKeys = keys
+	}
+}
+
+// encrypts reports whether values are encrypted with the options of the database.
+func (db *DB) encrypts() bool {
+	return db.encryptionKeys != nil || db.passphrase != "" || db.keyProvider != nil
+}
+
+func (db *DB) initEncryption() error {
+	// Files without header predate the flag, their values are decrypted if there's a key
+	switch headerless := db.dataStart == 0; {
+	case headerless:
+	case db.encrypted && db.encryptionKeys == nil:
+		return errors.New("the file is encrypted, an encryption key or passphrase is required")
+	case !db.encrypted && db.encryptionKeys != nil:
+		return errors.New("the file isn't encrypted")
+	}
+	if db.encryptionKeys == nil {
+		return nil
+	}
+	if _, ok := db.encryptionKeys[db.encryptionKeyID]; !ok {
+		return fmt.Errorf("init encryption: missing current key (ID %d)", db.encryptionKeyID)
+	}
+	db.aeads = make(map[byte]cipher.AEAD, len(db.encryptionKeys))
+	for id, key := range db.encryptionKeys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return fmt.Errorf("init encryption: %w (key ID %d)", err, id)
+		}
+		db.aeads[id], err = cipher.NewGCM(block)
+		if err != nil {
+			return fmt.Errorf("init encryption: %w (key ID %d)", err, id)
+		}
+	}
+	return nil
+}
+
+func encryptionAdditionalData(keyID byte, op byte, k string) []byte {
+	return append([]byte{keyID, op}, k...)
+}
+
+func (db *DB) encryptValue(op byte, k string, v []byte) ([]byte, error) {
+	if db.aeads == nil {
+		return v, nil
+	}
+	aead := db.aeads[db.encryptionKeyID]
+	sealed := make([]byte, 1+aead.NonceSize(), 1+aead.NonceSize()+len(v)+aead.Overhead())
+	sealed[0] = db.encryptionKeyID
+	nonce := sealed[1:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("generate nonce: %w", err)
+	}
+	return aead.Seal(sealed, nonce, v, encryptionAdditionalData(db.encryptionKeyID, op, k)), nil
+}
+
+var ErrDecrypt = errors.New("decrypt value")
+
+func (db *DB) decryptValue(op byte, k string, stored []byte) ([]byte, error) {
+	if db.aeads == nil {
+		return stored, nil
+	}
+	if len(stored) == 0 {
+		return nil, fmt.Errorf("%w: %q: missing key ID", ErrDecrypt, k)
+	}
+	keyID := stored[0]
+	aead, ok := db.aeads[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q: unknown key ID %d", ErrDecrypt, k, keyID)
+	}
+	if len(stored) < 1+aead.NonceSize() {
+		return nil, fmt.Errorf("%w: %q: value too short", ErrDecrypt, k)
+	}
+	nonce, ciphertext := stored[1:1+aead.NonceSize()], stored[1+aead.NonceSize():]
+	v, err := aead.Open(nil, nonce, ciphertext, encryptionAdditionalData(keyID, op, k))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q: %w", ErrDecrypt, k, err)
+	}
+	return v, nil
+}
+
+// reencryptValue decrypts a stored value and encrypts it again with the current key.
+func (db *DB) reencryptValue(op byte, k string, stored []byte) ([]byte, error) {
+	v, err := db.decryptValue(op, k, stored)
+	if err != nil {
+		return nil, err
+	}
+	return db.encryptValue(op, k, v)
+}
@@ -0,0 +1,93 @@
+package textdb
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// Failpoint names, see EnableFailpoint.
+const (
+	// FailpointWrite is hit on each write to the file (of one row, or of the write buffer when enabled).
+	FailpointWrite = "write"
+
+	// FailpointSync is hit when the file is synced to disk.
+	FailpointSync = "sync"
+
+	// FailpointCompact is hit once the compacted file is written, before it replaces the database file.
+	FailpointCompact = "compact"
+)
+
+// Failpoint is a fault injected at a point of the write path.
+type Failpoint struct {
+	Err        error // error returned when the failpoint triggers
+	ShortWrite int   // number of bytes written before failing, to simulate a torn write
+	Skip       int   // number of hits before the failpoint starts triggering
+	Times      int   // number of times the failpoint triggers, 0 for every hit
+}
+
+var failpoints struct {
+	enabled atomic.Bool
+	mu      sync.Mutex
+	active  map[string]*failpointState
+}
+
+type failpointState struct {
+	fp        Failpoint
+	hits      int
+	triggered int
+}
+
+// EnableFailpoint injects a fault at the named point for all databases of the process,
+// to test crash recovery. It returns a function that disables the failpoint.
+// It's meant for tests only.
+func EnableFailpoint(name string, fp Failpoint) (disable func()) {
+	failpoints.mu.Lock()
+	defer failpoints.mu.Unlock()
+	if failpoints.active == nil {
+		failpoints.active = make(map[string]*failpointState)
+	}
+	failpoints.active[name] = &failpointState{fp: fp}
+	failpoints.enabled.Store(true)
+	return func() {
+		failpoints.mu.Lock()
+		defer failpoints.mu.Unlock()
+		delete(failpoints.active, name)
+		failpoints.enabled.Store(len(failpoints.active) > 0)
+	}
+}
+
+// hitFailpoint returns the failpoint if it triggers on this hit.
+func hitFailpoint(name string) *Failpoint {
+	if !failpoints.enabled.Load() {
+		return nil
+	}
+	failpoints.mu.Lock()
+	defer failpoints.mu.Unlock()
+	st, ok := failpoints.active[name]
+	if !ok {
+		return nil
+	}
+	st.hits++
+	if st.hits <= st.fp.Skip || (st.fp.Times > 0 && st.triggered >= st.fp.Times) {
+		return nil
+	}
+	st.triggered++
+	return &st.fp
+}
+
+// failpointWriter is the last writer before the file, it injects write faults.
+type failpointWriter struct{ w io.Writer }
+
+func (fw failpointWriter) Write(p []byte) (int, error) {
+	fp := hitFailpoint(FailpointWrite)
+	if fp == nil {
+		return fw.w.Write(p)
+	}
+	n := fp.ShortWrite
+	if n > len(p) {
+		n = len(p)
+	}
+	n, _ = fw.w.Write(p[:n])
+	return n, fp.Err
+}
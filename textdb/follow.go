@@ -0,0 +1,96 @@
+package textdb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// A follower is a read-only database that reads the rows appended by the writer of the file
+// (usually another process) to keep its index up to date. It doesn't take the lock,
+// and only sees rows once the writer has written them to the file (not while they're in its write buffer).
+// When the writer compacts the file, the follower loads the new one.
+
+// WithFollow opens the database read-only as a follower, catching up with the file at the given interval
+// (only on CatchUp if it's zero). Errors of background catch-ups are returned by the next CatchUp or Close.
+func WithFollow(interval time.Duration) Option {
+	return func(db *DB) { db.readOnly, db.follow, db.followInterval = true, true, interval }
+}
+
+// CatchUp reads the rows appended to the file since it was last read.
+func (db *DB) CatchUp() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	if !db.follow {
+		return errors.New("catch up: not a follower")
+	}
+	err := errors.Join(db.followErr, db.catchUp())
+	db.followErr = nil
+	return err
+}
+
+func (db *DB) catchUp() error {
+	fi, err := db.r.Stat()
+	if err != nil {
+		return fmt.Errorf("catch up: %w", err)
+	}
+	// The file was empty when opened (so it had no header yet), compacted, or truncated
+	if db.wIndex == 0 && fi.Size() > 0 || db.fileReplaced(fi) || fi.Size() < int64(db.wIndex) {
+		return db.reload()
+	}
+	if fi.Size() == int64(db.wIndex) {
+		return nil
+	}
+	if _, err := db.r.Seek(int64(db.wIndex), io.SeekStart); err != nil {
+		return fmt.Errorf("catch up: %w", err)
+	}
+	batch, _, err := db.replay(db.recordReader(db.r, fi.Size()), true)
+	if err != nil {
+		return fmt.Errorf("catch up: %w", err)
+	}
+	if batch != nil {
+		// The rest of the batch is read once it's written
+		db.wIndex, db.lastMAC = batch.offset, batch.prevMAC
+	}
+	db.purgeExpired()
+	return nil
+}
+
+// fileReplaced reports whether the file at the path of the database isn't the open one anymore.
+func (db *DB) fileReplaced(open os.FileInfo) bool {
+	if _, ok := db.fs.(osFS); !ok {
+		return false
+	}
+	current, err := os.Stat(db.fpath)
+	return err == nil && !os.SameFile(current, open)
+}
+
+// reload opens the file at the path of the database again and rebuilds the index.
+func (db *DB) reload() error {
+	if err := db.closeFiles(); err != nil {
+		return fmt.Errorf("catch up: %w", err)
+	}
+	if err := db.reopen(); err != nil {
+		// The database can't be used anymore
+		db.closed = true
+		return errors.Join(fmt.Errorf("catch up: reopen: %w", err), db.keys.close())
+	}
+	db.purgeExpired()
+	return nil
+}
+
+func (db *DB) startFollowing() {
+	if db.followInterval <= 0 {
+		return
+	}
+	db.runPeriodically(db.followInterval, func() {
+		if err := db.catchUp(); err != nil {
+			db.followErr = err
+		}
+	})
+}
@@ -0,0 +1,45 @@
+package textdb
+
+import (
+	"io"
+	"os"
+)
+
+// FileSystem opens the files of a database, it's the OS file system by default.
+type FileSystem interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+}
+
+// File is an open file of a FileSystem.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// WithFileSystem opens the database file with the given file system (e.g. a simulated one for tests).
+// Memory mapping, preallocation and locking are only used with OS files,
+// and the spilled index (see WithIndexMemoryLimit) is always stored on the OS file system.
+func WithFileSystem(fs FileSystem) Option {
+	return func(db *DB) { db.fs = fs }
+}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) Rename(oldpath, newpath string) error { return os.Rename(oldpath, newpath) }
+func (osFS) Remove(name string) error             { return os.Remove(name) }
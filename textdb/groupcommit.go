@@ -0,0 +1,100 @@
+package textdb
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// WithGroupCommit syncs each write before it returns like SyncEveryWrite, but concurrent writes
+// share syncs: a write waits for the sync of the file without holding the lock,
+// so the writes appended meanwhile are synced together by the next sync.
+// The first waiting write waits for the given delay (which may be zero) before syncing,
+// to let more writes join the sync.
+func WithGroupCommit(delay time.Duration) Option {
+	return func(db *DB) { db.syncPolicy, db.groupDelay = SyncGroupCommit, delay }
+}
+
+// groupCommit tracks the syncs of SyncGroupCommit.
+type groupCommit struct {
+	mu      sync.Mutex
+	cond    sync.Cond
+	gen     uint64 // generation of the file handles of the last sync (see DB.fileGen)
+	synced  int    // write offset of the last sync
+	syncing bool
+}
+
+// groupSync waits until the rows written so far are synced, releasing the lock meanwhile.
+// It must be the last step of writes holding the lock.
+func (db *DB) groupSync() error {
+	gen, target := db.fileGen, db.wIndex
+	db.mu.Unlock()
+	defer db.mu.Lock()
+
+	g := &db.group
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.cond.L == nil {
+		g.cond.L = &g.mu
+	}
+	// The file is synced when its handles are replaced (see Compact), so rows of older handles are synced
+	for g.gen < gen || g.gen == gen && g.synced < target {
+		if g.syncing {
+			g.cond.Wait()
+			continue
+		}
+		g.syncing = true
+		g.mu.Unlock()
+		if db.groupDelay > 0 {
+			time.Sleep(db.groupDelay)
+		}
+		syncedGen, synced, err := db.syncGroup()
+		g.mu.Lock()
+		g.syncing = false
+		g.cond.Broadcast()
+		if err != nil {
+			return err
+		}
+		if syncedGen > g.gen || syncedGen == g.gen && synced > g.synced {
+			g.gen, g.synced = syncedGen, synced
+		}
+	}
+	return nil
+}
+
+// syncGroup flushes the rows written so far and syncs the file without holding the lock,
+// then returns the generation of the file handles and the synced offset.
+func (db *DB) syncGroup() (uint64, int, error) {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return 0, 0, ErrClosed
+	}
+	if err := db.flush(); err != nil {
+		db.mu.Unlock()
+		return 0, 0, err
+	}
+	f, gen, end := db.wf, db.fileGen, db.wIndex
+	db.mu.Unlock()
+
+	var err error
+	if fp := hitFailpoint(FailpointSync); fp != nil {
+		err = fp.Err
+	} else {
+		err = f.Sync()
+	}
+	if errors.Is(err, os.ErrClosed) {
+		err = nil // the handle was synced before being closed by Close or Compact
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.lastSync = time.Now()
+	if gen == db.fileGen && end > db.syncedOffset {
+		db.syncedOffset = end
+	}
+	return gen, end, nil
+}
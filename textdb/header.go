@@ -0,0 +1,166 @@
+package textdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/ejuju/go-db-playground/textdb/record"
+)
+
+// Files start with a header line identifying them, with the format version and flags:
+//
+//	#textdb <version> <flags>\n
+//
+// Files written before headers were added have none, they're in a text format
+// and must start with a row.
+const headerMagic = "#textdb "
+
+// maxHeaderLen bounds the size of the header.
+const maxHeaderLen = 64
+
+// HeaderFlags record options the file was written with.
+type HeaderFlags uint8
+
+const (
+	FlagHMACChain  HeaderFlags = 1 << iota // rows have a MAC (see WithHMACChain)
+	FlagTimestamps                         // rows are preceded by their write time (see WithTimestamps)
+	FlagEncrypted                          // values are encrypted (see WithEncryptionKey and WithPassphrase)
+
+	knownFlags = FlagHMACChain | FlagTimestamps | FlagEncrypted
+)
+
+var ErrNotATextDB = errors.New("not a textdb file")
+
+// WithFormat sets the format of the file when it's created (FormatChecksummed by default),
+// existing files keep their format. FormatText files are created with checksums.
+func WithFormat(format FormatVersion) Option {
+	return func(db *DB) { db.format = format }
+}
+
+// rows returns the encoding of rows in the format.
+func (format FormatVersion) rows() record.Format {
+	if format == FormatBinary {
+		return record.Binary
+	}
+	return record.Text
+}
+
+func (db *DB) rowFormat() record.Format { return db.format.rows() }
+
+func (db *DB) headerFlags() HeaderFlags {
+	var flags HeaderFlags
+	if db.hmacKey != nil {
+		flags |= FlagHMACChain
+	}
+	if db.timestamps {
+		flags |= FlagTimestamps
+	}
+	if db.encrypts() {
+		flags |= FlagEncrypted
+	}
+	return flags
+}
+
+func appendHeader(dst []byte, format FormatVersion, flags HeaderFlags) []byte {
+	dst = append(dst, headerMagic...)
+	dst = strconv.AppendInt(dst, int64(format), 10)
+	dst = append(dst, ' ')
+	dst = strconv.AppendUint(dst, uint64(flags), 10)
+	return append(dst, '\n')
+}
+
+// parseHeader decodes the header at the start of b and returns its size.
+func parseHeader(b []byte) (FormatVersion, HeaderFlags, int, error) {
+	end := bytes.IndexByte(b, '\n')
+	if end < 0 {
+		return 0, 0, 0, fmt.Errorf("%w: invalid header", ErrNotATextDB)
+	}
+	fields := bytes.Fields(b[len(headerMagic):end])
+	if len(fields) == 0 || len(fields) > 2 {
+		return 0, 0, 0, fmt.Errorf("%w: invalid header %q", ErrNotATextDB, b[:end])
+	}
+	v, err := strconv.Atoi(string(fields[0]))
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("%w: invalid header %q", ErrNotATextDB, b[:end])
+	}
+	format := FormatVersion(v)
+	if format != FormatText && format != FormatChecksummed && format != FormatBinary {
+		return 0, 0, 0, fmt.Errorf("%w: %d", ErrUnsupportedVersion, v)
+	}
+	var flags HeaderFlags // may be omitted
+	if len(fields) == 2 {
+		f, err := strconv.ParseUint(string(fields[1]), 10, 8)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("%w: invalid header flags %q", ErrNotATextDB, fields[1])
+		}
+		flags = HeaderFlags(f)
+	}
+	if flags&^knownFlags != 0 {
+		return 0, 0, 0, fmt.Errorf("%w: unknown flags %d", ErrUnsupportedVersion, flags&^knownFlags)
+	}
+	return format, flags, end + 1, nil
+}
+
+// initHeader validates the header of the file and detects its format, or writes the header of a new file.
+// It sets the offset of the first row.
+func (db *DB) initHeader(size int64) error {
+	db.dataStart = 0
+	if size == 0 {
+		switch db.format {
+		case 0, FormatText, FormatChecksummed:
+			db.format = FormatChecksummed
+		case FormatBinary:
+		default:
+			return fmt.Errorf("%w: %d", ErrUnsupportedVersion, db.format)
+		}
+		if db.readOnly {
+			return nil
+		}
+		header := appendHeader(nil, db.format, db.headerFlags())
+		if _, err := db.wf.Write(header); err != nil {
+			return fmt.Errorf("write header: %w", err)
+		}
+		// A crash must not leave a partial header, the file couldn't be opened
+		if err := db.wf.Sync(); err != nil {
+			return fmt.Errorf("sync header: %w", err)
+		}
+		db.dataStart = len(header)
+		db.encrypted = db.encrypts()
+		return nil
+	}
+
+	buf := make([]byte, maxHeaderLen)
+	n, err := db.r.ReadAt(buf, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("read header: %w", err)
+	}
+	buf = buf[:n]
+	if !bytes.HasPrefix(buf, []byte(headerMagic)) {
+		switch buf[0] {
+		case opSet, opDelete, opPut, opMeta, opPutCompressed, opBatch, opExpire:
+			db.format = FormatChecksummed
+			return nil
+		}
+		return ErrNotATextDB
+	}
+	format, flags, n, err := parseHeader(buf)
+	if err != nil {
+		return err
+	}
+	switch hmacChain := flags&FlagHMACChain != 0; {
+	case hmacChain && db.hmacKey == nil:
+		return errors.New("the file has an HMAC chain, WithHMACChain is required")
+	case !hmacChain && db.hmacKey != nil:
+		return errors.New("the file has no HMAC chain")
+	}
+	db.format, db.dataStart = format, n
+	db.timestamps = flags&FlagTimestamps != 0
+	db.encrypted = flags&FlagEncrypted != 0
+	if db.format == FormatText {
+		db.format = FormatChecksummed // rows are appended with checksums
+	}
+	return nil
+}
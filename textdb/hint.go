@@ -0,0 +1,224 @@
+package textdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// HintSuffix is appended to the file path to name the hint file written by WithHintFile.
+const HintSuffix = ".hint"
+
+const (
+	hintMagic    = "textdb-hint 1\n"
+	hintTailSize = 4 << 10 // size of the end of the covered rows whose checksum is in the hint
+)
+
+// WithHintFile writes a snapshot of the index (a "hint file") on Close and Compact, so that the next Open
+// loads it and only replays the rows appended after it. A hint that doesn't match the file is ignored.
+func WithHintFile() Option {
+	return func(db *DB) { db.hintFile = true }
+}
+
+func hintPath(fpath string) string { return fpath + HintSuffix }
+
+// writeHint writes the hint of the rows up to the write offset, which must be flushed.
+// It contains the offset, the checksum of the last rows, the HMAC of the last row,
+// then the index, the expiries and the metadata, and ends with its checksum.
+func (db *DB) writeHint() error {
+	tail := make([]byte, db.wIndex-db.dataStart)
+	if len(tail) > hintTailSize {
+		tail = tail[:hintTailSize]
+	}
+	if _, err := db.r.ReadAt(tail, int64(db.wIndex-len(tail))); err != nil {
+		return fmt.Errorf("write hint: %w", err)
+	}
+
+	b := []byte(hintMagic)
+	b = binary.AppendUvarint(b, uint64(db.wIndex))
+	b = binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(tail))
+	b = appendHintBytes(b, db.lastMAC)
+	b = binary.AppendUvarint(b, uint64(db.keys.len()))
+	db.keys.forEach(func(k []byte, r ref) bool {
+		b = appendHintBytes(b, k)
+		b = binary.AppendVarint(b, packIndex(r))
+		b = binary.AppendUvarint(b, uint64(packWidth(r)))
+		return true
+	})
+	b = binary.AppendUvarint(b, uint64(len(db.expiries)))
+	for k, exp := range db.expiries {
+		b = appendHintBytes(b, []byte(k))
+		b = binary.AppendVarint(b, exp)
+	}
+	b = binary.AppendUvarint(b, uint64(len(db.meta)))
+	for k, v := range db.meta {
+		b = appendHintBytes(b, []byte(k))
+		b = appendHintBytes(b, []byte(v))
+	}
+	b = binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+
+	// The hint is replaced so that a crash leaves either the old or the new one
+	tmpPath := hintPath(db.fpath) + ".tmp"
+	f, err := db.fs.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("write hint: %w", err)
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = db.fs.Rename(tmpPath, hintPath(db.fpath))
+	}
+	if err != nil {
+		db.fs.Remove(tmpPath)
+		return fmt.Errorf("write hint: %w", err)
+	}
+	return nil
+}
+
+func appendHintBytes(dst, b []byte) []byte {
+	return append(binary.AppendUvarint(dst, uint64(len(b))), b...)
+}
+
+// loadHint loads the index from the hint file, if it matches the file of the given size,
+// and moves the write offset to the end of the rows it covers.
+func (db *DB) loadHint(size int64) (bool, error) {
+	f, err := db.fs.OpenFile(hintPath(db.fpath), os.O_RDONLY, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("load hint: %w", err)
+	}
+	b, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return false, fmt.Errorf("load hint: %w", err)
+	}
+
+	// A hint that is damaged, or of another file (e.g. before a crash lost rows it covers), is ignored
+	if len(b) < len(hintMagic)+4 || !bytes.HasPrefix(b, []byte(hintMagic)) {
+		return false, nil
+	}
+	body, sum := b[:len(b)-4], binary.BigEndian.Uint32(b[len(b)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return false, nil
+	}
+	hr := &hintReader{b: body[len(hintMagic):]}
+	end := int(hr.uvarint())
+	tailSum := hr.uint32()
+	if hr.err != nil || end < db.dataStart || int64(end) > size {
+		return false, nil
+	}
+	tail := make([]byte, end-db.dataStart)
+	if len(tail) > hintTailSize {
+		tail = tail[:hintTailSize]
+	}
+	if _, err := db.r.ReadAt(tail, int64(end-len(tail))); err != nil {
+		return false, fmt.Errorf("load hint: %w", err)
+	}
+	if crc32.ChecksumIEEE(tail) != tailSum {
+		return false, nil
+	}
+
+	lastMAC := hr.bytes()
+	for n := hr.uvarint(); n > 0 && hr.err == nil; n-- {
+		k := string(hr.bytes())
+		index, width := hr.varint(), uint32(hr.uvarint())
+		db.keys.set(k, unpackRef(index, width))
+	}
+	if n := hr.uvarint(); n > 0 {
+		db.expiries = make(map[string]int64, n)
+		for ; n > 0 && hr.err == nil; n-- {
+			k := string(hr.bytes())
+			db.expiries[k] = hr.varint()
+		}
+	}
+	for n := hr.uvarint(); n > 0 && hr.err == nil; n-- {
+		k := string(hr.bytes())
+		db.meta[k] = string(hr.bytes())
+	}
+	if hr.err != nil {
+		return false, fmt.Errorf("load hint: %w", hr.err)
+	}
+	db.wIndex = end
+	if len(lastMAC) > 0 {
+		db.lastMAC = lastMAC
+	}
+	return true, nil
+}
+
+// hintReader decodes the fields of a hint, keeping the first error.
+type hintReader struct {
+	b   []byte
+	err error
+}
+
+var errInvalidHint = errors.New("invalid hint")
+
+func (hr *hintReader) uvarint() uint64 {
+	v, n := binary.Uvarint(hr.b)
+	if n <= 0 {
+		hr.fail()
+		return 0
+	}
+	hr.b = hr.b[n:]
+	return v
+}
+
+func (hr *hintReader) varint() int64 {
+	v, n := binary.Varint(hr.b)
+	if n <= 0 {
+		hr.fail()
+		return 0
+	}
+	hr.b = hr.b[n:]
+	return v
+}
+
+func (hr *hintReader) uint32() uint32 {
+	if len(hr.b) < 4 {
+		hr.fail()
+		return 0
+	}
+	v := binary.BigEndian.Uint32(hr.b)
+	hr.b = hr.b[4:]
+	return v
+}
+
+func (hr *hintReader) bytes() []byte {
+	n := hr.uvarint()
+	if n > uint64(len(hr.b)) {
+		hr.fail()
+		return nil
+	}
+	v := hr.b[:n]
+	hr.b = hr.b[n:]
+	return v
+}
+
+func (hr *hintReader) fail() {
+	if hr.err == nil {
+		hr.err = errInvalidHint
+	}
+	hr.b = nil
+}
+
+// saveHint writes the hint if enabled and the file is in a state that can be loaded again.
+func (db *DB) saveHint() error {
+	if !db.hintFile || db.readOnly || db.unnamed || db.inconsistent != nil || db.tornTail {
+		return nil
+	}
+	if err := db.flush(); err != nil {
+		return nil // the rows that couldn't be written aren't in the file, the error is returned by closeFiles
+	}
+	return db.writeHint()
+}
@@ -0,0 +1,72 @@
+package textdb
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// WithHMACChain appends an HMAC-SHA256 to each row, computed over the previous row's MAC
+// and the row itself, so that Verify can detect rows that have been modified,
+// inserted or removed. All rows of the file must have been written with this option.
+func WithHMACChain(key []byte) Option {
+	return func(db *DB) { db.hmacKey = key }
+}
+
+func (db *DB) rowMAC(row []byte) []byte {
+	if db.hmacKey == nil {
+		return nil
+	}
+	return chainMAC(db.hmacKey, db.lastMAC, row)
+}
+
+func chainMAC(key, prevMAC, row []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(prevMAC)
+	h.Write(row)
+	return h.Sum(nil)
+}
+
+var ErrTampered = errors.New("hmac chain mismatch")
+
+// Verify reads the whole file and checks the HMAC chain of every row.
+func (db *DB) Verify() error {
+	if db.hmacKey == nil {
+		return errors.New("hmac chain is not enabled")
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.flush(); err != nil {
+		return err
+	}
+
+	size := int64(db.wIndex - db.dataStart)
+	rr := db.recordReader(io.NewSectionReader(db.r, int64(db.dataStart), size), size)
+	var prevMAC []byte
+	offset, numRows := db.dataStart, 0
+	for {
+		r, n, err := rr.Next()
+		if errors.Is(err, io.EOF) && n == 0 {
+			return nil
+		}
+		numRows++
+		if err != nil {
+			return fmt.Errorf("%w (row %d)", err, numRows)
+		}
+
+		// Re-read the row without its MAC, checksum and row-end
+		bodyLen := n - db.rowFormat().TrailerLen(true, r.Checksum)
+		body := make([]byte, bodyLen)
+		_, err = db.r.ReadAt(body, int64(offset))
+		if err != nil {
+			return fmt.Errorf("read row: %w (row %d)", err, numRows)
+		}
+		if !hmac.Equal(r.MAC, chainMAC(db.hmacKey, prevMAC, body)) {
+			return fmt.Errorf("%w (row %d)", ErrTampered, numRows)
+		}
+		prevMAC = r.MAC
+		offset += n
+	}
+}
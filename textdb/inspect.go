@@ -0,0 +1,115 @@
+package textdb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ejuju/go-db-playground/textdb/record"
+)
+
+// Row is a row of the database file, see DB.RowAt and DB.NthRow.
+type Row struct {
+	Offset   int64
+	Size     int
+	Op       byte // e.g. 'P' for a key with value (see the record package)
+	Key      string
+	Value    []byte // decrypted and decompressed, nil for rows without value
+	MAC      []byte // with WithHMACChain
+	Checksum bool   // the row has a checksum, which was verified
+}
+
+// openRows flushes the buffered rows and opens another handle of the file,
+// to read the rows between the returned offsets without holding the lock.
+func (db *DB) openRows() (File, int, int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil, 0, 0, ErrClosed
+	}
+	if db.unnamed {
+		return nil, 0, 0, errors.New("not supported for unnamed files")
+	}
+	if err := db.flush(); err != nil {
+		return nil, 0, 0, err
+	}
+	f, err := db.fs.OpenFile(db.fpath, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return f, db.dataStart, db.wIndex, nil
+}
+
+// RowAt decodes the row starting at the offset of the file, for debugging.
+// The rows before it aren't read, so it can decode rows that follow a corrupt one.
+// If the value can't be decrypted or decompressed, the row is returned with its stored value along the error.
+func (db *DB) RowAt(offset int64) (Row, error) {
+	f, start, end, err := db.openRows()
+	if err != nil {
+		return Row{}, fmt.Errorf("row at %d: %w", offset, err)
+	}
+	defer f.Close()
+	if offset < int64(start) || offset >= int64(end) {
+		return Row{}, fmt.Errorf("row at %d: offset out of the rows [%d, %d)", offset, start, end)
+	}
+	rr := db.rowReader(f, offset, end)
+	r, n, err := rr.Next()
+	if err != nil {
+		return Row{}, fmt.Errorf("row at %d: %w", offset, &CorruptRecordError{Offset: offset, Err: err})
+	}
+	return db.decodeRow(offset, n, r)
+}
+
+// NthRow decodes the nth row of the file (from 0, after the header), for debugging.
+// If the value can't be decrypted or decompressed, the row is returned with its stored value along the error.
+func (db *DB) NthRow(n int) (Row, error) {
+	f, start, end, err := db.openRows()
+	if err != nil {
+		return Row{}, fmt.Errorf("row %d: %w", n, err)
+	}
+	defer f.Close()
+	if n < 0 {
+		return Row{}, fmt.Errorf("row %d: invalid row", n)
+	}
+	rr := db.rowReader(f, int64(start), end)
+	for i, offset := 0, int64(start); ; i++ {
+		r, size, err := rr.Next()
+		if errors.Is(err, io.EOF) && size == 0 {
+			return Row{}, fmt.Errorf("row %d: the file has %d rows", n, i)
+		}
+		if err != nil {
+			return Row{}, fmt.Errorf("row %d: %w", n, &CorruptRecordError{Offset: offset, Err: err})
+		}
+		if i == n {
+			return db.decodeRow(offset, size, r)
+		}
+		offset += int64(size)
+	}
+}
+
+func (db *DB) rowReader(f File, offset int64, end int) *record.Reader {
+	rr := record.NewReader(io.NewSectionReader(f, offset, int64(end)-offset))
+	rr.MAC = db.hmacKey != nil
+	rr.Format = db.rowFormat()
+	return rr
+}
+
+// decodeRow decrypts and decompresses the value of the row, with the lock held.
+func (db *DB) decodeRow(offset int64, size int, r record.Record) (Row, error) {
+	row := Row{Offset: offset, Size: size, Op: r.Op, Key: r.Key, Value: r.Value, MAC: r.MAC, Checksum: r.Checksum}
+	if r.Op != opPut && r.Op != opPutCompressed {
+		return row, nil
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	v, err := db.decryptValue(r.Op, r.Key, r.Value)
+	if err == nil && r.Op == opPutCompressed {
+		v, err = db.decompressValue(r.Key, v)
+	}
+	if err != nil {
+		return row, fmt.Errorf("row at %d: %w", offset, err)
+	}
+	row.Value = v
+	return row, nil
+}
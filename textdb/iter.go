@@ -0,0 +1,113 @@
+package textdb
+
+import (
+	"errors"
+	"strings"
+)
+
+// Keys returns all keys in lexicographic order (the key hashes with WithHashedKeys).
+func (db *DB) Keys() []string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.sortedKeys()
+}
+
+func (db *DB) sortedKeys() []string { return db.keysWithPrefix("") }
+
+// keysWithPrefix returns the stored keys starting with the prefix in lexicographic order.
+func (db *DB) keysWithPrefix(prefix string) []string {
+	if db.closed {
+		return nil
+	}
+	var keys []string
+	if prefix == "" {
+		keys = make([]string, 0, db.keys.len())
+	}
+	db.keys.ascend(prefix, func(k []byte, _ ref) bool {
+		if !strings.HasPrefix(string(k), prefix) {
+			return false
+		}
+		if !db.expired(string(k)) {
+			keys = append(keys, string(k))
+		}
+		return true
+	})
+	return keys
+}
+
+// Range returns the keys greater or equal to start and lower than end in lexicographic order,
+// an empty end means there is no upper bound.
+// With WithHashedKeys, the bounds apply to the key hashes.
+func (db *DB) Range(start, end string) []string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil
+	}
+	var keys []string
+	db.keys.ascend(start, func(k []byte, _ ref) bool {
+		if end != "" && string(k) >= end {
+			return false
+		}
+		if !db.expired(string(k)) {
+			keys = append(keys, string(k))
+		}
+		return true
+	})
+	return keys
+}
+
+// ForEach calls fn with each key and its value (nil for keys without value) in lexicographic order,
+// until fn returns an error, which is then returned.
+//
+// The keys are those that exist when ForEach is called and values are read as keys are visited,
+// so fn may write to the database: keys deleted before being visited are skipped
+// and values overwritten before being visited are seen with their new value.
+// With WithHashedKeys, keys are the key hashes.
+func (db *DB) ForEach(fn func(k string, v []byte) error) error {
+	return db.visit(db.Keys(), fn)
+}
+
+// Scan is like ForEach for the keys starting with the given prefix.
+// It isn't supported with WithHashedKeys since hashes don't preserve prefixes.
+func (db *DB) Scan(prefix string, fn func(k string, v []byte) error) error {
+	db.mu.RLock()
+	if db.keyHashSecret != nil {
+		db.mu.RUnlock()
+		return errors.New("scan: not supported with hashed keys")
+	}
+	keys := db.keysWithPrefix(prefix)
+	db.mu.RUnlock()
+	return db.visit(keys, fn)
+}
+
+// visit reads and passes the values of the given stored keys to fn.
+func (db *DB) visit(keys []string, fn func(k string, v []byte) error) error {
+	for _, k := range keys {
+		v, exists, err := db.getIfExists(k)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getIfExists reads the value of a stored key and reports whether the key exists.
+func (db *DB) getIfExists(k string) ([]byte, bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, false, ErrClosed
+	}
+	if !db.keys.has(k) || db.expired(k) {
+		return nil, false, nil
+	}
+	v, err := db.getStored(k)
+	return v, true, err
+}
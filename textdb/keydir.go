@@ -0,0 +1,246 @@
+package textdb
+
+import (
+	"hash/maphash"
+	"unsafe"
+)
+
+// keydir is the in-memory index of keys to value refs.
+// It's an open-addressing hash table whose entries store packed integers
+// and whose keys are stored back to back in a single arena,
+// which avoids a pointer and two allocations per key compared to a map[string]*ref.
+type keydir struct {
+	seed       maphash.Seed
+	slots      []uint32 // 0 if empty, slotDeleted, or the entry index + 1
+	entries    []kdEntry
+	arena      []byte
+	garbage    int // arena bytes of deleted keys
+	tombstones int
+	ordered    orderedKeys
+}
+
+type kdEntry struct {
+	key   uint64 // arena offset << keyLenBits | key length
+	index int64  // value offset in the file, -1 if the key has no value (packed with the cold flag, see packIndex)
+	width uint32 // packed with the compression flag, see packWidth
+	hash  uint32
+}
+
+const (
+	keyLenBits   = 24
+	maxKeySize   = 1<<keyLenBits - 1
+	maxValueSize = 1<<31 - 1
+
+	widthCompressed = 1 << 31 // flags a compressed value in packed widths
+
+	slotDeleted = ^uint32(0)
+
+	minArenaGarbage = 1 << 20 // don't compact the arena for less garbage than this
+)
+
+// ref locates a value in the file
+type ref struct {
+	index      int
+	width      int
+	compressed bool
+	cold       bool // the value is in the cold file (see WithColdTier)
+}
+
+// coldIndex is the packed index of a cold value at offset zero (see packIndex),
+// below the sentinels of the indexes.
+const coldIndex = -4
+
+func packIndex(r ref) int64 {
+	if r.cold {
+		return coldIndex - int64(r.index)
+	}
+	return int64(r.index)
+}
+
+func packWidth(r ref) uint32 {
+	if r.compressed {
+		return uint32(r.width) | widthCompressed
+	}
+	return uint32(r.width)
+}
+
+func unpackRef(index int64, width uint32) ref {
+	r := ref{index: int(index), width: int(width &^ widthCompressed), compressed: width&widthCompressed != 0}
+	if index <= coldIndex+1 {
+		r.index, r.cold = int(coldIndex-index), true
+	}
+	return r
+}
+
+// keyOnly is the ref of a key without value (written with Set)
+var keyOnly = ref{index: -1}
+
+func (r ref) hasValue() bool { return r.index >= 0 }
+
+// valueWidth returns the width of the stored value, or zero if there is none.
+func (r ref) valueWidth() int {
+	if !r.hasValue() {
+		return 0
+	}
+	return r.width
+}
+
+func newKeydir() *keydir {
+	return &keydir{seed: maphash.MakeSeed(), slots: make([]uint32, 16)}
+}
+
+func (kd *keydir) len() int { return len(kd.entries) }
+
+// memSize estimates the memory used by the index.
+func (kd *keydir) memSize() int {
+	size := cap(kd.entries)*int(unsafe.Sizeof(kdEntry{})) + cap(kd.arena) + cap(kd.slots)*4
+	if kd.ordered.built {
+		size += len(kd.entries) * 4
+	}
+	return size
+}
+
+func (kd *keydir) close() error { return nil }
+
+func (kd *keydir) hash(k string) uint32 { return uint32(maphash.String(kd.seed, k)) }
+
+func (kd *keydir) keyOf(e *kdEntry) []byte {
+	off, n := e.key>>keyLenBits, e.key&maxKeySize
+	return kd.arena[off : off+n]
+}
+
+// find returns the slot of the key, or the slot where it should be inserted.
+func (kd *keydir) find(k string, h uint32) (int, bool) {
+	mask := len(kd.slots) - 1
+	deleted := -1
+	for i := int(h) & mask; ; i = (i + 1) & mask {
+		switch s := kd.slots[i]; s {
+		case 0:
+			if deleted >= 0 {
+				return deleted, false
+			}
+			return i, false
+		case slotDeleted:
+			if deleted < 0 {
+				deleted = i
+			}
+		default:
+			e := &kd.entries[s-1]
+			if e.hash == h && string(kd.keyOf(e)) == k {
+				return i, true
+			}
+		}
+	}
+}
+
+func (kd *keydir) get(k string) (ref, bool) {
+	slot, ok := kd.find(k, kd.hash(k))
+	if !ok {
+		return ref{}, false
+	}
+	e := &kd.entries[kd.slots[slot]-1]
+	return unpackRef(e.index, e.width), true
+}
+
+func (kd *keydir) has(k string) bool {
+	_, ok := kd.find(k, kd.hash(k))
+	return ok
+}
+
+func (kd *keydir) set(k string, r ref) {
+	if (len(kd.entries)+kd.tombstones+1)*4 >= len(kd.slots)*3 {
+		kd.rehash()
+	}
+	h := kd.hash(k)
+	slot, ok := kd.find(k, h)
+	if ok {
+		e := &kd.entries[kd.slots[slot]-1]
+		e.index, e.width = packIndex(r), packWidth(r)
+		return
+	}
+
+	if kd.slots[slot] == slotDeleted {
+		kd.tombstones--
+	}
+	kd.entries = append(kd.entries, kdEntry{
+		key:   uint64(len(kd.arena))<<keyLenBits | uint64(len(k)),
+		index: packIndex(r),
+		width: packWidth(r),
+		hash:  h,
+	})
+	kd.arena = append(kd.arena, k...)
+	kd.slots[slot] = uint32(len(kd.entries))
+	kd.orderedInsert(k, uint32(len(kd.entries)-1))
+}
+
+func (kd *keydir) delete(k string) {
+	slot, ok := kd.find(k, kd.hash(k))
+	if !ok {
+		return
+	}
+	i := int(kd.slots[slot] - 1)
+	kd.orderedRemove(k)
+	kd.slots[slot] = slotDeleted
+	kd.tombstones++
+	kd.garbage += int(kd.entries[i].key & maxKeySize)
+
+	// Move the last entry in place of the deleted one
+	last := len(kd.entries) - 1
+	if i != last {
+		kd.entries[i] = kd.entries[last]
+		kd.orderedReplace(string(kd.keyOf(&kd.entries[i])), uint32(i))
+		mask := len(kd.slots) - 1
+		for j := int(kd.entries[i].hash) & mask; ; j = (j + 1) & mask {
+			if kd.slots[j] == uint32(last+1) {
+				kd.slots[j] = uint32(i + 1)
+				break
+			}
+		}
+	}
+	kd.entries = kd.entries[:last]
+
+	if kd.garbage > minArenaGarbage && kd.garbage > len(kd.arena)/2 {
+		kd.compactArena()
+	}
+}
+
+// rehash grows the table (or just clears tombstones if there are many) and re-inserts all entries.
+func (kd *keydir) rehash() {
+	size := len(kd.slots)
+	if (len(kd.entries)+1)*2 >= size {
+		size *= 2
+	}
+	kd.slots = make([]uint32, size)
+	kd.tombstones = 0
+	mask := size - 1
+	for i := range kd.entries {
+		j := int(kd.entries[i].hash) & mask
+		for kd.slots[j] != 0 {
+			j = (j + 1) & mask
+		}
+		kd.slots[j] = uint32(i + 1)
+	}
+}
+
+// compactArena drops the key bytes of deleted entries.
+func (kd *keydir) compactArena() {
+	arena := make([]byte, 0, len(kd.arena)-kd.garbage)
+	for i := range kd.entries {
+		e := &kd.entries[i]
+		k := kd.keyOf(e)
+		e.key = uint64(len(arena))<<keyLenBits | uint64(len(k))
+		arena = append(arena, k...)
+	}
+	kd.arena, kd.garbage = arena, 0
+}
+
+// forEach calls fn for each key in unspecified order (see ascend for lexicographic order), until fn returns false.
+// The key is only valid during the call and the index must not be modified.
+func (kd *keydir) forEach(fn func(k []byte, r ref) bool) {
+	for i := range kd.entries {
+		e := &kd.entries[i]
+		if !fn(kd.keyOf(e), unpackRef(e.index, e.width)) {
+			return
+		}
+	}
+}
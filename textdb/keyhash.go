@@ -0,0 +1,67 @@
+package textdb
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+)
+
+// Metadata keys marking databases whose keys are stored hashed and allowing to detect a wrong secret
+const (
+	metaKeyHash      = "keys.hash"
+	metaKeyHashCheck = "keys.hash.check"
+)
+
+const keyHashAlgorithm = "hmac-sha256"
+
+var ErrWrongKeyHashSecret = errors.New("wrong key hash secret")
+
+// WithHashedKeys stores keys as their hex HMAC-SHA256 (keyed with the given secret)
+// instead of plain text, for workloads where key names themselves are sensitive.
+// Original keys are never stored: lookups hash the requested key,
+// and exported or iterated keys are the hashes.
+// Opening the database with another secret fails with ErrWrongKeyHashSecret.
+func WithHashedKeys(secret []byte) Option {
+	return func(db *DB) { db.keyHashSecret = secret }
+}
+
+func (db *DB) initHashedKeys(isNew bool) error {
+	algorithm, hashed := db.meta[metaKeyHash]
+	switch {
+	case db.keyHashSecret == nil && hashed:
+		return errors.New("database keys are hashed, a key hash secret is required")
+	case db.keyHashSecret != nil && hashed && algorithm != keyHashAlgorithm:
+		return errors.New("unsupported key hash algorithm: " + algorithm)
+	case db.keyHashSecret != nil && !hashed && !isNew:
+		return errors.New("database keys are not hashed")
+	case db.keyHashSecret != nil && !hashed:
+		if err := db.putMeta(metaKeyHash, keyHashAlgorithm); err != nil {
+			return err
+		}
+		return db.putMeta(metaKeyHashCheck, keyHashCheck(db.keyHashSecret))
+	case db.keyHashSecret != nil:
+		// Databases created before the check was stored can't be verified
+		check, ok := db.meta[metaKeyHashCheck]
+		if ok && !hmac.Equal([]byte(check), []byte(keyHashCheck(db.keyHashSecret))) {
+			return ErrWrongKeyHashSecret
+		}
+	}
+	return nil
+}
+
+// keyHashCheck allows detecting a wrong key hash secret at open time without storing the secret.
+func keyHashCheck(secret []byte) string {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte("textdb key hash check"))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (db *DB) hashKey(k string) string {
+	if db.keyHashSecret == nil {
+		return k
+	}
+	h := hmac.New(sha256.New, db.keyHashSecret)
+	h.Write([]byte(k))
+	return hex.EncodeToString(h.Sum(nil))
+}
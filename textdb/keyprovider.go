@@ -0,0 +1,71 @@
+package textdb
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// KeyProvider supplies the encryption keyring at open time,
+// it can be implemented to fetch keys from a KMS or a secret manager.
+type KeyProvider interface {
+	Keyring() (currentKeyID byte, keys map[byte][]byte, err error)
+}
+
+type KeyProviderFunc func() (byte, map[byte][]byte, error)
+
+func (f KeyProviderFunc) Keyring() (byte, map[byte][]byte, error) { return f() }
+
+// EnvKeyProvider reads a base64-encoded key (used as key ID 0) from an environment variable.
+func EnvKeyProvider(name string) KeyProvider {
+	return KeyProviderFunc(func() (byte, map[byte][]byte, error) {
+		encoded, ok := os.LookupEnv(name)
+		if !ok {
+			return 0, nil, fmt.Errorf("environment variable %s is not set", name)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return 0, nil, fmt.Errorf("decode key from %s: %w", name, err)
+		}
+		return 0, map[byte][]byte{0: key}, nil
+	})
+}
+
+// FileKeyProvider reads a base64-encoded key (used as key ID 0) from a file.
+func FileKeyProvider(fpath string) KeyProvider {
+	return KeyProviderFunc(func() (byte, map[byte][]byte, error) {
+		encoded, err := os.ReadFile(fpath)
+		if err != nil {
+			return 0, nil, err
+		}
+		key, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(encoded)))
+		if err != nil {
+			return 0, nil, fmt.Errorf("decode key from %s: %w", fpath, err)
+		}
+		return 0, map[byte][]byte{0: key}, nil
+	})
+}
+
+// WithKeyProvider encrypts values with the keyring returned by the provider,
+// see WithEncryptionKeyring.
+func WithKeyProvider(p KeyProvider) Option {
+	return func(db *DB) { db.keyProvider = p }
+}
+
+func (db *DB) initKeyProvider() error {
+	if db.keyProvider == nil {
+		return nil
+	}
+	if db.encryptionKeys != nil || db.passphrase != "" {
+		return errors.New("key provider is mutually exclusive with encryption keys and passphrase")
+	}
+	var err error
+	db.encryptionKeyID, db.encryptionKeys, err = db.keyProvider.Keyring()
+	if err != nil {
+		return fmt.Errorf("get encryption keys: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package textdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+var ErrLocked = errors.New("database is locked by another process")
+
+// lock takes an exclusive lock on a file next to the database (flock on Unix, LockFileEx on Windows),
+// so that two processes can't append to the same file. The lock is also held against
+// other handles of the same process, so a file can only be opened once at a time.
+// Read-only databases take a shared lock, so they can be opened by several processes but not along a writer.
+// Locking the data file itself isn't possible on Windows where locks are mandatory
+// and would also block the database's own read handles.
+// Unnamed temporary files (see NewTempDB) aren't locked since no other handle can open them,
+// nor are followers (see WithFollow) which must run along the writer.
+//
+// The lock file stays next to the database after Close: removing it could let
+// a process lock the removed file while another one locks a new file at the same path.
+// Read-only databases that can't create the lock file (e.g. in a read-only directory) aren't locked.
+func (db *DB) lock(fpath string) error {
+	if _, ok := db.fs.(osFS); !ok || !lockSupported || db.unnamed || db.follow {
+		return nil
+	}
+	var f *os.File
+	var err error
+	if db.readOnly {
+		f, err = os.OpenFile(fpath+".lock", os.O_RDONLY, 0)
+		if errors.Is(err, os.ErrNotExist) {
+			f, err = os.OpenFile(fpath+".lock", os.O_RDONLY|os.O_CREATE, 0o600)
+		}
+		if err != nil {
+			return nil
+		}
+	} else if f, err = os.OpenFile(fpath+".lock", os.O_RDWR|os.O_CREATE, 0o600); err != nil {
+		return err
+	}
+	if err := lockFile(f, !db.readOnly); err != nil {
+		f.Close()
+		if errors.Is(err, ErrLocked) {
+			return fmt.Errorf("%w: %s", err, fpath)
+		}
+		return err
+	}
+	db.lockf = f
+	return nil
+}
+
+func (db *DB) unlock() error {
+	if db.lockf == nil {
+		return nil
+	}
+	return errors.Join(unlockFile(db.lockf), db.lockf.Close())
+}
@@ -0,0 +1,10 @@
+//go:build !windows && !unix
+
+package textdb
+
+import "os"
+
+const lockSupported = false
+
+func lockFile(f *os.File, exclusive bool) error { return nil }
+func unlockFile(f *os.File) error               { return nil }
@@ -0,0 +1,221 @@
+package textdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ManagerFileExt is the extension of the database files in a manager's directory.
+const ManagerFileExt = ".txt.db"
+
+var ErrManagerClosed = errors.New("manager is closed")
+
+type ManagerConfig struct {
+	Options     []Option      // applied to every database
+	IdleTimeout time.Duration // close databases unused for this long (zero keeps them open)
+}
+
+// Manager owns a directory of named databases, each stored in its own file.
+// Databases are opened on first use and, with an idle timeout, closed once unused.
+// Access to a database goes through Do, which serializes calls for the same name.
+type Manager struct {
+	dir string
+	cfg ManagerConfig
+
+	mu     sync.Mutex
+	dbs    map[string]*managedDB
+	closed bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type managedDB struct {
+	mu       sync.Mutex
+	db       *DB // nil until opened or once closed for being idle
+	lastUsed time.Time
+}
+
+func NewManager(dir string, cfg ManagerConfig) (*Manager, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	m := &Manager{dir: dir, cfg: cfg, dbs: make(map[string]*managedDB)}
+	if cfg.IdleTimeout > 0 {
+		m.stop, m.done = make(chan struct{}), make(chan struct{})
+		go m.closeIdlePeriodically()
+	}
+	return m, nil
+}
+
+// ValidateName reports whether the name can be used for a database of the manager.
+func ValidateName(name string) error {
+	if name == "" {
+		return errors.New("database name is empty")
+	}
+	if strings.HasPrefix(name, ".") {
+		return fmt.Errorf("database name starts with a dot: %q", name)
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return fmt.Errorf("database name contains invalid character %q: %q", c, name)
+		}
+	}
+	return nil
+}
+
+// Path returns the path of the file of the named database.
+func (m *Manager) Path(name string) string { return filepath.Join(m.dir, name+ManagerFileExt) }
+
+// Do calls fn with the named database, opening (and creating) it if needed.
+// The database must not be used after fn returns.
+func (m *Manager) Do(name string, fn func(db *DB) error) error {
+	if err := ValidateName(name); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return ErrManagerClosed
+	}
+	e, ok := m.dbs[name]
+	if !ok {
+		e = &managedDB{}
+		m.dbs[name] = e
+	}
+	m.mu.Unlock()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if m.isClosed() {
+		return ErrManagerClosed
+	}
+	if e.db == nil {
+		db, err := Open(m.Path(name), m.cfg.Options...)
+		if err != nil {
+			return fmt.Errorf("open database %q: %w", name, err)
+		}
+		e.db = db
+	}
+	e.lastUsed = time.Now()
+	return fn(e.db)
+}
+
+func (m *Manager) isClosed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closed
+}
+
+// Names returns the sorted names of the databases in the directory (opened or not).
+func (m *Manager) Names() ([]string, error) {
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ManagerFileExt)
+		if ok && !entry.IsDir() && ValidateName(name) == nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+type ManagerStats struct {
+	Databases int   // databases in the directory
+	Open      int   // currently open databases
+	Keys      int   // keys of the open databases
+	Bytes     int64 // size of all database files
+}
+
+func (m *Manager) Stats() (ManagerStats, error) {
+	names, err := m.Names()
+	if err != nil {
+		return ManagerStats{}, err
+	}
+	stats := ManagerStats{Databases: len(names)}
+	for _, name := range names {
+		fi, err := os.Stat(m.Path(name))
+		if err != nil {
+			return ManagerStats{}, err
+		}
+		stats.Bytes += fi.Size()
+	}
+	for _, e := range m.entries() {
+		e.mu.Lock()
+		if e.db != nil {
+			stats.Open++
+			stats.Keys += e.db.keys.len()
+		}
+		e.mu.Unlock()
+	}
+	return stats, nil
+}
+
+func (m *Manager) entries() []*managedDB {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entries := make([]*managedDB, 0, len(m.dbs))
+	for _, e := range m.dbs {
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func (m *Manager) closeIdlePeriodically() {
+	defer close(m.done)
+	ticker := time.NewTicker(m.cfg.IdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case now := <-ticker.C:
+			for _, e := range m.entries() {
+				e.mu.Lock()
+				if e.db != nil && now.Sub(e.lastUsed) >= m.cfg.IdleTimeout {
+					e.db.Close() // an error closing an idle database can't be reported, the file is reopened on next use
+					e.db = nil
+				}
+				e.mu.Unlock()
+			}
+		}
+	}
+}
+
+// Close waits for ongoing calls to Do and closes all open databases.
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return ErrManagerClosed
+	}
+	m.closed = true
+	m.mu.Unlock()
+	if m.stop != nil {
+		close(m.stop)
+		<-m.done
+	}
+
+	var errs []error
+	for name, e := range m.dbs {
+		e.mu.Lock()
+		if e.db != nil {
+			if err := e.db.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("close database %q: %w", name, err))
+			}
+			e.db = nil
+		}
+		e.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
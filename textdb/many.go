@@ -0,0 +1,49 @@
+package textdb
+
+import "sort"
+
+// GetMany returns the values of the keys that exist, holding the lock once for all of them.
+// Missing keys aren't in the returned map, keys without value have an empty value.
+func (db *DB) GetMany(keys []string) (map[string][]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	values := make(map[string][]byte, len(keys))
+	for _, k := range keys {
+		v, err := db.get(k)
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			if !db.exists(k) {
+				continue
+			}
+			v = []byte{}
+		}
+		values[k] = v
+	}
+	return values, nil
+}
+
+// PutMany writes the keys with their values in a single batch (see Batch),
+// so either all or none of them are written. The keys are written in lexicographic order.
+func (db *DB) PutMany(values map[string][]byte) error {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b := &Batch{db: db, ops: make([]batchOp, 0, len(keys))}
+	for _, k := range keys {
+		// The values aren't copied since they're only used until Commit returns
+		if err := db.ValidateValue(values[k]); err != nil {
+			return err
+		}
+		if err := b.add(opPut, k, values[k]); err != nil {
+			return err
+		}
+	}
+	return b.Commit()
+}
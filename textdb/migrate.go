@@ -0,0 +1,254 @@
+package textdb
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/ejuju/go-db-playground/textdb/record"
+)
+
+// FormatVersion identifies an on-disk format of the database file.
+type FormatVersion int
+
+const (
+	FormatText        FormatVersion = 1 // length-prefixed text rows
+	FormatChecksummed FormatVersion = 2 // text rows ending with a checksum
+	FormatBinary      FormatVersion = 3 // binary rows (see record.Format)
+
+	CurrentFormat = FormatChecksummed
+)
+
+var (
+	ErrUnsupportedVersion = errors.New("unsupported format version")
+	// Deprecated: use ErrUnsupportedVersion.
+	ErrUnsupportedFormat = ErrUnsupportedVersion
+	ErrMigrationMismatch = errors.New("migrated database doesn't match the source")
+)
+
+// Migrate rewrites the database at srcPath to a new file at dstPath in the target format version.
+// Only the current state is copied: overwritten and deleted keys are dropped, stored values
+// are copied as is (so they stay encrypted and compressed) and the HMAC chain, if any, is rebuilt.
+// The options must be those used to open the source and are also used to open the result,
+// which is compared to the source before being moved to dstPath.
+func Migrate(srcPath, dstPath string, target FormatVersion, opts ...Option) error {
+	if target != FormatText && target != FormatChecksummed && target != FormatBinary {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, target)
+	}
+	if _, err := os.Stat(srcPath); err != nil {
+		return err
+	}
+	if _, err := os.Stat(dstPath); err == nil {
+		return fmt.Errorf("destination already exists: %q", dstPath)
+	}
+	src, err := Open(srcPath, opts...)
+	if err != nil {
+		return fmt.Errorf("open source: %w", err)
+	}
+	defer src.Close()
+
+	tmpPath := dstPath + ".tmp"
+	defer os.Remove(tmpPath + ".lock")
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	src.mu.Lock()
+	err = src.writeLive(f, target, false, nil, nil)
+	src.mu.Unlock()
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("write: %w", err)
+	}
+	if err := verifyMigration(src, tmpPath, opts); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("verify: %w", err)
+	}
+	return os.Rename(tmpPath, dstPath)
+}
+
+// writeLive writes the metadata and the live keys of the database to the given file in the given format,
+// then syncs and closes it. If reencrypt is true, values encrypted with a previous key
+// are encrypted again with the current one. A filter restricts the keys that are written.
+// Cold values are written to cw if it's not nil (see WithColdTier), otherwise to the file.
+func (db *DB) writeLive(f File, format FormatVersion, reencrypt bool, filter *liveFilter, cw *coldWriter) error {
+	defer f.Close()
+	if err := db.writeLiveRows(f, format, reencrypt, filter, cw); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeLiveRows is like writeLive but writes to w.
+func (db *DB) writeLiveRows(w io.Writer, format FormatVersion, reencrypt bool, filter *liveFilter, cw *coldWriter) error {
+	if err := db.flush(); err != nil {
+		return err
+	}
+
+	bufw := bufio.NewWriter(w)
+	rw := newRowWriter(bufw, format, db.headerFlags(), db.hmacKey)
+	metaKeys := make([]string, 0, len(db.meta))
+	for k := range db.meta {
+		metaKeys = append(metaKeys, k)
+	}
+	sort.Strings(metaKeys)
+	for _, k := range metaKeys {
+		rw.write(opMeta, k, []byte(db.meta[k]))
+	}
+
+	var readErr error
+	db.keys.forEach(func(k []byte, r ref) bool {
+		if db.expired(string(k)) || !filter.keeps(string(k)) {
+			return true
+		}
+		if !r.hasValue() {
+			rw.write(opSet, string(k), nil)
+			return true
+		}
+		var v []byte
+		v, readErr = db.readStored(string(k), r)
+		if readErr != nil {
+			return false
+		}
+		op := opPut
+		if r.compressed {
+			op = opPutCompressed
+		}
+		if reencrypt && db.aeads != nil && len(v) > 0 && v[0] != db.encryptionKeyID {
+			if v, readErr = db.reencryptValue(op, string(k), v); readErr != nil {
+				return false
+			}
+		}
+		cw.write(rw, op, string(k), r, v)
+		return true
+	})
+	// Expiration times follow the keys they apply to
+	for k, exp := range db.expiries {
+		if !db.expired(k) && filter.keeps(k) {
+			rw.write(opExpire, k, strconv.AppendInt(nil, exp, 10))
+		}
+	}
+	if filter != nil {
+		for _, k := range filter.deleted {
+			rw.write(opDelete, k, nil)
+		}
+	}
+	if readErr != nil {
+		return readErr
+	}
+	return bufw.Flush()
+}
+
+// liveFilter restricts the keys written by writeLive (see SegmentedDB).
+type liveFilter struct {
+	keep    func(k string) bool // stored keys to write
+	deleted []string            // stored keys written as deleted after the live keys
+}
+
+func (filter *liveFilter) keeps(k string) bool { return filter == nil || filter.keep(k) }
+
+// rowWriter writes the header and rows of a new file, chaining their MACs if enabled.
+type rowWriter struct {
+	w       io.Writer
+	format  FormatVersion
+	hmacKey []byte
+	row     []byte
+	mac     []byte // MAC of the last row
+	offset  int    // number of bytes written
+}
+
+func newRowWriter(w io.Writer, format FormatVersion, flags HeaderFlags, hmacKey []byte) *rowWriter {
+	rw := &rowWriter{w: w, format: format, hmacKey: hmacKey}
+	header := appendHeader(nil, format, flags)
+	rw.w.Write(header)
+	rw.offset = len(header)
+	return rw
+}
+
+// write writes a row and returns the offset of its value and the length of the row.
+func (rw *rowWriter) write(op byte, k string, v []byte) (int, int) {
+	rw.row = rw.format.rows().AppendBody(rw.row[:0], op, k, v)
+	vStart := rw.offset + len(rw.row) - len(v)
+	if rw.hmacKey != nil {
+		rw.mac = chainMAC(rw.hmacKey, rw.mac, rw.row)
+	}
+	if rw.format == FormatText {
+		rw.row = record.AppendEndLegacy(rw.row, rw.mac)
+	} else {
+		rw.row = rw.format.rows().AppendEnd(rw.row, 0, rw.mac)
+	}
+	rw.w.Write(rw.row)
+	rw.offset += len(rw.row)
+	return vStart, len(rw.row)
+}
+
+// readStored reads a value as stored in the file (possibly encrypted and compressed).
+func (db *DB) readStored(k string, r ref) ([]byte, error) {
+	v := make([]byte, r.width)
+	if err := db.readVerified(db.valueReader(r), k, r, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func verifyMigration(src *DB, fpath string, opts []Option) error {
+	dst, err := Open(fpath, opts...)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	if dst.hmacKey != nil {
+		if err := dst.Verify(); err != nil {
+			return err
+		}
+	}
+	// Keys with an expiration time may have expired since they were copied, so they're not counted
+	if n, want := dst.keys.len()-len(dst.expiries), src.keys.len()-len(src.expiries); n != want {
+		return fmt.Errorf("%w: %d keys without expiration instead of %d", ErrMigrationMismatch, n, want)
+	}
+	for k, v := range src.meta {
+		if dst.meta[k] != v {
+			return fmt.Errorf("%w: metadata %q", ErrMigrationMismatch, k)
+		}
+	}
+	var verifyErr error
+	src.keys.forEach(func(k []byte, r ref) bool {
+		verifyErr = verifyMigratedKey(src, dst, string(k), r)
+		return verifyErr == nil
+	})
+	return verifyErr
+}
+
+func verifyMigratedKey(src, dst *DB, k string, r ref) error {
+	dr, ok := dst.keys.get(k)
+	if _, expires := src.expiries[k]; !ok && expires {
+		return nil
+	}
+	if !ok || dr.hasValue() != r.hasValue() || dr.compressed != r.compressed || dr.valueWidth() != r.valueWidth() {
+		return fmt.Errorf("%w: key %q", ErrMigrationMismatch, k)
+	}
+	if !r.hasValue() {
+		return nil
+	}
+	sv, err := src.readStored(k, r)
+	if err != nil {
+		return err
+	}
+	dv, err := dst.readStored(k, dr)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sv, dv) {
+		return fmt.Errorf("%w: value of %q", ErrMigrationMismatch, k)
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package textdb
+
+import "os"
+
+func mmapFile(f *os.File, size int) ([]byte, error) { return nil, errMmapUnsupported }
+
+func munmap(data []byte) {}
@@ -0,0 +1,21 @@
+//go:build unix
+
+package textdb
+
+import (
+	"os"
+	"syscall"
+)
+
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	if size == 0 {
+		return nil, nil
+	}
+	return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmap(data []byte) {
+	if len(data) > 0 {
+		syscall.Munmap(data)
+	}
+}
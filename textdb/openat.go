@@ -0,0 +1,31 @@
+package textdb
+
+import "io"
+
+// RecoveryPoint is the point of the file up to which OpenAt replays rows.
+// A field is ignored if it's zero, and replaying stops at the first point reached.
+type RecoveryPoint struct {
+	Offset int64 // offset in the file that rows must end at or before (see CorruptRecordError)
+	Rows   int   // number of rows, including the header rows of batches and the time rows (see WithTimestamps)
+}
+
+// OpenAt opens the database read-only with the state as of the given point of the file,
+// e.g. to inspect it before a bad write. Since its rows are only appended, the state is
+// that of the database once the rows before the point were written. A batch that the point
+// falls in isn't applied, like after a crash while it was being written.
+// Rows have no timestamps, so the point can't be a time.
+func OpenAt(fpath string, upTo RecoveryPoint, opts ...Option) (*DB, error) {
+	return Open(fpath, append(opts, WithReadOnly(), func(db *DB) {
+		db.upTo = &upTo
+		db.hintFile = false // the hint may cover rows after the point
+		db.follow = false
+	})...)
+}
+
+// replaySource returns the source of the rows to replay in a file of the given size, and its size.
+func (db *DB) replaySource(size int64) (io.ReadSeeker, int64) {
+	if db.upTo != nil && db.upTo.Offset > 0 && db.upTo.Offset < size {
+		return io.NewSectionReader(db.r, 0, db.upTo.Offset), db.upTo.Offset
+	}
+	return db.r, size
+}
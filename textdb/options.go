@@ -0,0 +1,67 @@
+package textdb
+
+import (
+	"fmt"
+	"os"
+)
+
+type Option func(*DB)
+
+// WithFileMode sets the permissions of the database file if it's created (os.ModePerm before umask by default).
+func WithFileMode(perm os.FileMode) Option {
+	return func(db *DB) { db.fileMode = perm }
+}
+
+// WithMaxKeySize limits the size of keys, it can't exceed the limit of the format.
+func WithMaxKeySize(n int) Option {
+	return func(db *DB) {
+		if n < maxKeySize {
+			db.maxKeyLen = n
+		}
+	}
+}
+
+// WithMaxValueSize limits the size of values (before compression and encryption),
+// it can't exceed the limit of the format.
+func WithMaxValueSize(n int) Option {
+	return func(db *DB) {
+		if n < maxValueSize {
+			db.maxValueLen = n
+		}
+	}
+}
+
+// Validation sets how much of the file is checked when it's opened.
+type Validation int
+
+const (
+	ValidateChecksums Validation = iota // row structure and checksums (default)
+	ValidateRows                        // row structure only, values are skipped (see WithLazyChecksums)
+	ValidateAll                         // also the HMAC chain if enabled and decoding every value
+)
+
+func WithValidation(v Validation) Option {
+	return func(db *DB) {
+		db.validation = v
+		db.lazyChecksums = v == ValidateRows
+	}
+}
+
+// validateAll verifies the HMAC chain and that each value can be read, decrypted and decompressed.
+func (db *DB) validateAll() error {
+	if db.hmacKey != nil {
+		if err := db.Verify(); err != nil {
+			return err
+		}
+	}
+	var err error
+	db.keys.forEach(func(k []byte, r ref) bool {
+		if r.hasValue() {
+			if _, err = db.readValue(string(k), r); err != nil {
+				err = fmt.Errorf("key %q: %w", k, err)
+			}
+		}
+		return err == nil
+	})
+	return err
+}
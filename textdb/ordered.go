@@ -0,0 +1,143 @@
+package textdb
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+)
+
+// orderedKeys keeps the entries of a keydir sorted by key, for ordered iteration.
+// It's a list of sorted blocks of entry IDs: small blocks keep inserts cheap
+// and only 4 bytes are used per key since keys stay in the keydir arena.
+//
+// It's only built on the first ordered iteration and then maintained on writes,
+// so that loading the index and databases that are never iterated in order don't pay for it.
+type orderedKeys struct {
+	mu     sync.Mutex // guards building, the keydir is otherwise only modified by writes
+	built  bool
+	blocks []orderedBlock
+}
+
+type orderedBlock struct {
+	first string // copy of the first key, so that finding a block doesn't access the arena
+	ids   []uint32
+}
+
+const maxOrderedBlockSize = 512
+
+// search returns the position of the key, or where it should be inserted.
+func (kd *keydir) search(k string) (b, i int, found bool) {
+	ok := &kd.ordered
+	if len(ok.blocks) == 0 {
+		return 0, 0, false
+	}
+	// Find the last block whose first key is lower or equal to k
+	b = sort.Search(len(ok.blocks), func(b int) bool { return ok.blocks[b].first > k }) - 1
+	if b < 0 {
+		b = 0
+	}
+	block := ok.blocks[b].ids
+	i = sort.Search(len(block), func(i int) bool { return kd.idKey(block[i]) >= k })
+	return b, i, i < len(block) && kd.idKey(block[i]) == k
+}
+
+// idKey returns the key of an entry, the conversion doesn't allocate when used in a comparison.
+// It does when stored (as a block's first key), which only happens once per block change.
+func (kd *keydir) idKey(id uint32) string { return string(kd.keyOf(&kd.entries[id])) }
+
+// buildOrdered sorts the entries if it wasn't done yet.
+func (kd *keydir) buildOrdered() {
+	ok := &kd.ordered
+	ok.mu.Lock()
+	defer ok.mu.Unlock()
+	if ok.built {
+		return
+	}
+	ids := make([]uint32, len(kd.entries))
+	for i := range ids {
+		ids[i] = uint32(i)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return bytes.Compare(kd.keyOf(&kd.entries[ids[i]]), kd.keyOf(&kd.entries[ids[j]])) < 0
+	})
+	// Leave room in blocks for inserts
+	for start := 0; start < len(ids); start += maxOrderedBlockSize / 2 {
+		end := start + maxOrderedBlockSize/2
+		if end > len(ids) {
+			end = len(ids)
+		}
+		ok.blocks = append(ok.blocks, orderedBlock{first: kd.idKey(ids[start]), ids: ids[start:end:end]})
+	}
+	ok.built = true
+}
+
+func (kd *keydir) orderedInsert(k string, id uint32) {
+	ok := &kd.ordered
+	if !ok.built {
+		return
+	}
+	if len(ok.blocks) == 0 {
+		ok.blocks = []orderedBlock{{first: k, ids: []uint32{id}}}
+		return
+	}
+	b, i, _ := kd.search(k)
+	block := append(ok.blocks[b].ids, 0)
+	copy(block[i+1:], block[i:])
+	block[i] = id
+	ok.blocks[b].ids = block
+	if i == 0 {
+		ok.blocks[b].first = k
+	}
+	if len(block) > maxOrderedBlockSize {
+		half := len(block) / 2
+		right := orderedBlock{first: kd.idKey(block[half]), ids: append([]uint32(nil), block[half:]...)}
+		ok.blocks[b].ids = block[:half:half]
+		ok.blocks = append(ok.blocks, orderedBlock{})
+		copy(ok.blocks[b+2:], ok.blocks[b+1:])
+		ok.blocks[b+1] = right
+	}
+}
+
+func (kd *keydir) orderedRemove(k string) {
+	if !kd.ordered.built {
+		return
+	}
+	b, i, found := kd.search(k)
+	if !found {
+		return
+	}
+	ok := &kd.ordered
+	block := append(ok.blocks[b].ids[:i], ok.blocks[b].ids[i+1:]...)
+	ok.blocks[b].ids = block
+	switch {
+	case len(block) == 0:
+		ok.blocks = append(ok.blocks[:b], ok.blocks[b+1:]...)
+	case i == 0:
+		ok.blocks[b].first = kd.idKey(block[0])
+	}
+}
+
+// orderedReplace changes the entry ID of a key (when entries are moved).
+func (kd *keydir) orderedReplace(k string, id uint32) {
+	if !kd.ordered.built {
+		return
+	}
+	if b, i, found := kd.search(k); found {
+		kd.ordered.blocks[b].ids[i] = id
+	}
+}
+
+// ascend calls fn for each key greater or equal to start in lexicographic order, until fn returns false.
+// The key is only valid during the call and the index must not be modified.
+func (kd *keydir) ascend(start string, fn func(k []byte, r ref) bool) {
+	kd.buildOrdered()
+	b, i, _ := kd.search(start)
+	for ; b < len(kd.ordered.blocks); b, i = b+1, 0 {
+		for _, id := range kd.ordered.blocks[b].ids[i:] {
+			e := &kd.entries[id]
+			if !fn(kd.keyOf(e), unpackRef(e.index, e.width)) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package textdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// Parquet physical types, encodings and other enum values used below,
+// see: https://github.com/apache/parquet-format/blob/master/src/main/thrift/parquet.thrift
+const (
+	pqTypeInt64     = 2
+	pqTypeByteArray = 6
+
+	pqRepetitionRequired = 0
+	pqRepetitionOptional = 1
+
+	pqConvertedUTF8            = 0
+	pqConvertedTimestampMicros = 10
+
+	pqEncodingPlain = 0
+	pqEncodingRLE   = 3
+
+	pqCodecUncompressed = 0
+	pqPageTypeData      = 0
+)
+
+var pqMagic = []byte("PAR1")
+
+// Maximum number of rows written per row group.
+const pqRowGroupSize = 10_000
+
+type pqColumn struct {
+	name      string
+	typ       int32
+	optional  bool
+	utf8      bool
+	timestamp bool
+	values    bytes.Buffer // PLAIN-encoded non-null values
+	defLevels []byte       // only for optional columns
+}
+
+func (c *pqColumn) appendByteArray(v []byte) {
+	c.defLevels = append(c.defLevels, 1)
+	binary.Write(&c.values, binary.LittleEndian, uint32(len(v)))
+	c.values.Write(v)
+}
+
+func (c *pqColumn) appendInt64(v int64) {
+	c.defLevels = append(c.defLevels, 1)
+	binary.Write(&c.values, binary.LittleEndian, v)
+}
+
+func (c *pqColumn) appendNull() { c.defLevels = append(c.defLevels, 0) }
+
+func (c *pqColumn) reset() {
+	c.values.Reset()
+	c.defLevels = c.defLevels[:0]
+}
+
+// ExportParquet writes all keys, values and value sizes as a Parquet file
+// with the columns "key" (string), "value" (binary, null for keys without value),
+// "value_size" (int64) and "written_at" (timestamp of the last write of the key, see WithTimestamps).
+// Rows are sorted by key. written_at is null for files without timestamps, for keys compacted
+// since their write, and for keys written while the export starts.
+func (db *DB) ExportParquet(w io.Writer) error {
+	writeTimes, err := db.writeTimes()
+	if err != nil {
+		return err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return ErrClosed
+	}
+	keys := db.sortedKeys()
+
+	cw := &countingWriter{w: w}
+	if _, err := cw.Write(pqMagic); err != nil {
+		return err
+	}
+
+	columns := []*pqColumn{
+		{name: "key", typ: pqTypeByteArray, utf8: true},
+		{name: "value", typ: pqTypeByteArray, optional: true},
+		{name: "value_size", typ: pqTypeInt64},
+		{name: "written_at", typ: pqTypeInt64, optional: true, timestamp: true},
+	}
+	var rowGroups [][]byte
+	for start := 0; start < len(keys); start += pqRowGroupSize {
+		end := start + pqRowGroupSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		for _, c := range columns {
+			c.reset()
+		}
+		for _, k := range keys[start:end] {
+			columns[0].appendByteArray([]byte(k))
+			if t, ok := writeTimes[k]; ok {
+				columns[3].appendInt64(t / 1000)
+			} else {
+				columns[3].appendNull()
+			}
+			if ref, _ := db.keys.get(k); !ref.hasValue() {
+				columns[1].appendNull()
+				columns[2].appendInt64(0)
+				continue
+			}
+			v, err := db.getStored(k)
+			if err != nil {
+				return err
+			}
+			columns[1].appendByteArray(v)
+			columns[2].appendInt64(int64(len(v)))
+		}
+		rg, err := writeParquetRowGroup(cw, columns, end-start)
+		if err != nil {
+			return err
+		}
+		rowGroups = append(rowGroups, rg)
+	}
+
+	// Write file metadata, its length and the trailing magic bytes
+	meta := &thriftWriter{}
+	meta.fieldI32(1, 1) // version
+	meta.fieldListBegin(2, thriftStruct, len(columns)+1)
+	meta.schemaRoot("schema", int32(len(columns)))
+	for _, c := range columns {
+		meta.structBegin()
+		meta.fieldI32(1, c.typ)
+		if c.optional {
+			meta.fieldI32(3, pqRepetitionOptional)
+		} else {
+			meta.fieldI32(3, pqRepetitionRequired)
+		}
+		meta.fieldBinary(4, []byte(c.name))
+		switch {
+		case c.utf8:
+			meta.fieldI32(6, pqConvertedUTF8)
+		case c.timestamp:
+			meta.fieldI32(6, pqConvertedTimestampMicros)
+		}
+		meta.structEnd()
+	}
+	meta.fieldI64(3, int64(len(keys)))
+	meta.fieldListBegin(4, thriftStruct, len(rowGroups))
+	for _, rg := range rowGroups {
+		meta.buf.Write(rg)
+	}
+	meta.fieldBinary(6, []byte("textdb"))
+	meta.structEnd()
+
+	if _, err := cw.Write(meta.buf.Bytes()); err != nil {
+		return err
+	}
+	if err := binary.Write(cw, binary.LittleEndian, uint32(meta.buf.Len())); err != nil {
+		return err
+	}
+	_, err = cw.Write(pqMagic)
+	return err
+}
+
+// writeTimes returns the time of the last write of the keys, in Unix nanoseconds,
+// read from the time rows of the file (see WithTimestamps).
+func (db *DB) writeTimes() (map[string]int64, error) {
+	if !db.timestamps || db.unnamed {
+		return nil, nil
+	}
+	f, start, end, err := db.openRows()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	times := make(map[string]int64)
+	rr := db.rowReader(f, int64(start), end)
+	var t int64
+	for offset := start; ; {
+		r, n, err := rr.Next()
+		if errors.Is(err, io.EOF) && n == 0 {
+			return times, nil
+		}
+		if err != nil {
+			return nil, &CorruptRecordError{Offset: int64(offset), Err: err}
+		}
+		switch r.Op {
+		case opTime:
+			t, _ = strconv.ParseInt(string(r.Value), 10, 64)
+		case opSet, opPut, opPutCompressed:
+			if t != 0 {
+				times[r.Key] = t
+			} else {
+				delete(times, r.Key)
+			}
+		case opDelete:
+			delete(times, r.Key)
+		}
+		offset += n
+	}
+}
+
+// writeParquetRowGroup writes one data page per column and returns the encoded RowGroup struct.
+func writeParquetRowGroup(cw *countingWriter, columns []*pqColumn, numRows int) ([]byte, error) {
+	rg := &thriftWriter{}
+	rg.structBegin()
+	rg.fieldListBegin(1, thriftStruct, len(columns))
+	totalSize := int64(0)
+	for _, c := range columns {
+		// Encode page data: definition levels (if any) followed by values
+		page := &bytes.Buffer{}
+		if c.optional {
+			levels := encodeRLELevels(c.defLevels)
+			binary.Write(page, binary.LittleEndian, uint32(len(levels)))
+			page.Write(levels)
+		}
+		page.Write(c.values.Bytes())
+
+		header := &thriftWriter{}
+		header.fieldI32(1, pqPageTypeData)
+		header.fieldI32(2, int32(page.Len()))
+		header.fieldI32(3, int32(page.Len()))
+		header.fieldStructBegin(5)
+		header.fieldI32(1, int32(numRows))
+		header.fieldI32(2, pqEncodingPlain)
+		header.fieldI32(3, pqEncodingRLE)
+		header.fieldI32(4, pqEncodingRLE)
+		header.structEnd()
+		header.structEnd()
+
+		offset := cw.n
+		if _, err := cw.Write(header.buf.Bytes()); err != nil {
+			return nil, err
+		}
+		if _, err := cw.Write(page.Bytes()); err != nil {
+			return nil, err
+		}
+		size := int64(header.buf.Len() + page.Len())
+		totalSize += size
+
+		// ColumnChunk with its ColumnMetaData
+		rg.structBegin()
+		rg.fieldI64(2, offset)
+		rg.fieldStructBegin(3)
+		rg.fieldI32(1, c.typ)
+		rg.fieldListBegin(2, thriftI32, 2)
+		rg.i32(pqEncodingPlain)
+		rg.i32(pqEncodingRLE)
+		rg.fieldListBegin(3, thriftBinary, 1)
+		rg.binary([]byte(c.name))
+		rg.fieldI32(4, pqCodecUncompressed)
+		rg.fieldI64(5, int64(numRows))
+		rg.fieldI64(6, size)
+		rg.fieldI64(7, size)
+		rg.fieldI64(9, offset)
+		rg.structEnd()
+		rg.structEnd()
+	}
+	rg.fieldI64(2, totalSize)
+	rg.fieldI64(3, int64(numRows))
+	rg.structEnd()
+	return rg.buf.Bytes(), nil
+}
+
+// encodeRLELevels encodes definition levels (bit-width 1) using RLE runs
+// of the RLE/bit-packing hybrid encoding.
+func encodeRLELevels(levels []byte) []byte {
+	var out []byte
+	for i := 0; i < len(levels); {
+		j := i
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		out = binary.AppendUvarint(out, uint64(j-i)<<1)
+		out = append(out, levels[i])
+		i = j
+	}
+	return out
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// Thrift compact protocol types
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter implements the subset of the Thrift compact protocol needed for Parquet metadata.
+type thriftWriter struct {
+	buf     bytes.Buffer
+	lastIDs []int16
+	lastID  int16
+}
+
+func (tw *thriftWriter) fieldHeader(id int16, typ byte) {
+	if delta := id - tw.lastID; delta > 0 && delta <= 15 {
+		tw.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		tw.buf.WriteByte(typ)
+		tw.varint(int64(id))
+	}
+	tw.lastID = id
+}
+
+func (tw *thriftWriter) varint(v int64) {
+	tw.buf.Write(binary.AppendVarint(nil, v))
+}
+
+func (tw *thriftWriter) i32(v int32) { tw.varint(int64(v)) }
+func (tw *thriftWriter) binary(b []byte) {
+	tw.buf.Write(binary.AppendUvarint(nil, uint64(len(b))))
+	tw.buf.Write(b)
+}
+
+func (tw *thriftWriter) fieldI32(id int16, v int32) { tw.fieldHeader(id, thriftI32); tw.i32(v) }
+func (tw *thriftWriter) fieldI64(id int16, v int64) { tw.fieldHeader(id, thriftI64); tw.varint(v) }
+func (tw *thriftWriter) fieldBinary(id int16, b []byte) {
+	tw.fieldHeader(id, thriftBinary)
+	tw.binary(b)
+}
+
+func (tw *thriftWriter) fieldListBegin(id int16, elemType byte, size int) {
+	tw.fieldHeader(id, thriftList)
+	if size < 15 {
+		tw.buf.WriteByte(byte(size)<<4 | elemType)
+	} else {
+		tw.buf.WriteByte(0xF0 | elemType)
+		tw.buf.Write(binary.AppendUvarint(nil, uint64(size)))
+	}
+}
+
+func (tw *thriftWriter) fieldStructBegin(id int16) {
+	tw.fieldHeader(id, thriftStruct)
+	tw.structBegin()
+}
+
+// structBegin starts a nested struct (either a field or a list element).
+func (tw *thriftWriter) structBegin() {
+	tw.lastIDs = append(tw.lastIDs, tw.lastID)
+	tw.lastID = 0
+}
+
+// structEnd writes the stop byte and restores the field ID context of the parent struct.
+func (tw *thriftWriter) structEnd() {
+	tw.buf.WriteByte(0)
+	if len(tw.lastIDs) > 0 {
+		tw.lastID = tw.lastIDs[len(tw.lastIDs)-1]
+		tw.lastIDs = tw.lastIDs[:len(tw.lastIDs)-1]
+	}
+}
+
+// schemaRoot writes the root SchemaElement struct that only has a name and a number of children.
+func (tw *thriftWriter) schemaRoot(name string, numChildren int32) {
+	tw.structBegin()
+	tw.fieldBinary(4, []byte(name))
+	tw.fieldI32(5, numChildren)
+	tw.structEnd()
+}
@@ -0,0 +1,111 @@
+package textdb
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Metadata keys used to store the key derivation parameters
+const (
+	metaKDF      = "kdf"
+	metaKDFCheck = "kdf.check"
+)
+
+// Default Argon2id parameters for new databases
+const (
+	argon2Time    = 2
+	argon2Memory  = 19 * 1024 // in KiB
+	argon2Threads = 1
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+var ErrWrongPassphrase = errors.New("wrong passphrase")
+
+// WithPassphrase encrypts values with a key derived from the passphrase using Argon2id.
+// The key derivation parameters are stored in the metadata rows at the start of the file
+// when the database is created, opening an existing database without these fails.
+func WithPassphrase(passphrase string) Option {
+	return func(db *DB) { db.passphrase = passphrase }
+}
+
+func (db *DB) initPassphrase(isNew bool) error {
+	if db.passphrase == "" {
+		if _, ok := db.meta[metaKDF]; ok && db.encryptionKeys == nil {
+			return errors.New("database is passphrase-protected")
+		}
+		return nil
+	}
+	if db.encryptionKeys != nil {
+		return errors.New("passphrase and encryption keys are mutually exclusive")
+	}
+
+	var kdf, check string
+	var key []byte
+	if isNew {
+		// New database: generate a salt and record the parameters
+		salt := make([]byte, argon2SaltLen)
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return fmt.Errorf("generate salt: %w", err)
+		}
+		kdf = fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s",
+			argon2.Version, argon2Memory, argon2Time, argon2Threads, base64.RawStdEncoding.EncodeToString(salt))
+		key = argon2.IDKey([]byte(db.passphrase), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+		check = passphraseCheck(key)
+		if err := db.putMeta(metaKDF, kdf); err != nil {
+			return err
+		}
+		if err := db.putMeta(metaKDFCheck, check); err != nil {
+			return err
+		}
+	} else {
+		var ok bool
+		if kdf, ok = db.meta[metaKDF]; !ok {
+			return errors.New("database is not passphrase-protected")
+		}
+		var err error
+		key, err = deriveKey(db.passphrase, kdf)
+		if err != nil {
+			return err
+		}
+		if !hmac.Equal([]byte(passphraseCheck(key)), []byte(db.meta[metaKDFCheck])) {
+			return ErrWrongPassphrase
+		}
+	}
+
+	db.encryptionKeys = map[byte][]byte{0: key}
+	return nil
+}
+
+func deriveKey(passphrase, kdf string) ([]byte, error) {
+	var version, memory, time int
+	var threads uint8
+	var saltB64 string
+	_, err := fmt.Sscanf(kdf, "$argon2id$v=%d$m=%d,t=%d,p=%d$%s", &version, &memory, &time, &threads, &saltB64)
+	if err != nil {
+		return nil, fmt.Errorf("parse key derivation parameters: %w", err)
+	}
+	if version != argon2.Version {
+		return nil, fmt.Errorf("unsupported argon2 version: %d", version)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(saltB64)
+	if err != nil {
+		return nil, fmt.Errorf("decode salt: %w", err)
+	}
+	return argon2.IDKey([]byte(passphrase), salt, uint32(time), uint32(memory), threads, argon2KeyLen), nil
+}
+
+// passphraseCheck allows detecting a wrong passphrase at open time without storing the key.
+func passphraseCheck(key []byte) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte("textdb passphrase check"))
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,26 @@
+package textdb
+
+import "time"
+
+// runPeriodically calls fn with the database locked at the given interval until the database is closed.
+func (db *DB) runPeriodically(interval time.Duration, fn func()) {
+	if db.stop == nil {
+		db.stop = make(chan struct{})
+	}
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				db.mu.Lock()
+				if !db.closed {
+					fn()
+				}
+				db.mu.Unlock()
+			}
+		}
+	}(db.stop)
+}
@@ -0,0 +1,28 @@
+package textdb
+
+import "sync"
+
+// Buffers larger than this are not returned to the pool to avoid pinning large allocations
+const maxPooledBufferSize = 1 << 20
+
+// buffers holds scratch space for row encoding and reads that doesn't outlive an operation.
+var buffers = sync.Pool{New: func() any { b := make([]byte, 0, 512); return &b }}
+
+// getBuffer returns a pooled buffer of length n.
+func getBuffer(n int) *[]byte {
+	buf := buffers.Get().(*[]byte)
+	if cap(*buf) < n {
+		*buf = make([]byte, n)
+	}
+	*buf = (*buf)[:n]
+	return buf
+}
+
+// putBuffer returns the buffer to the pool, b is the (possibly grown) slice last built in it.
+func putBuffer(buf *[]byte, b []byte) {
+	if cap(b) > maxPooledBufferSize {
+		return
+	}
+	*buf = b[:0]
+	buffers.Put(buf)
+}
@@ -0,0 +1,49 @@
+package textdb
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// WithPreallocation allocates file space in chunks of the given size ahead of the write offset,
+// reducing fragmentation and metadata updates during sustained writes.
+// It's only supported on Linux, where the file size isn't changed by preallocation
+// and unused space is released on Close. It's a no-op elsewhere or if the filesystem doesn't support it.
+func WithPreallocation(chunkSize int64) Option {
+	return func(db *DB) { db.preallocChunk = chunkSize }
+}
+
+var errPreallocUnsupported = errors.New("preallocation is not supported on this platform")
+
+// preallocWriter appends to the file and preallocates space before writing past the allocated end.
+type preallocWriter struct {
+	f         *os.File
+	w         io.Writer // writes to f
+	offset    int64
+	allocated int64
+	chunk     int64
+	disabled  bool
+}
+
+func (pw *preallocWriter) Write(p []byte) (int, error) {
+	if end := pw.offset + int64(len(p)); !pw.disabled && end > pw.allocated {
+		size := end + pw.chunk - pw.allocated
+		if err := fallocate(pw.f, pw.allocated, size); err != nil {
+			pw.disabled = true
+		} else {
+			pw.allocated += size
+		}
+	}
+	n, err := pw.w.Write(p)
+	pw.offset += int64(n)
+	return n, err
+}
+
+// release frees the preallocated space past the end of the file.
+func (pw *preallocWriter) release() error {
+	if pw.allocated <= pw.offset {
+		return nil
+	}
+	return pw.f.Truncate(pw.offset)
+}
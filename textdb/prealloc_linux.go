@@ -0,0 +1,12 @@
+package textdb
+
+import (
+	"os"
+	"syscall"
+)
+
+const fallocKeepSize = 0x01 // FALLOC_FL_KEEP_SIZE
+
+func fallocate(f *os.File, off, size int64) error {
+	return syscall.Fallocate(int(f.Fd()), fallocKeepSize, off, size)
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package textdb
+
+import "os"
+
+func fallocate(f *os.File, off, size int64) error { return errPreallocUnsupported }
@@ -0,0 +1,36 @@
+package textdb
+
+// ReplayProgress reports the rows read when the database is opened, see WithReplayProgress.
+type ReplayProgress struct {
+	Rows       int   // rows read so far (not those covered by a hint file, see WithHintFile)
+	Offset     int64 // offset of the next row to read
+	TotalBytes int64 // size of the file
+	Done       bool  // the rows were all read
+}
+
+// progressInterval is the number of bytes read between two progress reports.
+const progressInterval = 16 << 20
+
+// WithReplayProgress calls fn as the rows of the file are read when it's opened, about every 16MiB
+// and once they're all read. fn is called by Open, before it returns the database.
+// For large files, WithHintFile avoids reading the rows that were written before the last Close.
+func WithReplayProgress(fn func(ReplayProgress)) Option {
+	return func(db *DB) { db.onReplayProgress = fn }
+}
+
+// replayProgress tracks when to report the progress of the replay at open.
+type replayProgress struct {
+	fn         func(ReplayProgress)
+	total      int64
+	lastReport int
+}
+
+// reportProgress is called after each replayed row.
+func (db *DB) reportProgress(done bool) {
+	p := db.progress
+	if p == nil || !done && db.wIndex-p.lastReport < progressInterval {
+		return
+	}
+	p.lastReport = db.wIndex
+	p.fn(ReplayProgress{Rows: db.rowsReplayed, Offset: int64(db.wIndex), TotalBytes: p.total, Done: done})
+}
@@ -0,0 +1,122 @@
+package textdb
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Quota limits the number of keys and bytes (keys and stored values) under a key prefix.
+// A zero limit means unlimited.
+type Quota struct {
+	MaxKeys  int
+	MaxBytes int64
+}
+
+type Usage struct {
+	Keys  int
+	Bytes int64
+}
+
+type quotaState struct {
+	quota Quota
+	usage Usage
+}
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+type QuotaError struct {
+	Prefix string
+	Quota  Quota
+	Usage  Usage // usage the write would have resulted in
+}
+
+func (err *QuotaError) Error() string {
+	return fmt.Sprintf("%s: prefix %q (keys %d/%d, bytes %d/%d)",
+		ErrQuotaExceeded, err.Prefix, err.Usage.Keys, err.Quota.MaxKeys, err.Usage.Bytes, err.Quota.MaxBytes)
+}
+
+func (err *QuotaError) Unwrap() error { return ErrQuotaExceeded }
+
+// WithQuota limits the keys starting with the given prefix.
+// Writes that would go over quota fail with a *QuotaError, deletes are always allowed.
+func WithQuota(prefix string, q Quota) Option {
+	return func(db *DB) {
+		if db.quotas == nil {
+			db.quotas = make(map[string]*quotaState)
+		}
+		db.quotas[prefix] = &quotaState{quota: q}
+	}
+}
+
+func (db *DB) initQuotas() error {
+	if len(db.quotas) == 0 {
+		return nil
+	}
+	if db.keyHashSecret != nil {
+		return errors.New("quotas can't be used with hashed keys")
+	}
+	db.keys.forEach(func(k []byte, r ref) bool {
+		db.addUsage(string(k), Usage{Keys: 1, Bytes: int64(len(k) + r.valueWidth())})
+		return true
+	})
+	return nil
+}
+
+// QuotaUsage reports the current usage of the quota with the given prefix.
+func (db *DB) QuotaUsage(prefix string) (Usage, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	state, ok := db.quotas[prefix]
+	if !ok {
+		return Usage{}, false
+	}
+	return state.usage, true
+}
+
+// quotaDelta returns the change in usage caused by writing (or deleting) a key
+// with a stored value of the given width.
+func (db *DB) quotaDelta(k string, vWidth int, deleted bool) Usage {
+	if len(db.quotas) == 0 {
+		return Usage{}
+	}
+	ref, exists := db.keys.get(k)
+	return quotaDeltaFrom(k, ref, exists, vWidth, deleted)
+}
+
+// quotaDeltaFrom is like quotaDelta given the current ref of the key.
+func quotaDeltaFrom(k string, ref ref, exists bool, vWidth int, deleted bool) Usage {
+	var delta Usage
+	if exists {
+		delta.Keys--
+		delta.Bytes -= int64(len(k) + ref.valueWidth())
+	}
+	if !deleted {
+		delta.Keys++
+		delta.Bytes += int64(len(k) + vWidth)
+	}
+	return delta
+}
+
+func (db *DB) checkQuota(k string, delta Usage) error {
+	for prefix, state := range db.quotas {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		usage := Usage{Keys: state.usage.Keys + delta.Keys, Bytes: state.usage.Bytes + delta.Bytes}
+		if (state.quota.MaxKeys > 0 && delta.Keys > 0 && usage.Keys > state.quota.MaxKeys) ||
+			(state.quota.MaxBytes > 0 && delta.Bytes > 0 && usage.Bytes > state.quota.MaxBytes) {
+			return &QuotaError{Prefix: prefix, Quota: state.quota, Usage: usage}
+		}
+	}
+	return nil
+}
+
+func (db *DB) addUsage(k string, delta Usage) {
+	for prefix, state := range db.quotas {
+		if strings.HasPrefix(k, prefix) {
+			state.usage.Keys += delta.Keys
+			state.usage.Bytes += delta.Bytes
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package textdb
+
+import "os"
+
+// WithReadHandles opens n read-only handles on the file that concurrent reads are spread across,
+// so that many goroutines reading at once don't all go through the same file.
+func WithReadHandles(n int) Option {
+	return func(db *DB) { db.numReadHandles = n }
+}
+
+func (db *DB) openReadHandles(fpath string) error {
+	for i := 1; i < db.numReadHandles; i++ {
+		f, err := db.fs.OpenFile(fpath, os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		db.readers = append(db.readers, f)
+	}
+	return nil
+}
+
+// reader returns the next read handle in round-robin order.
+func (db *DB) reader() File {
+	if len(db.readers) == 0 {
+		return db.r
+	}
+	i := int(db.nextReader.Add(1) % uint32(len(db.readers)+1))
+	if i == 0 {
+		return db.r
+	}
+	return db.readers[i-1]
+}
+
+func (db *DB) closeReadHandles() error {
+	var err error
+	for _, f := range db.readers {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	db.readers = nil
+	return err
+}
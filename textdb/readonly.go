@@ -0,0 +1,16 @@
+package textdb
+
+import "errors"
+
+var ErrReadOnly = errors.New("database is read-only")
+
+// WithReadOnly opens the database without a write handle: the file must exist, it's never modified
+// and writes fail with ErrReadOnly. An incomplete batch or partial row at the end of the file is ignored.
+func WithReadOnly() Option {
+	return func(db *DB) { db.readOnly = true }
+}
+
+// OpenReadOnly is like Open with WithReadOnly.
+func OpenReadOnly(fpath string, opts ...Option) (*DB, error) {
+	return Open(fpath, append(opts, WithReadOnly())...)
+}
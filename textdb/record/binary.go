@@ -0,0 +1,232 @@
+package record
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Format is an encoding of rows.
+//
+// Binary rows have the same ops and parts as text rows, with uvarint lengths and no separators:
+//
+//	<op><klen>[<vlen>]<key>[<value>][<MAC>]<checksum>
+//
+// where the MAC is the raw HMAC-SHA256 and the checksum is the big-endian CRC-32 (IEEE)
+// of the preceding bytes of the row. Binary rows always have a checksum.
+type Format byte
+
+const (
+	Text Format = iota
+	Binary
+)
+
+// AppendHeader appends the part of a row body that precedes the value (the whole body for ops without value).
+func (f Format) AppendHeader(dst []byte, op byte, k string, vLen int) []byte {
+	if f == Text {
+		return AppendHeader(dst, op, k, vLen)
+	}
+	dst = append(dst, op)
+	dst = binary.AppendUvarint(dst, uint64(len(k)))
+	if HasValue(op) {
+		dst = binary.AppendUvarint(dst, uint64(vLen))
+	}
+	return append(dst, k...)
+}
+
+// AppendBody appends a row without its MAC and row end (see AppendEnd), like the package-level AppendBody.
+func (f Format) AppendBody(dst []byte, op byte, k string, v []byte) []byte {
+	dst = f.AppendHeader(dst, op, k, len(v))
+	if !HasValue(op) {
+		return dst
+	}
+	return append(dst, v...)
+}
+
+// AppendEnd terminates the row body starting at dst[start:] with its MAC (if not nil) and checksum.
+func (f Format) AppendEnd(dst []byte, start int, mac []byte) []byte {
+	return f.AppendTrailer(dst, crc32.ChecksumIEEE(dst[start:]), mac)
+}
+
+// AppendTrailer terminates a row like AppendEnd given the checksum of its body,
+// for rows whose body isn't in memory.
+func (f Format) AppendTrailer(dst []byte, sum uint32, mac []byte) []byte {
+	start := len(dst)
+	if f == Text {
+		if mac != nil {
+			dst = append(dst, macPrefix)
+			dst = append(dst, hex.EncodeToString(mac)...)
+		}
+		return AppendChecksum(dst, crc32.Update(sum, crc32.IEEETable, dst[start:]))
+	}
+	dst = append(dst, mac...)
+	return binary.BigEndian.AppendUint32(dst, crc32.Update(sum, crc32.IEEETable, dst[start:]))
+}
+
+// TrailerLen returns the size of what follows the body of a row with a checksum (or without, for text rows).
+func (f Format) TrailerLen(mac, checksum bool) int {
+	n := 0
+	if f == Binary {
+		if mac {
+			n += sha256.Size
+		}
+		return n + crc32.Size
+	}
+	if mac {
+		n += 1 + MACHexSize
+	}
+	if checksum {
+		n += 1 + ChecksumHexSize
+	}
+	return n + 1
+}
+
+// SplitTrailer decodes the trailer of a row (the bytes following its body) into the part covered
+// by the checksum (the MAC) and the checksum. ok is false for text rows without checksum.
+// The trailer must be TrailerLen(mac, true) bytes long, or shorter for text rows without checksum.
+func (f Format) SplitTrailer(trailer []byte, mac bool) (covered []byte, sum uint32, ok bool, err error) {
+	macLen := 0
+	if mac {
+		macLen = sha256.Size
+		if f == Text {
+			macLen = 1 + MACHexSize
+		}
+	}
+	if len(trailer) <= macLen {
+		return nil, 0, false, errors.New("trailer is too short")
+	}
+	covered, rest := trailer[:macLen], trailer[macLen:]
+	if f == Binary {
+		if len(rest) != crc32.Size {
+			return nil, 0, false, errors.New("invalid checksum")
+		}
+		return covered, binary.BigEndian.Uint32(rest), true, nil
+	}
+	switch rest[0] {
+	case rowEnd:
+		return covered, 0, false, nil // legacy row
+	case crcPrefix:
+	default:
+		return nil, 0, false, fmt.Errorf("unexpected byte %q after value", rest[0])
+	}
+	sum, ok = ParseChecksum(rest[1 : len(rest)-1])
+	if !ok || rest[len(rest)-1] != rowEnd {
+		return nil, 0, false, errors.New("invalid checksum")
+	}
+	return covered, sum, true, nil
+}
+
+// nextBinary reads the rest of a binary row after its op.
+func (rr *Reader) nextBinary(r *Record) (int, error) {
+	total := 1
+	switch r.Op {
+	default:
+		return total, fmt.Errorf("unknown op: %q", r.Op)
+	case OpSet, OpDelete, OpBatch, OpCold, OpPut, OpPutCompressed, OpMeta, OpExpire, OpTime:
+	}
+
+	// Read lengths
+	n, kLen, err := rr.readUvarint()
+	total += n
+	if err != nil {
+		return total, fmt.Errorf("read key-length: %w", err)
+	}
+	vLen := 0
+	if HasValue(r.Op) {
+		n, vLen, err = rr.readUvarint()
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("read value-length: %w", err)
+		}
+	}
+
+	// Read key
+	key, err := rr.readScratch(kLen)
+	total += len(key)
+	r.Key = string(key)
+	if err != nil {
+		return total, fmt.Errorf("read key: %w", unexpectedEOF(err))
+	}
+
+	// Read or skip value
+	if HasValue(r.Op) {
+		r.ValueOffset, r.ValueLen = total, vLen
+		if rr.ReadValue == nil || rr.ReadValue(r.Op) {
+			r.Value, err = rr.readFull(nil, vLen)
+			n = len(r.Value)
+		} else if !rr.SkipChecksums {
+			n, err = rr.discard(vLen)
+		} else {
+			n, err = rr.skip(vLen)
+		}
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("read value: %w", unexpectedEOF(err))
+		}
+	}
+
+	// Read MAC
+	if rr.MAC {
+		r.MAC = make([]byte, sha256.Size)
+		n, err := io.ReadFull(rr.br, r.MAC)
+		total += n
+		rr.hash(r.MAC[:n])
+		if err != nil {
+			return total, fmt.Errorf("read mac: %w", unexpectedEOF(err))
+		}
+	}
+
+	// Read checksum
+	r.Checksum = true
+	crc := rr.buffer(crc32.Size)
+	n, err = io.ReadFull(rr.br, crc)
+	total += n
+	if err != nil {
+		return total, fmt.Errorf("read checksum: %w", unexpectedEOF(err))
+	}
+	sum := binary.BigEndian.Uint32(crc)
+	if !rr.SkipChecksums && sum != rr.sum {
+		return total, fmt.Errorf("%w: %08x (computed %08x)", ErrChecksum, sum, rr.sum)
+	}
+	return total, nil
+}
+
+// readUvarint reads and hashes a length.
+func (rr *Reader) readUvarint() (int, int, error) {
+	var b [binary.MaxVarintLen64]byte
+	for n := 0; n < len(b); n++ {
+		c, err := rr.br.ReadByte()
+		if err != nil {
+			return n, 0, unexpectedEOF(err)
+		}
+		b[n] = c
+		if c < 0x80 {
+			rr.hash(b[:n+1])
+			v, _ := binary.Uvarint(b[:n+1])
+			if v > uint64(maxLength) {
+				return n + 1, 0, fmt.Errorf("length is too large: %d", v)
+			}
+			return n + 1, int(v), nil
+		}
+	}
+	rr.hash(b[:])
+	return len(b), 0, errors.New("length overflows")
+}
+
+// maxLength bounds decoded lengths so that corrupt ones don't allocate huge buffers.
+const maxLength = 1<<31 - 1
+
+// maxAlloc is the size up to which the bytes of a length are allocated before they're read.
+const maxAlloc = 1 << 20
+
+// unexpectedEOF converts io.EOF, since the row was started.
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,275 @@
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+)
+
+// Reader reads records sequentially and verifies their checksum.
+// When the source is seekable and checksums are skipped, value bytes that aren't read are skipped with a seek.
+type Reader struct {
+	// MAC must be set if rows have a MAC (written with an HMAC chain).
+	MAC bool
+	// ReadValue reports whether the value of rows of the op must be read,
+	// all values are read if it's nil. Skipped values only have their length and offset set.
+	ReadValue func(op byte) bool
+	// SkipChecksums disables checksum verification.
+	SkipChecksums bool
+	// Format is the encoding of rows, text by default.
+	Format Format
+
+	br      *bufio.Reader
+	src     io.Reader
+	size    int64 // source size if seekable
+	scratch []byte
+	sum     uint32 // checksum of the bytes of the current row
+}
+
+// NewReader returns a reader of the given source, in the text format unless Format is set.
+func NewReader(src io.Reader) *Reader { return &Reader{br: bufio.NewReader(src), src: src, size: -1} }
+
+// NewSeekingReader returns a reader skipping values with seeks on a source of the given size.
+func NewSeekingReader(src io.ReadSeeker, size int64) *Reader {
+	return &Reader{br: bufio.NewReader(src), src: src, size: size}
+}
+
+// Decode decodes the first record of b and returns its encoded size.
+func Decode(b []byte, mac bool) (Record, int, error) {
+	r := NewReader(bytes.NewReader(b))
+	r.MAC = mac
+	return r.Next()
+}
+
+// Next reads the next record and returns the number of bytes consumed.
+// It returns io.EOF (and zero bytes read) when there are no more records,
+// and an error wrapping ErrChecksum if the row doesn't match its checksum.
+func (rr *Reader) Next() (Record, int, error) {
+	var r Record
+	var err error
+	r.Op, err = rr.br.ReadByte()
+	if err != nil {
+		return r, 0, err
+	}
+	total := 1
+	rr.sum = 0
+	rr.hash([]byte{r.Op})
+	if rr.Format == Binary {
+		total, err = rr.nextBinary(&r)
+		return r, total, err
+	}
+
+	switch r.Op {
+	default:
+		return r, total, fmt.Errorf("unknown op: %q", r.Op)
+	case OpSet, OpDelete, OpBatch, OpCold:
+		// Read key-length (with suffix)
+		n, kLen, err := rr.readLengthWithSuffix(kPrefix)
+		total += n
+		if err != nil {
+			return r, total, fmt.Errorf("read key-length: %w", err)
+		}
+
+		// Read key
+		key, err := rr.readScratch(kLen)
+		total += len(key)
+		r.Key = string(key)
+		if err != nil {
+			return r, total, fmt.Errorf("read key: %w", err)
+		}
+	case OpPut, OpPutCompressed, OpMeta, OpExpire, OpTime:
+		// Read key-length (with suffix)
+		n, kLen, err := rr.readLengthWithSuffix(vLenPrefix)
+		total += n
+		if err != nil {
+			return r, total, fmt.Errorf("read key-length: %w", err)
+		}
+
+		// Read value-length (with suffix)
+		n, vLen, err := rr.readLengthWithSuffix(kPrefix)
+		total += n
+		if err != nil {
+			return r, total, fmt.Errorf("read value-length: %w", err)
+		}
+
+		// Read key (with suffix)
+		key, err := rr.readScratch(kLen + 1)
+		total += len(key)
+		if err != nil {
+			r.Key = string(key)
+			return r, total, fmt.Errorf("read key: %w", err)
+		}
+		r.Key = string(key[:kLen])
+		if key[kLen] != vPrefix {
+			// Parsing only relies on lengths, so a wrong length is caught here rather than by a later row
+			return r, total, fmt.Errorf("read key: unexpected byte %q after key", key[kLen])
+		}
+
+		// Read or skip value
+		r.ValueOffset, r.ValueLen = total, vLen
+		if rr.ReadValue == nil || rr.ReadValue(r.Op) {
+			r.Value, err = rr.readFull(nil, vLen)
+			n = len(r.Value)
+		} else if !rr.SkipChecksums {
+			n, err = rr.discard(vLen)
+		} else {
+			n, err = rr.skip(vLen)
+		}
+		total += n
+		if err != nil {
+			return r, total, fmt.Errorf("read value: %w", err)
+		}
+	}
+
+	// Read MAC (with prefix)
+	if rr.MAC {
+		macWithPrefix := make([]byte, 1+MACHexSize)
+		n, err := io.ReadFull(rr.br, macWithPrefix)
+		total += n
+		rr.hash(macWithPrefix[:n])
+		if err != nil {
+			return r, total, fmt.Errorf("read mac: %w", err)
+		}
+		r.MAC, err = hex.DecodeString(string(macWithPrefix[1:]))
+		if err != nil {
+			return r, total, fmt.Errorf("decode mac: %w", err)
+		}
+	}
+
+	// Read checksum (with prefix), legacy rows end right away
+	end, err := rr.br.ReadByte()
+	if err != nil {
+		return r, total, fmt.Errorf("read row-end: %w", err)
+	}
+	total++
+	if end == crcPrefix {
+		r.Checksum = true
+		crc := rr.buffer(ChecksumHexSize + 1)
+		n, err := io.ReadFull(rr.br, crc)
+		total += n
+		if err != nil {
+			return r, total, fmt.Errorf("read checksum: %w", err)
+		}
+		sum, ok := ParseChecksum(crc[:ChecksumHexSize])
+		if !ok {
+			return r, total, fmt.Errorf("decode checksum: %q", crc[:ChecksumHexSize])
+		}
+		if !rr.SkipChecksums && sum != rr.sum {
+			return r, total, fmt.Errorf("%w: %08x (computed %08x)", ErrChecksum, sum, rr.sum)
+		}
+		end = crc[ChecksumHexSize]
+	}
+
+	// Check row-end
+	if end != rowEnd {
+		return r, total, fmt.Errorf("read row-end: unexpected byte %q", end)
+	}
+	return r, total, nil
+}
+
+func (rr *Reader) hash(b []byte) {
+	if !rr.SkipChecksums {
+		rr.sum = crc32.Update(rr.sum, crc32.IEEETable, b)
+	}
+}
+
+// discard reads and hashes the next n bytes.
+func (rr *Reader) discard(n int) (int, error) {
+	read := 0
+	for read < n {
+		size := n - read
+		if size > rr.br.Size() {
+			size = rr.br.Size()
+		}
+		chunk := rr.buffer(size)
+		m, err := io.ReadFull(rr.br, chunk)
+		read += m
+		rr.hash(chunk[:m])
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+// readFull appends and hashes the next n bytes.
+// Large lengths allocate as bytes are read, so that a corrupt length doesn't allocate more than the source holds.
+func (rr *Reader) readFull(dst []byte, n int) ([]byte, error) {
+	for n > 0 {
+		if len(dst) == cap(dst) {
+			c := len(dst) + n
+			if limit := 2*len(dst) + maxAlloc; c > limit {
+				c = limit
+			}
+			dst = append(make([]byte, 0, c), dst...)
+		}
+		size := cap(dst) - len(dst)
+		if size > n {
+			size = n
+		}
+		start := len(dst)
+		m, err := io.ReadFull(rr.br, dst[start:start+size])
+		dst = dst[:start+m]
+		rr.hash(dst[start:])
+		n -= m
+		if err != nil {
+			return dst, err
+		}
+	}
+	return dst, nil
+}
+
+// readScratch reads and hashes the next n bytes into scratch space (see buffer).
+func (rr *Reader) readScratch(n int) ([]byte, error) {
+	b, err := rr.readFull(rr.scratch[:0], n)
+	rr.scratch = b[:cap(b)]
+	return b, err
+}
+
+// buffer returns scratch space for bytes that are copied before the next record is read.
+func (rr *Reader) buffer(n int) []byte {
+	if cap(rr.scratch) < n {
+		rr.scratch = make([]byte, n)
+	}
+	return rr.scratch[:n]
+}
+
+func (rr *Reader) readLengthWithSuffix(until byte) (int, int, error) {
+	lenWithSuffix, err := rr.br.ReadBytes(until)
+	rr.hash(lenWithSuffix)
+	if err != nil {
+		return len(lenWithSuffix), 0, err
+	}
+	length, err := strconv.Atoi(string(lenWithSuffix[:len(lenWithSuffix)-1]))
+	if err != nil {
+		return len(lenWithSuffix), 0, fmt.Errorf("parse integer: %w", err)
+	}
+	if length < 0 || length > maxLength {
+		return len(lenWithSuffix), 0, fmt.Errorf("invalid length: %d", length)
+	}
+	return len(lenWithSuffix), length, nil
+}
+
+// skip discards the next n bytes and returns the number of bytes skipped.
+// Small skips are served from the buffer, larger ones seek the source.
+func (rr *Reader) skip(n int) (int, error) {
+	buffered := rr.br.Buffered()
+	seeker, ok := rr.src.(io.Seeker)
+	if !ok || rr.size < 0 || n-buffered < rr.br.Size() {
+		return rr.br.Discard(n)
+	}
+	rr.br.Discard(buffered)
+	pos, err := seeker.Seek(int64(n-buffered), io.SeekCurrent)
+	if err != nil {
+		return buffered, err
+	}
+	rr.br.Reset(rr.src)
+	if pos > rr.size {
+		return n - int(pos-rr.size), io.ErrUnexpectedEOF
+	}
+	return n, nil
+}
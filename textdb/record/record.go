@@ -0,0 +1,148 @@
+// Package record encodes and decodes the rows of the textdb log.
+//
+// Rows are text with length prefixes, so keys and values may contain any byte:
+//
+//	S<klen> <key>\n                (key without value)
+//	D<klen> <key>\n                (deleted key)
+//	C<klen> <key>\n                (key whose value was moved to another file, see textdb.WithColdTier)
+//	P<klen> <vlen> <key> <value>\n (key with value, M for metadata and Z for compressed values)
+//	B<klen> <n>\n                  (header of a batch of the n following rows)
+//	E<klen> <vlen> <key> <time>\n  (expiration time of a key, in Unix nanoseconds)
+//	T0 <vlen>  <time>\n            (time the following rows were written, in Unix nanoseconds)
+//
+// When an HMAC chain is used, a space and the hex MAC are inserted before the row end.
+// Rows then end with a space and the hex CRC-32 (IEEE) of the preceding bytes of the row,
+// rows of the legacy format have no checksum and end right away.
+//
+// Rows can also be encoded in binary (see Format).
+package record
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"strconv"
+)
+
+// Ops
+const (
+	OpSet           = byte('S')
+	OpDelete        = byte('D')
+	OpPut           = byte('P')
+	OpMeta          = byte('M')
+	OpPutCompressed = byte('Z')
+	OpBatch         = byte('B') // the key is the number of rows in the batch
+	OpExpire        = byte('E') // the value is the expiration time of the key
+	OpTime          = byte('T') // the value is the write time of the following rows, the key is empty
+	OpCold          = byte('C') // the value of the key is in the cold file
+)
+
+const (
+	kPrefix    = byte(' ')
+	vLenPrefix = byte(' ')
+	vPrefix    = byte(' ')
+	macPrefix  = byte(' ')
+	crcPrefix  = byte(' ')
+	rowEnd     = byte('\n')
+
+	// MACHexSize is the size of an encoded MAC.
+	MACHexSize = 2 * sha256.Size
+	// ChecksumHexSize is the size of an encoded checksum.
+	ChecksumHexSize = 2 * crc32.Size
+)
+
+var ErrChecksum = errors.New("checksum mismatch")
+
+// Record is a decoded row.
+type Record struct {
+	Op    byte
+	Key   string
+	Value []byte // nil if the row has no value or it wasn't read (see Reader.ReadValue)
+	MAC   []byte // only set when the HMAC chain is enabled
+
+	ValueLen    int
+	ValueOffset int  // offset of the value from the start of the row
+	Checksum    bool // the row has a checksum (it's verified unless Reader.SkipChecksums is set)
+}
+
+// HasValue reports whether rows of the op have a value.
+func HasValue(op byte) bool {
+	return op == OpPut || op == OpPutCompressed || op == OpMeta || op == OpExpire || op == OpTime
+}
+
+// AppendBody appends a row without its MAC and row end (see AppendEnd),
+// the value is ignored for ops without value.
+// The value is always the last part of the body.
+func AppendBody(dst []byte, op byte, k string, v []byte) []byte {
+	dst = AppendHeader(dst, op, k, len(v))
+	if !HasValue(op) {
+		return dst
+	}
+	return append(dst, v...)
+}
+
+// AppendHeader appends the part of a row body that precedes the value (the whole body for ops without value).
+func AppendHeader(dst []byte, op byte, k string, vLen int) []byte {
+	dst = append(dst, op)
+	dst = strconv.AppendInt(dst, int64(len(k)), 10)
+	if !HasValue(op) {
+		dst = append(dst, kPrefix)
+		return append(dst, k...)
+	}
+	dst = append(dst, vLenPrefix)
+	dst = strconv.AppendInt(dst, int64(vLen), 10)
+	dst = append(dst, kPrefix)
+	dst = append(dst, k...)
+	return append(dst, vPrefix)
+}
+
+// AppendEnd terminates the row body starting at dst[start:] with its MAC (if not nil),
+// its checksum and the row end.
+func AppendEnd(dst []byte, start int, mac []byte) []byte {
+	if mac != nil {
+		dst = append(dst, macPrefix)
+		dst = append(dst, hex.EncodeToString(mac)...)
+	}
+	return AppendChecksum(dst, crc32.ChecksumIEEE(dst[start:]))
+}
+
+// AppendChecksum appends an encoded checksum and the row end.
+func AppendChecksum(dst []byte, sum uint32) []byte {
+	var b [crc32.Size]byte
+	binary.BigEndian.PutUint32(b[:], sum)
+	dst = append(dst, crcPrefix)
+	dst = append(dst, hex.EncodeToString(b[:])...)
+	return append(dst, rowEnd)
+}
+
+// AppendEndLegacy terminates a row body like AppendEnd but without checksum.
+func AppendEndLegacy(dst []byte, mac []byte) []byte {
+	if mac != nil {
+		dst = append(dst, macPrefix)
+		dst = append(dst, hex.EncodeToString(mac)...)
+	}
+	return append(dst, rowEnd)
+}
+
+// ParseChecksum decodes an encoded checksum.
+func ParseChecksum(b []byte) (uint32, bool) {
+	var sum [crc32.Size]byte
+	if len(b) != ChecksumHexSize {
+		return 0, false
+	}
+	if _, err := hex.Decode(sum[:], b); err != nil {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(sum[:]), true
+}
+
+// Append appends an encoded record.
+func Append(dst []byte, r Record) []byte {
+	start := len(dst)
+	return AppendEnd(AppendBody(dst, r.Op, r.Key, r.Value), start, r.MAC)
+}
+
+// Encode returns an encoded record.
+func Encode(r Record) []byte { return Append(nil, r) }
@@ -0,0 +1,126 @@
+package record
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// binarySafeCases are keys and values with bytes that separate parts of text rows.
+var binarySafeCases = []struct {
+	name string
+	k    string
+	v    []byte
+}{
+	{"newline", "a\nb", []byte("line 1\nline 2\n")},
+	{"carriage return", "a\rb", []byte("\r\n\r")},
+	{"NUL", "a\x00b", []byte{0, 'x', 0, 0}},
+	{"separators only", " \n", []byte(" \n \n")},
+	{"row-like value", "k", []byte("P1 1 k v 00000000\nS1 k\n")},
+	{"empty value", "\n", []byte{}},
+}
+
+func TestRoundTripBinarySafe(t *testing.T) {
+	for _, format := range []Format{Text, Binary} {
+		for _, mac := range []bool{false, true} {
+			for _, op := range []byte{OpPut, OpSet, OpDelete} {
+				for _, c := range binarySafeCases {
+					var m []byte
+					if mac {
+						m = bytes.Repeat([]byte{0xab}, MACHexSize/2)
+					}
+					row := format.AppendBody(nil, op, c.k, c.v)
+					row = format.AppendEnd(row, 0, m)
+					// A second row checks that the first one is consumed exactly
+					next := format.AppendEnd(format.AppendBody(nil, OpSet, "next", nil), 0, m)
+
+					rr := NewReader(bytes.NewReader(append(row, next...)))
+					rr.Format, rr.MAC = format, mac
+					r, n, err := rr.Next()
+					if err != nil {
+						t.Fatalf("format %d, mac %v, op %c, %s: %v", format, mac, op, c.name, err)
+					}
+					if n != len(row) || r.Op != op || r.Key != c.k {
+						t.Fatalf("format %d, mac %v, op %c, %s: got %c %q (%d bytes), want %c %q (%d bytes)",
+							format, mac, op, c.name, r.Op, r.Key, n, op, c.k, len(row))
+					}
+					if HasValue(op) && !bytes.Equal(r.Value, c.v) {
+						t.Fatalf("format %d, mac %v, %s: got value %q, want %q", format, mac, c.name, r.Value, c.v)
+					}
+					if mac && !bytes.Equal(r.MAC, m) {
+						t.Fatalf("format %d, %s: got MAC %x, want %x", format, c.name, r.MAC, m)
+					}
+					if r, _, err := rr.Next(); err != nil || r.Key != "next" {
+						t.Fatalf("format %d, mac %v, op %c, %s: next row: %q, %v", format, mac, op, c.name, r.Key, err)
+					}
+					if _, _, err := rr.Next(); !errors.Is(err, io.EOF) {
+						t.Fatalf("format %d, mac %v, op %c, %s: got %v, want EOF", format, mac, op, c.name, err)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeBinarySafe(t *testing.T) {
+	for _, c := range binarySafeCases {
+		row := Encode(Record{Op: OpPut, Key: c.k, Value: c.v})
+		r, n, err := Decode(row, false)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if n != len(row) || r.Key != c.k || !bytes.Equal(r.Value, c.v) {
+			t.Fatalf("%s: got %q %q (%d bytes), want %q %q (%d bytes)", c.name, r.Key, r.Value, n, c.k, c.v, len(row))
+		}
+	}
+}
+
+func TestWrongLengthIsDetected(t *testing.T) {
+	// A legacy row, without checksum, whose key length doesn't match the key
+	row := []byte("P2 1 a\nb v\n")
+	if _, _, err := Decode(row, false); err == nil {
+		t.Fatal("decoded a row with a wrong key length")
+	}
+}
+
+// invalidLengthCases are rows with lengths that must be rejected without allocating them.
+var invalidLengthCases = []string{
+	"S-1 x\n",
+	"P1 -3 x abc\n",
+	"P-1 3 x abc\n",
+	"P1 99999999999999 x abc\n",
+	"P1 2147483647 x abc\n",
+	"S99999999999999999999 x\n",
+}
+
+func TestInvalidLengthIsRejected(t *testing.T) {
+	for _, row := range invalidLengthCases {
+		if _, _, err := Decode([]byte(row), false); err == nil {
+			t.Fatalf("decoded %q", row)
+		}
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, c := range binarySafeCases {
+		f.Add(Encode(Record{Op: OpPut, Key: c.k, Value: c.v}), false)
+	}
+	for _, row := range invalidLengthCases {
+		f.Add([]byte(row), false)
+	}
+	f.Add([]byte("P1 1 k v "+strings.Repeat("ab", MACHexSize/2)+"\n"), true)
+	f.Fuzz(func(t *testing.T, b []byte, mac bool) {
+		r, n, err := Decode(b, mac)
+		if err != nil {
+			return
+		}
+		if n > len(b) {
+			t.Fatalf("consumed %d bytes of %d", n, len(b))
+		}
+		if HasValue(r.Op) && len(r.Value) != r.ValueLen {
+			t.Fatalf("got %d value bytes, want %d", len(r.Value), r.ValueLen)
+		}
+	})
+}
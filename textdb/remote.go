@@ -0,0 +1,304 @@
+package textdb
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SegmentStore stores the closed segments of a SegmentedDB away from its directory,
+// e.g. in an S3-compatible object storage service (see RemoteSegments).
+// Segments are identified by the base name of their file, they're uploaded whole and then only read by ranges.
+type SegmentStore interface {
+	Upload(name string, r io.Reader) error                // creates or replaces the segment
+	ReadAt(name string, p []byte, off int64) (int, error) // like io.ReaderAt
+	Size(name string) (int64, error)                      // fs.ErrNotExist if there's no such segment
+	Delete(name string) error
+}
+
+// RemoteSegments keeps only the active segment of a SegmentedDB in its directory (with the manifest,
+// hint and lock files): a segment is uploaded to the store once writes move to a new one,
+// and is then read through a cache of the most recently read pages of the remote segments.
+// Opening the database reads each remote segment once to locate its keys and deletes,
+// a hint file (see WithHintFile) avoids reading its keys.
+type RemoteSegments struct {
+	Store     SegmentStore
+	CacheSize int64 // maximum size of the cached pages (64 MiB by default)
+}
+
+const (
+	remotePageSize          = 64 << 10
+	defaultRemoteCacheSize  = 64 << 20
+	remoteSegmentPermission = 0o400
+)
+
+var errRemoteSegmentReadOnly = errors.New("remote segments are read-only")
+
+// DirSegmentStore is a SegmentStore keeping segments in a directory, e.g. a mounted network file system.
+type DirSegmentStore string
+
+func (dir DirSegmentStore) path(name string) string { return filepath.Join(string(dir), name) }
+
+// Upload writes the segment to a temporary file that replaces it once synced.
+func (dir DirSegmentStore) Upload(name string, r io.Reader) error {
+	if err := os.MkdirAll(string(dir), 0o700); err != nil {
+		return err
+	}
+	tmpPath := dir.path(name) + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, dir.path(name))
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+func (dir DirSegmentStore) ReadAt(name string, p []byte, off int64) (int, error) {
+	f, err := os.Open(dir.path(name))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.ReadAt(p, off)
+}
+
+func (dir DirSegmentStore) Size(name string) (int64, error) {
+	fi, err := os.Stat(dir.path(name))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (dir DirSegmentStore) Delete(name string) error { return os.Remove(dir.path(name)) }
+
+// pageCache caches pages of the remote segments, evicting the least recently used ones.
+type pageCache struct {
+	store   SegmentStore
+	maxSize int64
+
+	mu    sync.Mutex
+	pages map[pageKey]*list.Element // of *cachedPage
+	lru   *list.List                // most recently used first
+	size  int64
+}
+
+type pageKey struct {
+	name string
+	n    int64
+}
+
+type cachedPage struct {
+	key pageKey
+	b   []byte
+}
+
+func newPageCache(cfg *RemoteSegments) *pageCache {
+	maxSize := cfg.CacheSize
+	if maxSize <= 0 {
+		maxSize = defaultRemoteCacheSize
+	}
+	return &pageCache{store: cfg.Store, maxSize: maxSize, pages: make(map[pageKey]*list.Element), lru: list.New()}
+}
+
+// readAt reads the segment of the given size at the offset, reading the missing pages from the store.
+func (c *pageCache) readAt(name string, size int64, p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		if off >= size {
+			return n, io.EOF
+		}
+		pk := pageKey{name: name, n: off / remotePageSize}
+		b, err := c.page(pk, size)
+		if err != nil {
+			return n, err
+		}
+		copied := copy(p[n:], b[off-pk.n*remotePageSize:])
+		n += copied
+		off += int64(copied)
+	}
+	return n, nil
+}
+
+// page returns the cached page, which must not be modified.
+func (c *pageCache) page(pk pageKey, size int64) ([]byte, error) {
+	c.mu.Lock()
+	if e, ok := c.pages[pk]; ok {
+		c.lru.MoveToFront(e)
+		c.mu.Unlock()
+		return e.Value.(*cachedPage).b, nil
+	}
+	c.mu.Unlock()
+
+	start := pk.n * remotePageSize
+	b := make([]byte, remotePageSize)
+	if size-start < remotePageSize {
+		b = b[:size-start]
+	}
+	if n, err := c.store.ReadAt(pk.name, b, start); err != nil && !(errors.Is(err, io.EOF) && n == len(b)) {
+		return nil, fmt.Errorf("read remote segment %s: %w", pk.name, err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.pages[pk]; !ok {
+		c.pages[pk] = c.lru.PushFront(&cachedPage{key: pk, b: b})
+		c.size += int64(len(b))
+		for c.size > c.maxSize && c.lru.Len() > 1 {
+			c.remove(c.lru.Back())
+		}
+	}
+	return b, nil
+}
+
+// invalidate removes the pages of a segment that was replaced or deleted.
+func (c *pageCache) invalidate(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for pk, e := range c.pages {
+		if pk.name == name {
+			c.remove(e)
+		}
+	}
+}
+
+func (c *pageCache) remove(e *list.Element) {
+	p := c.lru.Remove(e).(*cachedPage)
+	delete(c.pages, p.key)
+	c.size -= int64(len(p.b))
+}
+
+// remoteFile is a read-only File of a remote segment.
+type remoteFile struct {
+	cache *pageCache
+	name  string
+	size  int64
+	pos   int64
+}
+
+func (f *remoteFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	return f.cache.readAt(f.name, f.size, p, off)
+}
+
+func (f *remoteFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	if n > 0 && errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *remoteFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *remoteFile) Stat() (os.FileInfo, error) { return remoteFileInfo{f}, nil }
+
+func (f *remoteFile) Close() error              { return nil }
+func (f *remoteFile) Sync() error               { return nil }
+func (f *remoteFile) Write([]byte) (int, error) { return 0, errRemoteSegmentReadOnly }
+func (f *remoteFile) Truncate(size int64) error { return errRemoteSegmentReadOnly }
+
+type remoteFileInfo struct{ f *remoteFile }
+
+func (fi remoteFileInfo) Name() string       { return fi.f.name }
+func (fi remoteFileInfo) Size() int64        { return fi.f.size }
+func (fi remoteFileInfo) Mode() os.FileMode  { return remoteSegmentPermission }
+func (fi remoteFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi remoteFileInfo) IsDir() bool        { return false }
+func (fi remoteFileInfo) Sys() any           { return nil }
+
+// remoteFS reads the segment files from the store of RemoteSegments, other files (e.g. hint files and
+// the temporary files of compactions) are in the local file system. Renaming a file to a segment file uploads it.
+type remoteFS struct {
+	FileSystem
+	cache *pageCache
+}
+
+func isSegmentFile(name string) bool { return strings.HasSuffix(name, SegmentFileExt) }
+
+func (fs remoteFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if !isSegmentFile(name) {
+		return fs.FileSystem.OpenFile(name, flag, perm)
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		return nil, fmt.Errorf("open %s: %w", name, errRemoteSegmentReadOnly)
+	}
+	size, err := fs.cache.store.Size(filepath.Base(name))
+	if err != nil {
+		return nil, fmt.Errorf("open remote segment %s: %w", name, err)
+	}
+	return &remoteFile{cache: fs.cache, name: filepath.Base(name), size: size}, nil
+}
+
+func (fs remoteFS) Rename(oldpath, newpath string) error {
+	if !isSegmentFile(newpath) {
+		return fs.FileSystem.Rename(oldpath, newpath)
+	}
+	if err := fs.upload(oldpath, filepath.Base(newpath)); err != nil {
+		return err
+	}
+	return fs.FileSystem.Remove(oldpath)
+}
+
+func (fs remoteFS) Remove(name string) error {
+	if !isSegmentFile(name) {
+		return fs.FileSystem.Remove(name)
+	}
+	fs.cache.invalidate(filepath.Base(name))
+	return fs.cache.store.Delete(filepath.Base(name))
+}
+
+// upload uploads the local file as the named segment.
+func (fs remoteFS) upload(fpath, name string) error {
+	f, err := fs.FileSystem.OpenFile(fpath, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = fs.cache.store.Upload(name, f)
+	fs.cache.invalidate(name)
+	if err != nil {
+		return fmt.Errorf("upload segment %s: %w", name, err)
+	}
+	return nil
+}
+
+// withRemoteSegments opens the database file read-only from the store of RemoteSegments.
+func withRemoteSegments(cache *pageCache) Option {
+	return func(db *DB) {
+		db.fs = remoteFS{FileSystem: db.fs, cache: cache}
+		db.readOnly = true
+	}
+}
@@ -0,0 +1,43 @@
+package textdb
+
+import (
+	"fmt"
+	"os"
+)
+
+// TornRowSuffix is appended to the file path to name the file where WithRepair moves partial rows.
+const TornRowSuffix = ".torn"
+
+// WithRepair recovers from a crash during an append: if the last row of the file is incomplete,
+// it's moved to the file path suffixed with TornRowSuffix and removed from the file instead of failing to open.
+// Other corrupt rows still fail to open.
+func WithRepair() Option {
+	return func(db *DB) { db.repair = true }
+}
+
+// sidelineTail appends the bytes of the file from offset to the sideline file
+// and truncates the file at offset.
+func (db *DB) sidelineTail(offset, size int64) error {
+	tail := make([]byte, size-offset)
+	if _, err := db.r.ReadAt(tail, offset); err != nil {
+		return fmt.Errorf("read partial row: %w", err)
+	}
+	f, err := db.fs.OpenFile(db.fpath+TornRowSuffix, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("sideline partial row: %w", err)
+	}
+	_, err = f.Write(tail)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("sideline partial row: %w", err)
+	}
+	if err := db.wf.Truncate(offset); err != nil {
+		return fmt.Errorf("truncate partial row: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package textdb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// RestoreConfig configures Restore.
+type RestoreConfig struct {
+	Overwrite bool     // replace the database at the path if there's one (it must not be open)
+	Options   []Option // options of the restored database (e.g. its encryption or HMAC keys)
+}
+
+// Restore writes the database file at the given path from a backup (see DB.Backup).
+// The backup is first written to a temporary file that is opened with the configured options
+// and whose values are all read, so a backup that is damaged or that doesn't match the options
+// is refused without modifying the path.
+// The restore is recorded in the audit trail of the path if the options include WithAuditTrail.
+func Restore(path string, r io.Reader, cfg RestoreConfig) error {
+	err := restore(path, r, cfg)
+	probe := &DB{}
+	for _, opt := range cfg.Options {
+		opt(probe)
+	}
+	if probe.auditTrail {
+		err = errors.Join(err, appendAudit(osFS{}, path, AuditRestore, "", err))
+	}
+	return err
+}
+
+func restore(path string, r io.Reader, cfg RestoreConfig) error {
+	if _, err := os.Stat(path); err == nil && !cfg.Overwrite {
+		return fmt.Errorf("restore: destination already exists: %q", path)
+	}
+	tmpPath := path + ".restore"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("restore: %w", err)
+	}
+	defer os.Remove(tmpPath + ".lock")
+	defer os.Remove(hintPath(tmpPath))
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = verifyBackup(tmpPath, cfg.Options)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("restore: %w", err)
+	}
+
+	// The lock of the destination is held so that a database opened meanwhile isn't replaced
+	l := &DB{fs: osFS{}}
+	if err := l.lock(path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("restore: %w", err)
+	}
+	defer l.unlock()
+	os.Remove(hintPath(path)) // it's of the replaced file
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("restore: %w", err)
+	}
+	return nil
+}
+
+// verifyBackup opens the database file and reads all its values.
+func verifyBackup(fpath string, opts []Option) error {
+	db, err := Open(fpath, opts...)
+	if err != nil {
+		return err
+	}
+	err = db.ForEach(func(string, []byte) error { return nil })
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,513 @@
+package textdb
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// SegmentFileExt is the extension of the segment files of a SegmentedDB.
+	SegmentFileExt = ".seg.db"
+	// ColdSegmentFileExt is the extension of the segment files compressed in blocks (see ColdSegments).
+	ColdSegmentFileExt = ".cold.seg.db"
+	// SegmentManifest is the name of the file listing the segments of a SegmentedDB in order.
+	SegmentManifest = "MANIFEST"
+
+	defaultMaxSegmentSize = 64 << 20
+)
+
+type SegmentConfig struct {
+	MaxSegmentSize int64           // size after which writes go to a new segment (64 MiB by default)
+	Options        []Option        // applied to every segment
+	Cold           *ColdSegments   // compresses rarely read segments when compacting (disabled if nil)
+	Remote         *RemoteSegments // keeps the segments before the active one in a SegmentStore (disabled if nil)
+}
+
+// ColdSegments configures the segments that Compact writes compressed in blocks, with an index of the blocks
+// so that reading a value only decompresses the block holding it. Such segments are opened read-only,
+// and written back as regular segments by the compaction following many reads.
+// Encrypted segments aren't compressed.
+type ColdSegments struct {
+	MaxReads   uint64     // segments with at most this many reads by Get since the last compaction are compressed
+	Compressor Compressor // Flate by default, others must be registered in the options (see WithCompressors)
+	BlockSize  int        // size of the blocks before compression (64 KiB by default)
+}
+
+// SegmentedDB stores keys in a directory of size-capped segment files (Bitcask-style).
+// Writes are appended to the active (last) segment, a new one is started once it exceeds the maximum size.
+// Older segments are only read, and are compacted independently of each other by Compact.
+// Deletes are recorded in the active segment so that keys don't reappear from older segments.
+// It's safe for concurrent use.
+type SegmentedDB struct {
+	dir string
+	cfg SegmentConfig
+
+	mu       sync.RWMutex
+	segments []*segment          // oldest first, the last one is active
+	keys     map[string]*segment // segment of the current write of each stored key
+	nextID   int
+	closed   bool
+	cache    *pageCache // of the remote segments (see RemoteSegments)
+}
+
+type segment struct {
+	id      int
+	db      *DB
+	deleted map[string]struct{} // stored keys deleted in the segment and not written again after
+	cold    bool                // the file is compressed in blocks (see ColdSegments)
+	remote  bool                // the file is in the store of RemoteSegments
+	reads   atomic.Uint64       // reads since the segment was opened or compacted
+}
+
+var _ Store = (*SegmentedDB)(nil)
+
+// OpenSegmented opens the segments listed in the manifest of the directory,
+// creating the directory and its first segment if needed.
+func OpenSegmented(dir string, cfg SegmentConfig) (*SegmentedDB, error) {
+	if cfg.MaxSegmentSize <= 0 {
+		cfg.MaxSegmentSize = defaultMaxSegmentSize
+	}
+	if cfg.Cold != nil {
+		cold := *cfg.Cold
+		if cold.Compressor == nil {
+			cold.Compressor = Flate
+		}
+		if cold.BlockSize <= 0 {
+			cold.BlockSize = defaultBlockSize
+		}
+		cfg.Cold = &cold
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	entries, err := readManifest(filepath.Join(dir, SegmentManifest))
+	if err != nil {
+		return nil, err
+	}
+	s := &SegmentedDB{dir: dir, cfg: cfg, keys: make(map[string]*segment), nextID: 1}
+	if cfg.Remote != nil {
+		s.cache = newPageCache(cfg.Remote)
+	}
+	for i, e := range entries {
+		// A segment closed before a crash may not have been uploaded yet
+		_, statErr := os.Stat(s.segmentPath(e.id, e.cold))
+		remote := s.cache != nil && i < len(entries)-1 && errors.Is(statErr, os.ErrNotExist)
+		seg, err := s.openSegment(e.id, e.cold, remote)
+		if err == nil && s.cache != nil && i < len(entries)-1 && !remote {
+			err = s.offload(seg)
+		}
+		if err != nil {
+			if seg != nil {
+				seg.db.Close()
+			}
+			s.closeSegments()
+			return nil, err
+		}
+		s.segments = append(s.segments, seg)
+		s.index(seg)
+		if e.id >= s.nextID {
+			s.nextID = e.id + 1
+		}
+	}
+	if len(s.segments) == 0 {
+		if err := s.addSegment(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *SegmentedDB) segmentPath(id int, cold bool) string {
+	if cold {
+		return filepath.Join(s.dir, fmt.Sprintf("%06d%s", id, ColdSegmentFileExt))
+	}
+	return filepath.Join(s.dir, fmt.Sprintf("%06d%s", id, SegmentFileExt))
+}
+
+func (s *SegmentedDB) openSegment(id int, cold, remote bool) (*segment, error) {
+	opts := s.cfg.Options
+	if remote {
+		opts = append(opts[:len(opts):len(opts)], withRemoteSegments(s.cache))
+	}
+	if cold {
+		opts = append(opts[:len(opts):len(opts)], withBlockFiles())
+	}
+	db, err := Open(s.segmentPath(id, cold), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("open segment %d: %w", id, err)
+	}
+	deleted, err := db.deletedKeys()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("open segment %d: %w", id, err)
+	}
+	return &segment{id: id, db: db, deleted: deleted, cold: cold, remote: remote}, nil
+}
+
+// offload uploads a closed segment to the store of RemoteSegments and reopens it from there,
+// the segment is reopened from its local file if the upload fails.
+func (s *SegmentedDB) offload(seg *segment) error {
+	fs := remoteFS{FileSystem: seg.db.fs, cache: s.cache}
+	if err := seg.db.Close(); err != nil {
+		return err
+	}
+	fpath := s.segmentPath(seg.id, seg.cold)
+	err := fs.upload(fpath, filepath.Base(fpath))
+	if err == nil {
+		// The local file is only removed once the segment can be read from the store
+		var remote *segment
+		if remote, err = s.openSegment(seg.id, seg.cold, true); err == nil {
+			seg.db, seg.deleted, seg.remote = remote.db, remote.deleted, true
+			fs.FileSystem.Remove(fpath)
+			return nil
+		}
+	}
+	local, reopenErr := s.openSegment(seg.id, seg.cold, false)
+	if reopenErr != nil {
+		return errors.Join(err, reopenErr)
+	}
+	seg.db, seg.deleted = local.db, local.deleted
+	return err
+}
+
+// index points the keys of a segment to it, segments must be indexed from the oldest.
+func (s *SegmentedDB) index(seg *segment) {
+	seg.db.mu.RLock()
+	seg.db.keys.forEach(func(k []byte, _ ref) bool {
+		s.keys[string(k)] = seg
+		return true
+	})
+	seg.db.mu.RUnlock()
+	for k := range seg.deleted {
+		delete(s.keys, k)
+	}
+}
+
+func (s *SegmentedDB) active() *segment { return s.segments[len(s.segments)-1] }
+
+// addSegment starts a new active segment and records it in the manifest.
+func (s *SegmentedDB) addSegment() error {
+	seg, err := s.openSegment(s.nextID, false, false)
+	if err != nil {
+		return err
+	}
+	segments := append(s.segments[:len(s.segments):len(s.segments)], seg)
+	if err := s.writeManifest(segments); err != nil {
+		seg.db.Close()
+		os.Remove(s.segmentPath(seg.id, false))
+		return err
+	}
+	s.segments = segments
+	s.nextID++
+	if s.cache != nil && len(s.segments) > 1 {
+		// Left local on failure, the upload is retried by the next OpenSegmented
+		return s.offload(s.segments[len(s.segments)-2])
+	}
+	return nil
+}
+
+// prepareWrite starts a new segment if the active one is full.
+func (s *SegmentedDB) prepareWrite() error {
+	if s.closed {
+		return ErrClosed
+	}
+	s.active().db.mu.RLock()
+	size := int64(s.active().db.wIndex)
+	s.active().db.mu.RUnlock()
+	if size < s.cfg.MaxSegmentSize {
+		return nil
+	}
+	return s.addSegment()
+}
+
+func (s *SegmentedDB) Get(k string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+	seg := s.keys[s.active().db.hashKey(k)]
+	if seg == nil {
+		return notFoundOrEmpty(k, false)
+	}
+	seg.reads.Add(1)
+	return seg.db.Get(k)
+}
+
+// Deprecated: Find is Get.
+func (s *SegmentedDB) Find(k string) ([]byte, error) { return s.Get(k) }
+
+func (s *SegmentedDB) Exists(k string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return false
+	}
+	seg := s.keys[s.active().db.hashKey(k)]
+	return seg != nil && seg.db.Exists(k)
+}
+
+func (s *SegmentedDB) Put(k string, v []byte) error {
+	return s.write(k, func(db *DB) error { return db.Put(k, v) })
+}
+
+func (s *SegmentedDB) Set(k string) error {
+	return s.write(k, func(db *DB) error { return db.Set(k) })
+}
+
+func (s *SegmentedDB) write(k string, fn func(db *DB) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.prepareWrite(); err != nil {
+		return err
+	}
+	seg := s.active()
+	if err := fn(seg.db); err != nil {
+		return err
+	}
+	sk := seg.db.hashKey(k)
+	s.keys[sk] = seg
+	delete(seg.deleted, sk)
+	return nil
+}
+
+func (s *SegmentedDB) Delete(k string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.prepareWrite(); err != nil {
+		return err
+	}
+	seg := s.active()
+	if err := seg.db.ValidateKey(k); err != nil {
+		return err
+	}
+	sk := seg.db.hashKey(k)
+	if s.keys[sk] == nil {
+		return nil
+	}
+	if err := seg.db.Delete(k); err != nil {
+		return err
+	}
+	delete(s.keys, sk)
+	seg.deleted[sk] = struct{}{}
+	return nil
+}
+
+// Compact rewrites each segment before the active one with only the keys whose current write it holds,
+// and the deletes of keys that older segments still hold. Segments left empty are removed.
+// Rarely read segments are compressed in blocks if configured (see ColdSegments).
+func (s *SegmentedDB) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	for i := len(s.segments) - 2; i >= 0; i-- {
+		if err := s.compactSegment(i); err != nil {
+			return fmt.Errorf("compact segment %d: %w", s.segments[i].id, err)
+		}
+	}
+	return nil
+}
+
+func (s *SegmentedDB) compactSegment(i int) error {
+	seg := s.segments[i]
+	var deleted []string
+	for k := range seg.deleted {
+		for _, older := range s.segments[:i] {
+			if older.db.has(k) {
+				deleted = append(deleted, k)
+				break
+			}
+		}
+	}
+	filter := &liveFilter{keep: func(k string) bool { return s.keys[k] == seg }, deleted: deleted}
+	cold := s.cfg.Cold != nil && seg.reads.Load() <= s.cfg.Cold.MaxReads && !seg.db.encrypts()
+
+	// Like DB.Compact, the rewritten segment is synced before it replaces the old one
+	fpath, newPath := s.segmentPath(seg.id, seg.cold), s.segmentPath(seg.id, cold)
+	tmpPath := newPath + ".compact"
+	f, err := seg.db.fs.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	seg.db.mu.Lock()
+	if cold {
+		err = seg.db.writeBlocks(f, s.cfg.Cold, filter)
+	} else {
+		err = seg.db.writeLive(f, seg.db.format, true, filter, nil)
+	}
+	seg.db.mu.Unlock()
+	if err != nil {
+		seg.db.fs.Remove(tmpPath)
+		return err
+	}
+	fs := seg.db.fs
+	if err := seg.db.Close(); err != nil {
+		fs.Remove(tmpPath)
+		return s.fail(err)
+	}
+	fs.Remove(hintPath(fpath)) // it's of the old file
+	if err := fs.Rename(tmpPath, newPath); err != nil {
+		fs.Remove(tmpPath)
+		return s.fail(err)
+	}
+	fs.Remove(coldPath(fpath)) // cold values were written to the segment
+	if newPath != fpath {
+		// The manifest lists the new file before the old one is removed
+		seg.cold = cold
+		if err := s.writeManifest(s.segments); err != nil {
+			return s.fail(err)
+		}
+		fs.Remove(fpath)
+		os.Remove(fpath + ".lock")
+	}
+	compacted, err := s.openSegment(seg.id, cold, seg.remote)
+	if err != nil {
+		return s.fail(err)
+	}
+	seg.db, seg.deleted = compacted.db, compacted.deleted // keeps the keys pointing to the segment
+	seg.reads.Store(0)
+
+	seg.db.mu.RLock()
+	empty := seg.db.keys.len() == 0
+	seg.db.mu.RUnlock()
+	if !empty || len(seg.deleted) > 0 {
+		return nil
+	}
+	segments := append(append([]*segment{}, s.segments[:i]...), s.segments[i+1:]...)
+	if err := s.writeManifest(segments); err != nil {
+		return err
+	}
+	s.segments = segments
+	if err := seg.db.Close(); err != nil {
+		return err
+	}
+	fs.Remove(hintPath(newPath))
+	return errors.Join(fs.Remove(newPath), os.Remove(newPath+".lock"))
+}
+
+// fail closes the database after an error that left a segment unusable.
+func (s *SegmentedDB) fail(err error) error {
+	s.closed = true
+	return errors.Join(err, s.closeSegments())
+}
+
+func (s *SegmentedDB) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	s.closed = true
+	return s.closeSegments()
+}
+
+func (s *SegmentedDB) closeSegments() error {
+	var errs []error
+	for _, seg := range s.segments {
+		if err := seg.db.Close(); err != nil && !errors.Is(err, ErrClosed) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// manifestEntry is a segment listed in the manifest.
+type manifestEntry struct {
+	id   int
+	cold bool
+}
+
+func readManifest(fpath string) ([]manifestEntry, error) {
+	b, err := os.ReadFile(fpath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var entries []manifestEntry
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		name, cold := strings.CutSuffix(sc.Text(), ColdSegmentFileExt)
+		if !cold {
+			name = strings.TrimSuffix(name, SegmentFileExt)
+		}
+		id, err := strconv.Atoi(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid manifest entry %q", sc.Text())
+		}
+		entries = append(entries, manifestEntry{id: id, cold: cold})
+	}
+	return entries, nil
+}
+
+// writeManifest replaces the manifest so that a crash leaves either the old or the new one.
+func (s *SegmentedDB) writeManifest(segments []*segment) error {
+	var b bytes.Buffer
+	for _, seg := range segments {
+		b.WriteString(filepath.Base(s.segmentPath(seg.id, seg.cold)))
+		b.WriteByte('\n')
+	}
+	fpath := filepath.Join(s.dir, SegmentManifest)
+	f, err := os.OpenFile(fpath+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(fpath + ".tmp")
+		return fmt.Errorf("write manifest: %w", err)
+	}
+	return os.Rename(fpath+".tmp", fpath)
+}
+
+// has reports whether the stored key is in the index.
+func (db *DB) has(k string) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.keys.has(k)
+}
+
+// deletedKeys reads the file and returns the stored keys whose last row is a delete.
+func (db *DB) deletedKeys() (map[string]struct{}, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.flush(); err != nil {
+		return nil, err
+	}
+	size := int64(db.wIndex - db.dataStart)
+	rr := db.recordReader(io.NewSectionReader(db.r, int64(db.dataStart), size), size)
+	rr.ReadValue = func(byte) bool { return false }
+	deleted := make(map[string]struct{})
+	for {
+		r, n, err := rr.Next()
+		if errors.Is(err, io.EOF) && n == 0 {
+			return deleted, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch r.Op {
+		case opDelete:
+			deleted[r.Key] = struct{}{}
+		case opSet, opPut, opPutCompressed, opCold:
+			delete(deleted, r.Key)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package textdb
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// ShardFileExt is the extension of the shard files of a ShardedDB.
+const ShardFileExt = ".shard.db"
+
+const defaultShards = 4
+
+type ShardConfig struct {
+	Shards  int      // number of shard files, it can't change once the directory is created (4 by default)
+	Options []Option // applied to every shard
+}
+
+// ShardedDB spreads keys across several database files by the hash of the key (CRC-32),
+// each with its own lock and writer, so that writes of keys of different shards run in parallel.
+// Iteration merges the keys of all shards in lexicographic order, and Compact compacts the shards in parallel.
+// It's safe for concurrent use.
+type ShardedDB struct {
+	dir    string
+	shards []*DB
+}
+
+var _ Store = (*ShardedDB)(nil)
+
+// OpenSharded opens the shards of the directory, creating the directory and the shards if needed.
+// Opening a directory with another number of shards fails, since keys would be looked up in the wrong shard.
+func OpenSharded(dir string, cfg ShardConfig) (*ShardedDB, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	existing, err := filepath.Glob(filepath.Join(dir, "*"+ShardFileExt))
+	if err != nil {
+		return nil, err
+	}
+	n := cfg.Shards
+	switch {
+	case n <= 0 && len(existing) > 0:
+		n = len(existing)
+	case n <= 0:
+		n = defaultShards
+	case len(existing) > 0 && len(existing) != n:
+		return nil, fmt.Errorf("open sharded: %s has %d shards, configured %d", dir, len(existing), n)
+	}
+
+	s := &ShardedDB{dir: dir, shards: make([]*DB, 0, n)}
+	for i := 0; i < n; i++ {
+		db, err := Open(filepath.Join(dir, fmt.Sprintf("%03d%s", i, ShardFileExt)), cfg.Options...)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("open shard %d: %w", i, err)
+		}
+		s.shards = append(s.shards, db)
+	}
+	return s, nil
+}
+
+// Shards returns the number of shards.
+func (s *ShardedDB) Shards() int { return len(s.shards) }
+
+func (s *ShardedDB) shard(k string) *DB {
+	return s.shards[crc32.ChecksumIEEE([]byte(k))%uint32(len(s.shards))]
+}
+
+func (s *ShardedDB) Get(k string) ([]byte, error) { return s.shard(k).Get(k) }
+
+// Deprecated: Find is Get.
+func (s *ShardedDB) Find(k string) ([]byte, error) { return s.Get(k) }
+
+func (s *ShardedDB) Exists(k string) bool { return s.shard(k).Exists(k) }
+
+func (s *ShardedDB) Put(k string, v []byte) error { return s.shard(k).Put(k, v) }
+
+func (s *ShardedDB) Set(k string) error { return s.shard(k).Set(k) }
+
+func (s *ShardedDB) Delete(k string) error { return s.shard(k).Delete(k) }
+
+// shardKey is a stored key of a shard.
+type shardKey struct {
+	k  string
+	db *DB
+}
+
+// sortedKeys returns the stored keys of all shards with the prefix, in lexicographic order.
+func (s *ShardedDB) sortedKeys(prefix string) ([]shardKey, error) {
+	var keys []shardKey
+	for _, db := range s.shards {
+		db.mu.RLock()
+		if db.closed {
+			db.mu.RUnlock()
+			return nil, ErrClosed
+		}
+		if prefix != "" && db.keyHashSecret != nil {
+			db.mu.RUnlock()
+			return nil, errors.New("scan: not supported with hashed keys")
+		}
+		for _, k := range db.keysWithPrefix(prefix) {
+			keys = append(keys, shardKey{k: k, db: db})
+		}
+		db.mu.RUnlock()
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].k < keys[j].k })
+	return keys, nil
+}
+
+// Keys returns the keys of all shards in lexicographic order (the key hashes with WithHashedKeys).
+func (s *ShardedDB) Keys() []string {
+	keys, _ := s.sortedKeys("")
+	ks := make([]string, len(keys))
+	for i, sk := range keys {
+		ks[i] = sk.k
+	}
+	return ks
+}
+
+// ForEach is like DB.ForEach over the keys of all shards.
+func (s *ShardedDB) ForEach(fn func(k string, v []byte) error) error { return s.Scan("", fn) }
+
+// Scan is like DB.Scan over the keys of all shards.
+func (s *ShardedDB) Scan(prefix string, fn func(k string, v []byte) error) error {
+	keys, err := s.sortedKeys(prefix)
+	if err != nil {
+		return err
+	}
+	for _, sk := range keys {
+		if err := sk.db.visit([]string{sk.k}, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compact compacts the shards in parallel (see DB.Compact).
+func (s *ShardedDB) Compact() error {
+	errs := make([]error, len(s.shards))
+	var wg sync.WaitGroup
+	for i, db := range s.shards {
+		wg.Add(1)
+		go func(i int, db *DB) {
+			defer wg.Done()
+			if err := db.Compact(); err != nil {
+				errs[i] = fmt.Errorf("compact shard %d: %w", i, err)
+			}
+		}(i, db)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (s *ShardedDB) Close() error {
+	var errs []error
+	closed := 0
+	for _, db := range s.shards {
+		if err := db.Close(); errors.Is(err, ErrClosed) {
+			closed++
+		} else if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if closed > 0 && closed == len(s.shards) {
+		return ErrClosed
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,26 @@
+package sim
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a virtual clock that only moves when advanced.
+type Clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewClock(start time.Time) *Clock { return &Clock{now: start} }
+
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
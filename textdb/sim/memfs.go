@@ -0,0 +1,254 @@
+package sim
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ejuju/go-db-playground/textdb"
+)
+
+// MemFS is an in-memory file system that can simulate crashes, losing writes that weren't synced.
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memFile
+}
+
+var _ textdb.FileSystem = (*MemFS)(nil)
+
+func NewMemFS() *MemFS { return &MemFS{files: make(map[string]*memFile)} }
+
+type memFile struct {
+	name   string
+	data   []byte
+	synced int   // length of the data persisted by the last Sync
+	writes []int // end offsets of the writes since the last Sync
+}
+
+func (mfs *MemFS) OpenFile(name string, flag int, perm os.FileMode) (textdb.File, error) {
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+	f, ok := mfs.files[name]
+	if !ok {
+		if flag&os.O_CREATE == 0 {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		f = &memFile{name: name}
+		mfs.files[name] = f
+	}
+	if flag&os.O_TRUNC != 0 {
+		f.truncate(0)
+	}
+	return &memHandle{fs: mfs, f: f, flag: flag}, nil
+}
+
+// Rename replaces newpath with oldpath, renames are durable as soon as they return.
+// Open handles keep referring to the same file.
+func (mfs *MemFS) Rename(oldpath, newpath string) error {
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+	f, ok := mfs.files[oldpath]
+	if !ok {
+		return &fs.PathError{Op: "rename", Path: oldpath, Err: fs.ErrNotExist}
+	}
+	delete(mfs.files, oldpath)
+	f.name = newpath
+	mfs.files[newpath] = f
+	return nil
+}
+
+func (mfs *MemFS) Remove(name string) error {
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+	if _, ok := mfs.files[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(mfs.files, name)
+	return nil
+}
+
+// Crash returns the file system as it would be found after a crash:
+// each file keeps its synced data and a random number of the writes that followed.
+// If torn is true, the first lost write may be partially kept.
+func (mfs *MemFS) Crash(r *rand.Rand, torn bool) *MemFS {
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+	crashed := NewMemFS()
+	names := make([]string, 0, len(mfs.files))
+	for name := range mfs.files {
+		names = append(names, name)
+	}
+	sort.Strings(names) // consume random numbers in a deterministic order
+	for _, name := range names {
+		f := mfs.files[name]
+		size := f.synced
+		if kept := r.Intn(len(f.writes) + 1); kept > 0 {
+			size = f.writes[kept-1]
+		}
+		if size > len(f.data) {
+			size = len(f.data)
+		}
+		if torn && size < len(f.data) {
+			size += r.Intn(len(f.data) - size + 1)
+		}
+		crashed.files[name] = &memFile{name: name, data: append([]byte(nil), f.data[:size]...), synced: size}
+	}
+	return crashed
+}
+
+type memHandle struct {
+	fs     *MemFS
+	f      *memFile
+	flag   int
+	pos    int64
+	closed bool
+}
+
+var errClosed = errors.New("file already closed")
+
+func (h *memHandle) check(write bool) error {
+	if h.closed {
+		return errClosed
+	}
+	if write && h.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return errors.New("file not opened for writing")
+	}
+	if !write && h.flag&os.O_WRONLY != 0 {
+		return errors.New("file not opened for reading")
+	}
+	return nil
+}
+
+func (h *memHandle) Read(p []byte) (int, error) {
+	n, err := h.ReadAt(p, h.pos)
+	h.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (h *memHandle) ReadAt(p []byte, off int64) (int, error) {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+	if err := h.check(false); err != nil {
+		return 0, err
+	}
+	if off >= int64(len(h.f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, h.f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (h *memHandle) Write(p []byte) (int, error) {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+	if err := h.check(true); err != nil {
+		return 0, err
+	}
+	if h.flag&os.O_APPEND != 0 {
+		h.pos = int64(len(h.f.data))
+	}
+	for int64(len(h.f.data)) < h.pos {
+		h.f.data = append(h.f.data, 0)
+	}
+	n := copy(h.f.data[h.pos:], p)
+	h.f.data = append(h.f.data, p[n:]...)
+	h.pos += int64(len(p))
+	h.f.writes = append(h.f.writes, len(h.f.data))
+	return len(p), nil
+}
+
+func (h *memHandle) Seek(offset int64, whence int) (int64, error) {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += h.pos
+	case io.SeekEnd:
+		offset += int64(len(h.f.data))
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	h.pos = offset
+	return offset, nil
+}
+
+func (h *memHandle) Sync() error {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+	if err := h.check(true); err != nil {
+		return err
+	}
+	h.f.synced, h.f.writes = len(h.f.data), nil
+	return nil
+}
+
+func (h *memHandle) Truncate(size int64) error {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+	if err := h.check(true); err != nil {
+		return err
+	}
+	h.f.truncate(int(size))
+	return nil
+}
+
+// truncate changes the size of the file, truncated bytes are lost even if they were synced.
+func (f *memFile) truncate(size int) {
+	if size < len(f.data) {
+		f.data = f.data[:size]
+	}
+	for len(f.data) < size {
+		f.data = append(f.data, 0)
+	}
+	if f.synced > size {
+		f.synced = size
+	}
+	writes := f.writes[:0]
+	for _, end := range f.writes {
+		if end <= size {
+			writes = append(writes, end)
+		}
+	}
+	f.writes = append(writes, size)
+}
+
+func (h *memHandle) Close() error {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+	if h.closed {
+		return errClosed
+	}
+	h.closed = true
+	return nil
+}
+
+func (h *memHandle) Stat() (os.FileInfo, error) {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+	return memFileInfo{name: filepath.Base(h.f.name), size: int64(len(h.f.data))}, nil
+}
+
+type memFileInfo struct {
+	name string
+	size int64
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) Mode() fs.FileMode  { return 0o600 }
+func (fi memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi memFileInfo) IsDir() bool        { return false }
+func (fi memFileInfo) Sys() any           { return nil }
@@ -0,0 +1,277 @@
+// Package sim runs reproducible randomized simulations of database workloads,
+// with simulated clients, crashes and file system, checking invariants against a model.
+//
+// Everything is derived from a seed: the operations of each client, the order in which clients run,
+// the time between operations and where crashes happen, so a failing seed can be replayed.
+package sim
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/ejuju/go-db-playground/textdb"
+)
+
+// Config configures a simulation, zero values are replaced by defaults.
+type Config struct {
+	Seed    int64
+	Clients int // concurrent clients (4 by default)
+	Steps   int // total number of operations (1000 by default)
+	Keys    int // size of the key space (50 by default)
+
+	// CrashProbability is the probability of a crash after each step,
+	// the database is then reopened from what a crash would leave on disk.
+	CrashProbability float64
+	// TornWrites allows crashes to keep part of a write,
+	// the database is then opened with textdb.WithRepair to truncate torn rows.
+	TornWrites bool
+
+	Options []textdb.Option // database options, the simulated file system is added to them
+}
+
+// Report summarizes a simulation.
+type Report struct {
+	Seed       int64
+	Steps      int
+	Crashes    int
+	Violations []string
+	Trace      []string // operations with their virtual time and client
+}
+
+// Err returns an error describing the first violation, if any.
+func (r *Report) Err() error {
+	if len(r.Violations) == 0 {
+		return nil
+	}
+	return fmt.Errorf("sim: seed %d: %d violations, first: %s", r.Seed, len(r.Violations), r.Violations[0])
+}
+
+type op struct {
+	kind  byte // textdb row ops: 'P', 'S' or 'D', or 'G' for a read
+	key   string
+	value []byte
+}
+
+// Run runs a simulation and returns its report.
+func Run(cfg Config) *Report {
+	if cfg.Clients <= 0 {
+		cfg.Clients = 4
+	}
+	if cfg.Steps <= 0 {
+		cfg.Steps = 1000
+	}
+	if cfg.Keys <= 0 {
+		cfg.Keys = 50
+	}
+	s := &simulation{
+		cfg:    cfg,
+		r:      rand.New(rand.NewSource(cfg.Seed)),
+		clock:  NewClock(time.Unix(0, 0).UTC()),
+		fs:     NewMemFS(),
+		model:  make(map[string][]byte),
+		report: &Report{Seed: cfg.Seed},
+	}
+	s.run()
+	return s.report
+}
+
+type simulation struct {
+	cfg    Config
+	r      *rand.Rand
+	clock  *Clock
+	fs     *MemFS
+	db     *textdb.DB
+	model  map[string][]byte // acknowledged state, nil values for keys without value
+	acked  []op              // acknowledged writes since the last open
+	base   map[string][]byte // model state at the last open
+	report *Report
+}
+
+func (s *simulation) open() error {
+	opts := append([]textdb.Option{textdb.WithFileSystem(s.fs)}, s.cfg.Options...)
+	if s.cfg.TornWrites {
+		opts = append(opts, textdb.WithRepair())
+	}
+	db, err := textdb.Open("sim.db", opts...)
+	if err != nil {
+		return err
+	}
+	s.db = db
+	s.base, s.acked = copyState(s.model), nil
+	return nil
+}
+
+func (s *simulation) violation(format string, args ...any) {
+	s.report.Violations = append(s.report.Violations, fmt.Sprintf("%s: ", s.clock.Now().Format(time.StampMilli))+fmt.Sprintf(format, args...))
+}
+
+func (s *simulation) run() {
+	if err := s.open(); err != nil {
+		s.violation("open: %v", err)
+		return
+	}
+
+	// Each client is a goroutine that only runs an operation when the scheduler hands it a step,
+	// so the interleaving is decided by the seed.
+	type step struct {
+		op   op
+		done chan error
+	}
+	clients := make([]chan step, s.cfg.Clients)
+	for i := range clients {
+		clients[i] = make(chan step)
+		go func(steps chan step) {
+			for st := range steps {
+				st.done <- s.apply(st.op)
+			}
+		}(clients[i])
+	}
+	defer func() {
+		for _, c := range clients {
+			close(c)
+		}
+	}()
+
+	for i := 0; i < s.cfg.Steps; i++ {
+		s.clock.Advance(time.Duration(s.r.Intn(10)+1) * time.Millisecond)
+		client := s.r.Intn(len(clients))
+		o := s.randomOp()
+		st := step{op: o, done: make(chan error)}
+		clients[client] <- st
+		err := <-st.done
+		s.report.Steps++
+		s.report.Trace = append(s.report.Trace, fmt.Sprintf("%s client %d: %c %q (%d bytes): %v", s.clock.Now().Format(time.StampMilli), client, o.kind, o.key, len(o.value), err))
+		if err != nil {
+			s.violation("%c %q: %v", o.kind, o.key, err)
+		}
+
+		if s.r.Float64() < s.cfg.CrashProbability {
+			if !s.crash() {
+				return
+			}
+		}
+	}
+	if err := s.db.Close(); err != nil {
+		s.violation("close: %v", err)
+	}
+}
+
+func (s *simulation) randomOp() op {
+	o := op{key: fmt.Sprintf("key-%d", s.r.Intn(s.cfg.Keys))}
+	switch x := s.r.Intn(100); {
+	case x < 40:
+		o.kind = 'G'
+	case x < 80:
+		o.kind = 'P'
+		o.value = make([]byte, s.r.Intn(64))
+		s.r.Read(o.value)
+	case x < 90:
+		o.kind = 'S'
+	default:
+		o.kind = 'D'
+	}
+	return o
+}
+
+// apply runs an operation and checks reads against the model.
+func (s *simulation) apply(o op) error {
+	var err error
+	switch o.kind {
+	case 'G':
+		var v []byte
+		v, err = s.db.Get(o.key)
+		want, ok := s.model[o.key]
+		if !ok && errors.Is(err, textdb.ErrKeyNotFound) {
+			return nil
+		}
+		if err == nil && (!ok || !bytes.Equal(v, want)) {
+			s.violation("get %q: got %q, want %q", o.key, v, want)
+		}
+		return err
+	case 'P':
+		err = s.db.Put(o.key, o.value)
+	case 'S':
+		err = s.db.Set(o.key)
+	case 'D':
+		if _, ok := s.model[o.key]; !ok {
+			return nil
+		}
+		err = s.db.Delete(o.key)
+	}
+	if err == nil {
+		applyOp(s.model, o)
+		s.acked = append(s.acked, o)
+	}
+	return err
+}
+
+func applyOp(state map[string][]byte, o op) {
+	switch o.kind {
+	case 'P':
+		state[o.key] = o.value
+	case 'S':
+		state[o.key] = nil
+	case 'D':
+		delete(state, o.key)
+	}
+}
+
+// crash simulates a crash and reopens the database, it returns false if the simulation can't continue.
+// The recovered state must be the state after a prefix of the acknowledged writes.
+func (s *simulation) crash() bool {
+	s.report.Crashes++
+	s.report.Trace = append(s.report.Trace, fmt.Sprintf("%s crash", s.clock.Now().Format(time.StampMilli)))
+	s.fs = s.fs.Crash(s.r, s.cfg.TornWrites)
+	base, acked := s.base, s.acked
+	if err := s.open(); err != nil {
+		s.violation("reopen after crash: %v", err)
+		return false
+	}
+
+	state := copyState(base)
+	for i := 0; ; i++ {
+		if s.matches(state) {
+			s.model = state
+			s.base = copyState(state)
+			return true
+		}
+		if i == len(acked) {
+			break
+		}
+		applyOp(state, acked[i])
+	}
+	s.violation("recovered state doesn't match any prefix of the %d acknowledged writes", len(acked))
+	return false
+}
+
+func (s *simulation) matches(state map[string][]byte) bool {
+	for i := 0; i < s.cfg.Keys; i++ {
+		k := fmt.Sprintf("key-%d", i)
+		want, ok := state[k]
+		if s.db.Exists(k) != ok {
+			return false
+		}
+		v, err := s.db.Get(k)
+		if !ok {
+			if !errors.Is(err, textdb.ErrKeyNotFound) {
+				return false
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(v, want) {
+			return false
+		}
+	}
+	return true
+}
+
+func copyState(state map[string][]byte) map[string][]byte {
+	c := make(map[string][]byte, len(state))
+	for k, v := range state {
+		c[k] = v
+	}
+	return c
+}
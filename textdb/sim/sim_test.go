@@ -0,0 +1,74 @@
+package sim
+
+import (
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/ejuju/go-db-playground/textdb"
+)
+
+func TestRun(t *testing.T) {
+	configs := map[string]Config{
+		"crashes":     {CrashProbability: 0.05},
+		"torn writes": {CrashProbability: 0.05, TornWrites: true},
+		"buffered": {CrashProbability: 0.05, TornWrites: true, Options: []textdb.Option{
+			textdb.WithWriteBuffer(textdb.WriteBuffer{MaxRecords: 8}),
+		}},
+		"repair":     {CrashProbability: 0.05, TornWrites: true, Options: []textdb.Option{textdb.WithRepair()}},
+		"hmac chain": {CrashProbability: 0.05, TornWrites: true, Options: []textdb.Option{textdb.WithHMACChain([]byte("key"))}},
+	}
+	for name, cfg := range configs {
+		for seed := int64(0); seed < 20; seed++ {
+			cfg.Seed = seed
+			report := Run(cfg)
+			if err := report.Err(); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if report.Steps != 1000 {
+				t.Fatalf("%s: seed %d: ran %d steps, want 1000", name, seed, report.Steps)
+			}
+		}
+	}
+}
+
+func TestRunIsDeterministic(t *testing.T) {
+	for _, torn := range []bool{false, true} {
+		cfg := Config{Seed: 7, CrashProbability: 0.05, TornWrites: torn}
+		a, b := Run(cfg), Run(cfg)
+		if a.Crashes == 0 {
+			t.Fatalf("torn writes %v: no crash", torn)
+		}
+		if len(a.Trace) != len(b.Trace) {
+			t.Fatalf("torn writes %v: got traces of %d and %d entries", torn, len(a.Trace), len(b.Trace))
+		}
+		for i := range a.Trace {
+			if a.Trace[i] != b.Trace[i] {
+				t.Fatalf("torn writes %v: entry %d: got %q and %q", torn, i, a.Trace[i], b.Trace[i])
+			}
+		}
+	}
+}
+
+func TestCrashAfterTruncate(t *testing.T) {
+	mfs := NewMemFS()
+	f, err := mfs.OpenFile("f", os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("synced data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(6); err != nil {
+		t.Fatal(err)
+	}
+	for seed := int64(0); seed < 10; seed++ {
+		crashed := mfs.Crash(rand.New(rand.NewSource(seed)), true)
+		if got := string(crashed.files["f"].data); got != "synced" {
+			t.Fatalf("seed %d: got %q after a crash, want %q", seed, got, "synced")
+		}
+	}
+}
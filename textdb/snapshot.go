@@ -0,0 +1,150 @@
+package textdb
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Snapshot is a read-only view of the database at the time it was taken.
+// It has its own handle of the file, so it isn't affected by later writes nor by Compact
+// (on Windows, Compact fails while the file is open elsewhere), and must be released with Close.
+// Keys are those that existed and hadn't expired when the snapshot was taken.
+type Snapshot struct {
+	db    *DB
+	f     File
+	coldF File           // handle of the cold file if there is one (see WithColdTier)
+	keys  map[string]ref // by stored key
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+var ErrSnapshotClosed = errors.New("snapshot is closed")
+
+func (db *DB) Snapshot() (*Snapshot, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.snapshotLocked()
+}
+
+// snapshotLocked is like Snapshot with the lock held.
+func (db *DB) snapshotLocked() (*Snapshot, error) {
+	if err := db.flush(); err != nil {
+		return nil, err
+	}
+	f, err := db.fs.OpenFile(db.fpath, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	s := &Snapshot{db: db, f: f, keys: make(map[string]ref, db.keys.len())}
+	if db.coldR != nil {
+		if s.coldF, err = db.fs.OpenFile(coldPath(db.fpath), os.O_RDONLY, 0); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	db.keys.forEach(func(k []byte, r ref) bool {
+		if !db.expired(string(k)) {
+			s.keys[string(k)] = r
+		}
+		return true
+	})
+	return s, nil
+}
+
+func (s *Snapshot) Get(k string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, ErrSnapshotClosed
+	}
+	sk := s.db.hashKey(k)
+	v, err := s.getStored(sk)
+	if v == nil && err == nil {
+		_, ok := s.keys[sk]
+		return notFoundOrEmpty(k, ok)
+	}
+	return v, err
+}
+
+func (s *Snapshot) getStored(k string) ([]byte, error) {
+	r, ok := s.keys[k]
+	if !ok || !r.hasValue() {
+		return nil, nil
+	}
+	// Decryption and decompression use the database state
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+	if r.cold {
+		return s.db.readValueFrom(s.readColdAt, k, r)
+	}
+	return s.db.readValueFrom(s.readAt, k, r)
+}
+
+func (s *Snapshot) readAt(p []byte, off int64) error {
+	_, err := s.f.ReadAt(p, off)
+	return err
+}
+
+func (s *Snapshot) readColdAt(p []byte, off int64) error {
+	_, err := s.coldF.ReadAt(p, off)
+	return err
+}
+
+func (s *Snapshot) Exists(k string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.keys[s.db.hashKey(k)]
+	return ok && !s.closed
+}
+
+// Keys returns the keys of the snapshot in lexicographic order (the key hashes with WithHashedKeys).
+func (s *Snapshot) Keys() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil
+	}
+	keys := make([]string, 0, len(s.keys))
+	for k := range s.keys {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ForEach calls fn with each key and its value in lexicographic order, like DB.ForEach.
+func (s *Snapshot) ForEach(fn func(k string, v []byte) error) error {
+	for _, k := range s.Keys() {
+		s.mu.RLock()
+		if s.closed {
+			s.mu.RUnlock()
+			return ErrSnapshotClosed
+		}
+		v, err := s.getStored(k)
+		s.mu.RUnlock()
+		if err != nil {
+			return err
+		}
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close releases the file handle of the snapshot.
+func (s *Snapshot) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrSnapshotClosed
+	}
+	s.closed = true
+	if s.coldF != nil {
+		return errors.Join(s.f.Close(), s.coldF.Close())
+	}
+	return s.f.Close()
+}
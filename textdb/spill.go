@@ -0,0 +1,425 @@
+package textdb
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// index maps keys to value refs, it's implemented by keydir (in memory)
+// and spillIndex (in memory up to a limit, then on disk).
+type index interface {
+	get(k string) (ref, bool)
+	has(k string) bool
+	set(k string, r ref)
+	delete(k string)
+	len() int
+	forEach(fn func(k []byte, r ref) bool)
+	ascend(start string, fn func(k []byte, r ref) bool)
+	close() error
+}
+
+// WithIndexMemoryLimit spills the key index to disk once its in-memory part exceeds the given size.
+// Spilled keys are stored in sorted run files (memory-mapped where supported, so pages are
+// only loaded when accessed) in a directory next to the database file.
+// The index is rebuilt from the log at open, so spilled runs are discarded on close.
+// Read-only databases and followers spill to a temporary directory of their own.
+//
+// If writing a run fails, the index stays in memory and spilling is retried on the next write,
+// the error is reported by Stats until a spill succeeds.
+func WithIndexMemoryLimit(size int) Option {
+	return func(db *DB) { db.indexMemoryLimit = size }
+}
+
+const (
+	runPageSize = 4096
+	maxRuns     = 4
+
+	// refDeleted marks keys deleted from the memory index that may still exist in a run
+	refDeleted = -2
+)
+
+type spillIndex struct {
+	dir       string
+	limit     int
+	bloomRate float64 // false positive rate of the bloom filters of runs, none if zero
+	seed      maphash.Seed
+	mem       *keydir
+	runs      []*run // newest first
+	nextRun   int
+	numKeys   int
+	err       error // error of the last spill, see Stats
+}
+
+func newSpillIndex(dir string, limit int, bloomRate float64) (*spillIndex, error) {
+	// Remove runs left by a previous process, the index is rebuilt from the log
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &spillIndex{dir: dir, limit: limit, bloomRate: bloomRate, seed: maphash.MakeSeed(), mem: newKeydir()}, nil
+}
+
+func (si *spillIndex) len() int { return si.numKeys }
+
+func (si *spillIndex) get(k string) (ref, bool) {
+	if r, ok := si.mem.get(k); ok {
+		return r, r.index != refDeleted
+	}
+	for _, run := range si.runs {
+		if r, ok := run.get(k); ok {
+			return r, r.index != refDeleted
+		}
+	}
+	return ref{}, false
+}
+
+func (si *spillIndex) has(k string) bool { _, ok := si.get(k); return ok }
+
+func (si *spillIndex) set(k string, r ref) {
+	if !si.has(k) {
+		si.numKeys++
+	}
+	si.mem.set(k, r)
+	si.maybeSpill()
+}
+
+func (si *spillIndex) delete(k string) {
+	if !si.has(k) {
+		return
+	}
+	si.numKeys--
+	if len(si.runs) == 0 {
+		si.mem.delete(k)
+		return
+	}
+	si.mem.set(k, ref{index: refDeleted})
+	si.maybeSpill()
+}
+
+func (si *spillIndex) maybeSpill() {
+	if si.mem.memSize() <= si.limit {
+		return
+	}
+	si.err = si.spill()
+}
+
+// spill writes the memory index to a new run and merges runs if there are too many.
+func (si *spillIndex) spill() error {
+	var entries []runEntry
+	si.mem.ascend("", func(k []byte, r ref) bool {
+		entries = append(entries, runEntry{key: k, ref: r})
+		return true
+	})
+	newRun, err := si.writeRun(func(fn func(runEntry)) {
+		for _, e := range entries {
+			fn(e)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	si.runs = append([]*run{newRun}, si.runs...)
+	si.mem = newKeydir()
+
+	if len(si.runs) <= maxRuns {
+		return nil
+	}
+	// Merge all runs, deleted keys can be dropped since no older run is left
+	merged, err := si.writeRun(func(fn func(runEntry)) {
+		mergeRuns(si.runs, "", func(e runEntry) bool {
+			if e.ref.index != refDeleted {
+				fn(e)
+			}
+			return true
+		})
+	})
+	if err != nil {
+		return err
+	}
+	for _, r := range si.runs {
+		r.remove()
+	}
+	si.runs = []*run{merged}
+	return nil
+}
+
+func (si *spillIndex) writeRun(entries func(fn func(runEntry))) (*run, error) {
+	fpath := filepath.Join(si.dir, fmt.Sprintf("%06d.run", si.nextRun))
+	si.nextRun++
+	f, err := os.OpenFile(fpath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := &run{fpath: fpath}
+	bufw := bufio.NewWriter(f)
+	var page, prevKey []byte
+	var firstKey string
+	var hashes []uint64
+	size := 0
+	flushPage := func() {
+		r.pages = append(r.pages, runPage{firstKey: firstKey, start: size})
+		bufw.Write(page)
+		size += len(page)
+		page = page[:0]
+	}
+	entries(func(e runEntry) {
+		// Keys are front-coded: each key only stores its suffix after the prefix shared with the previous key
+		shared := 0
+		if len(page) == 0 {
+			firstKey = string(e.key)
+		} else {
+			for shared < len(prevKey) && shared < len(e.key) && prevKey[shared] == e.key[shared] {
+				shared++
+			}
+		}
+		prevKey = append(prevKey[:0], e.key...)
+		if si.bloomRate > 0 {
+			hashes = append(hashes, maphash.Bytes(si.seed, e.key))
+		}
+		page = binary.AppendUvarint(page, uint64(shared))
+		page = binary.AppendUvarint(page, uint64(len(e.key)-shared))
+		page = append(page, e.key[shared:]...)
+		page = binary.AppendVarint(page, packIndex(e.ref))
+		page = binary.AppendUvarint(page, uint64(packWidth(e.ref)))
+		if len(page) >= runPageSize {
+			flushPage()
+		}
+	})
+	if len(page) > 0 {
+		flushPage()
+	}
+	if err := bufw.Flush(); err != nil {
+		os.Remove(fpath)
+		return nil, err
+	}
+	if si.bloomRate > 0 {
+		r.bloom = newBloomFilter(si.seed, len(hashes), si.bloomRate)
+		for _, h := range hashes {
+			r.bloom.add(h)
+		}
+	}
+
+	// Memory-map the run, or load it in memory if the platform doesn't support it
+	r.data, err = mmapFile(f, size)
+	r.mapped = err == nil
+	if errors.Is(err, errMmapUnsupported) {
+		r.data = make([]byte, size)
+		_, err = f.ReadAt(r.data, 0)
+	}
+	if err != nil {
+		os.Remove(fpath)
+		return nil, err
+	}
+	return r, nil
+}
+
+// forEach iterates over keys in lexicographic order.
+func (si *spillIndex) forEach(fn func(k []byte, r ref) bool) { si.ascend("", fn) }
+
+func (si *spillIndex) ascend(start string, fn func(k []byte, r ref) bool) {
+	var entries []runEntry
+	si.mem.ascend(start, func(k []byte, r ref) bool {
+		entries = append(entries, runEntry{key: k, ref: r})
+		return true
+	})
+	mem := &run{entries: entries}
+	mergeRuns(append([]*run{mem}, si.runs...), start, func(e runEntry) bool {
+		if e.ref.index == refDeleted {
+			return true
+		}
+		return fn(e.key, e.ref)
+	})
+}
+
+func (si *spillIndex) close() error {
+	for _, r := range si.runs {
+		r.remove()
+	}
+	si.runs = nil
+	return os.RemoveAll(si.dir)
+}
+
+type runEntry struct {
+	key []byte
+	ref ref
+}
+
+type runPage struct {
+	firstKey string
+	start    int
+}
+
+// run is a sorted, immutable set of index entries divided in pages.
+// Only the first key of each page is kept in memory.
+// Within a page, keys are front-coded so decoding starts at the beginning of a page.
+type run struct {
+	fpath  string
+	data   []byte
+	mapped bool
+	pages  []runPage
+	bloom  *bloomFilter // nil if disabled
+
+	entries []runEntry // used instead of pages when the run is an in-memory snapshot
+}
+
+func (r *run) page(i int) []byte {
+	end := len(r.data)
+	if i+1 < len(r.pages) {
+		end = r.pages[i+1].start
+	}
+	return r.data[r.pages[i].start:end]
+}
+
+func (r *run) get(k string) (ref, bool) {
+	if r.bloom != nil && !r.bloom.mayContain(k) {
+		return ref{}, false
+	}
+	// Find the last page whose first key is lower or equal to k
+	i := sort.Search(len(r.pages), func(i int) bool { return r.pages[i].firstKey > k }) - 1
+	if i < 0 {
+		return ref{}, false
+	}
+	var key []byte
+	for page := r.page(i); len(page) > 0; {
+		var e runEntry
+		e, page = decodeRunEntry(page, key)
+		key = e.key
+		if string(e.key) == k {
+			return e.ref, true
+		} else if string(e.key) > k {
+			break
+		}
+	}
+	return ref{}, false
+}
+
+func (r *run) remove() {
+	if r.mapped {
+		munmap(r.data)
+	}
+	os.Remove(r.fpath)
+}
+
+// decodeRunEntry decodes the next entry of a page given the previous key,
+// the returned key reuses the memory of the previous one.
+func decodeRunEntry(page, prevKey []byte) (runEntry, []byte) {
+	shared, n := binary.Uvarint(page)
+	page = page[n:]
+	suffixLen, n := binary.Uvarint(page)
+	page = page[n:]
+	e := runEntry{key: append(prevKey[:shared], page[:suffixLen]...)}
+	page = page[suffixLen:]
+	index, n := binary.Varint(page)
+	page = page[n:]
+	width, n := binary.Uvarint(page)
+	e.ref = unpackRef(index, uint32(width))
+	return e, page[n:]
+}
+
+// runIter iterates over the entries of a run in key order, decoding one page at a time.
+type runIter struct {
+	r    *run
+	age  int // position of the run, lower is newer
+	page int
+	buf  []byte
+	cur  runEntry
+	key  []byte // decoded key of cur
+}
+
+// seek positions the iterator on the first entry greater or equal to start.
+func (it *runIter) seek(start string) bool {
+	if it.r.entries != nil {
+		it.page = sort.Search(len(it.r.entries), func(i int) bool { return string(it.r.entries[i].key) >= start })
+		return it.next()
+	}
+	it.page = sort.Search(len(it.r.pages), func(i int) bool { return it.r.pages[i].firstKey > start }) - 1
+	if it.page < 0 {
+		it.page = 0
+	}
+	for it.next() {
+		if string(it.cur.key) >= start {
+			return true
+		}
+	}
+	return false
+}
+
+func (it *runIter) next() bool {
+	if it.r.entries != nil {
+		if it.page >= len(it.r.entries) {
+			return false
+		}
+		it.cur = it.r.entries[it.page]
+		it.page++
+		return true
+	}
+	for len(it.buf) == 0 {
+		if it.page >= len(it.r.pages) {
+			return false
+		}
+		it.buf = it.r.page(it.page)
+		it.page++
+		it.key = it.key[:0]
+	}
+	it.cur, it.buf = decodeRunEntry(it.buf, it.key)
+	it.key = it.cur.key
+	return true
+}
+
+// mergeRuns iterates over the entries of all runs greater or equal to start in key order until fn returns false.
+// When a key exists in several runs, only the entry of the first (newest) run is used.
+func mergeRuns(runs []*run, start string, fn func(e runEntry) bool) {
+	h := &runHeap{}
+	for i, r := range runs {
+		it := &runIter{r: r, age: i}
+		if it.seek(start) {
+			h.items = append(h.items, it)
+		}
+	}
+	heap.Init(h)
+	var last []byte
+	first := true
+	for h.Len() > 0 {
+		it := h.items[0]
+		if first || !bytes.Equal(it.cur.key, last) {
+			if !fn(it.cur) {
+				return
+			}
+			last, first = append(last[:0], it.cur.key...), false
+		}
+		if it.next() {
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+}
+
+type runHeap struct{ items []*runIter }
+
+func (h *runHeap) Len() int { return len(h.items) }
+func (h *runHeap) Less(i, j int) bool {
+	if c := bytes.Compare(h.items[i].cur.key, h.items[j].cur.key); c != 0 {
+		return c < 0
+	}
+	return h.items[i].age < h.items[j].age
+}
+func (h *runHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *runHeap) Push(x any)    { h.items = append(h.items, x.(*runIter)) }
+func (h *runHeap) Pop() any {
+	x := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return x
+}
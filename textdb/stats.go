@@ -0,0 +1,56 @@
+package textdb
+
+import "time"
+
+// Stats reports the state of the database and its operations since it was opened.
+type Stats struct {
+	Keys         int     // keys in the index, including expired keys not yet removed
+	LiveBytes    int64   // size of the header and rows a compaction would keep
+	TotalBytes   int64   // size of the file, including buffered rows
+	DeadRatio    float64 // fraction of the file a compaction would remove
+	RowsReplayed int     // rows read to load the index (a hint file loads it without reading them)
+	LastSync     time.Time
+	LastWrite    time.Time // the modification time of the file until a row is written
+	Reads        uint64    // values read
+	Writes       uint64    // rows or batches written
+	CacheHits    uint64    // reads served by the value cache (see WithValueCache)
+	CacheMisses  uint64
+	SpillErr     error // error of the last spill of the index (see WithIndexMemoryLimit)
+	ColdBytes    int64 // size of the cold file (see WithColdTier)
+}
+
+func (db *DB) Stats() (Stats, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return Stats{}, ErrClosed
+	}
+	s := Stats{
+		Keys:         db.keys.len(),
+		LiveBytes:    int64(db.dataStart) + db.liveSize(),
+		TotalBytes:   int64(db.wIndex),
+		RowsReplayed: db.rowsReplayed,
+		LastSync:     db.lastSync,
+		LastWrite:    db.lastWrite,
+		Reads:        db.reads.Load(),
+		Writes:       db.writes.Load(),
+	}
+	if db.cache != nil {
+		cs := db.cache.stats()
+		s.CacheHits, s.CacheMisses = cs.Hits, cs.Misses
+	}
+	if db.coldR != nil {
+		fi, err := db.coldR.Stat()
+		if err != nil {
+			return Stats{}, err
+		}
+		s.ColdBytes = fi.Size()
+	}
+	if si, ok := unwrapIndex(db.keys).(*spillIndex); ok {
+		s.SpillErr = si.err
+	}
+	if s.TotalBytes > 0 && s.LiveBytes < s.TotalBytes {
+		s.DeadRatio = float64(s.TotalBytes-s.LiveBytes) / float64(s.TotalBytes)
+	}
+	return s, nil
+}
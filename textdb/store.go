@@ -0,0 +1,193 @@
+package textdb
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Store is the key-value interface of DB, so that code using it can run against a MemDB.
+type Store interface {
+	Get(k string) ([]byte, error)
+	Find(k string) ([]byte, error)
+	Put(k string, v []byte) error
+	Set(k string) error
+	Delete(k string) error
+	Exists(k string) bool
+}
+
+// TTLStore is a Store whose keys can expire, see DB.PutWithTTL.
+// It's what caches and session stores need (see the cache and sessions packages).
+type TTLStore interface {
+	Store
+	PutWithTTL(k string, v []byte, ttl time.Duration) error
+}
+
+// CASStore is a Store whose values can be updated atomically, see DB.CompareAndSwap.
+// It's what stores shared by several processes or instances need (see the ratelimit and scheduler packages).
+type CASStore interface {
+	Store
+	CompareAndSwap(k string, old, new []byte) (bool, error)
+}
+
+var (
+	_ TTLStore = (*DB)(nil)
+	_ TTLStore = (*MemDB)(nil)
+	_ CASStore = (*DB)(nil)
+	_ CASStore = (*MemDB)(nil)
+)
+
+// MemDB is a Store in memory with the semantics of DB (e.g. for tests): keys and values are validated
+// with the default limits and values are copied. It's safe for concurrent use.
+type MemDB struct {
+	mu       sync.RWMutex
+	keys     map[string][]byte    // nil for keys without value
+	expiries map[string]time.Time // expiration times of keys written with PutWithTTL
+	closed   bool
+}
+
+func NewMemDB() *MemDB {
+	return &MemDB{keys: make(map[string][]byte), expiries: make(map[string]time.Time)}
+}
+
+// exists reports whether the key is stored and not expired, with the lock held.
+func (m *MemDB) exists(k string) bool {
+	if _, ok := m.keys[k]; !ok {
+		return false
+	}
+	exp, ok := m.expiries[k]
+	return !ok || time.Now().Before(exp)
+}
+
+func (m *MemDB) Get(k string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+	v, ok := m.keys[k]
+	ok = ok && m.exists(k)
+	if v == nil || !ok {
+		return notFoundOrEmpty(k, ok)
+	}
+	return append([]byte{}, v...), nil
+}
+
+// Lookup is like DB.Lookup.
+func (m *MemDB) Lookup(k string) ([]byte, bool, error) {
+	v, err := m.Get(k)
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, false, nil
+	}
+	return v, err == nil, err
+}
+
+// Deprecated: Find is Get.
+func (m *MemDB) Find(k string) ([]byte, error) { return m.Get(k) }
+
+// Put writes the key with a copy of the value.
+func (m *MemDB) Put(k string, v []byte) error {
+	if err := validateKey(k, maxKeySize); err != nil {
+		return err
+	}
+	if err := validateValue(v, maxValueSize); err != nil {
+		return err
+	}
+	return m.write(k, append([]byte{}, v...))
+}
+
+// PutWithTTL is like DB.PutWithTTL, expired keys are removed when written or deleted.
+func (m *MemDB) PutWithTTL(k string, v []byte, ttl time.Duration) error {
+	if err := validateKey(k, maxKeySize); err != nil {
+		return err
+	}
+	if err := validateValue(v, maxValueSize); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrClosed
+	}
+	m.keys[k] = append([]byte{}, v...)
+	m.expiries[k] = time.Now().Add(ttl)
+	return nil
+}
+
+func (m *MemDB) Set(k string) error {
+	if err := validateKey(k, maxKeySize); err != nil {
+		return err
+	}
+	return m.write(k, nil)
+}
+
+func (m *MemDB) write(k string, v []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrClosed
+	}
+	m.keys[k] = v
+	delete(m.expiries, k)
+	return nil
+}
+
+func (m *MemDB) Delete(k string) error {
+	if err := validateKey(k, maxKeySize); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrClosed
+	}
+	delete(m.keys, k)
+	delete(m.expiries, k)
+	return nil
+}
+
+// CompareAndSwap is like DB.CompareAndSwap.
+func (m *MemDB) CompareAndSwap(k string, old, new []byte) (bool, error) {
+	if err := validateKey(k, maxKeySize); err != nil {
+		return false, err
+	}
+	if err := validateValue(new, maxValueSize); err != nil {
+		return false, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return false, ErrClosed
+	}
+	current, exists := m.keys[k]
+	exists = exists && m.exists(k)
+	if old == nil && exists || old != nil && (!exists || !bytes.Equal(current, old)) {
+		return false, nil
+	}
+	if new == nil {
+		delete(m.keys, k)
+	} else {
+		m.keys[k] = append([]byte{}, new...)
+	}
+	delete(m.expiries, k)
+	return true, nil
+}
+
+func (m *MemDB) Exists(k string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return !m.closed && m.exists(k)
+}
+
+// Close releases the keys, once closed operations return ErrClosed (and Exists returns false).
+func (m *MemDB) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrClosed
+	}
+	m.closed = true
+	m.keys, m.expiries = nil, nil
+	return nil
+}
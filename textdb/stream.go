@@ -0,0 +1,206 @@
+package textdb
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+
+	"github.com/ejuju/go-db-playground/textdb/record"
+)
+
+// Values can be written from a reader and read as a stream, without holding them in memory.
+// Values that are compressed or encrypted (and writes with a write buffer) are still buffered.
+
+// streamChunkSize is the size of the chunks values are copied in.
+const streamChunkSize = 32 << 10
+
+// PutReader writes the key with a value of the given size read from r.
+// Other reads and writes wait until the value is copied.
+// If r doesn't return size bytes, nothing is written.
+func (db *DB) PutReader(k string, r io.Reader, size int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.ValidateKey(k); err != nil {
+		return err
+	}
+	if size < 0 {
+		return fmt.Errorf("invalid value size: %d", size)
+	}
+	if size > int64(db.maxValueLen) {
+		return fmt.Errorf("%w: %d (max %d)", ErrValueTooLarge, size, db.maxValueLen)
+	}
+	if db.compressor != nil && size >= int64(db.compressionMinSize) || db.aeads != nil || db.bw != nil {
+		v := make([]byte, size)
+		if _, err := io.ReadFull(r, v); err != nil {
+			return fmt.Errorf("read value: %w", err)
+		}
+		return db.syncWrite(db.put(k, v))
+	}
+	return db.syncWrite(db.putReader(db.hashKey(k), r, int(size)))
+}
+
+// putReader appends the row of a value read from r in chunks, k is the key as stored.
+func (db *DB) putReader(k string, r io.Reader, size int) error {
+	delta := db.quotaDelta(k, size, false)
+	if err := db.checkQuota(k, delta); err != nil {
+		return err
+	}
+	if err := db.prepareWrite(); err != nil {
+		return err
+	}
+	if err := db.writeTime(); err != nil {
+		return err
+	}
+
+	// The checksum and MAC are computed as the row is written
+	var sum uint32
+	var mac hash.Hash
+	if db.hmacKey != nil {
+		mac = hmac.New(sha256.New, db.hmacKey)
+		mac.Write(db.lastMAC)
+	}
+	written := 0
+	write := func(b []byte) error {
+		sum = crc32.Update(sum, crc32.IEEETable, b)
+		if mac != nil {
+			mac.Write(b)
+		}
+		n, err := db.w.Write(b)
+		written += n
+		return err
+	}
+
+	buf := getBuffer(streamChunkSize)
+	defer putBuffer(buf, *buf)
+	header := db.rowFormat().AppendHeader((*buf)[:0], opPut, k, size)
+	vStart := db.wIndex + len(header)
+	if err := write(header); err != nil {
+		return db.writeFailed(written, err)
+	}
+	for left := size; left > 0; {
+		chunk := (*buf)[:cap(*buf)]
+		if left < len(chunk) {
+			chunk = chunk[:left]
+		}
+		n, err := io.ReadFull(r, chunk)
+		if n > 0 {
+			if err := write(chunk[:n]); err != nil {
+				return db.writeFailed(written, err)
+			}
+		}
+		if err != nil {
+			// Remove the partial row
+			db.writeFailed(written, err)
+			return fmt.Errorf("read value: %w", err)
+		}
+		left -= n
+	}
+	var rowMAC []byte
+	if mac != nil {
+		rowMAC = mac.Sum(nil)
+	}
+	if err := write(db.rowFormat().AppendTrailer((*buf)[:0], sum, rowMAC)); err != nil {
+		return db.writeFailed(written, err)
+	}
+	db.wIndex += written
+	db.lastMAC = rowMAC
+	db.degraded = nil
+	db.writes.Add(1)
+	db.lastWrite = time.Now()
+
+	db.keys.set(k, ref{index: vStart, width: size})
+	delete(db.expiries, k)
+	db.uncache(k)
+	db.addUsage(k, delta)
+	db.notify(EventPut, k, func() []byte {
+		v, _ := db.readValue(k, ref{index: vStart, width: size})
+		return v
+	})
+	return nil
+}
+
+// GetReader returns a reader of the value of the key and its size, the reader must be closed.
+// The checksum of the row is verified once the value is read to the end.
+// Like a Snapshot, the reader has its own handle of the file so it isn't affected by later writes nor by Compact.
+func (db *DB) GetReader(k string) (io.ReadCloser, int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, 0, ErrClosed
+	}
+	sk := db.hashKey(k)
+	r, ok := db.keys.get(sk)
+	if !ok || db.expired(sk) {
+		return nil, 0, fmt.Errorf("%w: %q", ErrKeyNotFound, k)
+	}
+	db.countRead(sk)
+	if !r.hasValue() || r.compressed || r.cold || db.aeads != nil || db.bw != nil && int64(r.index) >= db.bw.flushedOffset() {
+		v, err := db.getStored(sk)
+		if err != nil {
+			return nil, 0, err
+		}
+		return io.NopCloser(bytes.NewReader(v)), int64(len(v)), nil
+	}
+
+	f, err := db.fs.OpenFile(db.fpath, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	db.reads.Add(1)
+	header := db.valueHeader(nil, sk, r)
+	return &valueReader{
+		f:      f,
+		r:      io.NewSectionReader(f, int64(r.index), int64(r.width)),
+		format: db.rowFormat(),
+		mac:    db.hmacKey != nil,
+		offset: int64(r.index - len(header)),
+		end:    int64(r.index + r.width),
+		sum:    crc32.ChecksumIEEE(header),
+	}, int64(r.width), nil
+}
+
+// valueReader reads a value from its own file handle and verifies the checksum of its row at the end.
+type valueReader struct {
+	f      File
+	r      *io.SectionReader
+	format record.Format
+	mac    bool
+	offset int64 // offset of the row
+	end    int64 // offset of the end of the value
+	sum    uint32
+	err    error // verification error, returned once the value is read
+}
+
+func (vr *valueReader) Read(p []byte) (int, error) {
+	if vr.err != nil {
+		return 0, vr.err
+	}
+	n, err := vr.r.Read(p)
+	vr.sum = crc32.Update(vr.sum, crc32.IEEETable, p[:n])
+	if err == io.EOF {
+		if vr.err = vr.verify(); vr.err == nil {
+			vr.err = io.EOF
+		}
+		return n, vr.err
+	}
+	return n, err
+}
+
+func (vr *valueReader) verify() error {
+	trailer := make([]byte, vr.format.TrailerLen(vr.mac, true))
+	n, err := vr.f.ReadAt(trailer, vr.end)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	// A legacy row without checksum can end the file before
+	return checkTrailer(vr.format, vr.mac, vr.offset, vr.sum, trailer[:n])
+}
+
+func (vr *valueReader) Close() error { return vr.f.Close() }
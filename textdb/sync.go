@@ -0,0 +1,92 @@
+package textdb
+
+import (
+	"errors"
+	"time"
+)
+
+// SyncPolicy configures when appended rows are synced to disk, besides explicit calls to Sync.
+// Rows that aren't synced yet may be lost if the machine crashes (not if only the process exits).
+type SyncPolicy int
+
+const (
+	SyncOnClose     SyncPolicy = iota // sync on Close (default)
+	SyncEveryWrite                    // sync each write before it returns, flushing the write buffer if any
+	SyncNever                         // never sync automatically, not even on Close
+	SyncGroupCommit                   // sync each write before it returns, along concurrent writes (see WithGroupCommit)
+)
+
+func WithSyncPolicy(p SyncPolicy) Option {
+	return func(db *DB) { db.syncPolicy = p }
+}
+
+// WithSyncInterval flushes and syncs in the background at the given interval when rows were appended
+// since the last sync. Errors are returned by the next call to Sync.
+func WithSyncInterval(d time.Duration) Option {
+	return func(db *DB) { db.syncInterval = d }
+}
+
+// Sync flushes buffered rows and syncs the file to disk.
+func (db *DB) Sync() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	err := errors.Join(db.syncErr, db.syncNow())
+	db.syncErr = nil
+	return err
+}
+
+func (db *DB) syncNow() error {
+	if err := db.flush(); err != nil {
+		return err
+	}
+	if err := db.sync(); err != nil {
+		return err
+	}
+	db.syncedOffset = db.wIndex
+	return nil
+}
+
+// syncWrite syncs after a successful write if required by the sync policy.
+// If the sync fails, the write is applied but may not be durable.
+func (db *DB) syncWrite(err error) error {
+	if err != nil {
+		return err
+	}
+	switch db.syncPolicy {
+	case SyncEveryWrite:
+		return db.syncNow()
+	case SyncGroupCommit:
+		return db.groupSync()
+	}
+	return nil
+}
+
+// sync commits the written rows to disk.
+func (db *DB) sync() error {
+	if db.wf == nil {
+		return nil // read-only
+	}
+	if fp := hitFailpoint(FailpointSync); fp != nil {
+		return fp.Err
+	}
+	if err := db.wf.Sync(); err != nil {
+		return err
+	}
+	db.lastSync = time.Now()
+	return nil
+}
+
+func (db *DB) startPeriodicSync() {
+	db.syncedOffset = db.wIndex
+	if db.syncInterval <= 0 {
+		return
+	}
+	db.runPeriodically(db.syncInterval, func() {
+		if db.wIndex == db.syncedOffset {
+			return
+		}
+		if err := db.syncNow(); err != nil {
+			db.syncErr = err
+		}
+	})
+}
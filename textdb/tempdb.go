@@ -0,0 +1,56 @@
+package textdb
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+)
+
+// NewTempDB creates a database in a new temporary file that's removed on Close,
+// for tests and scratch data. On Linux the file is created with O_TMPFILE where supported,
+// so it's never visible in the temporary directory and is reclaimed even if the process crashes.
+// Such a file can't be replaced, so Compact isn't supported.
+// The database always uses the OS file system.
+func NewTempDB(opts ...Option) (*DB, error) {
+	tf, err := createTempFile()
+	if err != nil {
+		return nil, err
+	}
+	db, err := Open(tf.path, append(opts, func(db *DB) {
+		db.fs = osFS{}
+		db.indexDir = tf.indexDir
+		db.unnamed = tf.unnamed
+	})...)
+	if err != nil {
+		tf.remove()
+		return nil, err
+	}
+	db.cleanup = tf.remove
+	return db, nil
+}
+
+type tempFile struct {
+	path     string
+	indexDir string // directory of the spilled index if it can't be next to the file
+	unnamed  bool
+	remove   func() error
+}
+
+// createNamedTempFile creates a regular temporary file.
+func createNamedTempFile() (*tempFile, error) {
+	f, err := os.CreateTemp("", "textdb-*.db")
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	path := f.Name()
+	return &tempFile{path: path, remove: func() error {
+		err := os.Remove(path)
+		if lockErr := os.Remove(path + ".lock"); !errors.Is(lockErr, fs.ErrNotExist) {
+			err = errors.Join(err, lockErr)
+		}
+		return err
+	}}, nil
+}
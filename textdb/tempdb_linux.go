@@ -0,0 +1,30 @@
+package textdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// createTempFile creates an unnamed file with O_TMPFILE, opened again through /proc,
+// or a regular temporary file if that's not supported.
+func createTempFile() (*tempFile, error) {
+	fd, err := unix.Open(os.TempDir(), unix.O_TMPFILE|unix.O_RDWR|unix.O_CLOEXEC, 0o600)
+	if err != nil {
+		return createNamedTempFile()
+	}
+	f := os.NewFile(uintptr(fd), "textdb-tmpfile")
+	path := fmt.Sprintf("/proc/self/fd/%d", fd)
+	if _, err := os.Stat(path); err != nil {
+		f.Close()
+		return createNamedTempFile()
+	}
+	return &tempFile{
+		path:     path,
+		unnamed:  true,
+		indexDir: filepath.Join(os.TempDir(), fmt.Sprintf("textdb-%d-%d.index", os.Getpid(), fd)),
+		remove:   f.Close, // the file is reclaimed once its last handle is closed
+	}, nil
+}
@@ -0,0 +1,5 @@
+//go:build !linux
+
+package textdb
+
+func createTempFile() (*tempFile, error) { return createNamedTempFile() }
@@ -0,0 +1,284 @@
+package textdb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/ejuju/go-db-playground/textdb/record"
+)
+
+// ColdSuffix is appended to the file path to name the cold file written by WithColdTier.
+const ColdSuffix = ".cold"
+
+// ColdTier configures which values compactions move to the cold file (see WithColdTier).
+type ColdTier struct {
+	MinValueSize int // size of the smallest stored value moved to the cold file (4 KiB by default)
+	MaxReads     int // values read more often since the last compaction stay in (or come back to) the database file
+}
+
+// WithColdTier moves large values that are rarely read to a cold file next to the database file when compacting,
+// keeping the database file small so that it stays in the page cache. The database file keeps a row without
+// value for each cold key, reading a cold value costs a read from the cold file.
+// Reads of large values by key are counted between compactions, scans aren't.
+//
+// Each compaction rewrites the cold file, which replaces the old one before the database file is replaced:
+// the values of the cold keys of the old database file are kept for one more compaction,
+// so a crash between the two leaves files that can be opened.
+// A database with a cold file can be opened without this option, compacting it then moves the values back.
+// It can't be used with WithHMACChain, the cold file isn't covered by the chain.
+func WithColdTier(cfg ColdTier) Option {
+	if cfg.MinValueSize <= 0 {
+		cfg.MinValueSize = 4 << 10
+	}
+	return func(db *DB) { db.coldTier = &cfg }
+}
+
+func coldPath(fpath string) string { return fpath + ColdSuffix }
+
+// coldPending is the ref of a cold key replayed before its value is located in the cold file.
+var coldPending = ref{index: -1, cold: true}
+
+// valueReader returns the function reading the file that holds the value.
+func (db *DB) valueReader(r ref) readAtFunc {
+	if r.cold {
+		return db.readColdAt
+	}
+	return db.readAt
+}
+
+func (db *DB) readColdAt(p []byte, off int64) error {
+	_, err := db.coldR.ReadAt(p, off)
+	return err
+}
+
+// countRead counts a read of the large value of the stored key.
+func (db *DB) countRead(k string) {
+	if db.coldTier == nil || db.closed {
+		return
+	}
+	if r, ok := db.keys.get(k); !ok || r.valueWidth() < db.coldTier.MinValueSize {
+		return
+	}
+	db.readsMu.Lock()
+	defer db.readsMu.Unlock()
+	if db.valueReads == nil {
+		db.valueReads = make(map[string]int)
+	}
+	db.valueReads[k]++
+}
+
+// takeReads returns the reads counted since the last compaction and resets them.
+func (db *DB) takeReads() map[string]int {
+	db.readsMu.Lock()
+	defer db.readsMu.Unlock()
+	reads := db.valueReads
+	db.valueReads = nil
+	return reads
+}
+
+// openCold opens the cold file if there is one and locates the values of the cold rows replayed from the database file.
+func (db *DB) openCold() error {
+	if err := db.closeCold(); err != nil {
+		return err
+	}
+	if db.coldTier != nil && db.hmacKey != nil {
+		return errors.New("cold tier can't be used with an HMAC chain")
+	}
+	if db.unnamed {
+		return nil
+	}
+	f, err := db.fs.OpenFile(coldPath(db.fpath), os.O_RDONLY, 0)
+	if errors.Is(err, fs.ErrNotExist) && !db.pendingCold {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open cold file: %w", err)
+	}
+	db.coldR = f
+	if !db.pendingCold {
+		return nil // the values were located by the hint
+	}
+	if err := db.replayCold(); err != nil {
+		return fmt.Errorf("replay cold file: %w", err)
+	}
+	db.pendingCold = false
+	return nil
+}
+
+// replayCold points the cold keys of the index to their values in the cold file.
+func (db *DB) replayCold() error {
+	err := db.scanCold(func(k string, r ref) {
+		if cur, ok := db.keys.get(k); ok && cur.cold {
+			db.keys.set(k, r)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	var missing error
+	db.keys.forEach(func(k []byte, r ref) bool {
+		if r.cold && r.index < 0 {
+			missing = fmt.Errorf("value of %q is missing", k)
+		}
+		return missing == nil
+	})
+	return missing
+}
+
+// coldRef locates the value of the key in the cold file, which holds a value per key.
+func (db *DB) coldRef(k string) (ref, error) {
+	if r, ok := db.keys.get(k); ok && r.cold {
+		return r, nil
+	}
+	found := coldPending
+	err := db.scanCold(func(key string, r ref) {
+		if key == k {
+			found = r
+		}
+	})
+	if err == nil && found.index < 0 {
+		err = fmt.Errorf("value of %q is missing from the cold file", k)
+	}
+	return found, err
+}
+
+// scanCold calls fn with the key and ref of each value of the cold file.
+func (db *DB) scanCold(fn func(k string, r ref)) error {
+	if db.coldR == nil {
+		return errors.New("no cold file")
+	}
+	fi, err := db.coldR.Stat()
+	if err != nil {
+		return err
+	}
+	header := make([]byte, maxHeaderLen)
+	n, err := db.coldR.ReadAt(header, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	format, _, start, err := parseHeader(header[:n])
+	if err != nil {
+		return err
+	}
+	src := io.NewSectionReader(db.coldR, 0, fi.Size())
+	if _, err := src.Seek(int64(start), io.SeekStart); err != nil {
+		return err
+	}
+	rr := record.NewSeekingReader(src, fi.Size())
+	rr.ReadValue = func(op byte) bool { return false }
+	rr.SkipChecksums = db.lazyChecksums
+	rr.Format = format.rows()
+	for offset := start; ; {
+		r, n, err := rr.Next()
+		if errors.Is(err, io.EOF) && n == 0 {
+			return nil
+		}
+		if err != nil {
+			return &CorruptRecordError{Offset: int64(offset), Err: err}
+		}
+		if r.Op == opPut || r.Op == opPutCompressed {
+			fn(r.Key, ref{index: offset + r.ValueOffset, width: r.ValueLen, compressed: r.Op == opPutCompressed, cold: true})
+		}
+		offset += n
+	}
+}
+
+func (db *DB) closeCold() error {
+	if db.coldR == nil {
+		return nil
+	}
+	err := db.coldR.Close()
+	db.coldR = nil
+	return err
+}
+
+// coldWriter writes the cold file of a compaction to a temporary file.
+type coldWriter struct {
+	db     *DB
+	f      File
+	bufw   *bufio.Writer
+	rw     *rowWriter
+	reads  map[string]int // reads since the last compaction
+	values int            // number of values written
+}
+
+// newColdWriter returns the writer of the cold file of a compaction,
+// or nil if the database has no cold tier nor cold file.
+func (db *DB) newColdWriter() (*coldWriter, error) {
+	reads := db.takeReads()
+	if db.coldTier == nil && db.coldR == nil {
+		return nil, nil
+	}
+	f, err := db.fs.OpenFile(coldPath(db.fpath)+".compact", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	bufw := bufio.NewWriter(f)
+	rw := newRowWriter(bufw, db.format, db.headerFlags(), nil)
+	return &coldWriter{db: db, f: f, bufw: bufw, rw: rw, reads: reads}, nil
+}
+
+// write writes a live value (as stored) to the compacted file rw, or a cold row if the value is cold,
+// and returns its new ref. Values that were cold are also written to the cold file when they come back
+// to the database file, since a crash may leave the old database file in place.
+func (cw *coldWriter) write(rw *rowWriter, op byte, k string, r ref, v []byte) ref {
+	compressed := op == opPutCompressed
+	if cw == nil {
+		vStart, _ := rw.write(op, k, v)
+		return ref{index: vStart, width: len(v), compressed: compressed}
+	}
+	cfg := cw.db.coldTier
+	cold := cfg != nil && len(v) >= cfg.MinValueSize && cw.reads[k] <= cfg.MaxReads
+	if !cold && !r.cold {
+		vStart, _ := rw.write(op, k, v)
+		return ref{index: vStart, width: len(v), compressed: compressed}
+	}
+	vStart, _ := cw.rw.write(op, k, v)
+	cw.values++
+	if cold {
+		rw.write(opCold, k, nil)
+		return ref{index: vStart, width: len(v), compressed: compressed, cold: true}
+	}
+	vStart, _ = rw.write(op, k, v)
+	return ref{index: vStart, width: len(v), compressed: compressed}
+}
+
+// finish syncs and closes the temporary file.
+func (cw *coldWriter) finish() error {
+	if err := cw.bufw.Flush(); err != nil {
+		return err
+	}
+	if err := cw.f.Sync(); err != nil {
+		return err
+	}
+	return cw.f.Close()
+}
+
+// abort closes and removes the temporary file.
+func (cw *coldWriter) abort() {
+	if cw != nil {
+		cw.f.Close()
+		cw.db.fs.Remove(coldPath(cw.db.fpath) + ".compact")
+	}
+}
+
+// replace replaces the cold file with the temporary file, before the database file is replaced.
+// The cold file handle must be closed.
+func (cw *coldWriter) replace() error {
+	if cw.values == 0 {
+		return cw.db.fs.Remove(coldPath(cw.db.fpath) + ".compact")
+	}
+	return cw.db.fs.Rename(coldPath(cw.db.fpath)+".compact", coldPath(cw.db.fpath))
+}
+
+// removeUnused removes the cold file once the database file that replaced it has no cold row
+// (a cold file left in place is unused, so errors are ignored).
+func (cw *coldWriter) removeUnused() {
+	if cw.values == 0 {
+		cw.db.fs.Remove(coldPath(cw.db.fpath))
+	}
+}
@@ -0,0 +1,136 @@
+package textdb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/ejuju/go-db-playground/textdb/record"
+)
+
+// timeResolution is the precision of write times: rows written within it share a time row.
+const timeResolution = time.Millisecond
+
+// WithTimestamps records the time of writes in the file when it's created, existing files
+// keep their setting. Rows written in a new millisecond are preceded by a row with the time,
+// so that History returns the write time of values. Files with timestamps can't be opened
+// by versions without them.
+func WithTimestamps() Option {
+	return func(db *DB) { db.timestamps = true }
+}
+
+// writeTime appends a time row if timestamps are enabled and the time changed since the last one.
+func (db *DB) writeTime() error {
+	if !db.timestamps {
+		return nil
+	}
+	now := time.Now().UnixNano()
+	if now >= db.rowTime && now-db.rowTime < int64(timeResolution) {
+		return nil
+	}
+	if err := db.prepareWrite(); err != nil {
+		return err
+	}
+	buf := getBuffer(0)
+	row := db.rowFormat().AppendBody(*buf, opTime, "", strconv.AppendInt(nil, now, 10))
+	defer func() { putBuffer(buf, row) }()
+	mac := db.rowMAC(row)
+	row = db.rowFormat().AppendEnd(row, 0, mac)
+	n, err := db.w.Write(row)
+	if err != nil {
+		return db.writeFailed(n, err)
+	}
+	db.wIndex += n
+	db.lastMAC = mac
+	db.rowTime = now
+	return nil
+}
+
+// Version is a value of a key, see History.
+type Version struct {
+	Value   []byte    // nil if the key was deleted
+	Deleted bool      // the key was deleted
+	Time    time.Time // write time, zero if the file has no timestamps or the row was compacted
+	Offset  int64     // offset of the row in the file
+}
+
+// History returns the values the key had, from the oldest to the current one, read from the rows of the file.
+// Keys without value have an empty value. Compact only keeps the current values, without their write time.
+// The file is read without holding the lock for the whole duration.
+func (db *DB) History(k string) ([]Version, error) {
+	if err := db.ValidateKey(k); err != nil {
+		return nil, err
+	}
+	k = db.hashKey(k)
+	f, start, end, err := db.openRows()
+	if err != nil {
+		return nil, fmt.Errorf("history: %w", err)
+	}
+	defer f.Close()
+
+	// The stored values are decoded once read, with the lock held
+	type storedVersion struct {
+		Version
+		op byte
+	}
+	var stored []storedVersion
+	rr := record.NewReader(io.NewSectionReader(f, int64(start), int64(end-start)))
+	rr.MAC = db.hmacKey != nil
+	rr.Format = db.rowFormat()
+	var t time.Time
+	for offset := start; ; {
+		r, n, err := rr.Next()
+		if errors.Is(err, io.EOF) && n == 0 {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("history: %w", &CorruptRecordError{Offset: int64(offset), Err: err})
+		}
+		switch {
+		case r.Op == opTime:
+			ns, _ := strconv.ParseInt(string(r.Value), 10, 64)
+			t = time.Unix(0, ns)
+		case r.Key != k:
+		case r.Op == opPut || r.Op == opPutCompressed:
+			stored = append(stored, storedVersion{Version{Value: r.Value, Time: t, Offset: int64(offset)}, r.Op})
+		case r.Op == opSet:
+			stored = append(stored, storedVersion{Version{Value: []byte{}, Time: t, Offset: int64(offset)}, r.Op})
+		case r.Op == opCold:
+			stored = append(stored, storedVersion{Version{Time: t, Offset: int64(offset)}, r.Op})
+		case r.Op == opDelete:
+			stored = append(stored, storedVersion{Version{Deleted: true, Time: t, Offset: int64(offset)}, r.Op})
+		}
+		offset += n
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	versions := make([]Version, len(stored))
+	for i, s := range stored {
+		versions[i] = s.Version
+		if s.op == opSet || s.op == opDelete {
+			continue
+		}
+		if s.op == opCold {
+			r, err := db.coldRef(k)
+			if err == nil {
+				versions[i].Value, err = db.readValue(k, r)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("history: %w", err)
+			}
+			continue
+		}
+		v, err := db.decryptValue(s.op, k, s.Value)
+		if err == nil && s.op == opPutCompressed {
+			v, err = db.decompressValue(k, v)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("history: %w", err)
+		}
+		versions[i].Value = v
+	}
+	return versions, nil
+}
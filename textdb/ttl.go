@@ -0,0 +1,114 @@
+package textdb
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Keys can have an expiration time, recorded in a row following the write of the key.
+// Expired keys are invisible to reads, they're removed from the index when the database is opened
+// or by the sweeper (see WithExpirySweep) and dropped by Compact.
+// Writing or deleting a key removes its expiration time.
+// Expiration times are kept in memory, even with a spilled index.
+
+// PutWithTTL writes the key with a copy of the value, expiring after the given duration.
+func (db *DB) PutWithTTL(k string, v []byte, ttl time.Duration) error {
+	b := db.NewBatch()
+	if err := b.Put(k, v); err != nil {
+		return err
+	}
+	b.ops = append(b.ops, batchOp{op: opExpire, k: k, v: db.expiryValue(ttl)})
+	return b.Commit()
+}
+
+// Expire sets the expiration time of an existing key, a non-positive ttl expires it right away.
+func (db *DB) Expire(k string, ttl time.Duration) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.ValidateKey(k); err != nil {
+		return err
+	}
+	if db.closed {
+		return ErrClosed
+	}
+	if !db.exists(k) {
+		return fmt.Errorf("%w: %q", ErrKeyNotFound, k)
+	}
+	k = db.hashKey(k)
+	v := db.expiryValue(ttl)
+	if _, err := db.writeKeyValueRow(opExpire, k, v); err != nil {
+		return err
+	}
+	db.setExpiry(k, v)
+	db.uncache(k)
+	return db.syncWrite(nil)
+}
+
+// TTL returns the time left before the key expires, and false if it doesn't exist or has no expiration time.
+func (db *DB) TTL(k string) (time.Duration, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if !db.exists(k) {
+		return 0, false
+	}
+	exp, ok := db.expiries[db.hashKey(k)]
+	if !ok {
+		return 0, false
+	}
+	return time.Until(time.Unix(0, exp)), true
+}
+
+// WithExpirySweep removes expired keys from the index at the given interval,
+// otherwise they're only removed when the database is opened.
+func WithExpirySweep(interval time.Duration) Option {
+	return func(db *DB) { db.sweepInterval = interval }
+}
+
+func (db *DB) expiryValue(ttl time.Duration) []byte {
+	return strconv.AppendInt(nil, time.Now().Add(ttl).UnixNano(), 10)
+}
+
+// setExpiry records the expiration time of a stored key, invalid times are ignored.
+func (db *DB) setExpiry(k string, v []byte) {
+	exp, err := strconv.ParseInt(string(v), 10, 64)
+	if err != nil || !db.keys.has(k) {
+		return
+	}
+	if db.expiries == nil {
+		db.expiries = make(map[string]int64)
+	}
+	db.expiries[k] = exp
+}
+
+// expired reports whether the stored key has expired.
+func (db *DB) expired(k string) bool {
+	if len(db.expiries) == 0 {
+		return false
+	}
+	exp, ok := db.expiries[k]
+	return ok && time.Now().UnixNano() >= exp
+}
+
+// purgeExpired removes expired keys from the index.
+func (db *DB) purgeExpired() {
+	now := time.Now().UnixNano()
+	for k, exp := range db.expiries {
+		if now < exp {
+			continue
+		}
+		if r, ok := db.keys.get(k); ok {
+			db.addUsage(k, quotaDeltaFrom(k, r, true, 0, true))
+			db.keys.delete(k)
+			db.notify(EventDelete, k, nil)
+		}
+		delete(db.expiries, k)
+		db.uncache(k)
+	}
+}
+
+func (db *DB) startExpirySweep() {
+	if db.sweepInterval > 0 {
+		db.runPeriodically(db.sweepInterval, db.purgeExpired)
+	}
+}
@@ -0,0 +1,96 @@
+package textdb
+
+import "errors"
+
+// Tx stages writes that are committed atomically (as a Batch), reads see the staged writes.
+// Writes of other transactions aren't detected: the last commit wins.
+// A transaction isn't safe for concurrent use.
+type Tx struct {
+	b      *Batch
+	staged map[string]stagedWrite
+	done   bool
+}
+
+type stagedWrite struct {
+	deleted bool
+	v       []byte // nil for keys without value
+}
+
+var ErrTxDone = errors.New("transaction already committed or rolled back")
+
+func (db *DB) Begin() *Tx { return &Tx{b: db.NewBatch(), staged: make(map[string]stagedWrite)} }
+
+func (tx *Tx) Set(k string) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if err := tx.b.Set(k); err != nil {
+		return err
+	}
+	tx.staged[k] = stagedWrite{}
+	return nil
+}
+
+func (tx *Tx) Delete(k string) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if err := tx.b.Delete(k); err != nil {
+		return err
+	}
+	tx.staged[k] = stagedWrite{deleted: true}
+	return nil
+}
+
+// Put stages a write of the key with a copy of the value.
+func (tx *Tx) Put(k string, v []byte) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if err := tx.b.Put(k, v); err != nil {
+		return err
+	}
+	tx.staged[k] = stagedWrite{v: tx.b.ops[len(tx.b.ops)-1].v}
+	return nil
+}
+
+// Get returns the staged value of the key, or its value in the database if it has no staged write.
+func (tx *Tx) Get(k string) ([]byte, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+	if w, ok := tx.staged[k]; ok && w.v == nil {
+		return notFoundOrEmpty(k, !w.deleted)
+	} else if ok {
+		return w.v, nil
+	}
+	return tx.b.db.Get(k)
+}
+
+func (tx *Tx) Exists(k string) bool {
+	if w, ok := tx.staged[k]; ok && !tx.done {
+		return !w.deleted
+	}
+	return !tx.done && tx.b.db.Exists(k)
+}
+
+// Commit appends the staged writes in a single write and applies them to the index.
+// The transaction is done even if it fails, in which case none of the writes are applied.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	return tx.b.Commit()
+}
+
+// Rollback discards the staged writes.
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	tx.b.Reset()
+	tx.staged = nil
+	return nil
+}
@@ -0,0 +1,92 @@
+package textdb
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+// Codec encodes values of type T to and from the bytes stored in the database.
+type Codec[T any] interface {
+	Marshal(v T) ([]byte, error)
+	Unmarshal(b []byte) (T, error)
+}
+
+// JSONCodec encodes values with encoding/json.
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Marshal(v T) ([]byte, error) { return json.Marshal(v) }
+
+func (JSONCodec[T]) Unmarshal(b []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(b, &v)
+	return v, err
+}
+
+// GobCodec encodes values with encoding/gob, each value is encoded with its type information.
+type GobCodec[T any] struct{}
+
+func (GobCodec[T]) Marshal(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec[T]) Unmarshal(b []byte) (T, error) {
+	var v T
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&v)
+	return v, err
+}
+
+// TypedStore stores values of type T in a database, encoded with a codec.
+type TypedStore[T any] struct {
+	db    *DB
+	codec Codec[T]
+}
+
+func Typed[T any](db *DB, codec Codec[T]) *TypedStore[T] {
+	return &TypedStore[T]{db: db, codec: codec}
+}
+
+func (s *TypedStore[T]) Get(k string) (T, error) {
+	var zero T
+	b, err := s.db.Get(k)
+	if err != nil {
+		return zero, err
+	}
+	v, err := s.codec.Unmarshal(b)
+	if err != nil {
+		return zero, fmt.Errorf("decode value of %q: %w", k, err)
+	}
+	return v, nil
+}
+
+func (s *TypedStore[T]) Put(k string, v T) error {
+	b, err := s.codec.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encode value of %q: %w", k, err)
+	}
+	return s.db.Put(k, b)
+}
+
+func (s *TypedStore[T]) Delete(k string) error { return s.db.Delete(k) }
+
+func (s *TypedStore[T]) Exists(k string) bool { return s.db.Exists(k) }
+
+// Scan calls fn with the decoded value of each key with the prefix, in order.
+// Keys without value are skipped.
+func (s *TypedStore[T]) Scan(prefix string, fn func(k string, v T) error) error {
+	return s.db.Scan(prefix, func(k string, b []byte) error {
+		if b == nil {
+			return nil
+		}
+		v, err := s.codec.Unmarshal(b)
+		if err != nil {
+			return fmt.Errorf("decode value of %q: %w", k, err)
+		}
+		return fn(k, v)
+	})
+}
@@ -0,0 +1,97 @@
+package textdb
+
+import "fmt"
+
+// WithVersions keeps the references of the previous values of keys in the index, so that GetVersion
+// can read them: at most limit values per key, or all of them if limit is zero.
+// They're loaded from the rows replayed at open (see WithHintFile), and dropped by Compact
+// since their rows are removed.
+func WithVersions(limit int) Option {
+	return func(db *DB) { db.versions, db.versionLimit = true, limit }
+}
+
+// GetVersion returns the value the key had n writes ago: n=0 is the current value (see Get),
+// n=1 the previous one and so on. It returns ErrKeyNotFound if the key didn't exist then
+// (e.g. it was deleted), or if the version isn't kept (see WithVersions).
+func (db *DB) GetVersion(k string, n int) ([]byte, error) {
+	if n == 0 {
+		return db.Get(k)
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	if n < 0 {
+		return nil, fmt.Errorf("invalid version: %d", n)
+	}
+	vi, ok := db.keys.(*versionedIndex)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q: versions aren't kept", ErrKeyNotFound, k)
+	}
+	chain := vi.previous[db.hashKey(k)]
+	if n > len(chain) {
+		return nil, fmt.Errorf("%w: %q: version %d isn't kept", ErrKeyNotFound, k, n)
+	}
+	v := chain[len(chain)-n]
+	if v.deleted {
+		return nil, fmt.Errorf("%w: %q at version %d", ErrKeyNotFound, k, n)
+	}
+	if !v.r.hasValue() {
+		return []byte{}, nil
+	}
+	db.reads.Add(1)
+	return db.readValue(db.hashKey(k), v.r)
+}
+
+// versionedIndex is an index that keeps the previous references of keys as they're overwritten.
+type versionedIndex struct {
+	index
+	limit    int
+	previous map[string][]version // from the oldest to the latest
+}
+
+// version is a previous reference of a key, or its deletion.
+type version struct {
+	r       ref
+	deleted bool
+}
+
+// unwrapIndex returns the index wrapped by versionedIndex if any.
+func unwrapIndex(idx index) index {
+	if vi, ok := idx.(*versionedIndex); ok {
+		return vi.index
+	}
+	return idx
+}
+
+func newVersionedIndex(idx index, limit int) *versionedIndex {
+	return &versionedIndex{index: idx, limit: limit, previous: make(map[string][]version)}
+}
+
+func (vi *versionedIndex) set(k string, r ref) {
+	if prev, ok := vi.index.get(k); ok {
+		vi.push(k, version{r: prev})
+	} else if len(vi.previous[k]) > 0 {
+		vi.push(k, version{deleted: true})
+	}
+	vi.index.set(k, r)
+}
+
+func (vi *versionedIndex) delete(k string) {
+	if prev, ok := vi.index.get(k); ok {
+		vi.push(k, version{r: prev})
+	}
+	vi.index.delete(k)
+}
+
+func (vi *versionedIndex) push(k string, v version) {
+	chain := append(vi.previous[k], v)
+	if vi.limit > 0 && len(chain) > vi.limit {
+		chain = append(chain[:0], chain[len(chain)-vi.limit:]...)
+	}
+	vi.previous[k] = chain
+}
+
+// reset drops the previous references, once they don't point to rows of the file.
+func (vi *versionedIndex) reset() { vi.previous = make(map[string][]version) }
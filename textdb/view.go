@@ -0,0 +1,150 @@
+package textdb
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+// View holds a value returned by GetView.
+type View struct {
+	b       []byte
+	mapping *mapping
+}
+
+// Bytes returns the value, it must not be modified nor used after Release.
+func (v *View) Bytes() []byte { return v.b }
+
+// Release allows the memory backing the view to be unmapped.
+func (v *View) Release() {
+	if v.mapping != nil {
+		v.mapping.release()
+		v.mapping = nil
+	}
+	v.b = nil
+}
+
+// GetView is like Get but returns a view aliasing the memory-mapped file instead of a copy.
+// It falls back to a copy when the value is encrypted, compressed or cold (see WithColdTier), not flushed yet,
+// or memory mapping isn't supported on the platform.
+func (db *DB) GetView(k string) (*View, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	sk := db.hashKey(k)
+	ref, ok := db.keys.get(sk)
+	if !ok || db.expired(sk) {
+		return nil, fmt.Errorf("%w: %q", ErrKeyNotFound, k)
+	}
+	if !ref.hasValue() {
+		return &View{}, nil
+	}
+	db.countRead(sk)
+	if db.aeads != nil || ref.compressed || ref.cold || (db.bw != nil && int64(ref.index+ref.width) > db.bw.flushedOffset()) {
+		v, err := db.getStored(sk)
+		return &View{b: v}, err
+	}
+
+	// The mapping also covers the trailer of the row, a row without checksum may end the file
+	end := ref.index + ref.width
+	m, err := db.mmaps.acquire(db, end+db.rowFormat().TrailerLen(db.hmacKey != nil, true))
+	if errors.Is(err, errMmapUnsupported) || errors.Is(err, io.ErrUnexpectedEOF) {
+		v, err := db.getStored(sk)
+		return &View{b: v}, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := db.checkMapped(sk, ref, m.data); err != nil {
+		m.release()
+		return nil, err
+	}
+	return &View{b: m.data[ref.index:end:end], mapping: m}, nil
+}
+
+// checkMapped verifies the checksum of the row of a stored value in the mapped file, like readVerified.
+func (db *DB) checkMapped(k string, r ref, data []byte) error {
+	header := getBuffer(0)
+	*header = db.valueHeader(*header, k, r)
+	defer putBuffer(header, *header)
+	end := r.index + r.width
+	sum := crc32.ChecksumIEEE(*header)
+	sum = crc32.Update(sum, crc32.IEEETable, data[r.index:end])
+	trailer := data[end : end+db.rowFormat().TrailerLen(db.hmacKey != nil, true)]
+	return checkTrailer(db.rowFormat(), db.hmacKey != nil, int64(r.index-len(*header)), sum, trailer)
+}
+
+// mapping is a read-only memory mapping of the file,
+// it's unmapped once it's been replaced by a larger one and all its views are released.
+type mapping struct {
+	mu    *sync.Mutex
+	data  []byte
+	refs  int
+	stale bool
+}
+
+func (m *mapping) release() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.refs--
+	if m.stale && m.refs == 0 {
+		munmap(m.data)
+	}
+}
+
+type mmaps struct {
+	mu      sync.Mutex
+	current *mapping
+}
+
+// acquire returns a mapping covering at least the given size.
+func (mm *mmaps) acquire(db *DB, size int) (*mapping, error) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if mm.current == nil || len(mm.current.data) < size {
+		info, err := db.r.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if info.Size() < int64(size) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		f, ok := db.r.(*os.File)
+		if !ok {
+			return nil, errMmapUnsupported
+		}
+		data, err := mmapFile(f, int(info.Size()))
+		if err != nil {
+			return nil, err
+		}
+		mm.retireLocked()
+		mm.current = &mapping{mu: &mm.mu, data: data}
+	}
+	mm.current.refs++
+	return mm.current, nil
+}
+
+// retireLocked marks the current mapping as stale and unmaps it if it has no views left.
+func (mm *mmaps) retireLocked() {
+	if mm.current == nil {
+		return
+	}
+	mm.current.stale = true
+	if mm.current.refs == 0 {
+		munmap(mm.current.data)
+	}
+	mm.current = nil
+}
+
+func (mm *mmaps) close() {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.retireLocked()
+}
+
+var errMmapUnsupported = errors.New("memory mapping is not supported on this platform")
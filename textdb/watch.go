@@ -0,0 +1,139 @@
+package textdb
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/ejuju/go-db-playground/textdb/record"
+)
+
+// EventOp is the kind of write an Event reports.
+type EventOp int
+
+const (
+	EventPut    EventOp = iota + 1 // the key was written with a value
+	EventSet                       // the key was written without value
+	EventDelete                    // the key was deleted, or removed from the index once expired
+)
+
+// Event reports a write of a key, the key is as stored (the hash with WithHashedKeys).
+type Event struct {
+	Key   string
+	Op    EventOp
+	Value []byte // nil unless the op is EventPut, must not be modified
+}
+
+// watcher queues the events of a Watch so that writes never wait for the receiver.
+type watcher struct {
+	prefix string
+	ch     chan Event
+
+	mu     sync.Mutex
+	queue  []Event
+	notify chan struct{} // signals queued events
+	done   chan struct{}
+	once   sync.Once
+}
+
+// Watch returns a channel of the events of keys with the given prefix, in the order of the writes,
+// and a function to stop watching which closes the channel. Events are queued in memory until received.
+// Followers (see WithFollow) report the writes read when catching up.
+// The channel is also closed when the database is closed.
+func (db *DB) Watch(prefix string) (<-chan Event, func()) {
+	w := &watcher{prefix: prefix, ch: make(chan Event), notify: make(chan struct{}, 1), done: make(chan struct{})}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		close(w.ch)
+		return w.ch, func() {}
+	}
+	if db.watchers == nil {
+		db.watchers = make(map[*watcher]struct{})
+	}
+	db.watchers[w] = struct{}{}
+	go w.run()
+	return w.ch, func() {
+		db.mu.Lock()
+		delete(db.watchers, w)
+		db.mu.Unlock()
+		w.stop()
+	}
+}
+
+func (w *watcher) run() {
+	defer close(w.ch)
+	for {
+		w.mu.Lock()
+		queue := w.queue
+		w.queue = nil
+		w.mu.Unlock()
+		for _, e := range queue {
+			select {
+			case w.ch <- e:
+			case <-w.done:
+				return
+			}
+		}
+		select {
+		case <-w.notify:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *watcher) send(e Event) {
+	w.mu.Lock()
+	w.queue = append(w.queue, e)
+	w.mu.Unlock()
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (w *watcher) stop() { w.once.Do(func() { close(w.done) }) }
+
+// notify sends an event of a stored key to the matching watchers.
+// value is only called if a watcher matches, to get the value of EventPut events.
+func (db *DB) notify(op EventOp, k string, value func() []byte) {
+	var v []byte
+	loaded := false
+	for w := range db.watchers {
+		if !strings.HasPrefix(k, w.prefix) {
+			continue
+		}
+		if op == EventPut && !loaded {
+			v, loaded = value(), true
+		}
+		w.send(Event{Key: k, Op: op, Value: v})
+	}
+}
+
+// notifyRecord sends the event of a row read when catching up.
+func (db *DB) notifyRecord(r record.Record, offset int) {
+	if len(db.watchers) == 0 {
+		return
+	}
+	switch r.Op {
+	case opSet:
+		db.notify(EventSet, r.Key, nil)
+	case opDelete:
+		db.notify(EventDelete, r.Key, nil)
+	case opPut, opPutCompressed:
+		db.notify(EventPut, r.Key, func() []byte {
+			v, _ := db.readValue(r.Key, ref{index: offset + r.ValueOffset, width: r.ValueLen, compressed: r.Op == opPutCompressed})
+			return v
+		})
+	}
+}
+
+// copyOf returns a function returning a copy of v, for notify.
+func copyOf(v []byte) func() []byte { return func() []byte { return append([]byte{}, v...) } }
+
+func (db *DB) stopWatchers() {
+	for w := range db.watchers {
+		w.stop()
+	}
+	db.watchers = nil
+}